@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Capabilities are what a server supports, as GetCapabilities returns them.
+type Capabilities struct {
+	Protocols  []int    `json:"protocols"`
+	Transports []string `json:"transports"`
+	Features   []string `json:"features"`
+	Limits     struct {
+		MaxMessageSize  int64   `json:"max_message_size"`
+		MaxDataSize     int     `json:"max_data_size"`
+		MaxMetadataSize int     `json:"max_metadata_size"`
+		MaxRoomSize     int     `json:"max_room_size"`
+		MaxEntries      int     `json:"max_entries"`
+		MessageRate     float64 `json:"message_rate"`
+		MessageBurst    int     `json:"message_burst"`
+		ResumeGraceMs   int64   `json:"resume_grace_ms"`
+	} `json:"limits"`
+}
+
+// Has reports whether the server has the feature, such as "turn" or
+// "resume".
+func (c Capabilities) Has(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// ResumeGrace is how long the server holds a dropped session.
+func (c Capabilities) ResumeGrace() time.Duration {
+	return time.Duration(c.Limits.ResumeGraceMs) * time.Millisecond
+}
+
+// GetCapabilities asks the server at url, the same as Config.URL, what it
+// supports. It needs no connection or credentials.
+func GetCapabilities(ctx context.Context, url string) (Capabilities, error) {
+	var caps Capabilities
+	url = strings.TrimSuffix(url, "/") + "/api/v1/capabilities"
+	if strings.HasPrefix(url, "ws") {
+		url = "http" + strings.TrimPrefix(url, "ws")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return caps, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return caps, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return caps, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		e := &Error{Payload: body}
+		if json.Unmarshal(body, e) != nil || e.Status == "" {
+			e.Status = fmt.Sprintf("capabilities: %s", resp.Status)
+		}
+		return caps, e
+	}
+	err = json.Unmarshal(body, &caps)
+	return caps, err
+}
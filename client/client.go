@@ -0,0 +1,676 @@
+// Package client is a Go client for the Seven signaling server. It registers
+// over a websocket, hands out the messages peers and the server send, and
+// reconnects by itself, resuming the session when the server still holds it.
+//
+//	c, err := client.Dial(ctx, client.Config{
+//		URL:          "wss://signal.example.com",
+//		Registration: client.Registration{UUID: id, Addr: "203.0.113.7:4000"},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//	members, err := c.JoinRoom(ctx, room)
+//	for msg := range c.Messages() {
+//		switch msg.Type {
+//		case client.TypeOffer:
+//			...
+//		}
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// ErrDisconnected is returned for requests made, or still unanswered,
+	// while the connection is down.
+	ErrDisconnected = errors.New("seven: disconnected")
+	// ErrClosed is returned once Close has been called.
+	ErrClosed = errors.New("seven: client closed")
+)
+
+// Config says where to connect and what to register as.
+type Config struct {
+	// URL is the server's base URL, such as wss://signal.example.com or,
+	// for a tenant, wss://signal.example.com/t/chess.
+	URL string
+	// APIKey is sent as X-API-Key when set.
+	APIKey string
+	// Token is sent as a bearer token when set.
+	Token string
+
+	Registration Registration
+
+	// Dialer defaults to websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+	// MinBackoff and MaxBackoff bound the wait between reconnect attempts,
+	// which doubles after every failure. They default to 500ms and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// PongWait is how long the connection may stay silent, pings included,
+	// before it is considered dead. It defaults to 90s, three of the
+	// server's pings.
+	PongWait time.Duration
+
+	// OnReconnect, if set, is called after the connection came back.
+	// resumed is false when the server had forgotten the session and the
+	// client registered again, in which case it is no longer in its room.
+	OnReconnect func(resumed bool)
+}
+
+// Client is a connection to the server. Its methods are safe for concurrent
+// use.
+type Client struct {
+	cfg  Config
+	msgs chan Message
+
+	mu          sync.Mutex
+	conn        *connection
+	reg         Registration
+	entries     []Entry
+	turn        json.RawMessage
+	resumeToken string
+	node        string // instance the session is on, when the server says
+	nodeURL     string // where that instance is, after a wrong_node refusal
+	room        string
+	pending     map[string]*call
+	seq         uint64
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// connection is one websocket; dead is closed when its read loop stops.
+type connection struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+	dead    chan struct{}
+	err     error // why the read loop stopped, set before dead is closed
+}
+
+// call is a request waiting for its ack. want is the type of the reply the
+// server sends before acking, if any.
+type call struct {
+	seq    uint64
+	want   string
+	reply  *Message
+	queued bool // a join that was put in line, see TypeRoomQueued
+	result chan callResult
+}
+
+type callResult struct {
+	reply Message
+	err   error
+}
+
+// Dial connects to the server and registers. It fails if the first attempt
+// does; later disconnects are retried in the background.
+func Dial(ctx context.Context, cfg Config) (*Client, error) {
+	if cfg.Dialer == nil {
+		cfg.Dialer = websocket.DefaultDialer
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 500 * time.Millisecond
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+	if cfg.PongWait <= 0 {
+		cfg.PongWait = 90 * time.Second
+	}
+	c := &Client{
+		cfg:     cfg,
+		msgs:    make(chan Message, 64),
+		reg:     cfg.Registration,
+		pending: make(map[string]*call),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	conn, _, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	go c.run(conn)
+	return c, nil
+}
+
+// Messages delivers everything the server sends that is not the answer to
+// a request: signals from peers, room and match events, undelivered notices
+// and errors. It is closed once the client is closed. Read it promptly; a
+// client that falls behind is disconnected by the server.
+func (c *Client) Messages() <-chan Message {
+	return c.msgs
+}
+
+// UUID is the uuid the client is registered as, which the server picks when
+// the Registration has none.
+func (c *Client) UUID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reg.UUID
+}
+
+// Entries are the peers returned by the latest registration.
+func (c *Client) Entries() []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Entry(nil), c.entries...)
+}
+
+// TURN is the TURN credentials handed out at the latest registration, if the
+// server vends any.
+func (c *Client) TURN() json.RawMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.turn
+}
+
+// Room is the room the client is in, if any.
+func (c *Client) Room() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.room
+}
+
+// Discover registers again, refreshing the entry, and returns the peers the
+// server hands out for it.
+func (c *Client) Discover(ctx context.Context) ([]Entry, error) {
+	conn, err := c.current()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.register(ctx, conn); err != nil {
+		return nil, err
+	}
+	return c.Entries(), nil
+}
+
+// Signal relays payload as a message of type typ to the peer to, returning
+// once the server has passed it on. to may name one device as uuid/device.
+func (c *Client) Signal(ctx context.Context, to string, typ string, payload any) error {
+	msg, err := newMessage(typ, payload)
+	if err != nil {
+		return err
+	}
+	msg.To = to
+	return c.Send(ctx, msg)
+}
+
+// Broadcast sends payload to every other member of the client's room.
+func (c *Client) Broadcast(ctx context.Context, payload any) error {
+	msg, err := newMessage(TypeBroadcast, payload)
+	if err != nil {
+		return err
+	}
+	return c.Send(ctx, msg)
+}
+
+// Direct sends payload to the member to of the client's room.
+func (c *Client) Direct(ctx context.Context, to string, payload any) error {
+	return c.Signal(ctx, to, TypeDirect, payload)
+}
+
+// Send sends msg as is and waits for the server to acknowledge it.
+func (c *Client) Send(ctx context.Context, msg Message) error {
+	_, err := c.request(ctx, msg, "")
+	return err
+}
+
+// CreateRoom opens a room holding up to maxPeers members, 0 leaving it to
+// the server, and joins it.
+func (c *Client) CreateRoom(ctx context.Context, maxPeers int) (string, error) {
+	var payload any
+	if maxPeers > 0 {
+		payload = map[string]int{"max_peers": maxPeers}
+	}
+	msg, err := newMessage(typeCreateRoom, payload)
+	if err != nil {
+		return "", err
+	}
+	reply, err := c.request(ctx, msg, TypeRoomJoined)
+	if err != nil {
+		return "", err
+	}
+	return reply.Room, nil
+}
+
+// JoinRoom joins room, leaving any other, and returns its members. If the
+// room is full and the server queues joins, it waits for a place.
+func (c *Client) JoinRoom(ctx context.Context, room string) ([]Entry, error) {
+	reply, err := c.request(ctx, Message{Type: typeJoinRoom, Room: room}, TypeRoomJoined)
+	if err != nil {
+		return nil, err
+	}
+	var joined roomJoined
+	if err := reply.Decode(&joined); err != nil {
+		return nil, err
+	}
+	return joined.Members, nil
+}
+
+// LeaveRoom leaves the client's room.
+func (c *Client) LeaveRoom(ctx context.Context) error {
+	_, err := c.request(ctx, Message{Type: typeLeaveRoom}, TypeRoomLeft)
+	return err
+}
+
+// Report tells the server how a connection to a peer it handed out went,
+// once it connected or failed, for its connection success metrics.
+func (c *Client) Report(ctx context.Context, r Report) error {
+	msg, err := newMessage(typeReport, r)
+	if err != nil {
+		return err
+	}
+	_, err = c.request(ctx, msg, "")
+	return err
+}
+
+// Close says bye, which deregisters the client, and disconnects.
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() {
+		conn, err := c.current()
+		close(c.closing)
+		if err == nil {
+			conn.write(Message{Type: TypeBye})
+			select {
+			case <-conn.dead:
+			case <-time.After(time.Second):
+			}
+			conn.ws.Close()
+		}
+	})
+	<-c.done
+	return nil
+}
+
+func newMessage(typ string, payload any) (Message, error) {
+	msg := Message{Type: typ}
+	if payload == nil {
+		return msg, nil
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return msg, err
+	}
+	msg.Payload = b
+	return msg, nil
+}
+
+func (c *Client) current() (*connection, error) {
+	select {
+	case <-c.closing:
+		return nil, ErrClosed
+	default:
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil, ErrDisconnected
+	}
+	return c.conn, nil
+}
+
+func (c *Client) request(ctx context.Context, msg Message, want string) (Message, error) {
+	conn, err := c.current()
+	if err != nil {
+		return Message{}, err
+	}
+	return c.call(ctx, conn, msg, want)
+}
+
+// call sends msg on conn with a fresh id and waits for the ack, returning
+// the reply of type want that preceded it.
+func (c *Client) call(ctx context.Context, conn *connection, msg Message, want string) (Message, error) {
+	c.mu.Lock()
+	c.seq++
+	p := &call{seq: c.seq, want: want, result: make(chan callResult, 1)}
+	msg.ID = "c" + strconv.FormatUint(c.seq, 10)
+	c.pending[msg.ID] = p
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, msg.ID)
+		c.mu.Unlock()
+	}()
+
+	if err := conn.write(msg); err != nil {
+		return Message{}, ErrDisconnected
+	}
+	select {
+	case r := <-p.result:
+		return r.reply, r.err
+	case <-conn.dead:
+		return Message{}, conn.failure()
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+// failure is ErrDisconnected, with the code and reason of the close frame if
+// the server sent one.
+func (conn *connection) failure() error {
+	var closed *websocket.CloseError
+	if errors.As(conn.err, &closed) {
+		return fmt.Errorf("%w: %v", ErrDisconnected, closed)
+	}
+	return ErrDisconnected
+}
+
+func (conn *connection) write(msg Message) error {
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+	conn.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	return conn.ws.WriteJSON(msg)
+}
+
+// connect dials the server and resumes the previous session if there is
+// one, registering otherwise. It reports which of the two happened.
+func (c *Client) connect(ctx context.Context) (*connection, bool, error) {
+	// Envelopes the server queued together come as one JSON array.
+	header := http.Header{"X-Seven-Protocol": {"1"}, "Sec-WebSocket-Protocol": {"seven-json-batch"}}
+	if c.cfg.APIKey != "" {
+		header.Set("X-API-Key", c.cfg.APIKey)
+	}
+	if c.cfg.Token != "" {
+		header.Set("Authorization", "Bearer "+c.cfg.Token)
+	}
+	c.mu.Lock()
+	token, node, nodeURL := c.resumeToken, c.node, c.nodeURL
+	c.mu.Unlock()
+	u, err := registerURL(c.cfg.URL, nodeURL)
+	if err != nil {
+		return nil, false, err
+	}
+	if token != "" && node != "" {
+		// Behind a load balancer, clustered instances forward the
+		// connection to the one holding the session.
+		u += "?node=" + url.QueryEscape(node)
+	}
+	ws, _, err := c.cfg.Dialer.DialContext(ctx, u, header)
+	if err != nil {
+		if nodeURL != "" {
+			c.mu.Lock()
+			c.nodeURL = ""
+			c.mu.Unlock()
+		}
+		return nil, false, err
+	}
+	conn := &connection{ws: ws, dead: make(chan struct{})}
+	go c.readLoop(conn)
+
+	if token != "" {
+		err := c.resume(ctx, conn, token)
+		if err == nil {
+			return conn, true, nil
+		}
+		var refused *Error
+		if errors.As(err, &refused) && refused.Code == "wrong_node" {
+			var where struct {
+				URL string `json:"url"`
+			}
+			if json.Unmarshal(refused.Payload, &where) == nil && where.URL != "" && where.URL != nodeURL {
+				// Reconnect there to resume.
+				c.mu.Lock()
+				c.nodeURL = where.URL
+				c.mu.Unlock()
+				ws.Close()
+				return nil, false, err
+			}
+		}
+		if errors.Is(err, ErrDisconnected) || ctx.Err() != nil {
+			ws.Close()
+			return nil, false, err
+		}
+	}
+	if err := c.register(ctx, conn); err != nil {
+		ws.Close()
+		return nil, false, err
+	}
+	return conn, false, nil
+}
+
+func (c *Client) resume(ctx context.Context, conn *connection, token string) error {
+	msg, err := newMessage(typeResume, map[string]string{"token": token})
+	if err != nil {
+		return err
+	}
+	reply, err := c.call(ctx, conn, msg, typeResumed)
+	if err != nil {
+		return err
+	}
+	var r resumed
+	if err := reply.Decode(&r); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = conn
+	c.resumeToken = r.ResumeToken
+	c.node = r.Node
+	c.room = r.Room
+	return nil
+}
+
+func (c *Client) register(ctx context.Context, conn *connection) error {
+	c.mu.Lock()
+	reg := c.reg
+	c.mu.Unlock()
+	msg, err := newMessage(typeRegister, reg)
+	if err != nil {
+		return err
+	}
+	reply, err := c.call(ctx, conn, msg, typeRegistered)
+	if err != nil {
+		return err
+	}
+	var r registered
+	if err := reply.Decode(&r); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r.UUID != "" {
+		c.reg.UUID, c.reg.UUIDToken = r.UUID, r.UUIDToken
+	}
+	if r.Device != "" {
+		c.reg.Device = r.Device
+	}
+	// Captcha tokens work once; re-registering the same entry needs none.
+	c.reg.CaptchaToken = ""
+	if c.conn != conn {
+		// A fresh registration is not in any room.
+		c.room = ""
+	}
+	c.conn = conn
+	c.entries = r.Entries
+	c.turn = r.Turn
+	c.resumeToken = r.ResumeToken
+	c.node = r.Node
+	return nil
+}
+
+// registerURL is the register websocket under base, on the instance at
+// nodeURL instead when it is set.
+func registerURL(base string, nodeURL string) (string, error) {
+	base = strings.TrimSuffix(base, "/")
+	if nodeURL != "" {
+		u, err := url.Parse(base)
+		if err != nil {
+			return "", err
+		}
+		n, err := url.Parse(nodeURL)
+		if err != nil {
+			return "", err
+		}
+		u.Scheme, u.Host = n.Scheme, n.Host
+		base = u.String()
+	}
+	return base + "/api/v1/ws/register", nil
+}
+
+// run reconnects whenever the connection drops, until the client is closed.
+func (c *Client) run(conn *connection) {
+	defer close(c.done)
+	defer close(c.msgs)
+	for {
+		<-conn.dead
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+
+		var resumed bool
+		if conn, resumed = c.reconnect(); conn == nil {
+			return
+		}
+		if c.cfg.OnReconnect != nil {
+			c.cfg.OnReconnect(resumed)
+		}
+	}
+}
+
+func (c *Client) reconnect() (*connection, bool) {
+	backoff := c.cfg.MinBackoff
+	for {
+		select {
+		case <-c.closing:
+			return nil, false
+		case <-time.After(backoff):
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.cfg.PongWait)
+		conn, resumed, err := c.connect(ctx)
+		cancel()
+		if err == nil {
+			return conn, resumed
+		}
+		var refused *Error
+		if errors.As(err, &refused) && refused.Code == "invalid_uuid_token" {
+			// Registering again cannot work; give up.
+			c.closeOnce.Do(func() { close(c.closing) })
+			return nil, false
+		}
+		if backoff *= 2; backoff > c.cfg.MaxBackoff {
+			backoff = c.cfg.MaxBackoff
+		}
+	}
+}
+
+// readLoop hands replies to the calls waiting for them and everything else
+// to Messages, until the connection fails.
+func (c *Client) readLoop(conn *connection) {
+	defer close(conn.dead)
+	defer conn.ws.Close()
+	alive := func() { conn.ws.SetReadDeadline(time.Now().Add(c.cfg.PongWait)) }
+	alive()
+	conn.ws.SetPingHandler(func(data string) error {
+		alive()
+		conn.writeMu.Lock()
+		defer conn.writeMu.Unlock()
+		return conn.ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(10*time.Second))
+	})
+	for {
+		msgs, err := conn.read()
+		if err != nil {
+			conn.err = err
+			return
+		}
+		alive()
+		for _, msg := range msgs {
+			if c.route(msg) {
+				continue
+			}
+			select {
+			case c.msgs <- msg:
+			case <-c.closing:
+				return
+			}
+		}
+	}
+}
+
+// read reads the next envelope, or batch of them.
+func (conn *connection) read() ([]Message, error) {
+	_, data, err := conn.ws.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '[' {
+		var msgs []Message
+		err := json.Unmarshal(data, &msgs)
+		return msgs, err
+	}
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return []Message{msg}, nil
+}
+
+// route settles the call msg answers, reporting whether it did.
+func (c *Client) route(msg Message) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch msg.Type {
+	case TypeRoomJoined:
+		c.room = msg.Room
+	case TypeRoomLeft:
+		c.room = ""
+	}
+
+	switch msg.Type {
+	case typeAck, typeNack:
+		p, ok := c.pending[msg.ID]
+		if !ok {
+			return false
+		}
+		switch {
+		case msg.Type == typeNack:
+			p.result <- callResult{err: decodeError(msg)}
+		case p.reply != nil && p.reply.Type == TypeRoomQueued:
+			// Acked, but the join only completes once admitted.
+			p.queued = true
+		case p.reply != nil:
+			p.result <- callResult{reply: *p.reply}
+		default:
+			p.result <- callResult{}
+		}
+		return true
+	}
+
+	// Replies come before their ack and in the order the requests were
+	// sent, so msg belongs to the oldest call waiting for its type.
+	// A queued join waits for the room_joined that admits it, which may
+	// even come before the ack.
+	var oldest *call
+	for _, p := range c.pending {
+		waiting := p.reply == nil && (p.want == msg.Type || p.want == TypeRoomJoined && msg.Type == TypeRoomQueued)
+		inLine := p.reply != nil && p.reply.Type == TypeRoomQueued && msg.Type == TypeRoomJoined
+		if (waiting || inLine) && (oldest == nil || p.seq < oldest.seq) {
+			oldest = p
+		}
+	}
+	if oldest == nil {
+		return false
+	}
+	reply := msg
+	oldest.reply = &reply
+	if oldest.queued {
+		oldest.result <- callResult{reply: reply}
+		oldest.queued = false
+	}
+	return true
+}
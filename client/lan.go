@@ -0,0 +1,68 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hoyle1974/seven/internal/mdns"
+)
+
+// LANServer is a server found on the local network by BrowseLAN.
+type LANServer struct {
+	Name string
+	// URL is what to put in Config.URL to connect to it.
+	URL string
+	// Protocols are the protocol versions it speaks, when it says.
+	Protocols []int
+}
+
+// BrowseLAN looks for servers announcing themselves over mDNS, such as those
+// started with --mdns, until ctx is done or for a second if it has no
+// deadline.
+func BrowseLAN(ctx context.Context) ([]LANServer, error) {
+	records, err := mdns.Browse(ctx)
+	if err != nil {
+		return nil, err
+	}
+	servers := []LANServer{}
+	for _, r := range records {
+		s := LANServer{Name: r.Instance}
+		port := strconv.Itoa(r.Port)
+		if r.Value("tls") == "1" {
+			// Certificates name the host, not its address.
+			s.URL = "wss://" + net.JoinHostPort(strings.TrimSuffix(r.Host, "."), port)
+		} else if len(r.IPs) > 0 {
+			s.URL = "ws://" + net.JoinHostPort(r.IPs[0].String(), port)
+		} else {
+			s.URL = "ws://" + net.JoinHostPort(strings.TrimSuffix(r.Host, "."), port)
+		}
+		for _, v := range strings.Split(r.Value("protocol"), ",") {
+			if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+				s.Protocols = append(s.Protocols, n)
+			}
+		}
+		servers = append(servers, s)
+	}
+	return servers, nil
+}
+
+// AnnounceLAN announces a server listening on port of this host, such as one
+// a game host embeds, the way --mdns does, until the returned Closer is
+// closed. name defaults to the hostname.
+func AnnounceLAN(name string, port int, tls bool) (io.Closer, error) {
+	txt := "tls=0"
+	if tls {
+		txt = "tls=1"
+	}
+	r, err := mdns.Local(port, txt)
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		r.Instance = name
+	}
+	return mdns.Announce(r)
+}
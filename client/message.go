@@ -0,0 +1,170 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Message types. Signals (offer, answer, candidate and anything else a
+// client makes up) are relayed to the peer named in To; the rest come from
+// the server.
+const (
+	TypeOffer       = "offer"
+	TypeAnswer      = "answer"
+	TypeCandidate   = "candidate"
+	TypeBye         = "bye"
+	TypePeerJoined  = "peer_joined"
+	TypePeerLeft    = "peer_left"
+	TypeRoomJoined  = "room_joined"
+	TypeRoomLeft    = "room_left"
+	TypeRoomQueued  = "room_queued"
+	TypeMeshPlan    = "mesh_plan"
+	TypeMatched     = "matched"
+	TypeUndelivered = "undelivered"
+	TypeDelivered   = "delivered"
+	TypeBroadcast   = "broadcast"
+	TypeDirect      = "direct"
+	TypeNATDetected = "nat_detected"
+	TypePunch       = "punch"
+	TypeError       = "error"
+	typeRegister    = "register"
+	typeRegistered  = "registered"
+	typeResume      = "resume"
+	typeResumed     = "resumed"
+	typeCreateRoom  = "create_room"
+	typeJoinRoom    = "join_room"
+	typeLeaveRoom   = "leave_room"
+	typeReport      = "report"
+	typeProbeNAT    = "probe_nat"
+	typeNATProbe    = "nat_probe"
+	typeRendezvous  = "rendezvous"
+	typeAck         = "ack"
+	typeNack        = "nack"
+)
+
+// Message is the envelope exchanged with the server.
+type Message struct {
+	Type    string          `json:"type"`
+	From    string          `json:"from,omitempty"`
+	To      string          `json:"to,omitempty"`
+	Room    string          `json:"room,omitempty"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// CorrelationID is set by the server on relayed signals, the same for
+	// one negotiation, for matching them up with its log lines.
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// Decode unmarshals the payload into v.
+func (m Message) Decode(v any) error {
+	return json.Unmarshal(m.Payload, v)
+}
+
+// Address is one of the addresses a peer can be reached on.
+type Address struct {
+	Addr      string `json:"addr"`
+	Kind      string `json:"kind,omitempty"`      // lan, wan, ipv6 or relay
+	Transport string `json:"transport,omitempty"` // udp or tcp
+	Priority  int    `json:"priority,omitempty"`
+}
+
+// Entry is a registered peer as the server hands it out.
+type Entry struct {
+	UUID     string            `json:"uuid"`
+	Addr     string            `json:"addr"`
+	Addrs    []Address         `json:"addrs,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Metadata json.RawMessage   `json:"metadata,omitempty"`
+	// Polite says whether this client should be polite towards the peer
+	// when both make offers at once.
+	Polite      *bool `json:"polite,omitempty"`
+	SameNetwork bool  `json:"same_network,omitempty"`
+	// NAT is NATEndpointIndependent or NATEndpointDependent for peers
+	// whose NAT was probed.
+	NAT string `json:"nat,omitempty"`
+}
+
+// Report is how a connection to a peer went, see Client.Report.
+type Report struct {
+	Peer          string        `json:"peer,omitempty"`
+	Connected     bool          `json:"-"`
+	TimeToConnect time.Duration `json:"-"`
+	CandidateType string        `json:"candidate_type,omitempty"` // host, srflx, prflx or relay
+}
+
+func (r Report) MarshalJSON() ([]byte, error) {
+	type report Report
+	outcome := "failed"
+	if r.Connected {
+		outcome = "connected"
+	}
+	return json.Marshal(struct {
+		report
+		Outcome         string `json:"outcome"`
+		TimeToConnectMs int64  `json:"time_to_connect_ms,omitempty"`
+	}{report(r), outcome, r.TimeToConnect.Milliseconds()})
+}
+
+// Registration is what the client registers as. It is sent again on every
+// reconnect that cannot resume the old session.
+type Registration struct {
+	UUID      string            `json:"uuid,omitempty"`
+	UUIDToken string            `json:"uuid_token,omitempty"`
+	Addr      string            `json:"addr,omitempty"`
+	Addrs     []Address         `json:"addrs,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Metadata  json.RawMessage   `json:"metadata,omitempty"`
+	Device    string            `json:"device,omitempty"`
+	// CaptchaToken is needed by servers running with --captcha when the
+	// client has no API key or bearer token.
+	CaptchaToken string `json:"captcha_token,omitempty"`
+	// Filter and Count narrow the entries returned, see Discover.
+	Filter string `json:"filter,omitempty"`
+	Count  int    `json:"count,omitempty"`
+}
+
+type registered struct {
+	Entries     []Entry         `json:"entries"`
+	UUID        string          `json:"uuid"`
+	UUIDToken   string          `json:"uuid_token"`
+	Device      string          `json:"device"`
+	ResumeToken string          `json:"resume_token"`
+	Node        string          `json:"node"`
+	Turn        json.RawMessage `json:"turn"`
+}
+
+type resumed struct {
+	UUID        string `json:"uuid"`
+	Room        string `json:"room"`
+	ResumeToken string `json:"resume_token"`
+	Node        string `json:"node"`
+}
+
+type roomJoined struct {
+	Members []Entry `json:"members"`
+}
+
+// Error is the server refusing a request.
+type Error struct {
+	Status string `json:"status"`
+	// Code is the machine-readable reason, such as room_full.
+	Code      string `json:"code"`
+	RequestID string `json:"request_id"`
+	// Payload is the whole refusal, which may carry details such as
+	// retry_after or max_peers.
+	Payload json.RawMessage `json:"-"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("seven: %s", e.Status)
+}
+
+func decodeError(m Message) error {
+	e := &Error{Payload: m.Payload}
+	if err := json.Unmarshal(m.Payload, e); err != nil || e.Status == "" {
+		e.Status = "request refused"
+	}
+	return e
+}
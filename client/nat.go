@@ -0,0 +1,176 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/hoyle1974/seven/internal/stun"
+)
+
+// NAT mapping behaviors, as returned by ProbeNAT and set on Entry.NAT.
+// Two peers behind endpoint dependent NATs can rarely connect directly and
+// are better off going through TURN from the start.
+const (
+	NATEndpointIndependent = "endpoint_independent"
+	NATEndpointDependent   = "endpoint_dependent"
+)
+
+// ErrNATProbe is returned by ProbeNAT when the server's probe ports did not
+// answer, usually because UDP to them is blocked.
+var ErrNATProbe = errors.New("seven: no answer to nat probe")
+
+type natProbe struct {
+	Token string `json:"token"`
+	Ports []int  `json:"ports"`
+}
+
+// ProbeNAT finds out how the client's NAT maps UDP addresses by sending STUN
+// Binding requests from one socket to the server's two probe ports. The
+// server, which needs --nat-probe-addr, comes to the same conclusion and
+// hands it out with the client's entry.
+func (c *Client) ProbeNAT(ctx context.Context) (string, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return c.ProbeNATFrom(ctx, conn)
+}
+
+// ProbeNATFrom is ProbeNAT from conn, which also tells the server where
+// conn is reachable for Rendezvous. It reads from conn, so call it before
+// other traffic on it starts.
+func (c *Client) ProbeNATFrom(ctx context.Context, conn *net.UDPConn) (string, error) {
+	reply, err := c.request(ctx, Message{Type: typeProbeNAT}, typeNATProbe)
+	if err != nil {
+		return "", err
+	}
+	var probe natProbe
+	if err := reply.Decode(&probe); err != nil {
+		return "", err
+	}
+	u, err := url.Parse(c.cfg.URL)
+	if err != nil {
+		return "", err
+	}
+
+	defer conn.SetReadDeadline(time.Time{})
+	targets := make([]*net.UDPAddr, len(probe.Ports))
+	for i, port := range probe.Ports {
+		if targets[i], err = net.ResolveUDPAddr("udp", net.JoinHostPort(u.Hostname(), strconv.Itoa(port))); err != nil {
+			return "", err
+		}
+	}
+
+	mapped := make([]netip.AddrPort, len(targets))
+	buf := make([]byte, 1500)
+	for attempt := 0; attempt < 3; attempt++ {
+		pending := map[[12]byte]int{}
+		for i, to := range targets {
+			if mapped[i].IsValid() {
+				continue
+			}
+			req := stun.NewRequest(probe.Token)
+			pending[req.Transaction] = i
+			if _, err := conn.WriteToUDP(req.Encode(), to); err != nil {
+				return "", err
+			}
+		}
+		deadline := time.Now().Add(time.Second)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetReadDeadline(deadline)
+		for len(pending) > 0 {
+			n, _, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break
+			}
+			resp, err := stun.Decode(buf[:n])
+			if i, ok := pending[resp.Transaction]; err == nil && ok && resp.Mapped.IsValid() {
+				mapped[i] = resp.Mapped
+				delete(pending, resp.Transaction)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+	}
+
+	if len(mapped) < 2 || !mapped[0].IsValid() || !mapped[1].IsValid() {
+		return "", ErrNATProbe
+	}
+	if mapped[0] == mapped[1] {
+		return NATEndpointIndependent, nil
+	}
+	return NATEndpointDependent, nil
+}
+
+// Punch is a rendezvous with Peer: at At, both sides start sending to the
+// other's Endpoints, best first.
+type Punch struct {
+	ID        string   `json:"id"`
+	Peer      string   `json:"peer"`
+	Endpoints []string `json:"endpoints"`
+	At        int64    `json:"at"`    // unix milliseconds, by the server's clock
+	InMs      int64    `json:"in_ms"` // the same, relative to when it was sent
+}
+
+// Time is when to start sending, assuming the local clock is close to the
+// server's.
+func (p Punch) Time() time.Time {
+	return time.UnixMilli(p.At)
+}
+
+// Rendezvous asks the server to have the client and peer punch holes
+// towards each other. The peer gets the same as a TypePunch message. For
+// the best endpoints both should have run ProbeNATFrom on the sockets they
+// punch from.
+func (c *Client) Rendezvous(ctx context.Context, peer string) (Punch, error) {
+	reply, err := c.request(ctx, Message{Type: typeRendezvous, To: peer}, TypePunch)
+	if err != nil {
+		return Punch{}, err
+	}
+	var p Punch
+	err = reply.Decode(&p)
+	return p, err
+}
+
+// Run waits for p's time and sends packet from conn to each endpoint a few
+// times, one every 100ms, which opens the mapping on the local NAT and
+// reaches the peer once its NAT has opened too.
+func (p Punch) Run(ctx context.Context, conn *net.UDPConn, packet []byte) error {
+	var targets []*net.UDPAddr
+	for _, e := range p.Endpoints {
+		if addr, err := net.ResolveUDPAddr("udp", e); err == nil {
+			targets = append(targets, addr)
+		}
+	}
+	if len(targets) == 0 {
+		return errors.New("seven: no endpoints to punch")
+	}
+	timer := time.NewTimer(time.Until(p.Time()))
+	defer timer.Stop()
+	for i := 0; i < 10; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+		for _, addr := range targets {
+			if _, err := conn.WriteToUDP(packet, addr); err != nil {
+				return err
+			}
+		}
+		timer.Reset(100 * time.Millisecond)
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	sevenclient "github.com/hoyle1974/seven/client"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// runBench is `seven bench`: it connects simulated clients to a server, puts
+// them in rooms and has them signal each other, then reports how long each
+// kind of operation took and how often it failed.
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("url", "ws://localhost:8080", "Base URL of the server to load")
+	apiKey := fs.String("api-key", "", "API key the clients connect with")
+	clients := fs.Int("clients", 100, "Number of simulated clients")
+	roomSize := fs.Int("room-size", 4, "Clients per room (1 only registers them)")
+	rate := fs.Float64("rate", 1, "Signals each client sends per second")
+	duration := fs.Duration("duration", 30*time.Second, "How long to signal once everyone is connected")
+	ramp := fs.Duration("ramp", 5*time.Second, "Time over which the clients connect")
+	payload := fs.Int("payload", 512, "Size in bytes of each signal's payload")
+	fs.Parse(args)
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	if *clients < 1 || *roomSize < 1 || *rate <= 0 {
+		log.Fatal().Msg("--clients, --room-size and --rate must be positive")
+	}
+
+	b := &bench{url: *target, apiKey: *apiKey, ops: map[string]*benchOp{}, padding: randomPadding(*payload)}
+	log.Info().Int("clients", *clients).Str("url", *target).Msg("Connecting clients")
+	start := time.Now()
+	peers := b.connect(*clients, *roomSize, *ramp)
+	log.Info().Int("connected", len(peers)).Dur("took", time.Since(start)).Msg("Signaling")
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		wg.Add(2)
+		go func(p *benchPeer) { defer wg.Done(); b.signal(ctx, p, *rate) }(p)
+		go func(p *benchPeer) { defer wg.Done(); b.receive(ctx, p) }(p)
+	}
+	wg.Wait()
+	cancel()
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p *benchPeer) { defer wg.Done(); p.c.Close() }(p)
+	}
+	wg.Wait()
+	b.report(os.Stdout, *duration)
+}
+
+type bench struct {
+	url     string
+	apiKey  string
+	padding string
+
+	mu  sync.Mutex
+	ops map[string]*benchOp
+}
+
+// benchOp collects the outcomes of one kind of operation.
+type benchOp struct {
+	latencies []time.Duration
+	errors    map[string]int
+}
+
+type benchPeer struct {
+	c     *sevenclient.Client
+	mates []string
+}
+
+// benchSignal is the payload of the signals sent, stamped for measuring how
+// long they take to arrive.
+type benchSignal struct {
+	Sent    int64  `json:"sent"`
+	Padding string `json:"padding,omitempty"`
+}
+
+func randomPadding(n int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+func (b *bench) record(op string, took time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	o, ok := b.ops[op]
+	if !ok {
+		o = &benchOp{errors: map[string]int{}}
+		b.ops[op] = o
+	}
+	if err != nil {
+		o.errors[err.Error()]++
+		return
+	}
+	o.latencies = append(o.latencies, took)
+}
+
+// connect registers n clients spread over ramp and groups them into rooms,
+// the first of every roomSize creating the room the others join.
+func (b *bench) connect(n int, roomSize int, ramp time.Duration) []*benchPeer {
+	var (
+		mu    sync.Mutex
+		peers []*benchPeer
+		wg    sync.WaitGroup
+	)
+	for r := 0; r*roomSize < n; r++ {
+		size := roomSize
+		if rest := n - r*roomSize; rest < size {
+			size = rest
+		}
+		wg.Add(1)
+		go func(r int, size int) {
+			defer wg.Done()
+			time.Sleep(time.Duration(float64(ramp) * float64(r*roomSize) / float64(n)))
+			group := b.connectRoom(r, size, roomSize > 1)
+			mu.Lock()
+			peers = append(peers, group...)
+			mu.Unlock()
+		}(r, size)
+	}
+	wg.Wait()
+	return peers
+}
+
+func (b *bench) connectRoom(r int, size int, rooms bool) []*benchPeer {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var group []*benchPeer
+	room := ""
+	for i := 0; i < size; i++ {
+		start := time.Now()
+		c, err := sevenclient.Dial(ctx, sevenclient.Config{
+			URL:    b.url,
+			APIKey: b.apiKey,
+			Registration: sevenclient.Registration{
+				UUID: uuid.NewString(),
+				Addr: fmt.Sprintf("198.51.100.%d:%d", 1+r%254, 1024+i),
+			},
+		})
+		b.record("register", time.Since(start), err)
+		if err != nil {
+			continue
+		}
+		if rooms {
+			start = time.Now()
+			if room == "" {
+				room, err = c.CreateRoom(ctx, 0)
+				b.record("create_room", time.Since(start), err)
+			} else {
+				_, err = c.JoinRoom(ctx, room)
+				b.record("join_room", time.Since(start), err)
+			}
+			if err != nil {
+				c.Close()
+				continue
+			}
+		}
+		group = append(group, &benchPeer{c: c})
+	}
+	for _, p := range group {
+		for _, o := range group {
+			if o != p {
+				p.mates = append(p.mates, o.c.UUID())
+			}
+		}
+	}
+	return group
+}
+
+// signal sends offers to random room mates at rate per second until ctx is
+// done.
+func (b *bench) signal(ctx context.Context, p *benchPeer, rate float64) {
+	if len(p.mates) == 0 {
+		return
+	}
+	tick := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		to := p.mates[rand.Intn(len(p.mates))]
+		start := time.Now()
+		err := p.c.Signal(ctx, to, sevenclient.TypeOffer, benchSignal{Sent: start.UnixNano(), Padding: b.padding})
+		if ctx.Err() != nil {
+			return
+		}
+		b.record("signal_ack", time.Since(start), err)
+	}
+}
+
+// receive times the signals arriving at p and counts what could not be
+// delivered.
+func (b *bench) receive(ctx context.Context, p *benchPeer) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-p.c.Messages():
+			if !ok {
+				return
+			}
+			switch msg.Type {
+			case sevenclient.TypeOffer:
+				var s benchSignal
+				if err := json.Unmarshal(msg.Payload, &s); err == nil {
+					b.record("signal_delivery", time.Since(time.Unix(0, s.Sent)), nil)
+				}
+			case sevenclient.TypeUndelivered:
+				b.record("signal_delivery", 0, fmt.Errorf("undelivered"))
+			case sevenclient.TypeError:
+				b.record("server_error", 0, fmt.Errorf("%s", msg.Payload))
+			}
+		}
+	}
+}
+
+func (b *bench) report(w *os.File, duration time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	names := make([]string, 0, len(b.ops))
+	for name := range b.ops {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "operation\tok\terrors\terror rate\tp50\tp90\tp99\tmax\t")
+	for _, name := range names {
+		o := b.ops[name]
+		failed := 0
+		for _, n := range o.errors {
+			failed += n
+		}
+		total := len(o.latencies) + failed
+		sort.Slice(o.latencies, func(i, j int) bool { return o.latencies[i] < o.latencies[j] })
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.2f%%\t%s\t%s\t%s\t%s\t\n", name, len(o.latencies), failed,
+			100*float64(failed)/float64(total),
+			percentile(o.latencies, 0.5), percentile(o.latencies, 0.9), percentile(o.latencies, 0.99), percentile(o.latencies, 1))
+	}
+	tw.Flush()
+	if o, ok := b.ops["signal_delivery"]; ok {
+		fmt.Fprintf(w, "\n%.1f signals delivered per second\n", float64(len(o.latencies))/duration.Seconds())
+	}
+	for _, name := range names {
+		for err, n := range b.ops[name].errors {
+			fmt.Fprintf(w, "%s: %d x %s\n", name, n, err)
+		}
+	}
+}
+
+// percentile of sorted latencies, rounded for reading.
+func percentile(sorted []time.Duration, p float64) string {
+	if len(sorted) == 0 {
+		return "-"
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i].Round(10 * time.Microsecond).String()
+}
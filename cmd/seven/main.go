@@ -0,0 +1,30 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Seven is a WebRTC signaling server. `seven bench` load tests one instead,
+// and `seven openapi` prints the OpenAPI document of its client API.
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/hoyle1974/seven/internal/api"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "openapi" {
+		os.Stdout.Write(api.OpenAPI())
+		return
+	}
+	fs := flag.NewFlagSet("seven", flag.ExitOnError)
+	opts := api.NewOptions()
+	opts.RegisterFlags(fs)
+	fs.Parse(os.Args[1:])
+	api.Main(opts)
+}
@@ -0,0 +1,7 @@
+// Package examples embeds the example pages the server can serve.
+package examples
+
+import _ "embed"
+
+//go:embed video/index.html
+var VideoDemo []byte
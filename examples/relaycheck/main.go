@@ -0,0 +1,133 @@
+// Relaycheck runs two clients through a Seven server and checks that the
+// offer, answer and candidate relay works end to end. It stands in for a
+// real WebRTC negotiation: the session descriptions are placeholders, but
+// every message takes the path a browser's would. It exits non zero on the
+// first step that fails.
+//
+//	go run ./examples/relaycheck -url ws://localhost:8080
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hoyle1974/seven/client"
+)
+
+var url = flag.String("url", "ws://localhost:8080", "Base URL of the server")
+var apiKey = flag.String("api-key", "", "API key to connect with")
+var timeout = flag.Duration("timeout", 10*time.Second, "How long the whole check may take")
+
+type description struct {
+	Type string `json:"type"`
+	SDP  string `json:"sdp"`
+}
+
+func main() {
+	flag.Parse()
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if err := check(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "FAIL:", err)
+		os.Exit(1)
+	}
+	fmt.Println("ok")
+}
+
+func dial(ctx context.Context, addr string) (*client.Client, error) {
+	return client.Dial(ctx, client.Config{
+		URL:          *url,
+		APIKey:       *apiKey,
+		Registration: client.Registration{UUID: uuid.NewString(), Addr: addr},
+	})
+}
+
+func check(ctx context.Context) error {
+	offerer, err := dial(ctx, "192.0.2.1:9")
+	if err != nil {
+		return fmt.Errorf("registering the first peer: %w", err)
+	}
+	defer offerer.Close()
+	answerer, err := dial(ctx, "192.0.2.2:9")
+	if err != nil {
+		return fmt.Errorf("registering the second peer: %w", err)
+	}
+	defer answerer.Close()
+
+	room, err := offerer.CreateRoom(ctx, 2)
+	if err != nil {
+		return fmt.Errorf("creating a room: %w", err)
+	}
+	if _, err := answerer.JoinRoom(ctx, room); err != nil {
+		return fmt.Errorf("joining the room: %w", err)
+	}
+	// The peer that joined later offers, as its mesh plan says.
+	plan, err := await(ctx, answerer, client.TypeMeshPlan)
+	if err != nil {
+		return err
+	}
+	var offerTo struct {
+		OfferTo []string `json:"offer_to"`
+	}
+	if err := plan.Decode(&offerTo); err != nil || len(offerTo.OfferTo) != 1 || offerTo.OfferTo[0] != offerer.UUID() {
+		return fmt.Errorf("unexpected mesh plan %s", plan.Payload)
+	}
+
+	steps := []struct {
+		from, to *client.Client
+		typ      string
+		payload  any
+	}{
+		{answerer, offerer, client.TypeOffer, description{"offer", "v=0 relaycheck offer"}},
+		{offerer, answerer, client.TypeAnswer, description{"answer", "v=0 relaycheck answer"}},
+		{answerer, offerer, client.TypeCandidate, map[string]any{"candidate": "candidate:1 1 udp 1 192.0.2.2 9 typ host", "sdpMid": "0"}},
+		{offerer, answerer, client.TypeCandidate, map[string]any{"candidate": "candidate:1 1 udp 1 192.0.2.1 9 typ host", "sdpMid": "0"}},
+	}
+	for _, s := range steps {
+		if err := s.from.Signal(ctx, s.to.UUID(), s.typ, s.payload); err != nil {
+			return fmt.Errorf("sending %s: %w", s.typ, err)
+		}
+		got, err := await(ctx, s.to, s.typ)
+		if err != nil {
+			return err
+		}
+		want, _ := json.Marshal(s.payload)
+		if got.From != s.from.UUID() || string(got.Payload) != string(want) {
+			return fmt.Errorf("%s arrived as %+v", s.typ, got)
+		}
+		fmt.Printf("relayed %s\n", s.typ)
+	}
+
+	if err := answerer.LeaveRoom(ctx); err != nil {
+		return fmt.Errorf("leaving the room: %w", err)
+	}
+	if _, err := await(ctx, offerer, client.TypePeerLeft); err != nil {
+		return err
+	}
+	return nil
+}
+
+// await skips messages until one of type typ arrives.
+func await(ctx context.Context, c *client.Client, typ string) (client.Message, error) {
+	for {
+		select {
+		case msg, ok := <-c.Messages():
+			if !ok {
+				return msg, fmt.Errorf("connection closed waiting for %s", typ)
+			}
+			if msg.Type == typ {
+				return msg, nil
+			}
+			if msg.Type == client.TypeError {
+				return msg, fmt.Errorf("server error waiting for %s: %s", typ, msg.Payload)
+			}
+		case <-ctx.Done():
+			return client.Message{}, fmt.Errorf("timed out waiting for %s", typ)
+		}
+	}
+}
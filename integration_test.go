@@ -0,0 +1,175 @@
+//go:build integration
+
+package seven_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hoyle1974/seven"
+	"github.com/hoyle1974/seven/client"
+	"github.com/pion/webrtc/v3"
+)
+
+// peer is a pion PeerConnection signaling through a Seven client.
+type peer struct {
+	t  *testing.T
+	c  *client.Client
+	pc *webrtc.PeerConnection
+
+	mu      sync.Mutex
+	remote  string
+	pending []webrtc.ICECandidateInit // until the remote description is set
+}
+
+func newPeer(ctx context.Context, t *testing.T, url string, addr string) *peer {
+	t.Helper()
+	c, err := client.Dial(ctx, client.Config{URL: url, Registration: client.Registration{UUID: uuid.NewString(), Addr: addr}})
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	var s webrtc.SettingEngine
+	s.SetIncludeLoopbackCandidate(true)
+	pc, err := webrtc.NewAPI(webrtc.WithSettingEngine(s)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	p := &peer{t: t, c: c, pc: pc}
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		p.mu.Lock()
+		to := p.remote
+		p.mu.Unlock()
+		if candidate == nil || to == "" {
+			return
+		}
+		if err := c.Signal(ctx, to, client.TypeCandidate, candidate.ToJSON()); err != nil && ctx.Err() == nil {
+			t.Errorf("Error sending candidate: %v", err)
+		}
+	})
+	go p.signal(ctx)
+	return p
+}
+
+// signal answers offers and takes the answers and candidates it is sent.
+func (p *peer) signal(ctx context.Context) {
+	for {
+		var msg client.Message
+		select {
+		case <-ctx.Done():
+			return
+		case msg = <-p.c.Messages():
+		}
+		switch msg.Type {
+		case client.TypeOffer, client.TypeAnswer:
+			var sd webrtc.SessionDescription
+			if err := json.Unmarshal(msg.Payload, &sd); err != nil {
+				p.t.Errorf("Error decoding %s: %v", msg.Type, err)
+				return
+			}
+			p.mu.Lock()
+			p.remote = msg.From
+			p.mu.Unlock()
+			if err := p.pc.SetRemoteDescription(sd); err != nil {
+				p.t.Errorf("Error setting %s: %v", msg.Type, err)
+				return
+			}
+			p.addPending()
+			if msg.Type == client.TypeOffer {
+				answer, err := p.pc.CreateAnswer(nil)
+				if err == nil {
+					err = p.pc.SetLocalDescription(answer)
+				}
+				if err == nil {
+					err = p.c.Signal(ctx, msg.From, client.TypeAnswer, answer)
+				}
+				if err != nil {
+					p.t.Errorf("Error answering: %v", err)
+					return
+				}
+			}
+		case client.TypeCandidate:
+			var candidate webrtc.ICECandidateInit
+			if err := json.Unmarshal(msg.Payload, &candidate); err != nil {
+				p.t.Errorf("Error decoding candidate: %v", err)
+				return
+			}
+			p.mu.Lock()
+			p.pending = append(p.pending, candidate)
+			p.mu.Unlock()
+			if p.pc.RemoteDescription() != nil {
+				p.addPending()
+			}
+		}
+	}
+}
+
+func (p *peer) addPending() {
+	p.mu.Lock()
+	pending := p.pending
+	p.pending = nil
+	p.mu.Unlock()
+	for _, candidate := range pending {
+		if err := p.pc.AddICECandidate(candidate); err != nil {
+			p.t.Errorf("Error adding candidate: %v", err)
+		}
+	}
+}
+
+func TestDataChannel(t *testing.T) {
+	srv, err := seven.New(seven.Config{Options: map[string]string{"ip-rate": "0", "log-level": "warn"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv.Handler())
+	// Cleanups run last first, so the peers go before the server.
+	t.Cleanup(func() {
+		ts.Close()
+		srv.Shutdown(context.Background())
+	})
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	offerer := newPeer(ctx, t, url, "192.0.2.1:9")
+	answerer := newPeer(ctx, t, url, "192.0.2.2:9")
+
+	offered, answered := make(chan struct{}), make(chan struct{})
+	dc, err := offerer.pc.CreateDataChannel("seven", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc.OnOpen(func() { close(offered) })
+	answerer.pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		dc.OnOpen(func() { close(answered) })
+	})
+
+	offerer.mu.Lock()
+	offerer.remote = answerer.c.UUID()
+	offerer.mu.Unlock()
+	offer, err := offerer.pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := offerer.pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	if err := offerer.c.Signal(ctx, answerer.c.UUID(), client.TypeOffer, offer); err != nil {
+		t.Fatalf("Error sending offer: %v", err)
+	}
+
+	for _, opened := range []chan struct{}{offered, answered} {
+		select {
+		case <-opened:
+		case <-ctx.Done():
+			t.Fatal("Timed out waiting for the data channel to open")
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hoyle1974/seven/internal/registry"
+)
+
+const (
+	maxPeerAddresses = 8
+	maxAddressLength = 256
+)
+
+// AddressError says which registered address was refused and why.
+type AddressError struct {
+	Field  string
+	Addr   string
+	Reason string
+}
+
+func (e *AddressError) Error() string {
+	return fmt.Sprintf("Invalid address %q in %s: %s", e.Addr, e.Field, e.Reason)
+}
+
+// details are the error details clients get for the error.
+func (e *AddressError) details() gin.H {
+	return gin.H{"field": e.Field, "addr": e.Addr, "reason": e.Reason}
+}
+
+var addressKinds = map[string]bool{"": true, "lan": true, "wan": true, "ipv6": true, "relay": true}
+var addressTransports = map[string]bool{"": true, "udp": true, "tcp": true}
+
+// normalizeAddresses validates a registration's addresses and sorts them by
+// priority. The primary address is addr, or the best of addrs when addr is
+// empty, so clients that only read addr keep working.
+func normalizeAddresses(addr string, addrs []registry.Address) (string, []registry.Address, error) {
+	if len(addrs) > maxPeerAddresses {
+		return "", nil, &AddressError{Field: "addrs", Reason: fmt.Sprintf("at most %d addresses are allowed", maxPeerAddresses)}
+	}
+	for i, a := range addrs {
+		field := fmt.Sprintf("addrs[%d]", i)
+		if !addressKinds[a.Kind] {
+			return "", nil, &AddressError{Field: field, Addr: a.Addr, Reason: fmt.Sprintf("unknown kind %q", a.Kind)}
+		}
+		if !addressTransports[a.Transport] {
+			return "", nil, &AddressError{Field: field, Addr: a.Addr, Reason: fmt.Sprintf("unknown transport %q", a.Transport)}
+		}
+		if err := checkAddress(field, a.Addr, a.Kind); err != nil {
+			return "", nil, err
+		}
+	}
+	if addr != "" {
+		if err := checkAddress("addr", addr, ""); err != nil {
+			return "", nil, err
+		}
+	}
+	if len(addrs) == 0 {
+		return addr, nil, nil
+	}
+	sorted := append([]registry.Address{}, addrs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority > sorted[j].Priority })
+	if addr == "" {
+		addr = sorted[0].Addr
+	}
+	return addr, sorted, nil
+}
+
+// checkAddress requires addr to be an IP literal and port, with IPv6 hosts in
+// brackets. Unless --allow-private is set, addresses other peers cannot
+// reach are refused: loopback, multicast, unspecified and link-local ones,
+// and private ranges that are not marked as lan.
+func checkAddress(field string, addr string, kind string) error {
+	fail := func(reason string) error {
+		return &AddressError{Field: field, Addr: addr, Reason: reason}
+	}
+	if len(addr) > maxAddressLength {
+		return fail(fmt.Sprintf("longer than %d characters", maxAddressLength))
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fail("not host:port, IPv6 hosts go in brackets")
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return fail("host is not an IP address")
+	}
+	if ip.Zone() != "" {
+		return fail("zoned addresses are only meaningful on the peer's host")
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err != nil || p == 0 {
+		return fail("port is not between 1 and 65535")
+	}
+	ip = ip.Unmap()
+	if kind == "ipv6" && !ip.Is6() {
+		return fail("kind ipv6 needs an IPv6 address")
+	}
+	if *allowPrivate {
+		return nil
+	}
+	switch {
+	case ip.IsLoopback():
+		return fail("loopback address")
+	case ip.IsMulticast():
+		return fail("multicast address")
+	case ip.IsUnspecified():
+		return fail("unspecified address")
+	case ip.IsLinkLocalUnicast():
+		return fail("link-local address")
+	case ip.IsPrivate() && kind != "lan":
+		return fail("private address not marked as lan")
+	}
+	return nil
+}
+
+// markSameNetwork flags the entries registered from ip, the requester's
+// public address. Those peers are probably behind the same NAT and can try
+// their lan addresses first.
+func markSameNetwork(entries []EntryForm, values []registry.Entry, ip string) {
+	if ip == "" {
+		return
+	}
+	same := map[string]bool{}
+	for _, e := range values {
+		if e.IP == ip {
+			same[e.UUID.String()] = true
+		}
+	}
+	for i := range entries {
+		entries[i].SameNetwork = same[entries[i].Uuid]
+	}
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// requireAdmin only lets through requests bearing --admin-token.
+func requireAdmin(ctx *gin.Context) {
+	token := bearerToken(ctx.Request)
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+		reqLog(ctx).Warn().Str("ip", ctx.ClientIP()).Str("path", ctx.Request.URL.Path).Msg("Rejected admin request")
+		auditRequest(ctx, "auth_failed").Int("status", http.StatusUnauthorized).Str("reason", "invalid admin token").Send()
+		strike(ctx.ClientIP(), "invalid admin token")
+		abortError(ctx, http.StatusUnauthorized, "unauthorized", "unauthorized", nil)
+		return
+	}
+	ctx.Set(auditActorKey, "admin")
+	ctx.Next()
+}
+
+func dashboard(ctx *gin.Context) {
+	ctx.Data(http.StatusOK, "text/html; charset=utf-8", adminHTML)
+}
+
+type APIKeyForm struct {
+	Name              string `json:"name" binding:"required"`
+	RequestsPerMinute int    `json:"requests_per_minute"`
+	MaxConnections    int    `json:"max_connections"`
+	Tenant            string `json:"tenant"`
+}
+
+func createAPIKey(ctx *gin.Context) {
+	var form APIKeyForm
+	if err := ctx.BindJSON(&form); err != nil {
+		reqLog(ctx).Err(err).Msg("Error parsing form")
+		respondError(ctx, http.StatusNotAcceptable, "invalid_json", "error parsing json", nil)
+		return
+	}
+	if form.Tenant != "" && !tenantPattern.MatchString(form.Tenant) {
+		respondError(ctx, http.StatusNotAcceptable, "invalid_tenant", "invalid tenant", nil)
+		return
+	}
+
+	secret, err := newAPIKeySecret()
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error generating api key")
+		respondError(ctx, http.StatusInternalServerError, "internal", "error", nil)
+		return
+	}
+	k := APIKey{
+		ID:                uuid.New().String(),
+		Name:              form.Name,
+		Hash:              hashAPIKey(secret),
+		RequestsPerMinute: form.RequestsPerMinute,
+		MaxConnections:    form.MaxConnections,
+		Tenant:            form.Tenant,
+		CreatedAt:         time.Now(),
+	}
+	if err := apiKeys.Create(ctx.Request.Context(), k); err != nil {
+		reqLog(ctx).Err(err).Msg("Error storing api key")
+		respondError(ctx, http.StatusInternalServerError, "internal", "error", nil)
+		return
+	}
+
+	reqLog(ctx).Info().Str("id", k.ID).Str("name", k.Name).Msg("Created api key")
+	auditRequest(ctx, "api_key_created").Str("key", k.ID).Str("name", k.Name).Str("tenant", k.Tenant).Send()
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok", "key": secret, "api_key": k})
+}
+
+func listAPIKeys(ctx *gin.Context) {
+	keys, err := apiKeys.List(ctx.Request.Context())
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error listing api keys")
+		respondError(ctx, http.StatusInternalServerError, "internal", "error", nil)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok", "api_keys": keys})
+}
+
+func revokeAPIKey(ctx *gin.Context) {
+	id := ctx.Param("id")
+	ok, err := apiKeys.Revoke(ctx.Request.Context(), id)
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error revoking api key")
+		respondError(ctx, http.StatusInternalServerError, "internal", "error", nil)
+		return
+	}
+	if !ok {
+		respondError(ctx, http.StatusNotFound, "not_found", "not found", nil)
+		return
+	}
+	quotas.forget(id)
+	reqLog(ctx).Info().Str("id", id).Msg("Revoked api key")
+	auditRequest(ctx, "api_key_revoked").Str("key", id).Send()
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
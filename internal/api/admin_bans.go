@@ -0,0 +1,96 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type BanForm struct {
+	Target string `json:"target" binding:"required"`
+	Reason string `json:"reason"`
+	// Duration, such as "24h", makes a temporary ban.
+	Duration string `json:"duration"`
+}
+
+func createBan(ctx *gin.Context) {
+	var form BanForm
+	if err := ctx.BindJSON(&form); err != nil {
+		reqLog(ctx).Err(err).Msg("Error parsing form")
+		respondError(ctx, http.StatusNotAcceptable, "invalid_json", "error parsing json", nil)
+		return
+	}
+	target, err := parseBanTarget(form.Target)
+	if err != nil {
+		respondError(ctx, http.StatusNotAcceptable, "invalid_target", "invalid target", nil)
+		return
+	}
+	b := Ban{Target: target, Reason: form.Reason, CreatedAt: time.Now()}
+	if form.Duration != "" {
+		d, err := time.ParseDuration(form.Duration)
+		if err != nil || d <= 0 {
+			respondError(ctx, http.StatusNotAcceptable, "invalid_duration", "invalid duration", nil)
+			return
+		}
+		expires := b.CreatedAt.Add(d)
+		b.ExpiresAt = &expires
+	}
+	if err := addBan(ctx.Request.Context(), b); err != nil {
+		reqLog(ctx).Err(err).Msg("Error storing ban")
+		respondError(ctx, http.StatusInternalServerError, "internal", "error", nil)
+		return
+	}
+
+	reqLog(ctx).Info().Str("target", target).Str("reason", b.Reason).Msg("Banned")
+	e := auditRequest(ctx, "ban_added").Str("target", target).Str("reason", b.Reason)
+	if b.ExpiresAt != nil {
+		e = e.Time("expires_at", *b.ExpiresAt)
+	}
+	e.Send()
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok", "ban": b})
+}
+
+func listBans(ctx *gin.Context) {
+	list, err := banStore.List(ctx.Request.Context())
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error listing bans")
+		respondError(ctx, http.StatusInternalServerError, "internal", "error", nil)
+		return
+	}
+	now := time.Now()
+	live := []Ban{}
+	for _, b := range list {
+		if !b.expired(now) {
+			live = append(live, b)
+		}
+	}
+	sort.Slice(live, func(i, j int) bool { return live[i].CreatedAt.Before(live[j].CreatedAt) })
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok", "bans": live})
+}
+
+// deleteBan lifts the ban on the rest of the path, so subnets need no
+// escaping: DELETE /admin/bans/10.0.0.0/8.
+func deleteBan(ctx *gin.Context) {
+	target, err := parseBanTarget(strings.TrimPrefix(ctx.Param("target"), "/"))
+	if err != nil {
+		respondError(ctx, http.StatusNotAcceptable, "invalid_target", "invalid target", nil)
+		return
+	}
+	ok, err := banStore.Delete(ctx.Request.Context(), target)
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error deleting ban")
+		respondError(ctx, http.StatusInternalServerError, "internal", "error", nil)
+		return
+	}
+	bans.remove(target)
+	if !ok {
+		respondError(ctx, http.StatusNotFound, "not_found", "not found", nil)
+		return
+	}
+	reqLog(ctx).Info().Str("target", target).Msg("Lifted ban")
+	auditRequest(ctx, "ban_removed").Str("target", target).Send()
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
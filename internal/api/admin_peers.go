@@ -0,0 +1,335 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/hoyle1974/seven/internal/registry"
+	"github.com/hoyle1974/seven/internal/ws"
+	"github.com/rs/zerolog/log"
+)
+
+// PeerInfo is everything the admin API knows about a registered uuid.
+// Connection state is only known for sessions on this instance.
+type PeerInfo struct {
+	EntryForm
+	Tenant    string             `json:"tenant,omitempty"`
+	IP        string             `json:"ip,omitempty"`
+	Location  *registry.Location `json:"location,omitempty"`
+	LastSeen  time.Time          `json:"last_seen"`
+	Room      string             `json:"room,omitempty"`
+	Connected bool               `json:"connected"`
+	Transport string             `json:"transport,omitempty"`
+	Observed  *ObservedAddress   `json:"observed,omitempty"`
+	Parked    bool               `json:"parked,omitempty"`
+	Queued    int                `json:"queued,omitempty"`
+	Devices   []string           `json:"devices,omitempty"`
+	Score     *float64           `json:"score,omitempty"` // from connection reports, see score.go
+}
+
+func transportKind(t transport) string {
+	switch t := t.(type) {
+	case *ws.Transport:
+		if t.Proto() {
+			return "websocket+proto"
+		}
+		return "websocket"
+	case *grpcTransport:
+		return "grpc"
+	case *queueTransport:
+		return "http"
+	default:
+		return ""
+	}
+}
+
+func peerInfo(e registry.Entry) PeerInfo {
+	id := e.UUID.String()
+	info := PeerInfo{
+		EntryForm: entryForm(e),
+		Tenant:    e.Tenant,
+		IP:        e.IP,
+		Location:  e.Location,
+		LastSeen:  e.LastSeen,
+		Room:      rooms.RoomOf(id),
+		Queued:    offlineQueued(id),
+	}
+	if s, ok := connections.Lookup(id); ok {
+		observed := s.observed
+		info.Connected = true
+		info.Transport = transportKind(s.t)
+		info.Observed = &observed
+	}
+	for _, s := range connections.Sessions(id) {
+		if s.device != "" {
+			info.Devices = append(info.Devices, s.device)
+		}
+	}
+	if n, ok := resumes.queued(id); ok {
+		info.Parked = true
+		info.Queued += n
+	}
+	if v, ok := scores.Score(id); ok {
+		info.Score = &v
+	}
+	return info
+}
+
+// listPeers returns registered peers in uuid order. The filter, room,
+// connected and tenant query parameters narrow the list.
+func listPeers(ctx *gin.Context) {
+	filter, err := parseTagFilter(ctx.Query("filter"))
+	if err != nil {
+		respondError(ctx, http.StatusBadRequest, "invalid_filter", err.Error(), nil)
+		return
+	}
+	values, err := peerRegistry.Values(ctx.Request.Context())
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error listing registry")
+		respondError(ctx, http.StatusInternalServerError, "internal", "error", nil)
+		return
+	}
+
+	room, connected := ctx.Query("room"), ctx.Query("connected")
+	if tenant, ok := ctx.GetQuery("tenant"); ok {
+		values = tenantEntries(values, tenant)
+	}
+	peers := []PeerInfo{}
+	for _, e := range filterEntries(values, filter) {
+		info := peerInfo(e)
+		if room != "" && info.Room != room {
+			continue
+		}
+		if connected != "" && (connected == "true") != info.Connected {
+			continue
+		}
+		peers = append(peers, info)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Uuid < peers[j].Uuid })
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok", "peers": peers})
+}
+
+func getPeer(ctx *gin.Context) {
+	e, ok, err := peerRegistry.Get(ctx.Request.Context(), ctx.Param("uuid"))
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error looking up peer")
+		respondError(ctx, http.StatusInternalServerError, "internal", "error", nil)
+		return
+	}
+	if !ok {
+		respondError(ctx, http.StatusNotFound, "not_found", "not found", nil)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok", "peer": peerInfo(e)})
+}
+
+// evictPeer disconnects id, takes it out of its room and the registry, and
+// throws away anything queued for it.
+func evictPeer(ctx context.Context, id string) (bool, error) {
+	sessions := connections.Sessions(id)
+	connected := len(sessions) > 0
+	for _, s := range sessions {
+		connections.Remove(s)
+	}
+	parked := resumes.forget(id) != nil
+	matches.remove(id)
+	leaveRoom(id, "evicted")
+	dropOffline(id)
+	for _, s := range sessions {
+		if err := s.t.CloseWith(ws.CloseEvicted, "evicted"); err != nil {
+			log.Err(err).Msg("Error sending close frame")
+		}
+	}
+
+	removed, err := deregisterUUID(ctx, id)
+	if removed || connected || parked {
+		events.publish(Event{Type: EventPeerEvicted, UUID: id})
+		return true, err
+	}
+	return false, err
+}
+
+func deletePeer(ctx *gin.Context) {
+	id := ctx.Param("uuid")
+	ok, err := evictPeer(ctx.Request.Context(), id)
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error evicting peer")
+		respondError(ctx, http.StatusInternalServerError, "internal", "error", nil)
+		return
+	}
+	if !ok {
+		respondError(ctx, http.StatusNotFound, "not_found", "not found", nil)
+		return
+	}
+	reqLog(ctx).Info().Str("uuid", id).Msg("Evicted peer")
+	auditRequest(ctx, "peer_evicted").Str("uuid", id).Send()
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func listRooms(ctx *gin.Context) {
+	list := rooms.List()
+	if tenant, ok := ctx.GetQuery("tenant"); ok {
+		kept := []RoomStats{}
+		for _, room := range list {
+			if room.Tenant == tenant {
+				kept = append(kept, room)
+			}
+		}
+		list = kept
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok", "rooms": list})
+}
+
+// ReservationForm books a room through POST /admin/rooms.
+type ReservationForm struct {
+	ID           string    `json:"id"`
+	Tenant       string    `json:"tenant"`
+	Host         string    `json:"host"`
+	MaxPeers     int       `json:"max_peers"`
+	StartsAt     time.Time `json:"starts_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	Participants []string  `json:"participants"`
+	RelayOnly    bool      `json:"relay_only"`
+}
+
+const (
+	maxRoomIDLength       = 128
+	maxParticipants       = 256
+	defaultReservedWindow = time.Hour
+)
+
+// reserveRoom books a room for a scheduled call or match, returning the
+// token its participants join it with. It starts now and lasts an hour
+// unless the form says otherwise; max_peers defaults to the participants.
+func reserveRoom(ctx *gin.Context) {
+	var form ReservationForm
+	if err := ctx.BindJSON(&form); err != nil {
+		reqLog(ctx).Err(err).Msg("Error parsing form")
+		respondError(ctx, http.StatusNotAcceptable, "invalid_json", "error parsing json", nil)
+		return
+	}
+	if form.Tenant != "" && !tenantPattern.MatchString(form.Tenant) {
+		respondError(ctx, http.StatusNotAcceptable, "invalid_tenant", "invalid tenant", nil)
+		return
+	}
+	if len(form.ID) > maxRoomIDLength {
+		respondError(ctx, http.StatusNotAcceptable, "room_id_too_long", "room id too long", nil)
+		return
+	}
+	if len(form.Participants) > maxParticipants {
+		respondError(ctx, http.StatusNotAcceptable, "too_many_participants", "too many participants", nil)
+		return
+	}
+	for _, peer := range append(form.Participants, form.Host) {
+		if _, err := uuid.Parse(peer); peer != "" && err != nil {
+			respondError(ctx, http.StatusNotAcceptable, "invalid_uuid", "invalid uuid", gin.H{"uuid": peer})
+			return
+		}
+	}
+	if form.StartsAt.IsZero() {
+		form.StartsAt = time.Now()
+	}
+	if form.ExpiresAt.IsZero() {
+		form.ExpiresAt = form.StartsAt.Add(defaultReservedWindow)
+	}
+	if !form.ExpiresAt.After(form.StartsAt) || !form.ExpiresAt.After(time.Now()) {
+		respondError(ctx, http.StatusNotAcceptable, "invalid_expiry", "expires_at must be after starts_at and in the future", nil)
+		return
+	}
+	if form.MaxPeers == 0 {
+		form.MaxPeers = len(form.Participants)
+	}
+
+	if roomStore != nil && form.ID != "" {
+		exists, err := roomStore.exists(ctx.Request.Context(), form.ID)
+		if err != nil {
+			reqLog(ctx).Err(err).Msg("Error looking up room")
+			respondError(ctx, http.StatusInternalServerError, "internal", "error", nil)
+			return
+		}
+		if exists {
+			respondError(ctx, http.StatusConflict, "room_exists", "room exists", gin.H{"room": form.ID})
+			return
+		}
+	}
+	id, token, err := rooms.Reserve(form.ID, form.Tenant, form.Host, form.MaxPeers, form.StartsAt, form.ExpiresAt, form.Participants)
+	if err == errRoomExists {
+		respondError(ctx, http.StatusConflict, "room_exists", "room exists", gin.H{"room": form.ID})
+		return
+	}
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error reserving room")
+		respondError(ctx, http.StatusInternalServerError, "internal", "error", nil)
+		return
+	}
+	if form.RelayOnly {
+		rooms.SetRelayOnly(id)
+	}
+	reqLog(ctx).Info().Str("room", id).Time("starts_at", form.StartsAt).Msg("Reserved room")
+	auditRequest(ctx, "room_reserved").Str("room", id).Str("tenant", form.Tenant).Send()
+	events.publish(Event{Type: EventRoomCreated, UUID: form.Host, Room: id, Reason: "reserved"})
+	stats, _ := rooms.Stats(id)
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok", "room": stats, "token": token})
+}
+
+func getRoom(ctx *gin.Context) {
+	id := ctx.Param("id")
+	stats, ok := rooms.Stats(id)
+	if !ok {
+		respondError(ctx, http.StatusNotFound, "not_found", "not found", nil)
+		return
+	}
+
+	members := []PeerInfo{}
+	for _, peer := range rooms.Members(id) {
+		e, ok, err := peerRegistry.Get(ctx.Request.Context(), peer)
+		if err != nil {
+			reqLog(ctx).Err(err).Str("uuid", peer).Msg("Error looking up room member")
+		}
+		info := PeerInfo{EntryForm: EntryForm{Uuid: peer}, Room: id}
+		if ok {
+			info = peerInfo(e)
+		}
+		members = append(members, info)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Uuid < members[j].Uuid })
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok", "room": stats, "members": members})
+}
+
+// TenantCapacity is how much of its peer limit a tenant is using on this
+// instance.
+type TenantCapacity struct {
+	Tenant    string `json:"tenant"`
+	Connected int    `json:"connected"`
+	MaxPeers  int    `json:"max_peers,omitempty"`
+}
+
+// getCapacity reports the utilization of every tenant with peers connected
+// or a limit, and of every room with a limit or a queue.
+func getCapacity(ctx *gin.Context) {
+	counts := connections.TenantCounts()
+	for tenant := range setting(&tenantMaxPeersOf) {
+		if _, ok := counts[tenant]; !ok {
+			counts[tenant] = 0
+		}
+	}
+	tenants := []TenantCapacity{}
+	for tenant, n := range counts {
+		tenants = append(tenants, TenantCapacity{Tenant: tenantLabel(tenant), Connected: n, MaxPeers: tenantLimit(tenant)})
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Tenant < tenants[j].Tenant })
+
+	limited := []RoomStats{}
+	for _, room := range rooms.List() {
+		if room.MaxPeers > 0 || room.Queued > 0 {
+			limited = append(limited, room)
+		}
+	}
+	sort.Slice(limited, func(i, j int) bool { return limited[i].Created.Before(limited[j].Created) })
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok", "tenants": tenants, "rooms": limited})
+}
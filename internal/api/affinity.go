@@ -0,0 +1,277 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Resumable sessions are parked on the instance the client was connected
+// to, so behind a load balancer a reconnecting client has to get back there.
+// When clustered, or with --affinity-cookie, resume tokens carry the name of
+// the instance that issued them, and registered and resumed say it as node.
+// With --affinity-cookie the websocket upgrade also sets a cookie naming it,
+// which load balancers that route on cookies can stick to.
+//
+// A connection that lands elsewhere anyway is forwarded, when clustered, to
+// the member its cookie or ?node= names. A resume token of another instance
+// is refused with wrong_node, with that instance's --public-url when it has
+// one, for clients to reconnect there. The member forwarding a connection
+// passes the client's address along in clientHeader, signed with
+// --cluster-secret, and the member taking it serves it as coming from there.
+
+// forwardedHeader marks connections one member forwarded to another, which
+// are not forwarded again.
+const forwardedHeader = "X-Seven-Forwarded"
+
+// clientHeader carries the address of the client of a forwarded connection
+// as "address;unix time;signature".
+const clientHeader = "X-Seven-Client"
+
+// clientHeaderMaxAge is how old a clientHeader may be.
+const clientHeaderMaxAge = 30 * time.Second
+
+// affinityNode is the name resume tokens and the cookie carry, empty when
+// neither clustered nor --affinity-cookie is set.
+var affinityNode string
+
+func initAffinity() error {
+	if *affinityCookie != "" {
+		if err := (&http.Cookie{Name: *affinityCookie, Value: "x"}).Valid(); err != nil {
+			return fmt.Errorf("Invalid --affinity-cookie %q: %w", *affinityCookie, err)
+		}
+	}
+	if members == nil && *affinityCookie == "" {
+		return nil
+	}
+	name, err := thisNode()
+	if err != nil {
+		return err
+	}
+	affinityNode = name
+	if members == nil {
+		return nil
+	}
+	// Members forward connections to the host they gossip on and the
+	// port they serve http on.
+	_, port, err := net.SplitHostPort(*addr)
+	if err != nil {
+		return fmt.Errorf("Invalid --addr %q: %w", *addr, err)
+	}
+	for _, m := range members.Members() {
+		if m.Name == members.Name() {
+			host, _, _ := net.SplitHostPort(m.Addr)
+			members.SetMeta("http", net.JoinHostPort(host, port))
+		}
+	}
+	if publicBase != "" {
+		members.SetMeta("url", publicBase)
+	}
+	return nil
+}
+
+// affinityHeader is the response header of a websocket upgrade, setting the
+// affinity cookie when there is one.
+func affinityHeader(r *http.Request) http.Header {
+	if *affinityCookie == "" {
+		return nil
+	}
+	cookie := &http.Cookie{
+		Name:     *affinityCookie,
+		Value:    affinityNode,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil || strings.HasPrefix(publicBase, "wss:"),
+		SameSite: http.SameSiteLaxMode,
+	}
+	return http.Header{"Set-Cookie": {cookie.String()}}
+}
+
+// wantedNode is the instance ctx's connection asks for, by ?node= or the
+// affinity cookie.
+func wantedNode(ctx *gin.Context) string {
+	if node := ctx.Query("node"); node != "" {
+		return node
+	}
+	if *affinityCookie != "" {
+		if c, err := ctx.Request.Cookie(*affinityCookie); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// forwardToNode proxies ctx's websocket to the live member it asks for, and
+// reports whether it did. Connections the member cannot take are served
+// here after all.
+func forwardToNode(ctx *gin.Context) bool {
+	r := ctx.Request
+	node := wantedNode(ctx)
+	if members == nil || node == "" || node == members.Name() || r.Header.Get(forwardedHeader) != "" {
+		return false
+	}
+	target := ""
+	for _, m := range members.Members() {
+		if m.Name == node {
+			target = m.Meta["http"]
+		}
+	}
+	if target == "" {
+		return false
+	}
+	scheme := "http"
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if r.TLS != nil {
+		// Members share the certificate of the name clients connect to.
+		scheme = "https"
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		transport.TLSClientConfig = &tls.Config{ServerName: host}
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(&url.URL{Scheme: scheme, Host: target})
+			pr.Out.Host = pr.In.Host
+			pr.SetXForwarded()
+			pr.Out.Header.Set(forwardedHeader, members.Name())
+			pr.Out.Header.Set(clientHeader, signClient(ctx, node, time.Now()))
+		},
+		Transport: transport,
+		ModifyResponse: func(*http.Response) error {
+			metricNodeForwards.WithLabelValues("forwarded").Inc()
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
+			if ctx.Request.Context().Err() != nil {
+				return
+			}
+			reqLog(ctx).Warn().Err(err).Str("node", node).Msg("Error forwarding connection, serving it here")
+			metricNodeForwards.WithLabelValues("failed").Inc()
+			serveWS(ctx)
+		},
+	}
+	reqLog(ctx).Debug().Str("node", node).Msg("Forwarding connection to cluster member")
+	proxy.ServeHTTP(ctx.Writer, r)
+	return true
+}
+
+// signClient is the clientHeader for ctx's connection, forwarded to node.
+func signClient(ctx *gin.Context, node string, now time.Time) string {
+	obs := observedAddress(ctx)
+	value := net.JoinHostPort(obs.IP, strconv.Itoa(obs.Port)) + ";" + strconv.FormatInt(now.Unix(), 10)
+	return value + ";" + clientSignature(value, node)
+}
+
+func clientSignature(value, node string) string {
+	mac := hmac.New(sha256.New, []byte(*clusterSecret))
+	mac.Write([]byte(node + ";" + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// forwardedClient is middleware serving a connection another member
+// forwarded as coming from the client's address. The clientHeader has to
+// be signed with --cluster-secret or, without one, come from a member.
+func forwardedClient(ctx *gin.Context) {
+	header := ctx.GetHeader(clientHeader)
+	if header == "" {
+		return
+	}
+	ctx.Request.Header.Del(clientHeader)
+	if members == nil {
+		return
+	}
+	address, ok := verifyClient(ctx.Request.RemoteAddr, header, time.Now())
+	if !ok {
+		reqLog(ctx).Warn().Str("remote_addr", ctx.Request.RemoteAddr).Msg("Ignoring invalid forwarded client address")
+		return
+	}
+	ctx.Request.RemoteAddr = address
+	for _, h := range strings.Split(*remoteIPHeaders, ",") {
+		ctx.Request.Header.Del(strings.TrimSpace(h))
+	}
+}
+
+// verifyClient is the client address in header, which remote sent, and
+// whether it is to be trusted.
+func verifyClient(remote, header string, now time.Time) (string, bool) {
+	parts := strings.Split(header, ";")
+	if len(parts) != 3 {
+		return "", false
+	}
+	if _, _, err := net.SplitHostPort(parts[0]); err != nil {
+		return "", false
+	}
+	sent, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", false
+	}
+	if age := now.Sub(time.Unix(sent, 0)); age > clientHeaderMaxAge || age < -clientHeaderMaxAge {
+		return "", false
+	}
+	if *clusterSecret != "" {
+		want := clientSignature(parts[0]+";"+parts[1], members.Name())
+		return parts[0], hmac.Equal([]byte(want), []byte(parts[2]))
+	}
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return "", false
+	}
+	for _, m := range members.Members() {
+		if h, _, err := net.SplitHostPort(m.Meta["http"]); err == nil && h == host && m.Name != members.Name() {
+			return parts[0], true
+		}
+	}
+	return "", false
+}
+
+// tagResumeToken tags token with the instance that issued it.
+func tagResumeToken(token string) string {
+	if affinityNode == "" {
+		return token
+	}
+	return token + "." + base64.RawURLEncoding.EncodeToString([]byte(affinityNode))
+}
+
+// tokenNode is the instance that issued a resume token, if it says.
+func tokenNode(token string) string {
+	_, tag, ok := strings.Cut(token, ".")
+	if !ok {
+		return ""
+	}
+	node, err := base64.RawURLEncoding.DecodeString(tag)
+	if err != nil {
+		return ""
+	}
+	return string(node)
+}
+
+// wrongNode are the details of a refused resume token issued by node, and
+// false when node is not a live member to go to.
+func wrongNode(node string) (gin.H, bool) {
+	if members == nil {
+		return gin.H{"node": node}, true
+	}
+	for _, m := range members.Members() {
+		if m.Name == node {
+			details := gin.H{"node": node}
+			if m.Meta["url"] != "" {
+				details["url"] = m.Meta["url"]
+			}
+			return details, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,251 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// APIKey lets a client use the signaling endpoints within its quotas. Only a
+// hash of the key itself is stored.
+type APIKey struct {
+	ID                string    `json:"id"`
+	Name              string    `json:"name"`
+	Hash              string    `json:"-"`
+	RequestsPerMinute int       `json:"requests_per_minute"`
+	MaxConnections    int       `json:"max_connections"`
+	Tenant            string    `json:"tenant,omitempty"`
+	CreatedAt         time.Time `json:"created_at"`
+}
+
+// APIKeyStore persists API keys next to the registry.
+type APIKeyStore interface {
+	Create(ctx context.Context, k APIKey) error
+	Revoke(ctx context.Context, id string) (bool, error)
+	Lookup(ctx context.Context, hash string) (APIKey, bool, error)
+	List(ctx context.Context) ([]APIKey, error)
+}
+
+var apiKeys APIKeyStore
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKeySecret returns a random key to hand to a client.
+func newAPIKeySecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "sk_" + hex.EncodeToString(b), nil
+}
+
+// storedAPIKey keeps the hash that APIKey leaves out of its JSON.
+type storedAPIKey struct {
+	APIKey
+	Hash string `json:"hash"`
+}
+
+func encodeAPIKey(k APIKey) ([]byte, error) {
+	return json.Marshal(storedAPIKey{APIKey: k, Hash: k.Hash})
+}
+
+func decodeAPIKey(b []byte) (APIKey, bool, error) {
+	var stored storedAPIKey
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return APIKey{}, false, err
+	}
+	k := stored.APIKey
+	k.Hash = stored.Hash
+	return k, true, nil
+}
+
+type memoryKeyStore struct {
+	mu     sync.RWMutex
+	byID   map[string]APIKey
+	byHash map[string]string
+}
+
+func newMemoryKeyStore() *memoryKeyStore {
+	return &memoryKeyStore{
+		byID:   make(map[string]APIKey),
+		byHash: make(map[string]string),
+	}
+}
+
+func (s *memoryKeyStore) Create(ctx context.Context, k APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID[k.ID] = k
+	s.byHash[k.Hash] = k.ID
+	return nil
+}
+
+func (s *memoryKeyStore) Revoke(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.byID[id]
+	if !ok {
+		return false, nil
+	}
+	delete(s.byID, id)
+	delete(s.byHash, k.Hash)
+	return true, nil
+}
+
+func (s *memoryKeyStore) Lookup(ctx context.Context, hash string) (APIKey, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.byID[s.byHash[hash]]
+	return k, ok, nil
+}
+
+func (s *memoryKeyStore) List(ctx context.Context) ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]APIKey, 0, len(s.byID))
+	for _, k := range s.byID {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// apiKeyContextKey is where requireAPIKey stores the caller's APIKey.
+const apiKeyContextKey = "api_key"
+
+type keyUsage struct {
+	limiter *rate.Limiter
+	conns   int
+}
+
+// keyQuotas tracks the request rate and open websockets of each API key.
+type keyQuotas struct {
+	mu    sync.Mutex
+	usage map[string]*keyUsage
+}
+
+var quotas = &keyQuotas{usage: make(map[string]*keyUsage)}
+
+func (q *keyQuotas) get(k APIKey) *keyUsage {
+	u, ok := q.usage[k.ID]
+	if !ok {
+		u = &keyUsage{}
+		if k.RequestsPerMinute > 0 {
+			u.limiter = rate.NewLimiter(rate.Limit(float64(k.RequestsPerMinute)/60), k.RequestsPerMinute)
+		}
+		q.usage[k.ID] = u
+	}
+	return u
+}
+
+func (q *keyQuotas) allowRequest(k APIKey) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.get(k)
+	return u.limiter == nil || u.limiter.Allow()
+}
+
+func (q *keyQuotas) acquireConn(k APIKey) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.get(k)
+	if k.MaxConnections > 0 && u.conns >= k.MaxConnections {
+		return false
+	}
+	u.conns++
+	return true
+}
+
+func (q *keyQuotas) releaseConn(k APIKey) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if u, ok := q.usage[k.ID]; ok && u.conns > 0 {
+		u.conns--
+	}
+}
+
+func (q *keyQuotas) forget(id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.usage, id)
+}
+
+var (
+	errMissingAPIKey = errors.New("Missing api key")
+	errInvalidAPIKey = errors.New("Invalid api key")
+	errRequestQuota  = errors.New("Request quota exceeded")
+)
+
+// authenticateAPIKey looks up key and charges one request against its quota.
+func authenticateAPIKey(ctx context.Context, key string) (APIKey, error) {
+	if key == "" {
+		return APIKey{}, errMissingAPIKey
+	}
+	k, ok, err := apiKeys.Lookup(ctx, hashAPIKey(key))
+	if err != nil {
+		return APIKey{}, err
+	}
+	if !ok {
+		return APIKey{}, errInvalidAPIKey
+	}
+	if !quotas.allowRequest(k) {
+		return k, errRequestQuota
+	}
+	return k, nil
+}
+
+// requireAPIKey rejects client requests without a valid API key, or beyond
+// that key's request and connection quotas.
+func requireAPIKey(ctx *gin.Context) {
+	if !*requireAPIKeys {
+		ctx.Next()
+		return
+	}
+
+	key := ctx.GetHeader("X-API-Key")
+	if key == "" {
+		key = ctx.Query("api_key")
+	}
+	k, err := authenticateAPIKey(ctx.Request.Context(), key)
+	switch err {
+	case nil:
+	case errMissingAPIKey:
+		abortClient(ctx, http.StatusUnauthorized, "missing_api_key", "missing api key")
+		return
+	case errInvalidAPIKey:
+		reqLog(ctx).Warn().Str("ip", ctx.ClientIP()).Msg("Rejected unknown api key")
+		abortClient(ctx, http.StatusUnauthorized, "invalid_api_key", "invalid api key")
+		return
+	case errRequestQuota:
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(60/float64(k.RequestsPerMinute)))))
+		abortClient(ctx, http.StatusTooManyRequests, "request_quota_exceeded", "request quota exceeded")
+		return
+	default:
+		reqLog(ctx).Err(err).Msg("Error looking up api key")
+		abortClient(ctx, http.StatusInternalServerError, "internal", "error")
+		return
+	}
+	if ctx.IsWebsocket() {
+		if !quotas.acquireConn(k) {
+			abortClient(ctx, http.StatusTooManyRequests, "connection_quota_exceeded", "connection quota exceeded")
+			return
+		}
+		defer quotas.releaseConn(k)
+	}
+
+	ctx.Set(apiKeyContextKey, k)
+	ctx.Next()
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"context"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltAPIKeysBucket      = []byte("apikeys")
+	boltAPIKeyHashesBucket = []byte("apikey-hashes")
+)
+
+// boltKeyStore keeps API keys in the bolt registry's database, by id and by
+// key hash.
+type boltKeyStore struct {
+	db *bolt.DB
+}
+
+func (s *boltKeyStore) Create(ctx context.Context, k APIKey) error {
+	b, err := encodeAPIKey(k)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltAPIKeysBucket).Put([]byte(k.ID), b); err != nil {
+			return err
+		}
+		return tx.Bucket(boltAPIKeyHashesBucket).Put([]byte(k.Hash), []byte(k.ID))
+	})
+}
+
+func (s *boltKeyStore) Revoke(ctx context.Context, id string) (bool, error) {
+	var found bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(boltAPIKeysBucket)
+		b := keys.Get([]byte(id))
+		if b == nil {
+			return nil
+		}
+		k, _, err := decodeAPIKey(b)
+		if err != nil {
+			return err
+		}
+		found = true
+		if err := tx.Bucket(boltAPIKeyHashesBucket).Delete([]byte(k.Hash)); err != nil {
+			return err
+		}
+		return keys.Delete([]byte(id))
+	})
+	return found, err
+}
+
+func (s *boltKeyStore) Lookup(ctx context.Context, hash string) (APIKey, bool, error) {
+	var k APIKey
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(boltAPIKeyHashesBucket).Get([]byte(hash))
+		if id == nil {
+			return nil
+		}
+		b := tx.Bucket(boltAPIKeysBucket).Get(id)
+		if b == nil {
+			return nil
+		}
+		var err error
+		k, ok, err = decodeAPIKey(b)
+		return err
+	})
+	return k, ok, err
+}
+
+func (s *boltKeyStore) List(ctx context.Context) ([]APIKey, error) {
+	keys := []APIKey{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltAPIKeysBucket).ForEach(func(_, v []byte) error {
+			if k, ok, err := decodeAPIKey(v); err == nil && ok {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+	})
+	return keys, err
+}
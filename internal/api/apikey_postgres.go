@@ -0,0 +1,57 @@
+package api
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresKeyStore keeps API keys in the api_keys table next to the entries.
+type postgresKeyStore struct {
+	pool *pgxpool.Pool
+}
+
+const postgresAPIKeyColumns = `id, name, hash, requests_per_minute, max_connections, tenant, created_at`
+
+func scanPostgresAPIKey(row pgx.Row) (APIKey, error) {
+	var k APIKey
+	err := row.Scan(&k.ID, &k.Name, &k.Hash, &k.RequestsPerMinute, &k.MaxConnections, &k.Tenant, &k.CreatedAt)
+	return k, err
+}
+
+func (s *postgresKeyStore) Create(ctx context.Context, k APIKey) error {
+	_, err := s.pool.Exec(ctx, `INSERT INTO api_keys (`+postgresAPIKeyColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		k.ID, k.Name, k.Hash, k.RequestsPerMinute, k.MaxConnections, k.Tenant, k.CreatedAt)
+	return err
+}
+
+func (s *postgresKeyStore) Revoke(ctx context.Context, id string) (bool, error) {
+	tag, err := s.pool.Exec(ctx, `DELETE FROM api_keys WHERE id = $1`, id)
+	return tag.RowsAffected() > 0, err
+}
+
+func (s *postgresKeyStore) Lookup(ctx context.Context, hash string) (APIKey, bool, error) {
+	k, err := scanPostgresAPIKey(s.pool.QueryRow(ctx, `SELECT `+postgresAPIKeyColumns+` FROM api_keys WHERE hash = $1`, hash))
+	if err == pgx.ErrNoRows {
+		return APIKey{}, false, nil
+	}
+	return k, err == nil, err
+}
+
+func (s *postgresKeyStore) List(ctx context.Context) ([]APIKey, error) {
+	rows, err := s.pool.Query(ctx, `SELECT `+postgresAPIKeyColumns+` FROM api_keys ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanPostgresAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
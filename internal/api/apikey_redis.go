@@ -0,0 +1,78 @@
+package api
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisAPIKeysKey      = "seven:apikeys"
+	redisAPIKeyHashesKey = "seven:apikey-hashes"
+)
+
+// redisKeyStore keeps API keys in a hash of id to key, with a second hash
+// from key hash to id for lookups.
+type redisKeyStore struct {
+	client *redis.Client
+}
+
+func (s *redisKeyStore) Create(ctx context.Context, k APIKey) error {
+	b, err := encodeAPIKey(k)
+	if err != nil {
+		return err
+	}
+	pipe := s.client.TxPipeline()
+	pipe.HSet(ctx, redisAPIKeysKey, k.ID, b)
+	pipe.HSet(ctx, redisAPIKeyHashesKey, k.Hash, k.ID)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (s *redisKeyStore) get(ctx context.Context, id string) (APIKey, bool, error) {
+	b, err := s.client.HGet(ctx, redisAPIKeysKey, id).Bytes()
+	if err == redis.Nil {
+		return APIKey{}, false, nil
+	}
+	if err != nil {
+		return APIKey{}, false, err
+	}
+	return decodeAPIKey(b)
+}
+
+func (s *redisKeyStore) Revoke(ctx context.Context, id string) (bool, error) {
+	k, ok, err := s.get(ctx, id)
+	if err != nil || !ok {
+		return false, err
+	}
+	pipe := s.client.TxPipeline()
+	pipe.HDel(ctx, redisAPIKeysKey, id)
+	pipe.HDel(ctx, redisAPIKeyHashesKey, k.Hash)
+	_, err = pipe.Exec(ctx)
+	return err == nil, err
+}
+
+func (s *redisKeyStore) Lookup(ctx context.Context, hash string) (APIKey, bool, error) {
+	id, err := s.client.HGet(ctx, redisAPIKeyHashesKey, hash).Result()
+	if err == redis.Nil {
+		return APIKey{}, false, nil
+	}
+	if err != nil {
+		return APIKey{}, false, err
+	}
+	return s.get(ctx, id)
+}
+
+func (s *redisKeyStore) List(ctx context.Context) ([]APIKey, error) {
+	values, err := s.client.HVals(ctx, redisAPIKeysKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]APIKey, 0, len(values))
+	for _, v := range values {
+		if k, ok, err := decodeAPIKey([]byte(v)); err == nil && ok {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
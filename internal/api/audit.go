@@ -0,0 +1,103 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The audit log records security relevant events apart from the operational
+// log, one JSON object per line: failed authentication, admin changes,
+// evictions and rate limit rejections. Every record carries the action, the
+// actor when one is known (admin, key:<api key id>, sub:<token subject> or
+// the peer's uuid), the client IP and the time.
+var audit = zerolog.Nop()
+
+// auditActorKey is where requireAdmin marks a request as made by the admin.
+const auditActorKey = "audit_actor"
+
+// initAudit opens the audit log at dest: a file path, "stdout", "stderr" or
+// "syslog". Without a destination nothing is recorded.
+func initAudit(dest string) error {
+	var w io.Writer
+	switch dest {
+	case "":
+		return nil
+	case "stdout":
+		w = os.Stdout
+	case "stderr":
+		w = os.Stderr
+	case "syslog":
+		sw, err := syslogWriter()
+		if err != nil {
+			return fmt.Errorf("Error opening syslog: %w", err)
+		}
+		w = sw
+	default:
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return fmt.Errorf("Error opening audit log: %w", err)
+		}
+		w = f
+	}
+	audit = zerolog.New(w).With().Timestamp().Logger()
+	return nil
+}
+
+// auditEvent starts a record of action by actor from ip. Finish it with Send.
+func auditEvent(action string, actor string, ip string) *zerolog.Event {
+	return audit.Log().Str("action", action).Str("actor", actor).Str("ip", ip)
+}
+
+// auditRequest is auditEvent for the caller of an HTTP request.
+func auditRequest(ctx *gin.Context, action string) *zerolog.Event {
+	return auditEvent(action, requestActor(ctx), ctx.ClientIP()).
+		Str("method", ctx.Request.Method).
+		Str("path", ctx.Request.URL.Path)
+}
+
+func requestActor(ctx *gin.Context) string {
+	if actor := ctx.GetString(auditActorKey); actor != "" {
+		return actor
+	}
+	if k, ok := ctx.Get(apiKeyContextKey); ok {
+		return "key:" + k.(APIKey).ID
+	}
+	if sub := ctx.GetString(subjectKey); sub != "" {
+		return "sub:" + sub
+	}
+	return ""
+}
+
+// auditRejection records an HTTP request turned away by the authentication
+// or rate limiting middleware.
+func auditRejection(ctx *gin.Context, status int, reason string) {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		auditRequest(ctx, "auth_failed").Int("status", status).Str("reason", reason).Send()
+	case http.StatusTooManyRequests:
+		auditRequest(ctx, "rate_limited").Str("reason", reason).Send()
+	}
+}
+
+// auditGRPCRejection is auditRejection for a gRPC call refused with err.
+func auditGRPCRejection(ctx context.Context, err error) {
+	st := status.Convert(err)
+	action := ""
+	switch st.Code() {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		action = "auth_failed"
+	case codes.ResourceExhausted:
+		action = "rate_limited"
+	default:
+		return
+	}
+	auditEvent(action, "", grpcObserved(ctx).IP).Str("code", st.Code().String()).Str("reason", st.Message()).Send()
+}
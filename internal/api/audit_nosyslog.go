@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package api
+
+import (
+	"errors"
+	"io"
+)
+
+func syslogWriter() (io.Writer, error) {
+	return nil, errors.New("Syslog is not available on this platform")
+}
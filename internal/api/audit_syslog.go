@@ -0,0 +1,12 @@
+//go:build !windows && !plan9
+
+package api
+
+import (
+	"io"
+	"log/syslog"
+)
+
+func syslogWriter() (io.Writer, error) {
+	return syslog.New(syslog.LOG_AUTH|syslog.LOG_NOTICE, "seven")
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+// subjectKey and claimsKey are where requireJWT stores the token's subject
+// and claims in the gin context.
+const (
+	subjectKey = "jwt_subject"
+	claimsKey  = "jwt_claims"
+)
+
+var jwtKeyfunc jwt.Keyfunc
+var jwtMethods []string
+
+// initAuth enables bearer token checks when an HMAC secret or JWKS URL is set.
+func initAuth(secret string, jwksURL string) error {
+	switch {
+	case secret != "" && jwksURL != "":
+		return fmt.Errorf("Only one of --jwt-secret and --jwt-jwks-url may be set")
+	case secret != "":
+		jwtKeyfunc = func(*jwt.Token) (interface{}, error) { return []byte(secret), nil }
+		jwtMethods = []string{"HS256", "HS384", "HS512"}
+	case jwksURL != "":
+		jwks, err := keyfunc.Get(jwksURL, keyfunc.Options{
+			RefreshInterval: time.Hour,
+			RefreshErrorHandler: func(err error) {
+				log.Err(err).Str("url", jwksURL).Msg("Error refreshing JWKS")
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("Error fetching JWKS from %s: %w", jwksURL, err)
+		}
+		jwtKeyfunc = jwks.Keyfunc
+		jwtMethods = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "PS256", "PS384", "PS512", "EdDSA"}
+	}
+	return nil
+}
+
+func bearerToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	// Browsers cannot set headers on a websocket handshake.
+	return r.URL.Query().Get("access_token")
+}
+
+// requireJWT rejects requests without a valid bearer token and records the
+// token's subject so handlers can bind it to the peer uuid.
+func requireJWT(ctx *gin.Context) {
+	if jwtKeyfunc == nil {
+		ctx.Next()
+		return
+	}
+
+	sub, claims, err := tokenSubject(bearerToken(ctx.Request))
+	if err == errNoSubject {
+		abortClient(ctx, http.StatusUnauthorized, "missing_subject", "token has no subject")
+		return
+	}
+	if err != nil {
+		reqLog(ctx).Err(err).Str("ip", ctx.ClientIP()).Msg("Rejected bearer token")
+		abortClient(ctx, http.StatusUnauthorized, "unauthorized", "unauthorized")
+		return
+	}
+	ctx.Set(subjectKey, sub)
+	ctx.Set(claimsKey, claims)
+	ctx.Next()
+}
+
+var errNoSubject = errors.New("Token has no subject")
+
+// tokenSubject validates a bearer token and returns its subject and claims.
+func tokenSubject(raw string) (string, map[string]any, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(raw, claims, jwtKeyfunc, jwt.WithValidMethods(jwtMethods))
+	if err != nil {
+		return "", nil, err
+	}
+	sub, err := token.Claims.GetSubject()
+	if err != nil || sub == "" {
+		return "", nil, errNoSubject
+	}
+	return sub, claims, nil
+}
+
+// tokenClaims are the claims requireJWT found, nil without authentication.
+func tokenClaims(ctx *gin.Context) map[string]any {
+	claims, _ := ctx.Value(claimsKey).(map[string]any)
+	return claims
+}
+
+// subjectAllows reports whether a request authenticated as subject may act as
+// uuid. Without authentication every uuid is allowed.
+func subjectAllows(subject string, uuid string) bool {
+	return jwtKeyfunc == nil || subject == uuid
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// authorizerNamed is the built in Authorizer selected by --authorizer.
+func authorizerNamed(kind string) (Authorizer, error) {
+	switch kind {
+	case "allow":
+		return AllowAll{}, nil
+	case "same-room":
+		return SameRoom{}, nil
+	case "claims":
+		return Claims{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown authorizer %q", kind)
+	}
+}
+
+// AllowAll allows every action.
+type AllowAll struct{}
+
+func (AllowAll) Authorize(ctx context.Context, a Action) error {
+	return nil
+}
+
+// SameRoom only lets peers signal peers in the same room as them.
+type SameRoom struct{}
+
+var errNotInRoom = errors.New("Peers may only signal within a room")
+
+func (SameRoom) Authorize(ctx context.Context, a Action) error {
+	if (a.Kind == ActionRelay || a.Kind == ActionDirect) && (a.Room == "" || rooms.RoomOf(a.To) != a.Room) {
+		return errNotInRoom
+	}
+	return nil
+}
+
+// Claims decides by the claims of a peer's bearer token: "tenant", when
+// present, is the only tenant it may register in, "rooms" lists the rooms it
+// may join ("*" for any), and "peers" the uuids it may signal outside of a
+// room.
+type Claims struct{}
+
+func (Claims) Authorize(ctx context.Context, a Action) error {
+	switch a.Kind {
+	case ActionRegister:
+		if tenant, ok := a.Claims["tenant"]; ok && tenant != a.Tenant {
+			return fmt.Errorf("Token is not for tenant %q", a.Tenant)
+		}
+	case ActionJoin:
+		if !claimLists(a.Claims, "rooms", a.Room) {
+			return fmt.Errorf("Token does not allow joining room %q", a.Room)
+		}
+	case ActionRelay, ActionDirect:
+		if (a.Room == "" || rooms.RoomOf(a.To) != a.Room) && !claimLists(a.Claims, "peers", a.To) {
+			return fmt.Errorf("Token does not allow signaling %q", a.To)
+		}
+	}
+	return nil
+}
+
+// claimLists reports whether the list claim name holds value or "*".
+func claimLists(claims map[string]any, name string, value string) bool {
+	list, _ := claims[name].([]any)
+	for _, v := range list {
+		if v == value || v == "*" {
+			return true
+		}
+	}
+	return false
+}
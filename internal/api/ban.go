@@ -0,0 +1,330 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/hoyle1974/seven/internal/ws"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Ban keeps an IP, a subnet or a uuid off the server, until ExpiresAt or for
+// good. Bans an admin makes and the automatic ones IPs earn by failing
+// authentication or rate limits too often are kept next to the registry, so
+// every instance enforces them.
+type Ban struct {
+	Target    string     `json:"target"` // an IP, a CIDR subnet or a uuid
+	Reason    string     `json:"reason,omitempty"`
+	Auto      bool       `json:"auto,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (b Ban) expired(now time.Time) bool {
+	return b.ExpiresAt != nil && !now.Before(*b.ExpiresAt)
+}
+
+// BanStore persists bans next to the registry, by target.
+type BanStore interface {
+	Put(ctx context.Context, b Ban) error
+	Delete(ctx context.Context, target string) (bool, error)
+	List(ctx context.Context) ([]Ban, error)
+}
+
+var banStore BanStore
+
+var errInvalidBanTarget = errors.New("Ban target must be an IP, a CIDR subnet or a uuid")
+
+// parseBanTarget returns target in the form bans are stored under.
+func parseBanTarget(target string) (string, error) {
+	if id, err := uuid.Parse(target); err == nil {
+		return id.String(), nil
+	}
+	if ip, err := netip.ParseAddr(target); err == nil {
+		return ip.Unmap().String(), nil
+	}
+	if prefix, err := netip.ParsePrefix(target); err == nil {
+		return prefix.Masked().String(), nil
+	}
+	return "", errInvalidBanTarget
+}
+
+func encodeBan(b Ban) ([]byte, error) {
+	return json.Marshal(b)
+}
+
+func decodeBan(data []byte) (Ban, error) {
+	var b Ban
+	err := json.Unmarshal(data, &b)
+	return b, err
+}
+
+type memoryBanStore struct {
+	mu   sync.RWMutex
+	bans map[string]Ban
+}
+
+func newMemoryBanStore() *memoryBanStore {
+	return &memoryBanStore{bans: make(map[string]Ban)}
+}
+
+func (s *memoryBanStore) Put(ctx context.Context, b Ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bans[b.Target] = b
+	return nil
+}
+
+func (s *memoryBanStore) Delete(ctx context.Context, target string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.bans[target]
+	delete(s.bans, target)
+	return ok, nil
+}
+
+func (s *memoryBanStore) List(ctx context.Context) ([]Ban, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	bans := make([]Ban, 0, len(s.bans))
+	for _, b := range s.bans {
+		bans = append(bans, b)
+	}
+	return bans, nil
+}
+
+// banList is this instance's copy of the store, checked on every upgrade
+// and registration. It is reloaded every banSyncInterval to pick up the
+// bans other instances made.
+type banList struct {
+	mu      sync.RWMutex
+	targets map[string]Ban // IPs and uuids
+	subnets map[netip.Prefix]Ban
+}
+
+const banSyncInterval = 30 * time.Second
+
+var bans = &banList{targets: map[string]Ban{}, subnets: map[netip.Prefix]Ban{}}
+
+func (l *banList) set(list []Ban) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.targets = map[string]Ban{}
+	l.subnets = map[netip.Prefix]Ban{}
+	for _, b := range list {
+		l.add(b)
+	}
+}
+
+// add records b. l.mu must be held.
+func (l *banList) add(b Ban) {
+	if strings.Contains(b.Target, "/") {
+		if prefix, err := netip.ParsePrefix(b.Target); err == nil {
+			l.subnets[prefix] = b
+		}
+		return
+	}
+	l.targets[b.Target] = b
+}
+
+func (l *banList) put(b Ban) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.add(b)
+}
+
+func (l *banList) remove(target string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if prefix, err := netip.ParsePrefix(target); err == nil {
+		delete(l.subnets, prefix)
+		return
+	}
+	delete(l.targets, target)
+}
+
+// match returns the ban in force at now on ip or id, either of which may be
+// empty.
+func (l *banList) match(ip string, id string, now time.Time) (Ban, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if b, ok := l.targets[id]; ok && id != "" && !b.expired(now) {
+		return b, true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return Ban{}, false
+	}
+	addr = addr.Unmap()
+	if b, ok := l.targets[addr.String()]; ok && !b.expired(now) {
+		return b, true
+	}
+	for prefix, b := range l.subnets {
+		if prefix.Contains(addr) && !b.expired(now) {
+			return b, true
+		}
+	}
+	return Ban{}, false
+}
+
+// loadBans fills the ban list from the store.
+func loadBans(ctx context.Context) error {
+	list, err := banStore.List(ctx)
+	if err != nil {
+		return err
+	}
+	bans.set(list)
+	return nil
+}
+
+// syncBans reloads the ban list, deleting bans that have expired from the
+// store. The server runs it every banSyncInterval.
+func syncBans() {
+	ctx := context.Background()
+	list, err := banStore.List(ctx)
+	if err != nil {
+		log.Err(err).Msg("Error loading bans")
+		return
+	}
+	now := time.Now()
+	live := list[:0]
+	for _, b := range list {
+		if !b.expired(now) {
+			live = append(live, b)
+		} else if _, err := banStore.Delete(ctx, b.Target); err != nil {
+			log.Err(err).Str("target", b.Target).Msg("Error deleting expired ban")
+		}
+	}
+	bans.set(live)
+}
+
+// addBan stores b and disconnects every session it covers.
+func addBan(ctx context.Context, b Ban) error {
+	if err := banStore.Put(ctx, b); err != nil {
+		return err
+	}
+	bans.put(b)
+	source := "admin"
+	if b.Auto {
+		source = "auto"
+	}
+	metricBans.WithLabelValues(source).Inc()
+	dropBanned(b)
+	return nil
+}
+
+// dropBanned disconnects the sessions from an IP or of a uuid b covers.
+func dropBanned(b Ban) {
+	covered := &banList{targets: map[string]Ban{}, subnets: map[netip.Prefix]Ban{}}
+	covered.add(b)
+	if _, err := uuid.Parse(b.Target); err == nil && resumes.forget(b.Target) != nil {
+		matches.remove(b.Target)
+		leaveRoom(b.Target, "banned")
+	}
+	now := time.Now()
+	for _, s := range connections.OpenSessions() {
+		if _, ok := covered.match(s.observed.IP, s.uuid, now); !ok {
+			continue
+		}
+		if s.uuid != "" && connections.Remove(s) {
+			resumes.forget(s.uuid)
+			matches.remove(s.uuid)
+			leaveRoom(s.uuid, "banned")
+		}
+		if err := s.t.CloseWith(ws.CloseBanned, "banned"); err != nil {
+			log.Err(err).Msg("Error sending close frame")
+		}
+	}
+}
+
+// strikeCount is how often an IP failed within the current --ban-window.
+type strikeCount struct {
+	n     int
+	since time.Time
+}
+
+// strikeCounts lives in an LRU so a flood of distinct IPs cannot grow it
+// without bound.
+var strikeCounts, _ = lru.New[string, *strikeCount](65536)
+var strikesMu sync.Mutex
+
+// strike counts a request from ip turned away for failing authentication or
+// a rate limit. Once ip has --ban-strikes of them within --ban-window it is
+// banned for --ban-duration.
+func strike(ip string, reason string) {
+	strikes, window, duration := setting(banStrikes), setting(banWindow), setting(banDuration)
+	if strikes <= 0 || ip == "" {
+		return
+	}
+	now := time.Now()
+	strikesMu.Lock()
+	c, ok := strikeCounts.Get(ip)
+	if !ok || now.Sub(c.since) >= window {
+		c = &strikeCount{since: now}
+		strikeCounts.Add(ip, c)
+	}
+	c.n++
+	banned := c.n >= strikes
+	if banned {
+		strikeCounts.Remove(ip)
+	}
+	strikesMu.Unlock()
+	if !banned {
+		return
+	}
+
+	target, err := parseBanTarget(ip)
+	if err != nil {
+		return
+	}
+	expires := now.Add(duration)
+	b := Ban{Target: target, Reason: reason, Auto: true, CreatedAt: now, ExpiresAt: &expires}
+	if err := addBan(context.Background(), b); err != nil {
+		log.Err(err).Str("ip", ip).Msg("Error storing ban")
+		return
+	}
+	log.Warn().Str("ip", ip).Str("reason", reason).Dur("duration", duration).Msg("Banned IP")
+	auditEvent("ban_added", "auto", ip).Str("target", target).Str("reason", reason).Time("expires_at", expires).Send()
+}
+
+// strikeGRPC is strike for a gRPC call refused with err.
+func strikeGRPC(ctx context.Context, err error) {
+	switch status.Code(err) {
+	case codes.Unauthenticated, codes.PermissionDenied, codes.ResourceExhausted:
+		strike(grpcObserved(ctx).IP, status.Convert(err).Message())
+	}
+}
+
+// rejectBanned is middleware turning away banned IPs, and banned uuids on
+// routes naming one, before the websocket upgrade.
+func rejectBanned(ctx *gin.Context) {
+	if b, ok := bans.match(ctx.ClientIP(), ctx.Param("uuid"), time.Now()); ok {
+		metricBanRejections.Inc()
+		reqLog(ctx).Debug().Str("ip", ctx.ClientIP()).Str("target", b.Target).Msg("Rejected banned client")
+		abortWithClose(ctx, http.StatusForbidden, ws.CloseBanned, "banned", "banned")
+		return
+	}
+	ctx.Next()
+}
+
+var errBanned = errors.New("Banned")
+
+// checkBanned returns errBanned when ip or id is banned.
+func checkBanned(ip string, id string) error {
+	if _, ok := bans.match(ip, id, time.Now()); ok {
+		metricBanRejections.Inc()
+		return errBanned
+	}
+	return nil
+}
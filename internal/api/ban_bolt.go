@@ -0,0 +1,47 @@
+package api
+
+import (
+	"context"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBansBucket = []byte("bans")
+
+// boltBanStore keeps bans in the bolt registry's database, by target.
+type boltBanStore struct {
+	db *bolt.DB
+}
+
+func (s *boltBanStore) Put(ctx context.Context, b Ban) error {
+	data, err := encodeBan(b)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBansBucket).Put([]byte(b.Target), data)
+	})
+}
+
+func (s *boltBanStore) Delete(ctx context.Context, target string) (bool, error) {
+	var found bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBansBucket)
+		found = bucket.Get([]byte(target)) != nil
+		return bucket.Delete([]byte(target))
+	})
+	return found, err
+}
+
+func (s *boltBanStore) List(ctx context.Context) ([]Ban, error) {
+	bans := []Ban{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBansBucket).ForEach(func(_, v []byte) error {
+			if b, err := decodeBan(v); err == nil {
+				bans = append(bans, b)
+			}
+			return nil
+		})
+	})
+	return bans, err
+}
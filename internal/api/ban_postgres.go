@@ -0,0 +1,41 @@
+package api
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// postgresBanStore keeps bans in the bans table next to the entries.
+type postgresBanStore struct {
+	pool *pgxpool.Pool
+}
+
+func (s *postgresBanStore) Put(ctx context.Context, b Ban) error {
+	_, err := s.pool.Exec(ctx, `INSERT INTO bans (target, reason, auto, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (target) DO UPDATE SET reason = EXCLUDED.reason, auto = EXCLUDED.auto, created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at`,
+		b.Target, b.Reason, b.Auto, b.CreatedAt, b.ExpiresAt)
+	return err
+}
+
+func (s *postgresBanStore) Delete(ctx context.Context, target string) (bool, error) {
+	tag, err := s.pool.Exec(ctx, `DELETE FROM bans WHERE target = $1`, target)
+	return tag.RowsAffected() > 0, err
+}
+
+func (s *postgresBanStore) List(ctx context.Context) ([]Ban, error) {
+	rows, err := s.pool.Query(ctx, `SELECT target, reason, auto, created_at, expires_at FROM bans ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bans := []Ban{}
+	for rows.Next() {
+		var b Ban
+		if err := rows.Scan(&b.Target, &b.Reason, &b.Auto, &b.CreatedAt, &b.ExpiresAt); err != nil {
+			return nil, err
+		}
+		bans = append(bans, b)
+	}
+	return bans, rows.Err()
+}
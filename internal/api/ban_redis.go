@@ -0,0 +1,41 @@
+package api
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const redisBansKey = "seven:bans"
+
+// redisBanStore keeps bans in a hash of target to ban.
+type redisBanStore struct {
+	client *redis.Client
+}
+
+func (s *redisBanStore) Put(ctx context.Context, b Ban) error {
+	data, err := encodeBan(b)
+	if err != nil {
+		return err
+	}
+	return s.client.HSet(ctx, redisBansKey, b.Target, data).Err()
+}
+
+func (s *redisBanStore) Delete(ctx context.Context, target string) (bool, error) {
+	n, err := s.client.HDel(ctx, redisBansKey, target).Result()
+	return n > 0, err
+}
+
+func (s *redisBanStore) List(ctx context.Context) ([]Ban, error) {
+	values, err := s.client.HVals(ctx, redisBansKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	bans := make([]Ban, 0, len(values))
+	for _, v := range values {
+		if b, err := decodeBan([]byte(v)); err == nil {
+			bans = append(bans, b)
+		}
+	}
+	return bans, nil
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/v1/capabilities says what this deployment supports, from its
+// flags, so clients can pick a transport and leave out what is switched off
+// instead of finding out from errors. Under /t/<tenant>/ it has the
+// tenant's feature flags. It needs no credentials, like the config next to
+// it.
+
+// Capabilities is the reply of GET /capabilities.
+type Capabilities struct {
+	Protocols  []int            `json:"protocols"`
+	Transports []string         `json:"transports"` // ws, sse, poll and grpc
+	Features   []string         `json:"features"`
+	Limits     CapabilityLimits `json:"limits"`
+}
+
+// CapabilityLimits are the limits a client runs into; 0 is unlimited.
+type CapabilityLimits struct {
+	MaxMessageSize  int64   `json:"max_message_size"`  // websocket message, in bytes
+	MaxDataSize     int     `json:"max_data_size"`     // broadcast and direct payload, in bytes
+	MaxMetadataSize int     `json:"max_metadata_size"` // in bytes
+	MaxRoomSize     int     `json:"max_room_size"`
+	MaxEntries      int     `json:"max_entries"`  // entries returned by one registration
+	MessageRate     float64 `json:"message_rate"` // websocket messages per second
+	MessageBurst    int     `json:"message_burst"`
+	ResumeGraceMs   int64   `json:"resume_grace_ms"`
+}
+
+func capabilitiesFor(tenant string) Capabilities {
+	transports := []string{"ws", "sse", "poll"}
+	if *grpcAddr != "" {
+		transports = append(transports, "grpc")
+	}
+	features := []string{"rooms", "metadata"}
+	for _, f := range []struct {
+		name string
+		on   bool
+	}{
+		{"room_directory", featureEnabled(tenant, "room_directory")},
+		{"matchmaking", featureEnabled(tenant, "matchmaking")},
+		{"reports", featureEnabled(tenant, "reports")},
+		{"rendezvous", featureEnabled(tenant, "rendezvous")},
+		{"privacy_mode", featureEnabled(tenant, "privacy_mode")},
+		{"resume", *resumeGrace > 0},
+		{"offline_queue", *offlineQueueSize > 0},
+		{"mesh_plans", *meshMaxPeers > 0},
+		{"glare_detection", *glareWindow > 0},
+		{"room_queue", *roomFull == "queue"},
+		{"assigned_uuids", *assignUUIDs},
+		{"turn", *turnSecret != "" && *turnURLs != ""},
+		{"nat_probe", natProbes.enabled() && featureEnabled(tenant, "nat_probe")},
+		{"compression", *compression},
+		{"captcha", *captchaProvider != ""},
+		{"api_keys", *requireAPIKeys},
+		{"jwt", *jwtSecret != "" || *jwtJWKSURL != ""},
+	} {
+		if f.on {
+			features = append(features, f.name)
+		}
+	}
+	rate, burst := setting(maxMessageRate), setting(maxMessageBurst)
+	if rate <= 0 {
+		rate, burst = 0, 0
+	}
+	return Capabilities{
+		Protocols:  protocolVersions,
+		Transports: transports,
+		Features:   features,
+		Limits: CapabilityLimits{
+			MaxMessageSize:  *maxMessageSize,
+			MaxDataSize:     *maxDataSize,
+			MaxMetadataSize: *maxMetadataSize,
+			MaxRoomSize:     setting(roomMaxPeers),
+			MaxEntries:      *maxEntries,
+			MessageRate:     rate,
+			MessageBurst:    burst,
+			ResumeGraceMs:   resumeGrace.Milliseconds(),
+		},
+	}
+}
+
+func capabilities(ctx *gin.Context) {
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.JSON(http.StatusOK, capabilitiesFor(ctx.GetString(tenantKey)))
+}
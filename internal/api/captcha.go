@@ -0,0 +1,120 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// With --captcha, registrations that come with neither an API key nor a
+// bearer token must carry a captcha_token from an hCaptcha or Turnstile
+// widget, which the server checks with the provider. A peer refreshing the
+// entry it registered from the same IP needs no new token, nor does one
+// registering again on a session that already passed.
+
+var captchaVerifyURLs = map[string]string{
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+	"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+}
+
+const captchaTimeout = 5 * time.Second
+
+var captchaVerifyURL string
+var captchaClient = &http.Client{Timeout: captchaTimeout}
+
+func initCaptcha(provider string, secret string, verifyURL string) error {
+	if provider == "" {
+		return nil
+	}
+	u, ok := captchaVerifyURLs[provider]
+	if !ok {
+		return fmt.Errorf("Unknown --captcha provider %q", provider)
+	}
+	if secret == "" {
+		return errors.New("--captcha needs --captcha-secret")
+	}
+	if verifyURL != "" {
+		u = verifyURL
+	}
+	captchaVerifyURL = u
+	return nil
+}
+
+// captchaNeeded reports whether registrations over a request must pass the
+// captcha: it is enabled and the request has no API key or bearer token.
+func captchaNeeded(ctx *gin.Context) bool {
+	_, keyed := ctx.Get(apiKeyContextKey)
+	return captchaVerifyURL != "" && !keyed && ctx.GetString(subjectKey) == ""
+}
+
+func grpcCaptchaNeeded(ctx context.Context) bool {
+	_, keyed := ctx.Value(grpcAPIKeyKey).(APIKey)
+	return captchaVerifyURL != "" && !keyed && grpcSubject(ctx) == ""
+}
+
+var (
+	errCaptchaRequired = errors.New("Captcha token required")
+	errCaptchaFailed   = errors.New("Captcha verification failed")
+)
+
+// captchaRejection is the HTTP status, error code and message for a
+// registration checkCaptcha refused with err.
+func captchaRejection(err error) (int, string, string) {
+	switch err {
+	case errCaptchaRequired:
+		return http.StatusForbidden, "captcha_required", "captcha required"
+	case errCaptchaFailed:
+		return http.StatusForbidden, "captcha_failed", "captcha failed"
+	default:
+		log.Err(err).Msg("Error verifying captcha")
+		return http.StatusBadGateway, "captcha_unavailable", "error verifying captcha"
+	}
+}
+
+// checkCaptcha verifies the captcha token of form, registered from ip,
+// unless it refreshes an entry registered from ip before.
+func checkCaptcha(ctx context.Context, form EntryForm, ip string) error {
+	if e, ok, err := peerRegistry.Get(ctx, form.Uuid); err == nil && ok && e.IP == ip {
+		return nil
+	}
+	if form.CaptchaToken == "" {
+		return errCaptchaRequired
+	}
+
+	verify, cancel := context.WithTimeout(ctx, captchaTimeout)
+	defer cancel()
+	body := url.Values{"secret": {*captchaSecret}, "response": {form.CaptchaToken}, "remoteip": {ip}}
+	req, err := http.NewRequestWithContext(verify, http.MethodPost, captchaVerifyURL, strings.NewReader(body.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := captchaClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error verifying captcha: %w", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success bool     `json:"success"`
+		Errors  []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("Error decoding captcha verification: %w", err)
+	}
+	if !result.Success {
+		log.Debug().Str("ip", ip).Strs("errors", result.Errors).Msg("Captcha failed")
+		metricCaptcha.WithLabelValues("failed").Inc()
+		strike(ip, "captcha failed")
+		return errCaptchaFailed
+	}
+	metricCaptcha.WithLabelValues("passed").Inc()
+	return nil
+}
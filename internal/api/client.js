@@ -12,7 +12,7 @@ window.addEventListener("load", function(evt) {
         if (ws) {  
             return false;
         }
-        ws = new WebSocket("{{.}}");
+        ws = new WebSocket("{{js .Register}}");
         ws.onopen = function(evt) {
             print("OPEN");
         }
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hoyle1974/seven/internal/ws"
+)
+
+// closeCodeFor maps the HTTP status a request was rejected with to the close
+// code a websocket client sees.
+func closeCodeFor(status int) int {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ws.CloseAuthFailed
+	case http.StatusTooManyRequests:
+		return ws.CloseRateLimited
+	default:
+		return ws.CloseServerError
+	}
+}
+
+// abortClient rejects a request. Browsers cannot read the HTTP status of a
+// failed websocket handshake, so websocket requests are upgraded and closed
+// with the matching close code instead.
+func abortClient(ctx *gin.Context, status int, code string, reason string) {
+	auditRejection(ctx, status, reason)
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		strike(ctx.ClientIP(), reason)
+	}
+	abortWithClose(ctx, status, closeCodeFor(status), code, reason)
+}
+
+// abortWithClose rejects a request with status and an error with code, or a
+// websocket with closeCode.
+func abortWithClose(ctx *gin.Context, status int, closeCode int, code string, reason string) {
+	if !ctx.IsWebsocket() {
+		abortError(ctx, status, code, reason, nil)
+		return
+	}
+	ctx.Abort()
+	c, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	newTransport(c).CloseWith(closeCode, reason)
+}
@@ -0,0 +1,388 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hoyle1974/seven/internal/cluster"
+	"github.com/hoyle1974/seven/internal/ws"
+	"github.com/rs/zerolog/log"
+)
+
+// With --cluster-addr instances find each other by gossip, see package
+// cluster, and need no broker: --relay=cluster and --registry=cluster work
+// through the other members directly.
+//
+// The relay gives every uuid an owner by consistent hashing. Each instance
+// tells the owners of the uuids connected to it where they are, and a
+// message for a uuid not connected here goes to its owner, which hands it
+// to the instance the uuid is on. When members come or go every instance
+// tells the owners again, and it does every locateRefresh anyway.
+
+// locateRefresh is how often every instance repeats where its uuids are.
+const locateRefresh = 10 * time.Second
+
+var members *cluster.Cluster
+
+// errClusterOff is returned for cluster backends without --cluster-addr.
+var errClusterOff = errors.New("--cluster-addr is not set")
+
+func initCluster() error {
+	if *clusterAddr == "" {
+		return nil
+	}
+	name, err := thisNode()
+	if err != nil {
+		return err
+	}
+	var seeds []string
+	for _, seed := range strings.Split(*clusterJoin, ",") {
+		if seed = strings.TrimSpace(seed); seed != "" {
+			seeds = append(seeds, seed)
+		}
+	}
+	c, err := cluster.New(cluster.Config{
+		Name:          name,
+		BindAddr:      *clusterAddr,
+		AdvertiseAddr: *clusterAdvertise,
+		Seeds:         seeds,
+		Secret:        *clusterSecret,
+		OnChange:      clusterChanged,
+	})
+	if err != nil {
+		return err
+	}
+	if *clusterSecret == "" {
+		log.Warn().Msg("Cluster traffic is not authenticated, set --cluster-secret")
+	}
+	log.Info().Str("node", name).Str("addr", *clusterAddr).Strs("join", seeds).Msg("Joined cluster")
+	members = c
+	metricClusterMembers.Set(1)
+	return nil
+}
+
+// clusterChanged is called when members come, go or change their digests.
+func clusterChanged() {
+	list := members.Members()
+	metricClusterMembers.Set(float64(len(list)))
+	if r, ok := connections.Relay().(*clusterRelay); ok {
+		r.membersChanged(list)
+	}
+	if clusterEntries != nil {
+		clusterEntries.membersChanged(list)
+	}
+}
+
+// thisNode is --node-name, or the hostname.
+func thisNode() (string, error) {
+	if *nodeName != "" {
+		return *nodeName, nil
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("Error getting hostname for --node-name: %w", err)
+	}
+	return name, nil
+}
+
+// listMembers serves GET /admin/cluster.
+func listMembers(ctx *gin.Context) {
+	if members == nil {
+		respondError(ctx, http.StatusNotFound, "not_found", "not clustered", nil)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok", "node": members.Name(), "members": members.Members()})
+}
+
+const (
+	locatePath  = "/seven/v1/locate"
+	forwardPath = "/seven/v1/forward"
+	deliverPath = "/seven/v1/deliver"
+)
+
+// clusterRelay routes messages through the owner of their uuid.
+type clusterRelay struct {
+	deliver func(uuid string, msg ws.Message)
+
+	mu      sync.Mutex
+	local   map[string]bool   // uuids connected here
+	where   map[string]string // uuids owned here, to the member they are on
+	pending map[string]bool   // changes to local the owners were not told of
+	names   string            // live members when last told
+	wake    chan struct{}
+}
+
+// located is what an instance tells an owner about its uuids. With All the
+// uuids in Add are every one of the owner's the instance has.
+type located struct {
+	Node   string   `json:"node"`
+	Add    []string `json:"add,omitempty"`
+	Remove []string `json:"remove,omitempty"`
+	All    bool     `json:"all,omitempty"`
+}
+
+type forwarded struct {
+	UUID string     `json:"uuid"`
+	Msg  ws.Message `json:"msg"`
+}
+
+func newClusterRelay(deliver func(uuid string, msg ws.Message)) (*clusterRelay, error) {
+	if members == nil {
+		return nil, errClusterOff
+	}
+	r := &clusterRelay{
+		deliver: deliver,
+		local:   make(map[string]bool),
+		where:   make(map[string]string),
+		pending: make(map[string]bool),
+		wake:    make(chan struct{}, 1),
+	}
+	members.Handle(locatePath, http.HandlerFunc(r.serveLocate))
+	members.Handle(forwardPath, http.HandlerFunc(r.serveForward))
+	members.Handle(deliverPath, http.HandlerFunc(r.serveDeliver))
+	go r.announce()
+	return r, nil
+}
+
+func (r *clusterRelay) Subscribe(uuid string) error {
+	r.mu.Lock()
+	r.local[uuid] = true
+	r.pending[uuid] = true
+	r.mu.Unlock()
+	r.poke()
+	return nil
+}
+
+func (r *clusterRelay) Unsubscribe(uuid string) error {
+	r.mu.Lock()
+	delete(r.local, uuid)
+	r.pending[uuid] = false
+	r.mu.Unlock()
+	r.poke()
+	return nil
+}
+
+func (r *clusterRelay) poke() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *clusterRelay) Publish(uuid string, msg ws.Message) (bool, error) {
+	owner := members.Owner(uuid)
+	if owner == members.Name() {
+		return r.route(uuid, msg)
+	}
+	return r.call(owner, forwardPath, forwarded{UUID: uuid, Msg: msg})
+}
+
+func (r *clusterRelay) Ping(ctx context.Context) error {
+	return members.Ping(ctx)
+}
+
+// route hands msg to the member uuid is on, as its owner.
+func (r *clusterRelay) route(uuid string, msg ws.Message) (bool, error) {
+	r.mu.Lock()
+	node, ok := r.where[uuid]
+	r.mu.Unlock()
+	switch {
+	case !ok:
+		return false, nil
+	case node == members.Name():
+		r.deliver(uuid, msg)
+		return true, nil
+	}
+	return r.call(node, deliverPath, forwarded{UUID: uuid, Msg: msg})
+}
+
+func (r *clusterRelay) call(node string, path string, body any) (bool, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	reply, err := members.Call(ctx, node, path, b)
+	if err != nil {
+		return false, err
+	}
+	var delivered struct {
+		Delivered bool `json:"delivered"`
+	}
+	err = json.Unmarshal(reply, &delivered)
+	return delivered.Delivered, err
+}
+
+// announce tells owners about the uuids that came and went, batched, and
+// all of them every locateRefresh.
+func (r *clusterRelay) announce() {
+	ticker := time.NewTicker(locateRefresh)
+	defer ticker.Stop()
+	for {
+		all := false
+		select {
+		case <-r.wake:
+		case <-ticker.C:
+			all = true
+		}
+		r.mu.Lock()
+		var changes map[string]bool
+		if all {
+			changes = make(map[string]bool, len(r.local))
+			for uuid := range r.local {
+				changes[uuid] = true
+			}
+			r.pending = make(map[string]bool)
+		} else {
+			changes, r.pending = r.pending, make(map[string]bool)
+		}
+		r.mu.Unlock()
+		r.tell(changes, all)
+	}
+}
+
+// tell sends the owners of the uuids changes names what they are to know.
+func (r *clusterRelay) tell(changes map[string]bool, all bool) {
+	self := members.Name()
+	byOwner := map[string]*located{}
+	if all {
+		for _, m := range members.Members() {
+			byOwner[m.Name] = &located{Node: self, All: true}
+		}
+	}
+	for uuid, present := range changes {
+		owner := members.Owner(uuid)
+		l, ok := byOwner[owner]
+		if !ok {
+			l = &located{Node: self}
+			byOwner[owner] = l
+		}
+		if present {
+			l.Add = append(l.Add, uuid)
+		} else {
+			l.Remove = append(l.Remove, uuid)
+		}
+	}
+	for owner, l := range byOwner {
+		if owner == self {
+			r.locate(*l)
+			continue
+		}
+		b, err := json.Marshal(l)
+		if err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		if _, err := members.Call(ctx, owner, locatePath, b); err != nil {
+			log.Warn().Err(err).Str("node", owner).Msg("Error telling cluster member where uuids are")
+		}
+		cancel()
+	}
+}
+
+// locate records what l says as the owner of its uuids.
+func (r *clusterRelay) locate(l located) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if l.All {
+		for uuid, node := range r.where {
+			if node == l.Node {
+				delete(r.where, uuid)
+			}
+		}
+	}
+	for _, uuid := range l.Add {
+		r.where[uuid] = l.Node
+	}
+	for _, uuid := range l.Remove {
+		if r.where[uuid] == l.Node {
+			delete(r.where, uuid)
+		}
+	}
+}
+
+// membersChanged forgets uuids on members that are gone and, when members
+// came or went, moves each uuid to its new owner.
+func (r *clusterRelay) membersChanged(list []cluster.Member) {
+	live := make(map[string]bool, len(list))
+	names := make([]string, 0, len(list))
+	for _, m := range list {
+		live[m.Name] = true
+		names = append(names, m.Name)
+	}
+	sort.Strings(names)
+	r.mu.Lock()
+	for uuid, node := range r.where {
+		if !live[node] {
+			delete(r.where, uuid)
+		}
+	}
+	moved := r.names != strings.Join(names, ",")
+	r.names = strings.Join(names, ",")
+	r.mu.Unlock()
+	if moved {
+		go func() {
+			r.mu.Lock()
+			changes := make(map[string]bool, len(r.local))
+			for uuid := range r.local {
+				changes[uuid] = true
+			}
+			r.mu.Unlock()
+			r.tell(changes, true)
+		}()
+	}
+}
+
+func (r *clusterRelay) serveLocate(w http.ResponseWriter, req *http.Request) {
+	var l located
+	if err := json.NewDecoder(io.LimitReader(req.Body, 16<<20)).Decode(&l); err != nil || l.Node == "" {
+		http.Error(w, "invalid locate", http.StatusBadRequest)
+		return
+	}
+	r.locate(l)
+	writeDelivered(w, true)
+}
+
+func (r *clusterRelay) serveForward(w http.ResponseWriter, req *http.Request) {
+	var f forwarded
+	if err := json.NewDecoder(io.LimitReader(req.Body, 16<<20)).Decode(&f); err != nil {
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+	delivered, err := r.route(f.UUID, f.Msg)
+	if err != nil {
+		log.Warn().Err(err).Str("uuid", f.UUID).Msg("Error forwarding relayed message")
+	}
+	writeDelivered(w, delivered)
+}
+
+func (r *clusterRelay) serveDeliver(w http.ResponseWriter, req *http.Request) {
+	var f forwarded
+	if err := json.NewDecoder(io.LimitReader(req.Body, 16<<20)).Decode(&f); err != nil {
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	here := r.local[f.UUID]
+	r.mu.Unlock()
+	if here {
+		r.deliver(f.UUID, f.Msg)
+	}
+	writeDelivered(w, here)
+}
+
+func writeDelivered(w http.ResponseWriter, delivered bool) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"delivered":%t}`, delivered)
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/rs/zerolog/log"
+)
+
+func init() {
+	expvar.Publish("seven", expvar.Func(func() any {
+		return map[string]int{
+			"goroutines": runtime.NumGoroutine(),
+			"peers":      connections.Count(),
+			"sessions":   connections.SessionCount(),
+			"rooms":      len(rooms.List()),
+		}
+	}))
+}
+
+// debugHandler serves the pprof profiles under /debug/pprof/ and expvar under
+// /debug/vars.
+func debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// serveDebug serves debugHandler, without authentication, on addr. It is
+// meant for a loopback or otherwise internal address.
+func serveDebug(addr string) {
+	log.Info().Str("addr", addr).Msg("Serving debug endpoints")
+	if err := http.ListenAndServe(addr, debugHandler()); err != nil {
+		log.Fatal().Err(err).Msg("Error serving debug endpoints")
+	}
+}
@@ -0,0 +1,16 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hoyle1974/seven/examples"
+)
+
+// The video chat in examples/video doubles as an end to end check of the
+// relay: two tabs of /demo/ only see each other if offers, answers and
+// candidates all make it through.
+
+func demoPage(ctx *gin.Context) {
+	ctx.Data(http.StatusOK, "text/html; charset=utf-8", examples.VideoDemo)
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// listDirectory serves GET /rooms, the listed rooms of the caller's tenant
+// for lobby browsers. The filter (over room tags), name and available query
+// parameters narrow the list, which is paged in id order by cursor and count.
+func listDirectory(ctx *gin.Context) {
+	if !featureEnabled(ctx.GetString(tenantKey), "room_directory") {
+		abortFeatureDisabled(ctx, "room_directory")
+		return
+	}
+	filter, err := parseTagFilter(ctx.Query("filter"))
+	if err != nil {
+		respondError(ctx, http.StatusBadRequest, "invalid_filter", err.Error(), nil)
+		return
+	}
+	count := 0
+	if c := ctx.Query("count"); c != "" {
+		if count, err = strconv.Atoi(c); err != nil {
+			respondError(ctx, http.StatusBadRequest, "invalid_count", "Invalid count", nil)
+			return
+		}
+	}
+	name := strings.ToLower(ctx.Query("name"))
+	available := ctx.Query("available") == "true"
+
+	list := []RoomListing{}
+	for _, room := range rooms.Directory(ctx.GetString(tenantKey)) {
+		if !filter.Match(room.Tags) || !strings.Contains(strings.ToLower(room.Name), name) {
+			continue
+		}
+		if available && (room.Locked || (room.MaxPeers > 0 && room.Members >= room.MaxPeers)) {
+			continue
+		}
+		list = append(list, room)
+	}
+	page, next := pageRooms(list, ctx.Query("cursor"), entryCount(count))
+	resp := gin.H{"status": "ok", "rooms": page}
+	if next != "" {
+		resp["next"] = next
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// pageRooms returns up to count of list, which is in id order, after cursor
+// and the cursor for the next page, or "" on the last page.
+func pageRooms(list []RoomListing, cursor string, count int) ([]RoomListing, string) {
+	start := sort.Search(len(list), func(i int) bool { return list[i].ID > cursor })
+	list = list[start:]
+	if len(list) > count {
+		return list[:count], list[count-1].ID
+	}
+	return list, ""
+}
@@ -0,0 +1,325 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/hoyle1974/seven/internal/registry"
+)
+
+func entryForm(e registry.Entry) EntryForm {
+	return EntryForm{
+		Uuid:     e.UUID.String(),
+		Address:  e.Address,
+		Addrs:    e.Addrs,
+		Tags:     e.Tags,
+		Metadata: e.Metadata,
+		NAT:      e.NAT,
+	}
+}
+
+// pickSome returns up to amount entries chosen at random, weighted by their
+// scores (see score.go) if any has one, and otherwise uniformly using a
+// partial Fisher-Yates shuffle over a copy of values.
+func pickSome(values []registry.Entry, amount int) []EntryForm {
+	if amount > len(values) {
+		amount = len(values)
+	}
+	if amount <= 0 {
+		return []EntryForm{}
+	}
+	if weights := entryWeights(values); weights != nil {
+		return pickWeighted(values, weights, amount)
+	}
+	picked := make([]EntryForm, 0, amount)
+
+	shuffled := make([]registry.Entry, len(values))
+	copy(shuffled, values)
+	for i := 0; i < amount; i++ {
+		j := i + rand.Intn(len(shuffled)-i)
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		picked = append(picked, entryForm(shuffled[i]))
+	}
+	return picked
+}
+
+const (
+	defaultEntryCount = 16
+	maxExcluded       = 1024
+)
+
+// entryCount applies the default and the --max-entries cap to a requested count.
+func entryCount(requested int) int {
+	if requested <= 0 {
+		requested = defaultEntryCount
+	}
+	if requested > *maxEntries {
+		requested = *maxEntries
+	}
+	return requested
+}
+
+func excludeEntries(values []registry.Entry, exclude []string) []registry.Entry {
+	if len(exclude) == 0 {
+		return values
+	}
+	skip := make(map[string]bool, len(exclude))
+	for _, u := range exclude {
+		skip[u] = true
+	}
+	kept := make([]registry.Entry, 0, len(values))
+	for _, e := range values {
+		if !skip[e.UUID.String()] {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// excludeSelf drops the requester's own entry and, with --exclude-same-ip, any
+// peer that registered from the same address.
+func excludeSelf(values []registry.Entry, self uuid.UUID, ip string) []registry.Entry {
+	kept := make([]registry.Entry, 0, len(values))
+	for _, e := range values {
+		if e.UUID == self || (*excludeSameIP && ip != "" && e.IP == ip) {
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
+
+// pageEntries walks values in uuid order, returning up to count entries after
+// cursor and the cursor for the next page, or "" on the last page.
+func pageEntries(values []registry.Entry, cursor string, count int) ([]EntryForm, string) {
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].UUID.String() < values[j].UUID.String()
+	})
+	start := sort.Search(len(values), func(i int) bool {
+		return values[i].UUID.String() > cursor
+	})
+
+	page := make([]EntryForm, 0, count)
+	for _, e := range values[start:] {
+		if len(page) == count {
+			return page, page[len(page)-1].Uuid
+		}
+		page = append(page, entryForm(e))
+	}
+	return page, ""
+}
+
+// lookupEntries returns the registered entries for uuids, skipping any that
+// are no longer in the registry.
+func lookupEntries(ctx context.Context, uuids []string) []EntryForm {
+	entries := []EntryForm{}
+	for _, u := range uuids {
+		e, ok, err := peerRegistry.Get(ctx, u)
+		if err != nil {
+			logFor(ctx).Err(err).Str("uuid", u).Msg("Error looking up entry")
+			continue
+		}
+		if ok {
+			entries = append(entries, entryForm(e))
+			hideAddresses(e.Tenant, entries[len(entries)-1:])
+		}
+	}
+	return entries
+}
+
+// touchEntry refreshes lastSeen (and so the TTL) of a registered uuid.
+func touchEntry(ctx context.Context, uuid string) {
+	e, ok, err := peerRegistry.Get(ctx, uuid)
+	if err != nil {
+		logFor(ctx).Err(err).Str("uuid", uuid).Msg("Error refreshing entry")
+		return
+	}
+	if ok {
+		e.LastSeen = time.Now()
+		if err := peerRegistry.Add(ctx, e); err != nil {
+			logFor(ctx).Err(err).Str("uuid", uuid).Msg("Error refreshing entry")
+		}
+	}
+}
+
+// selectEntries picks the peers to hand to self, applying the filter, count,
+// cursor and exclude parameters of the request.
+func selectEntries(ctx context.Context, tenant string, json EntryForm, self uuid.UUID, ip string, loc *registry.Location) ([]EntryForm, string, error) {
+	values, err := peerValues(ctx, tenant)
+	if err != nil {
+		return []EntryForm{}, "", err
+	}
+	return pickEntries(tenant, json, values, self, ip, loc)
+}
+
+// peerValues are the registry entries of tenant.
+func peerValues(ctx context.Context, tenant string) ([]registry.Entry, error) {
+	values, err := peerRegistry.Values(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tenantEntries(values, tenant), nil
+}
+
+// pickEntries is selectEntries out of values, the entries of tenant.
+func pickEntries(tenant string, json EntryForm, values []registry.Entry, self uuid.UUID, ip string, loc *registry.Location) ([]EntryForm, string, error) {
+	filter, err := parseTagFilter(json.Filter)
+	if err != nil {
+		return []EntryForm{}, "", &FormError{Code: "invalid_filter", Field: "filter", Err: err}
+	}
+	if len(json.Exclude) > maxExcluded {
+		return []EntryForm{}, "", &FormError{Code: "invalid_exclude", Field: "exclude", Err: fmt.Errorf("At most %d uuids can be excluded", maxExcluded)}
+	}
+
+	values = excludeSelf(values, self, ip)
+	values = excludeEntries(filterEntries(values, filter), json.Exclude)
+	var entries []EntryForm
+	next := ""
+	if json.Cursor != nil {
+		entries, next = pageEntries(values, *json.Cursor, entryCount(json.Count))
+	} else {
+		entries = pickNearby(values, loc, entryCount(json.Count))
+	}
+	markSameNetwork(entries, values, ip)
+	hideAddresses(tenant, entries)
+	if self != uuid.Nil {
+		entries = withRoles(self.String(), entries)
+	}
+	return entries, next, nil
+}
+
+// politeTowards reports whether self takes the polite role of the perfect
+// negotiation pattern with other. The peer with the lower uuid is polite.
+func politeTowards(self string, other string) bool {
+	return self < other
+}
+
+// withRoles sets Polite on each entry to the role self plays towards it.
+func withRoles(self string, entries []EntryForm) []EntryForm {
+	for i := range entries {
+		if entries[i].Uuid == self {
+			continue
+		}
+		polite := politeTowards(self, entries[i].Uuid)
+		entries[i].Polite = &polite
+	}
+	return entries
+}
+
+// FormError is a field of a registration or discovery request refused for
+// Err. Code is the error code clients get, such as invalid_tags.
+type FormError struct {
+	Code  string
+	Field string
+	Err   error
+}
+
+func (e *FormError) Error() string {
+	return fmt.Sprintf("Invalid %s: %s", e.Field, e.Err)
+}
+
+func (e *FormError) Unwrap() error {
+	return e.Err
+}
+
+// message is the message clients get for the error.
+func (e *FormError) message() string {
+	return strings.ReplaceAll(e.Code, "_", " ")
+}
+
+// details are the error details clients get for the error.
+func (e *FormError) details() gin.H {
+	return gin.H{"field": e.Field, "reason": e.Err.Error()}
+}
+
+// registerJSON stores the entry and returns peers for it. Peers are picked at
+// random unless the request carries a cursor, in which case they are paged in
+// uuid order and next is the cursor of the following page.
+func registerJSON(ctx context.Context, tenant string, claims map[string]any, json EntryForm, observed ObservedAddress) (entries []EntryForm, next string, err error) {
+	entries = []EntryForm{}
+
+	// Extract and validate uuid
+	if json.Uuid == "" {
+		return entries, "", &FormError{Code: "invalid_uuid", Field: "uuid", Err: errMissingUUID}
+	}
+	uuid, err := uuid.Parse(json.Uuid)
+	if err != nil {
+		return entries, "", &FormError{Code: "invalid_uuid", Field: "uuid", Err: fmt.Errorf("Uuid %q is malformed", json.Uuid)}
+	}
+	address, addrs, err := normalizeAddresses(json.Address, json.Addrs)
+	if err != nil {
+		return entries, "", err
+	}
+	if len(address) < 1 {
+		return entries, "", &AddressError{Field: "addr", Reason: "missing"}
+	}
+	if err := validateTags(json.Tags); err != nil {
+		return entries, "", &FormError{Code: "invalid_tags", Field: "tags", Err: err}
+	}
+	metadata, err := normalizeMetadata(json.Metadata)
+	if err != nil {
+		return entries, "", &FormError{Code: "invalid_metadata", Field: "metadata", Err: err}
+	}
+
+	if err := checkBanned(observed.IP, json.Uuid); err != nil {
+		return entries, "", err
+	}
+	loc := lookupLocation(observed.IP)
+	if !tenantAllows(ctx, tenant, json.Uuid) {
+		return entries, "", errOtherTenant
+	}
+
+	values, err := peerValues(ctx, tenant)
+	if err != nil {
+		return entries, "", err
+	}
+	if err := checkTenantEntries(tenant, values, uuid); err != nil {
+		return entries, "", err
+	}
+	entries, next, err = pickEntries(tenant, json, values, uuid, observed.IP, loc)
+	if err != nil {
+		return entries, "", err
+	}
+
+	entry := registry.Entry{
+		UUID:     uuid,
+		Tenant:   tenant,
+		Address:  address,
+		Addrs:    addrs,
+		Tags:     json.Tags,
+		Metadata: metadata,
+		IP:       observed.IP,
+		Location: loc,
+		LastSeen: time.Now(),
+		NAT:      natBehavior(ctx, json.Uuid, observed.IP),
+	}
+	if err := registerAllowed(ctx, entry, claims); err != nil {
+		return entries, "", err
+	}
+
+	// Store this uuid and it's address
+	logFor(ctx).Debug().Str("uuid", json.Uuid).Msg("Registering client")
+	if err := peerRegistry.Add(ctx, entry); err != nil {
+		return entries, "", err
+	}
+	metricRegistrations.Inc()
+	metricTenantRegistrations.WithLabelValues(metricTenant(tenant)).Inc()
+	events.publish(Event{Type: EventPeerRegistered, UUID: json.Uuid})
+
+	return entries, next, nil
+}
+
+// deregisterUUID removes id from the registry, reporting whether it was there.
+func deregisterUUID(ctx context.Context, id string) (bool, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return false, &FormError{Code: "invalid_uuid", Field: "uuid", Err: fmt.Errorf("Uuid %q is malformed", id)}
+	}
+	logFor(ctx).Debug().Str("uuid", id).Msg("Deregistering client")
+	return peerRegistry.Remove(ctx, id)
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/hoyle1974/seven/internal/registry"
+)
+
+func testEntries(n int) []registry.Entry {
+	values := make([]registry.Entry, n)
+	for i := range values {
+		values[i] = registry.Entry{UUID: uuid.New(), Address: "203.0.113.1:4000"}
+	}
+	return values
+}
+
+func TestPickSome(t *testing.T) {
+	tests := []struct {
+		name   string
+		values int
+		amount int
+		want   int
+	}{
+		{"empty input", 0, 5, 0},
+		{"amount 0", 10, 0, 0},
+		{"negative amount", 10, -3, 0},
+		{"fewer than available", 10, 4, 4},
+		{"exactly available", 10, 10, 10},
+		{"amount greater than len", 3, 8, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := testEntries(tt.values)
+			before := make([]registry.Entry, len(values))
+			copy(before, values)
+
+			picked := pickSome(values, tt.amount)
+			if picked == nil {
+				t.Fatal("pickSome returned nil, want an empty slice")
+			}
+			if len(picked) != tt.want {
+				t.Fatalf("pickSome picked %d entries, want %d", len(picked), tt.want)
+			}
+			known := make(map[string]bool, len(values))
+			for _, e := range values {
+				known[e.UUID.String()] = true
+			}
+			seen := make(map[string]bool, len(picked))
+			for _, e := range picked {
+				if !known[e.Uuid] {
+					t.Errorf("pickSome returned %s, which it was not given", e.Uuid)
+				}
+				if seen[e.Uuid] {
+					t.Errorf("pickSome returned %s twice", e.Uuid)
+				}
+				seen[e.Uuid] = true
+			}
+			for i := range values {
+				if values[i].UUID != before[i].UUID {
+					t.Fatal("pickSome reordered its input")
+				}
+			}
+		})
+	}
+}
+
+func TestPickSomeDistribution(t *testing.T) {
+	const (
+		entries = 10
+		amount  = 3
+		rounds  = 20000
+	)
+	values := testEntries(entries)
+	counts := make(map[string]int, entries)
+	for i := 0; i < rounds; i++ {
+		for _, e := range pickSome(values, amount) {
+			counts[e.Uuid]++
+		}
+	}
+	// Every entry is picked amount/entries of the time; allow 10% either way.
+	want := float64(rounds*amount) / entries
+	for _, e := range values {
+		got := float64(counts[e.UUID.String()])
+		if got < want*0.9 || got > want*1.1 {
+			t.Errorf("Entry picked %v times in %d rounds, want about %v", got, rounds, want)
+		}
+	}
+}
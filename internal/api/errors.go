@@ -0,0 +1,42 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// Error replies, over HTTP and in websocket error and nack messages, carry a
+// machine-readable code, a message for people and, for some codes, details
+// such as the room or when to retry:
+//
+//	{"code": "room_full", "message": "room full", "details": {"room": "lobby", "max_peers": 8}, "request_id": "..."}
+//
+// Codes are part of the v1 contract; messages may be reworded. For clients
+// written before codes existed the message is repeated as status, and the
+// details at the top level.
+
+// errorBody is the reply for an error.
+func errorBody(code string, message string, details gin.H, requestID string) gin.H {
+	body := gin.H{"status": message, "code": code, "message": message}
+	if requestID != "" {
+		body["request_id"] = requestID
+	}
+	if len(details) > 0 {
+		body["details"] = details
+		for k, v := range details {
+			if _, ok := body[k]; !ok {
+				body[k] = v
+			}
+		}
+	}
+	return body
+}
+
+// respondError replies to ctx with an error.
+func respondError(ctx *gin.Context, status int, code string, message string, details gin.H) {
+	ctx.JSON(status, errorBody(code, message, details, requestID(ctx)))
+}
+
+// abortError is respondError for middleware.
+func abortError(ctx *gin.Context, status int, code string, message string, details gin.H) {
+	ctx.AbortWithStatusJSON(status, errorBody(code, message, details, requestID(ctx)))
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hoyle1974/seven/internal/ws"
+)
+
+// Event describes something that happened on the signaling plane. Relayed
+// messages are reported by type only, never with their payload.
+type Event struct {
+	Type    string         `json:"type"`
+	Time    time.Time      `json:"time"`
+	UUID    string         `json:"uuid,omitempty"`
+	To      string         `json:"to,omitempty"`
+	Room    string         `json:"room,omitempty"`
+	Message ws.MessageType `json:"message,omitempty"`
+	Reason  string         `json:"reason,omitempty"`
+}
+
+const (
+	EventPeerRegistered   = "peer_registered"
+	EventPeerResumed      = "peer_resumed"
+	EventPeerDisconnected = "peer_disconnected"
+	EventPeerDeregistered = "peer_deregistered"
+	EventPeerEvicted      = "peer_evicted"
+	EventPeerExpired      = "peer_expired"
+	EventRoomCreated      = "room_created"
+	EventRoomClosed       = "room_closed"
+	EventRoomJoined       = "room_joined"
+	EventRoomLeft         = "room_left"
+	EventRoomHostChanged  = "room_host_changed"
+	EventRoomLocked       = "room_locked"
+	EventRoomUnlocked     = "room_unlocked"
+	EventPeerKicked       = "peer_kicked"
+	EventPeerMuted        = "peer_muted"
+	EventPeerUnmuted      = "peer_unmuted"
+	EventMessageRelayed   = "message_relayed"
+)
+
+// eventBufferSize is how far a subscriber may fall behind before events are
+// dropped for it.
+const eventBufferSize = 256
+
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+var events = &eventBus{subs: make(map[chan Event]struct{})}
+
+func (b *eventBus) subscribe() chan Event {
+	ch := make(chan Event, eventBufferSize)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[ch] = struct{}{}
+	return ch
+}
+
+func (b *eventBus) unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, ch)
+}
+
+// close ends every subscription, on Shutdown.
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		close(ch)
+		delete(b.subs, ch)
+	}
+}
+
+// publish hands e to every subscriber without waiting on slow ones.
+func (b *eventBus) publish(e Event) {
+	e.Time = time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// eventFilter narrows a stream to some event types, a peer or a room. Empty
+// fields match everything.
+type eventFilter struct {
+	types map[string]bool
+	uuid  string
+	room  string
+}
+
+func parseEventFilter(ctx *gin.Context) eventFilter {
+	f := eventFilter{uuid: ctx.Query("uuid"), room: ctx.Query("room")}
+	if types := ctx.Query("types"); types != "" {
+		f.types = map[string]bool{}
+		for _, t := range strings.Split(types, ",") {
+			f.types[strings.TrimSpace(t)] = true
+		}
+	}
+	return f
+}
+
+func (f eventFilter) Match(e Event) bool {
+	if f.types != nil && !f.types[e.Type] {
+		return false
+	}
+	if f.uuid != "" && e.UUID != f.uuid && e.To != f.uuid {
+		return false
+	}
+	return f.room == "" || e.Room == f.room
+}
+
+// streamEvents serves /ws/events, sending each matching event to an admin
+// websocket as a line of JSON.
+func streamEvents(ctx *gin.Context) {
+	filter := parseEventFilter(ctx)
+	c, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error upgrading connection")
+		return
+	}
+	t := newTransport(c)
+	defer t.Close()
+
+	ch := events.subscribe()
+	defer events.unsubscribe(ch)
+
+	// Nothing is read from the client, but reading notices when it goes away.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-gone:
+			return
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !filter.Match(e) {
+				continue
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				reqLog(ctx).Err(err).Msg("Error encoding event")
+				continue
+			}
+			if err := t.WriteText(b); err != nil {
+				reqLog(ctx).Err(err).Msg("Error writing event")
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Feature flags switch behaviors on or off per tenant, so a new one can be
+// tried on a few tenants before everybody gets it. --features sets them for
+// every tenant and --tenant-features overrides them for some; both can be
+// changed by a config reload. Clients asking for a feature that is off get
+// a feature_disabled error, and it is left out of their capabilities.
+
+// features are the known flags and whether they are on unless configured.
+var features = map[string]bool{
+	"matchmaking":    true,
+	"nat_probe":      true,
+	"privacy_mode":   true,
+	"rendezvous":     true,
+	"reports":        true,
+	"room_directory": true,
+}
+
+var (
+	// featureDefaults are --features over the built in defaults.
+	featureDefaults = map[string]bool{}
+	// tenantFeatures are --tenant-features, by tenant.
+	tenantFeatures = map[string]map[string]bool{}
+)
+
+// parseFeatures parses a list such as matchmaking=off,reports; a bare name
+// is on.
+func parseFeatures(list string) (map[string]bool, error) {
+	set := map[string]bool{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		name, value, hasValue := strings.Cut(item, "=")
+		if _, ok := features[name]; !ok {
+			return nil, fmt.Errorf("Unknown feature %q", name)
+		}
+		switch {
+		case !hasValue || value == "on":
+			set[name] = true
+		case value == "off":
+			set[name] = false
+		default:
+			return nil, fmt.Errorf("Invalid feature setting %q, want on or off", item)
+		}
+	}
+	return set, nil
+}
+
+// parseTenantFeatures parses --tenant-features, such as
+// chess:matchmaking=on;go:reports=off,rendezvous=off. The default tenant
+// is written as "default".
+func parseTenantFeatures(list string) (map[string]map[string]bool, error) {
+	sets := map[string]map[string]bool{}
+	for _, pair := range strings.Split(list, ";") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		tenant, items, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("Invalid tenant features %q", pair)
+		}
+		if tenant == "default" {
+			tenant = ""
+		} else if !tenantPattern.MatchString(tenant) {
+			return nil, fmt.Errorf("Invalid tenant name %q", tenant)
+		}
+		set, err := parseFeatures(items)
+		if err != nil {
+			return nil, err
+		}
+		sets[tenant] = set
+	}
+	return sets, nil
+}
+
+// initFeatures parses --features and --tenant-features. settingsMu must be
+// held, or the server not started yet.
+func initFeatures() error {
+	defaults, err := parseFeatures(*featuresFlag)
+	if err != nil {
+		return err
+	}
+	tenants, err := parseTenantFeatures(*tenantFeaturesFlag)
+	if err != nil {
+		return err
+	}
+	featureDefaults, tenantFeatures = defaults, tenants
+	return nil
+}
+
+// featureEnabled reports whether feature is on for tenant.
+func featureEnabled(tenant string, feature string) bool {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	if on, ok := tenantFeatures[tenant][feature]; ok {
+		return on
+	}
+	if on, ok := featureDefaults[feature]; ok {
+		return on
+	}
+	return features[feature]
+}
+
+// listFeatures serves GET /admin/features, the flags of ?tenant= or the
+// default tenant.
+func listFeatures(ctx *gin.Context) {
+	tenant := ctx.Query("tenant")
+	if tenant == "default" {
+		tenant = ""
+	}
+	states := map[string]bool{}
+	for name := range features {
+		states[name] = featureEnabled(tenant, name)
+	}
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok", "tenant": tenantLabel(tenant), "features": states})
+}
+
+// abortFeatureDisabled is the HTTP error for a feature that is off.
+func abortFeatureDisabled(ctx *gin.Context, feature string) {
+	abortError(ctx, http.StatusForbidden, "feature_disabled", "feature disabled", gin.H{"feature": feature})
+}
+
+// requireFeature sends s a feature_disabled error if feature is off for its
+// tenant, and reports whether it is on.
+func (s *Session) requireFeature(feature string) (bool, error) {
+	if featureEnabled(s.tenant, feature) {
+		return true, nil
+	}
+	return false, s.reject("feature_disabled", "feature disabled", gin.H{"feature": feature})
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"net"
+
+	"github.com/hoyle1974/seven/internal/registry"
+	"github.com/oschwald/geoip2-golang"
+)
+
+var geoDB *geoip2.Reader
+
+// initGeoIP opens a MaxMind City or Country database. Without one peers are
+// picked at random.
+func initGeoIP(path string) error {
+	if path == "" {
+		return nil
+	}
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return err
+	}
+	geoDB = db
+	return nil
+}
+
+func lookupLocation(ip string) *registry.Location {
+	if geoDB == nil {
+		return nil
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+	rec, err := geoDB.Country(parsed)
+	if err != nil || (rec.Continent.Code == "" && rec.Country.IsoCode == "") {
+		return nil
+	}
+	return &registry.Location{Continent: rec.Continent.Code, Country: rec.Country.IsoCode}
+}
+
+// pickNearby prefers peers in the same country, then the same continent,
+// picking at random within each group and from everyone else after that.
+func pickNearby(values []registry.Entry, loc *registry.Location, amount int) []EntryForm {
+	if loc == nil {
+		return pickSome(values, amount)
+	}
+
+	var country, continent, rest []registry.Entry
+	for _, e := range values {
+		switch {
+		case e.Location == nil:
+			rest = append(rest, e)
+		case loc.Country != "" && e.Location.Country == loc.Country:
+			country = append(country, e)
+		case loc.Continent != "" && e.Location.Continent == loc.Continent:
+			continent = append(continent, e)
+		default:
+			rest = append(rest, e)
+		}
+	}
+
+	picked := make([]EntryForm, 0)
+	for _, group := range [][]registry.Entry{country, continent, rest} {
+		if len(picked) >= amount {
+			break
+		}
+		picked = append(picked, pickSome(group, amount-len(picked))...)
+	}
+	return picked
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// offerTracker remembers the offers in flight between pairs of peers, from
+// the offer until its answer or --glare-window, to spot glare: two peers
+// offering to each other at once.
+type offerTracker struct {
+	mu      sync.Mutex
+	pending map[[2]string]time.Time // from, to
+	purged  time.Time
+}
+
+var offers = &offerTracker{pending: make(map[[2]string]time.Time)}
+
+// offer records an offer from from to to unless to has one of its own to
+// from in flight, which is glare. Then the impolite peer's offer wins, as
+// in perfect negotiation: an impolite from replaces to's offer, a polite
+// from's is not recorded.
+func (t *offerTracker) offer(from string, to string, now time.Time) (glare bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.purge(now)
+	reverse := [2]string{to, from}
+	if at, ok := t.pending[reverse]; ok && now.Sub(at) < *glareWindow {
+		if politeTowards(from, to) {
+			return true
+		}
+		delete(t.pending, reverse)
+		glare = true
+	}
+	t.pending[[2]string{from, to}] = now
+	return glare
+}
+
+// answered forgets the offer from to to from that from answered.
+func (t *offerTracker) answered(from string, to string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, [2]string{to, from})
+}
+
+// purge drops offers older than --glare-window, once per window. t.mu must
+// be held.
+func (t *offerTracker) purge(now time.Time) {
+	if now.Sub(t.purged) < *glareWindow {
+		return
+	}
+	t.purged = now
+	for pair, at := range t.pending {
+		if now.Sub(at) >= *glareWindow {
+			delete(t.pending, pair)
+		}
+	}
+}
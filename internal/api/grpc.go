@@ -0,0 +1,438 @@
+package api
+
+//go:generate buf generate --template buf.gen.yaml --path sevenpb/seven.proto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/hoyle1974/seven/internal/registry"
+	"github.com/hoyle1974/seven/internal/ws"
+	"github.com/hoyle1974/seven/sevenpb"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// newGRPCServer serves the Signaling service with the same authentication,
+// limits and TLS certificate as the HTTP endpoints.
+func newGRPCServer() (*grpc.Server, error) {
+	opts := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(int(*maxMessageSize)),
+		grpc.ChainUnaryInterceptor(grpcUnaryAuth),
+		grpc.ChainStreamInterceptor(grpcStreamAuth),
+	}
+	switch {
+	case *autocertDomain != "":
+		opts = append(opts, grpc.Creds(credentials.NewTLS(certManager().TLSConfig())))
+	case *tlsCert != "":
+		creds, err := credentials.NewServerTLSFromFile(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	srv := grpc.NewServer(opts...)
+	sevenpb.RegisterSignalingServer(srv, &grpcSignaling{})
+	return srv, nil
+}
+
+type grpcContextKey int
+
+const (
+	grpcSubjectKey grpcContextKey = iota
+	grpcAPIKeyKey
+	grpcTenantKey
+	grpcClaimsKey
+)
+
+func grpcSubject(ctx context.Context) string {
+	sub, _ := ctx.Value(grpcSubjectKey).(string)
+	return sub
+}
+
+func grpcClaims(ctx context.Context) map[string]any {
+	claims, _ := ctx.Value(grpcClaimsKey).(map[string]any)
+	return claims
+}
+
+func grpcTenant(ctx context.Context) string {
+	tenant, _ := ctx.Value(grpcTenantKey).(string)
+	return tenant
+}
+
+func grpcObserved(ctx context.Context) ObservedAddress {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ObservedAddress{}
+	}
+	host, port, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return ObservedAddress{IP: p.Addr.String()}
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	obs := ObservedAddress{IP: forwardedIP(host, func(key string) string {
+		return strings.Join(md.Get(key), ",")
+	})}
+	if obs.IP == host {
+		obs.Port, _ = strconv.Atoi(port)
+	}
+	return obs
+}
+
+// grpcRequestID is the call's x-request-id metadata, or a new id.
+func grpcRequestID(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get("x-request-id"); len(v) > 0 && v[0] != "" && len(v[0]) <= 128 {
+		return v[0]
+	}
+	return uuid.NewString()
+}
+
+// grpcAuthenticate applies the per IP rate limit, API key and bearer token
+// checks of the HTTP middleware to a call's metadata.
+func grpcAuthenticate(ctx context.Context) (context.Context, error) {
+	if ok, _ := ipLimits.allow(grpcObserved(ctx).IP); !ok {
+		return nil, status.Error(codes.ResourceExhausted, "rate limited")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	var key *APIKey
+	if *requireAPIKeys {
+		k, err := authenticateAPIKey(ctx, first("x-api-key"))
+		switch err {
+		case nil:
+			ctx = context.WithValue(ctx, grpcAPIKeyKey, k)
+			key = &k
+		case errMissingAPIKey, errInvalidAPIKey:
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		case errRequestQuota:
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		default:
+			log.Err(err).Msg("Error looking up api key")
+			return nil, status.Error(codes.Internal, "error")
+		}
+	}
+	tenant, err := pickTenant(first("x-seven-tenant"), key)
+	switch err {
+	case nil:
+		ctx = context.WithValue(ctx, grpcTenantKey, tenant)
+	case errTenantMismatch:
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	default:
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	if jwtKeyfunc != nil {
+		sub, claims, err := tokenSubject(strings.TrimPrefix(first("authorization"), "Bearer "))
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, "unauthorized")
+		}
+		ctx = context.WithValue(ctx, grpcSubjectKey, sub)
+		ctx = context.WithValue(ctx, grpcClaimsKey, claims)
+	}
+	return ctx, nil
+}
+
+func grpcUnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := checkBanned(grpcObserved(ctx).IP, ""); err != nil {
+		return nil, status.Error(codes.PermissionDenied, "banned")
+	}
+	authed, err := grpcAuthenticate(ctx)
+	if err != nil {
+		auditGRPCRejection(ctx, err)
+		strikeGRPC(ctx, err)
+		return nil, err
+	}
+	return handler(authed, req)
+}
+
+type authedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authedStream) Context() context.Context { return s.ctx }
+
+func grpcStreamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := checkBanned(grpcObserved(ss.Context()).IP, ""); err != nil {
+		return status.Error(codes.PermissionDenied, "banned")
+	}
+	ctx, err := grpcAuthenticate(ss.Context())
+	if err != nil {
+		auditGRPCRejection(ss.Context(), err)
+		strikeGRPC(ss.Context(), err)
+		return err
+	}
+	if k, ok := ctx.Value(grpcAPIKeyKey).(APIKey); ok {
+		if !quotas.acquireConn(k) {
+			return status.Error(codes.ResourceExhausted, "connection quota exceeded")
+		}
+		defer quotas.releaseConn(k)
+	}
+	return handler(srv, authedStream{ServerStream: ss, ctx: ctx})
+}
+
+func entriesToProto(entries []EntryForm) []*sevenpb.Entry {
+	out := make([]*sevenpb.Entry, len(entries))
+	for i, e := range entries {
+		out[i] = &sevenpb.Entry{
+			Uuid:        e.Uuid,
+			Addr:        e.Address,
+			Addrs:       addressesToProto(e.Addrs),
+			Tags:        e.Tags,
+			Polite:      e.Polite,
+			Metadata:    e.Metadata,
+			SameNetwork: e.SameNetwork,
+			Nat:         e.NAT,
+		}
+	}
+	return out
+}
+
+func addressesToProto(addrs []registry.Address) []*sevenpb.PeerAddress {
+	out := make([]*sevenpb.PeerAddress, len(addrs))
+	for i, a := range addrs {
+		out[i] = &sevenpb.PeerAddress{Addr: a.Addr, Kind: a.Kind, Transport: a.Transport, Priority: int32(a.Priority)}
+	}
+	return out
+}
+
+func addressesFromProto(addrs []*sevenpb.PeerAddress) []registry.Address {
+	out := make([]registry.Address, len(addrs))
+	for i, a := range addrs {
+		out[i] = registry.Address{Addr: a.Addr, Kind: a.Kind, Transport: a.Transport, Priority: int(a.Priority)}
+	}
+	return out
+}
+
+type grpcSignaling struct {
+	sevenpb.UnimplementedSignalingServer
+}
+
+func (g *grpcSignaling) Register(ctx context.Context, req *sevenpb.RegisterRequest) (*sevenpb.RegisterResponse, error) {
+	form := EntryForm{
+		Uuid:      req.Uuid,
+		Address:   req.Addr,
+		Addrs:     addressesFromProto(req.Addrs),
+		Tags:      req.Tags,
+		Filter:    req.Filter,
+		Count:     int(req.Count),
+		Cursor:    req.Cursor,
+		Exclude:   req.Exclude,
+		UuidToken: req.UuidToken,
+		Metadata:  req.Metadata,
+	}
+	if err := requireUUID(form); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	uuidToken, err := claimUUID(ctx, &form, "")
+	if err == errUUIDNotAssigned {
+		auditEvent("auth_failed", form.Uuid, grpcObserved(ctx).IP).Str("reason", "invalid uuid_token").Send()
+		strike(grpcObserved(ctx).IP, "invalid uuid_token")
+		return nil, status.Error(codes.PermissionDenied, "missing or invalid uuid_token")
+	} else if err != nil {
+		log.Err(err).Msg("Error assigning uuid")
+		return nil, status.Error(codes.Internal, "error assigning uuid")
+	}
+	if !subjectAllows(grpcSubject(ctx), form.Uuid) {
+		return nil, status.Error(codes.PermissionDenied, "uuid does not match token subject")
+	}
+	if ok, _ := peerLimits.allow(form.Uuid); !ok {
+		return nil, status.Error(codes.ResourceExhausted, "rate limited")
+	}
+	if grpcCaptchaNeeded(ctx) {
+		// RegisterRequest has no field for it, so the token comes as metadata.
+		md, _ := metadata.FromIncomingContext(ctx)
+		if v := md.Get("x-captcha-token"); len(v) > 0 {
+			form.CaptchaToken = v[0]
+		}
+		if err := checkCaptcha(ctx, form, grpcObserved(ctx).IP); err != nil {
+			code, _, reason := captchaRejection(err)
+			if code == http.StatusForbidden {
+				return nil, status.Error(codes.PermissionDenied, reason)
+			}
+			return nil, status.Error(codes.Unavailable, reason)
+		}
+	}
+
+	observed := grpcObserved(ctx)
+	entries, next, err := registerJSON(ctx, grpcTenant(ctx), grpcClaims(ctx), form, observed)
+	var refused *RefusedError
+	var addrErr *AddressError
+	var formErr *FormError
+	var full *TenantFullError
+	if errors.As(err, &full) {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if err == errOtherTenant || err == errBanned || errors.As(err, &refused) {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	if errors.As(err, &addrErr) || errors.As(err, &formErr) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		log.Err(err).Msg("Error registering over grpc")
+		return nil, status.Error(codes.Internal, "error")
+	}
+
+	resp := &sevenpb.RegisterResponse{
+		Entries:  entriesToProto(entries),
+		Next:     next,
+		Observed: &sevenpb.ObservedAddress{Ip: observed.IP, Port: int32(observed.Port)},
+	}
+	if uuidToken != "" {
+		resp.Uuid, resp.UuidToken = form.Uuid, uuidToken
+	}
+	if turnEnabled() {
+		c := newTurnCredentials(form.Uuid, time.Now())
+		resp.Turn = &sevenpb.TurnCredentials{Username: c.Username, Password: c.Password, Ttl: int32(c.TTL), Uris: c.URIs}
+	}
+	return resp, nil
+}
+
+func (g *grpcSignaling) Discover(ctx context.Context, req *sevenpb.DiscoverRequest) (*sevenpb.DiscoverResponse, error) {
+	self, _ := uuid.Parse(req.Uuid)
+	form := EntryForm{
+		Filter:  req.Filter,
+		Count:   int(req.Count),
+		Cursor:  req.Cursor,
+		Exclude: req.Exclude,
+	}
+	ip := grpcObserved(ctx).IP
+	entries, next, err := selectEntries(ctx, grpcTenant(ctx), form, self, ip, lookupLocation(ip))
+	var formErr *FormError
+	if errors.As(err, &formErr) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		log.Err(err).Msg("Error discovering over grpc")
+		return nil, status.Error(codes.Internal, "error")
+	}
+	return &sevenpb.DiscoverResponse{Entries: entriesToProto(entries), Next: next}, nil
+}
+
+// grpcTransport delivers envelopes on a Signal stream. Closing it ends the
+// stream with a status carrying the websocket close code.
+type grpcTransport struct {
+	stream  sevenpb.Signaling_SignalServer
+	closing chan struct{}
+	once    sync.Once
+	code    int
+	reason  string
+}
+
+func (t *grpcTransport) WriteMessage(msg ws.Message) error {
+	return t.stream.Send(msg.ToProto())
+}
+
+func (t *grpcTransport) CloseWith(code int, reason string) error {
+	t.once.Do(func() {
+		t.code, t.reason = code, reason
+		close(t.closing)
+	})
+	return nil
+}
+
+func (t *grpcTransport) Close() error {
+	return t.CloseWith(websocket.CloseGoingAway, "closed")
+}
+
+func (t *grpcTransport) status() error {
+	t.stream.SetTrailer(metadata.Pairs("seven-close-code", strconv.Itoa(t.code)))
+	switch t.code {
+	case ws.CloseDeregistered:
+		return nil
+	case ws.CloseServerDraining, ws.CloseTimeout:
+		return status.Error(codes.Unavailable, t.reason)
+	case ws.CloseAuthFailed:
+		return status.Error(codes.Unauthenticated, t.reason)
+	case ws.CloseRateLimited:
+		return status.Error(codes.ResourceExhausted, t.reason)
+	case ws.CloseDuplicateUUID:
+		return status.Error(codes.AlreadyExists, t.reason)
+	case ws.CloseBanned:
+		return status.Error(codes.PermissionDenied, t.reason)
+	default:
+		return status.Error(codes.Aborted, t.reason)
+	}
+}
+
+func (g *grpcSignaling) Signal(stream sevenpb.Signaling_SignalServer) error {
+	ctx := stream.Context()
+	t := &grpcTransport{stream: stream, closing: make(chan struct{})}
+	s := &Session{t: t, tenant: grpcTenant(ctx), subject: grpcSubject(ctx), claims: grpcClaims(ctx), observed: grpcObserved(ctx), captcha: grpcCaptchaNeeded(ctx), resumable: true}
+	s.setRequestID(grpcRequestID(ctx))
+	stream.SetHeader(metadata.Pairs("x-request-id", s.requestID))
+	connections.Open(s)
+	rolling.opened()
+	defer connections.Close(s)
+	defer endSession(s, "disconnected")
+
+	// Recv blocks, so it runs on its own goroutine and everything else,
+	// including dispatch, stays on this one.
+	envelopes := make(chan *sevenpb.Envelope)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			env, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case envelopes <- env:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var flood messageLimiter
+	for !s.done {
+		select {
+		case <-t.closing:
+			return t.status()
+		case err := <-recvErr:
+			log.Debug().Err(err).Msg("Signal stream ended")
+			return nil
+		case env := <-envelopes:
+			if !flood.allow() {
+				log.Warn().Str("uuid", s.uuid).Str("ip", s.observed.IP).Msg("Disconnecting flooding client")
+				auditEvent("rate_limited", s.uuid, s.observed.IP).Str("reason", "message rate exceeded").Send()
+				t.CloseWith(ws.CloseRateLimited, "message rate exceeded")
+				return t.status()
+			}
+			msg := ws.MessageFromProto(env)
+			if len(msg.Payload) > 0 && !json.Valid(msg.Payload) {
+				if err := s.sendError("invalid_payload", "error parsing payload"); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := dispatch(s, msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hellofresh/health-go/v5"
+)
+
+const readinessTimeout = 2 * time.Second
+
+var errDraining = errors.New("Server is draining")
+
+// draining is set once shutdown starts, so /readyz takes the instance out
+// of rotation while its clients are moved elsewhere.
+var draining atomic.Bool
+
+// pinger is implemented by the backends that talk to a server of their own.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// liveness only answers whether the process is serving at all; restarting
+// would not fix a broken dependency.
+func liveness(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// newReadiness checks what the instance needs to take new clients: the
+// registry, relay and room store backends, and that it is not shutting down.
+func newReadiness() (*health.Health, error) {
+	checks := []health.Config{{
+		Name: "draining",
+		Check: func(ctx context.Context) error {
+			if draining.Load() {
+				return errDraining
+			}
+			return nil
+		},
+	}}
+	if r, ok := peerRegistry.(tracedRegistry); ok {
+		if p, ok := r.next.(pinger); ok {
+			checks = append(checks, health.Config{Name: "registry", Timeout: readinessTimeout, Check: p.Ping})
+		}
+	}
+	if p, ok := connections.Relay().(pinger); ok {
+		checks = append(checks, health.Config{Name: "relay", Timeout: readinessTimeout, Check: p.Ping})
+	}
+	if roomStore != nil {
+		checks = append(checks, health.Config{Name: "room_store", Timeout: readinessTimeout, Check: roomStore.Ping})
+	}
+	return health.New(
+		health.WithComponent(health.Component{
+			Name:    "Seven",
+			Version: "v0.1",
+		}),
+		health.WithChecks(checks...))
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hoyle1974/seven/internal/hub"
+	"github.com/hoyle1974/seven/internal/registry"
+	"github.com/hoyle1974/seven/internal/ws"
+)
+
+// Hooks let a program embedding the server take part in signaling. Any of
+// them may be nil.
+//
+// The registry, hub and rooms, whether the server's own or given here, are
+// package globals like the rest of its state rather than fields of Server.
+// That is why a process runs one Server at a time.
+type Hooks struct {
+	// OnRegister is called before a peer's entry is stored. An error refuses
+	// the registration.
+	OnRegister func(ctx context.Context, e registry.Entry) error
+	// OnRelay is called before an offer, answer or candidate is passed on.
+	// An error refuses to pass it on.
+	OnRelay func(ctx context.Context, msg ws.Message) error
+	// Authorizer decides whether peers may do what they ask.
+	Authorizer Authorizer
+
+	// Registry replaces the one --registry selects. API keys and bans are
+	// then kept in memory.
+	Registry registry.Registry
+	// Hub replaces the server's own, which --duplicate-uuid, tenant limits
+	// and resumable sessions are built into.
+	Hub Hub
+	// Rooms replaces the server's own, a RoomManager. Snapshots and
+	// --room-store=etcd need that one.
+	Rooms Rooms
+}
+
+var hooks Hooks
+
+// Kinds of Action.
+const (
+	ActionRegister  = "register"
+	ActionJoin      = "join"      // join_room
+	ActionRelay     = "relay"     // offer, answer or candidate
+	ActionDirect    = "direct"    // a room message to one member
+	ActionBroadcast = "broadcast" // a room message to every member
+)
+
+// Action is something a peer asks to do.
+type Action struct {
+	Kind   string
+	UUID   string
+	Tenant string
+	// Room is the room to join, or the room the sender of a relay is in.
+	Room string
+	// To is the uuid a relay or direct message is for.
+	To string
+	// Claims are those of the peer's bearer token, nil without --jwt-secret
+	// or --jwt-jwks-url.
+	Claims map[string]any
+}
+
+// Authorizer is asked about every Action. An error refuses it, the error's
+// message being passed on to the peer.
+type Authorizer interface {
+	Authorize(ctx context.Context, a Action) error
+}
+
+// RefusedError is a hook refusing what a peer asked.
+type RefusedError struct {
+	Err error
+}
+
+func (e *RefusedError) Error() string {
+	return "Refused: " + e.Err.Error()
+}
+
+func (e *RefusedError) Unwrap() error {
+	return e.Err
+}
+
+// details are the error details clients get for the error.
+func (e *RefusedError) details() gin.H {
+	return gin.H{"reason": e.Err.Error()}
+}
+
+func authorize(ctx context.Context, a Action) error {
+	if hooks.Authorizer == nil {
+		return nil
+	}
+	if err := hooks.Authorizer.Authorize(ctx, a); err != nil {
+		return &RefusedError{err}
+	}
+	return nil
+}
+
+// registerAllowed consults the Authorizer and OnRegister about e.
+func registerAllowed(ctx context.Context, e registry.Entry, claims map[string]any) error {
+	if err := authorize(ctx, Action{Kind: ActionRegister, UUID: e.UUID.String(), Tenant: e.Tenant, Claims: claims}); err != nil {
+		return err
+	}
+	if hooks.OnRegister != nil {
+		if err := hooks.OnRegister(ctx, e); err != nil {
+			return &RefusedError{err}
+		}
+	}
+	return nil
+}
+
+// dataAllowed consults the Authorizer about s sending the room message msg.
+func dataAllowed(ctx context.Context, s *Session, msg ws.Message) error {
+	a := Action{Kind: ActionBroadcast, UUID: s.uuid, Tenant: s.tenant, Room: msg.Room, Claims: s.claims}
+	if msg.Type == ws.MsgDirect {
+		a.Kind = ActionDirect
+		a.To, _ = hub.SplitDevice(msg.To)
+	}
+	return authorize(ctx, a)
+}
+
+// relayAllowed consults the Authorizer and OnRelay about s sending msg.
+func relayAllowed(ctx context.Context, s *Session, msg ws.Message) error {
+	to, _ := hub.SplitDevice(msg.To)
+	if err := authorize(ctx, Action{Kind: ActionRelay, UUID: s.uuid, Tenant: s.tenant, Room: msg.Room, To: to, Claims: s.claims}); err != nil {
+		return err
+	}
+	if hooks.OnRelay != nil {
+		if err := hooks.OnRelay(ctx, msg); err != nil {
+			return &RefusedError{err}
+		}
+	}
+	return nil
+}
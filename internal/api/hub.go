@@ -0,0 +1,85 @@
+package api
+
+import (
+	"context"
+
+	"github.com/gorilla/websocket"
+	"github.com/hoyle1974/seven/internal/hub"
+	"github.com/hoyle1974/seven/internal/ws"
+)
+
+// Hub holds the sessions connected to an instance and delivers messages to
+// them, through the relay for those connected elsewhere. It is a
+// *hub.Hub[*Session] unless Hooks.Hub replaces it.
+type Hub interface {
+	Open(s *Session)
+	Close(s *Session)
+	Drain(ctx context.Context, code int, reason string)
+	OpenCount() int
+	OpenSessions() []*Session
+	SetRelay(r hub.Relay)
+	Relay() hub.Relay
+	Add(s *Session) error
+	Remove(s *Session) bool
+	RemoveSession(s *Session) (removed bool, last bool)
+	TenantCounts() map[string]int
+	Lookup(addr string) (*Session, bool)
+	Sessions(uuid string) []*Session
+	Count() int
+	SessionCount() int
+	Send(addr string, msg ws.Message) error
+	SendPrepared(addr string, p *ws.Prepared) error
+	DeliverLocal(addr string, msg ws.Message)
+}
+
+// connections holds the sessions connected to this instance, for the one
+// Server running.
+var connections Hub
+
+func initConnections() {
+	if hooks.Hub != nil {
+		connections = hooks.Hub
+		return
+	}
+	connections = hub.New[*Session](hub.Options{
+		Duplicates:    *duplicateUUID,
+		TenantLimit:   tenantLimit,
+		Park:          resumes.enqueue,
+		Admit:         admitRelayed,
+		OnTenantCount: setTenantPeers,
+		Log:           relayLog,
+	})
+}
+
+// admitRelayed refuses signals another instance relayed to a peer that is not
+// in the room they were sent from. The sending instance only knows the rooms
+// of its own peers, so it leaves this to the one the peer is connected to.
+func admitRelayed(addr string, msg ws.Message) bool {
+	switch msg.Type {
+	case ws.MsgOffer, ws.MsgAnswer, ws.MsgCandidate, ws.MsgDirect, ws.MsgDelivered:
+	default:
+		return true
+	}
+	uuid, _ := hub.SplitDevice(addr)
+	if rooms.RoomOf(uuid) == msg.Room || rooms.Departed(uuid, msg.Room) {
+		return true
+	}
+	if msg.Type != ws.MsgDelivered {
+		// Not on the relay's delivery path, which the notice may need.
+		go notifyUndelivered([]ws.Message{msg}, "not in room")
+	}
+	return false
+}
+
+// newTransport wraps an upgraded websocket as the flags configure.
+func newTransport(c *websocket.Conn) *ws.Transport {
+	return ws.NewTransport(c, ws.Options{
+		SendQueue:            *sendQueue,
+		WriteTimeout:         *writeTimeout,
+		PingInterval:         *pingInterval,
+		Compression:          *compression,
+		CompressionLevel:     *compressionLevel,
+		CompressionThreshold: *compressionThreshold,
+		OnSlow:               metricSlowClients.Inc,
+	})
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+// With --assign-uuids the server picks peer uuids instead of trusting the
+// client. Registering without a uuid mints one and returns it with a
+// uuid_token, an HMAC of the uuid, which the client must present to register
+// as (or poll, stream or deregister) that uuid again. Bearer tokens already
+// bind the uuid to their subject, so the mode is ignored when they are on.
+const mintAttempts = 5
+
+var errUUIDNotAssigned = errors.New("Uuid was not assigned to this client")
+var errMissingUUID = errors.New("Uuid is required")
+
+var uuidKey []byte
+
+func assigningUUIDs() bool {
+	return *assignUUIDs && jwtKeyfunc == nil
+}
+
+// initUUIDSecret sets the key uuid tokens are signed with. Without a secret a
+// random key is used and tokens stop working when the server restarts.
+func initUUIDSecret(secret string) error {
+	if !assigningUUIDs() {
+		return nil
+	}
+	if secret != "" {
+		uuidKey = []byte(secret)
+		return nil
+	}
+	uuidKey = make([]byte, 32)
+	if _, err := rand.Read(uuidKey); err != nil {
+		return fmt.Errorf("Error generating uuid secret: %w", err)
+	}
+	log.Warn().Msg("No --uuid-secret set, assigned uuids will not survive a restart")
+	return nil
+}
+
+func uuidToken(id string) string {
+	mac := hmac.New(sha256.New, uuidKey)
+	mac.Write([]byte(id))
+	return "ut_" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// uuidAllowed reports whether a client presenting token may act as id.
+func uuidAllowed(id string, token string) bool {
+	return !assigningUUIDs() || hmac.Equal([]byte(uuidToken(id)), []byte(token))
+}
+
+// requireUUID refuses a registration without a uuid, unless the server is
+// to assign one.
+func requireUUID(form EntryForm) error {
+	if form.Uuid == "" && !assigningUUIDs() {
+		return &FormError{Code: "invalid_uuid", Field: "uuid", Err: errMissingUUID}
+	}
+	return nil
+}
+
+// claimUUID checks the uuid a registration asks for, minting one when it is
+// empty. current is a uuid the caller already holds, which needs no token.
+// It returns the uuid_token to hand back, if any.
+func claimUUID(ctx context.Context, form *EntryForm, current string) (string, error) {
+	if !assigningUUIDs() {
+		return "", nil
+	}
+	if form.Uuid == "" {
+		id, err := mintUUID(ctx)
+		if err != nil {
+			return "", err
+		}
+		form.Uuid = id
+	} else if form.Uuid != current && !uuidAllowed(form.Uuid, form.UuidToken) {
+		return "", errUUIDNotAssigned
+	}
+	return uuidToken(form.Uuid), nil
+}
+
+// mintUUID picks a random uuid nobody is registered or connected as.
+func mintUUID(ctx context.Context) (string, error) {
+	for i := 0; i < mintAttempts; i++ {
+		id := uuid.NewString()
+		_, taken, err := peerRegistry.Get(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		if !taken && len(connections.Sessions(id)) == 0 {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("No unused uuid after %d attempts", mintAttempts)
+}
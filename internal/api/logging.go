@@ -0,0 +1,64 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// relayLog is used on the relay path, which logs for every signal passed
+// on. With --log-sample it only lets that many messages a second through.
+var relayLog = log.Logger
+
+// initLogging sets up the global logger from --log-level, --log-format and
+// --log-sample.
+func initLogging(level string, format string, sample int) error {
+	lvl, err := zerolog.ParseLevel(level)
+	if err != nil || level == "" {
+		return fmt.Errorf("Unknown log level %q", level)
+	}
+	switch format {
+	case "console":
+		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	case "json":
+		log.Logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+	default:
+		return fmt.Errorf("Unknown log format %q", format)
+	}
+	zerolog.SetGlobalLevel(lvl)
+	relayLog = log.Logger
+	if sample > 0 {
+		relayLog = log.Logger.Sample(&zerolog.BurstSampler{Burst: uint32(sample), Period: time.Second})
+	}
+	return nil
+}
+
+func getLogLevel(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok", "level": zerolog.GlobalLevel().String()})
+}
+
+// setLogLevel changes the log level until the next restart.
+func setLogLevel(ctx *gin.Context) {
+	var form struct {
+		Level string `json:"level" binding:"required"`
+	}
+	if err := ctx.BindJSON(&form); err != nil {
+		respondError(ctx, http.StatusNotAcceptable, "invalid_json", "error parsing json", nil)
+		return
+	}
+	lvl, err := zerolog.ParseLevel(form.Level)
+	if err != nil {
+		respondError(ctx, http.StatusNotAcceptable, "unknown_level", "unknown level", nil)
+		return
+	}
+	previous := zerolog.GlobalLevel()
+	zerolog.SetGlobalLevel(lvl)
+	log.Info().Str("from", previous.String()).Str("to", lvl.String()).Msg("Changed log level")
+	auditRequest(ctx, "log_level_changed").Str("from", previous.String()).Str("to", lvl.String()).Send()
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok", "level": lvl.String()})
+}
@@ -0,0 +1,261 @@
+// Package api is the Seven server: its flags, HTTP routes and the handlers
+// of the signaling protocol.
+package api
+
+import (
+	_ "embed"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/hoyle1974/seven/internal/registry"
+	"github.com/hoyle1974/seven/internal/ws"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+//go:embed index.html
+var indexHtml string
+var homeTemplate = template.Must(template.New("").Parse(indexHtml))
+
+//go:embed client.js
+var clientJS string
+var clientTemplate = template.Must(template.New("").Parse(clientJS))
+
+//go:embed admin.html
+var adminHTML []byte
+
+//go:embed swagger.html
+var swaggerHTML []byte
+
+var upgrader = websocket.Upgrader{Subprotocols: []string{ws.SubprotocolJSON, ws.SubprotocolJSONBatch, ws.SubprotocolProto}}
+
+type EntryForm struct {
+	Uuid    string            `form:"uuid" json:"uuid"`
+	Address string            `form:"addr" json:"addr"`
+	Tags    map[string]string `form:"tags" json:"tags,omitempty"`
+	Filter  string            `form:"filter" json:"filter,omitempty"`
+	Count   int               `form:"count" json:"count,omitempty"`
+	Cursor  *string           `form:"cursor" json:"cursor,omitempty"`
+	Exclude []string          `form:"exclude" json:"exclude,omitempty"`
+	Device  string            `form:"device" json:"device,omitempty"`
+
+	// Addrs lists every address the peer can be reached on; Address is the
+	// preferred one.
+	Addrs []registry.Address `form:"-" json:"addrs,omitempty"`
+
+	// Metadata is an opaque JSON object stored with the entry, such as a
+	// display name or game version.
+	Metadata json.RawMessage `form:"-" json:"metadata,omitempty"`
+
+	// UuidToken proves the uuid was assigned to the client, see claimUUID.
+	UuidToken string `form:"uuid_token" json:"uuid_token,omitempty"`
+	// CaptchaToken is the response of a captcha widget, see checkCaptcha.
+	CaptchaToken string `form:"captcha_token" json:"captcha_token,omitempty"`
+
+	// Polite is only set on entries the server returns: whether the peer
+	// receiving the entry should be polite towards it.
+	Polite *bool `form:"-" json:"polite,omitempty"`
+	// SameNetwork is set on returned entries registered from the requester's
+	// public IP.
+	SameNetwork bool `form:"-" json:"same_network,omitempty"`
+	// NAT is set on returned entries of peers whose NAT was probed, see
+	// natprobe.go.
+	NAT string `form:"-" json:"nat,omitempty"`
+}
+
+func register(ctx *gin.Context) {
+	var json EntryForm
+	err := ctx.BindJSON(&json)
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error parsing form")
+		respondError(ctx, http.StatusNotAcceptable, "invalid_json", "error parsing json", nil)
+		return
+	}
+	var formErr *FormError
+	if err := requireUUID(json); errors.As(err, &formErr) {
+		respondError(ctx, http.StatusNotAcceptable, formErr.Code, formErr.message(), formErr.details())
+		return
+	}
+
+	uuidToken, err := claimUUID(ctx.Request.Context(), &json, "")
+	if err == errUUIDNotAssigned {
+		auditRequest(ctx, "auth_failed").Str("uuid", json.Uuid).Str("reason", "invalid uuid_token").Send()
+		strike(ctx.ClientIP(), "invalid uuid_token")
+		respondError(ctx, http.StatusForbidden, "invalid_uuid_token", "missing or invalid uuid_token", nil)
+		return
+	} else if err != nil {
+		reqLog(ctx).Err(err).Msg("Error assigning uuid")
+		respondError(ctx, http.StatusInternalServerError, "internal", "error", nil)
+		return
+	}
+	if !subjectAllows(ctx.GetString(subjectKey), json.Uuid) {
+		respondError(ctx, http.StatusForbidden, "subject_mismatch", "uuid does not match token subject", nil)
+		return
+	}
+	if ok, retry := peerLimits.allow(json.Uuid); !ok {
+		abortRateLimited(ctx, retry)
+		return
+	}
+	if captchaNeeded(ctx) {
+		if err := checkCaptcha(ctx.Request.Context(), json, ctx.ClientIP()); err != nil {
+			status, code, message := captchaRejection(err)
+			respondError(ctx, status, code, message, nil)
+			return
+		}
+	}
+
+	trace.SpanFromContext(ctx.Request.Context()).SetAttributes(attribute.String("uuid", json.Uuid))
+	entries, next, err := registerJSON(ctx.Request.Context(), ctx.GetString(tenantKey), tokenClaims(ctx), json, observedAddress(ctx))
+	var addrErr *AddressError
+	if errors.As(err, &addrErr) {
+		respondError(ctx, http.StatusNotAcceptable, "invalid_address", "invalid address", addrErr.details())
+		return
+	}
+	if errors.As(err, &formErr) {
+		respondError(ctx, http.StatusNotAcceptable, formErr.Code, formErr.message(), formErr.details())
+		return
+	}
+	var refused *RefusedError
+	if errors.As(err, &refused) {
+		respondError(ctx, http.StatusForbidden, "refused", "refused", refused.details())
+		return
+	}
+	if err == errOtherTenant {
+		respondError(ctx, http.StatusForbidden, "other_tenant", "uuid belongs to another tenant", nil)
+		return
+	}
+	var full *TenantFullError
+	if errors.As(err, &full) {
+		respondError(ctx, http.StatusForbidden, "tenant_full", "tenant full", full.details())
+		return
+	}
+	if err == errBanned {
+		respondError(ctx, http.StatusForbidden, "banned", "banned", nil)
+		return
+	}
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error registering")
+		respondError(ctx, http.StatusInternalServerError, "internal", "error", nil)
+		return
+	}
+
+	resp := gin.H{"status": "ok", "entries": entries, "observed": observedAddress(ctx)}
+	if next != "" {
+		resp["next"] = next
+	}
+	if uuidToken != "" {
+		resp["uuid"] = json.Uuid
+		resp["uuid_token"] = uuidToken
+	}
+	if turnEnabled() {
+		resp["turn"] = newTurnCredentials(json.Uuid, time.Now())
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+func deregister(ctx *gin.Context) {
+	id := ctx.Param("uuid")
+	if !subjectAllows(ctx.GetString(subjectKey), id) {
+		respondError(ctx, http.StatusForbidden, "subject_mismatch", "uuid does not match token subject", nil)
+		return
+	}
+	if !uuidAllowed(id, ctx.Query("uuid_token")) {
+		respondError(ctx, http.StatusForbidden, "invalid_uuid_token", "missing or invalid uuid_token", nil)
+		return
+	}
+	if !tenantAllows(ctx.Request.Context(), ctx.GetString(tenantKey), id) {
+		respondError(ctx, http.StatusForbidden, "other_tenant", "uuid belongs to another tenant", nil)
+		return
+	}
+
+	found, err := deregisterUUID(ctx.Request.Context(), id)
+	var formErr *FormError
+	if errors.As(err, &formErr) {
+		respondError(ctx, http.StatusNotAcceptable, formErr.Code, formErr.message(), formErr.details())
+		return
+	}
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error deregistering")
+		respondError(ctx, http.StatusInternalServerError, "internal", "error", nil)
+		return
+	}
+
+	if found {
+		events.publish(Event{Type: EventPeerDeregistered, UUID: id})
+	}
+	matches.remove(id)
+	leaveRoom(id, "deregistered")
+	sessions := connections.Sessions(id)
+	connected := len(sessions) > 0
+	for _, s := range sessions {
+		connections.Remove(s)
+		s.t.CloseWith(ws.CloseDeregistered, "deregistered")
+		s.t.Close()
+	}
+
+	if !found && !connected {
+		respondError(ctx, http.StatusNotFound, "not_found", "not found", nil)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func home(c *gin.Context) {
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	homeTemplate.Execute(c.Writer, sdkConfigFor(c))
+}
+
+func client(c *gin.Context) {
+	c.Header("Content-Type", "text/javascript; charset=utf-8")
+	c.Header("Cache-Control", "no-cache")
+	clientTemplate.Execute(c.Writer, sdkConfigFor(c))
+}
+
+// signalingRoutes adds the client endpoints to g, once under /api/v1 and once
+// under each tenant's path prefix, and again at the legacy unversioned paths.
+func signalingRoutes(g *gin.RouterGroup) {
+	g.GET("/ws/register", rejectBanned, rateLimitIP, requireAPIKey, requireJWT, resolveTenant, registerWS)
+	g.POST("/register", rejectBanned, rateLimitIP, requireAPIKey, requireJWT, resolveTenant, register)
+	g.DELETE("/register/:uuid", rejectBanned, rateLimitIP, requireAPIKey, requireJWT, resolveTenant, deregister)
+	g.GET("/rooms", rejectBanned, rateLimitIP, requireAPIKey, requireJWT, resolveTenant, listDirectory)
+	g.GET("/turn-credentials", rejectBanned, rateLimitIP, requireAPIKey, requireJWT, resolveTenant, turnCredentials)
+	g.GET("/sse/:uuid", rejectBanned, rateLimitIP, requireAPIKey, requireJWT, resolveTenant, sseStream)
+	g.POST("/sse/:uuid", rejectBanned, rateLimitIP, requireAPIKey, requireJWT, resolveTenant, ssePost)
+	g.GET("/poll/:uuid", rejectBanned, rateLimitIP, requireAPIKey, requireJWT, resolveTenant, pollWait)
+	g.POST("/poll/:uuid", rejectBanned, rateLimitIP, requireAPIKey, requireJWT, resolveTenant, pollPost)
+	g.POST("/reports", rejectBanned, rateLimitIP, requireAPIKey, requireJWT, resolveTenant, postReport)
+}
+
+// Main serves with o, parsed from the command line, until interrupted.
+func Main(o *Options) {
+	srv, err := NewServer(o, Hooks{})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error configuring server")
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		log.Fatal().Err(err).Msg("Error starting server")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go reloadOnHangup(ctx, hangups)
+	<-ctx.Done()
+	stop()
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), *shutdownDelay+*drainTimeout)
+	defer cancel()
+	srv.Shutdown(drainCtx)
+}
@@ -0,0 +1,235 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hoyle1974/seven/internal/ws"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultMatchSize = 2
+	maxMatchSize     = 16
+)
+
+// MatchForm is the payload of a match request. Peers are grouped with others
+// asking for the same mode and size, in the same region if both name one,
+// whose skill is close enough. The allowed skill gap widens the longer a
+// peer waits.
+type MatchForm struct {
+	Mode   string `json:"mode"`
+	Region string `json:"region,omitempty"`
+	Skill  int    `json:"skill"`
+	Size   int    `json:"size,omitempty"`
+}
+
+type matchTicket struct {
+	uuid   string
+	tenant string
+	form   MatchForm
+	joined time.Time
+}
+
+// skillWindow is how far apart in skill t accepts a partner at now.
+func (t *matchTicket) skillWindow(now time.Time) float64 {
+	return float64(*matchSkillWindow) + *matchWiden*now.Sub(t.joined).Seconds()
+}
+
+func (t *matchTicket) compatible(o *matchTicket, now time.Time) bool {
+	if t.tenant != o.tenant || t.form.Mode != o.form.Mode || t.form.Size != o.form.Size {
+		return false
+	}
+	if t.form.Region != "" && o.form.Region != "" && t.form.Region != o.form.Region {
+		return false
+	}
+	gap := float64(t.form.Skill - o.form.Skill)
+	if gap < 0 {
+		gap = -gap
+	}
+	window := t.skillWindow(now)
+	if w := o.skillWindow(now); w > window {
+		window = w
+	}
+	return gap <= window
+}
+
+// matchmaker holds the peers waiting for a match on this instance.
+type matchmaker struct {
+	mu      sync.Mutex
+	waiting map[string]*matchTicket
+}
+
+var matches = &matchmaker{waiting: make(map[string]*matchTicket)}
+
+// enqueue puts uuid in the queue, replacing any earlier request of its own,
+// and returns how many peers are waiting.
+func (m *matchmaker) enqueue(uuid string, tenant string, form MatchForm) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.waiting[uuid] = &matchTicket{uuid: uuid, tenant: tenant, form: form, joined: time.Now()}
+	return len(m.waiting)
+}
+
+func (m *matchmaker) remove(uuid string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.waiting[uuid]
+	delete(m.waiting, uuid)
+	return ok
+}
+
+// take pulls every complete group out of the queue, oldest tickets first, as
+// well as the tickets that have waited longer than --match-timeout.
+func (m *matchmaker) take(now time.Time) (groups [][]*matchTicket, expired []*matchTicket) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tickets := make([]*matchTicket, 0, len(m.waiting))
+	for _, t := range m.waiting {
+		if *matchTimeout > 0 && now.Sub(t.joined) > *matchTimeout {
+			expired = append(expired, t)
+			delete(m.waiting, t.uuid)
+			continue
+		}
+		tickets = append(tickets, t)
+	}
+	sort.Slice(tickets, func(i, j int) bool { return tickets[i].joined.Before(tickets[j].joined) })
+
+	used := map[string]bool{}
+	for i, t := range tickets {
+		if used[t.uuid] {
+			continue
+		}
+		group := []*matchTicket{t}
+		for _, o := range tickets[i+1:] {
+			if used[o.uuid] || !fitsGroup(group, o, now) {
+				continue
+			}
+			if group = append(group, o); len(group) == t.form.Size {
+				break
+			}
+		}
+		if len(group) < t.form.Size {
+			continue
+		}
+		for _, g := range group {
+			used[g.uuid] = true
+			delete(m.waiting, g.uuid)
+		}
+		groups = append(groups, group)
+	}
+	return groups, expired
+}
+
+func fitsGroup(group []*matchTicket, o *matchTicket, now time.Time) bool {
+	for _, g := range group {
+		if !g.compatible(o, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// run matches whatever has become compatible and settles the groups found.
+func (m *matchmaker) run(ctx context.Context) {
+	groups, expired := m.take(time.Now())
+	for _, t := range expired {
+		notifyMatch(t.uuid, ws.MsgMatchCancelled, "", gin.H{"reason": "timeout"})
+	}
+	for _, group := range groups {
+		startMatch(ctx, group)
+	}
+}
+
+// sweepMatches reruns matching, every second so widening skill windows and
+// timeouts take effect without new requests coming in.
+func sweepMatches() {
+	matches.run(context.Background())
+}
+
+// startMatch puts a group in a fresh room and tells every member who the
+// others are.
+func startMatch(ctx context.Context, group []*matchTicket) {
+	room := rooms.Create(group[0].tenant, "", 0)
+	rooms.Describe(room, "", nil, nil, true)
+	events.publish(Event{Type: EventRoomCreated, UUID: group[0].uuid, Room: room})
+	uuids := make([]string, len(group))
+	for i, t := range group {
+		uuids[i] = t.uuid
+		previous, err := rooms.Join(room, t.uuid, t.tenant)
+		if err != nil {
+			log.Err(err).Str("room", room).Msg("Error joining match room")
+			continue
+		}
+		if previous != "" {
+			announceLeft(previous, t.uuid, "matched")
+		}
+		events.publish(Event{Type: EventRoomJoined, UUID: t.uuid, Room: room})
+	}
+	log.Debug().Str("room", room).Strs("peers", uuids).Str("mode", group[0].form.Mode).Msg("Matched peers")
+
+	entries := lookupEntries(ctx, uuids)
+	for _, t := range group {
+		peers := []EntryForm{}
+		for _, e := range entries {
+			if e.Uuid != t.uuid {
+				peers = append(peers, e)
+			}
+		}
+		notifyMatch(t.uuid, ws.MsgMatched, room, gin.H{"mode": t.form.Mode, "peers": withRoles(t.uuid, peers)})
+	}
+	sendMeshPlan(room)
+}
+
+func notifyMatch(uuid string, t ws.MessageType, room string, payload gin.H) {
+	msg, err := ws.NewMessage(t, payload)
+	if err != nil {
+		log.Err(err).Msg("Error encoding match message")
+		return
+	}
+	msg.Room = room
+	if err := connections.Send(uuid, msg); err != nil {
+		log.Err(err).Str("uuid", uuid).Msg("Error sending match message")
+	}
+}
+
+func handleMatch(ctx context.Context, s *Session, msg ws.Message) error {
+	if s.uuid == "" {
+		return s.sendError("not_registered", "not registered")
+	}
+	if ok, err := s.requireFeature("matchmaking"); !ok {
+		return err
+	}
+	var form MatchForm
+	if err := json.Unmarshal(msg.Payload, &form); err != nil {
+		return s.sendError("invalid_payload", "error parsing payload")
+	}
+	if form.Mode == "" {
+		return s.sendError("missing_mode", "missing mode")
+	}
+	if form.Size == 0 {
+		form.Size = defaultMatchSize
+	}
+	if form.Size < 2 || form.Size > maxMatchSize {
+		return s.sendError("invalid_match_size", "invalid match size")
+	}
+
+	waiting := matches.enqueue(s.uuid, s.tenant, form)
+	if err := s.send(ws.MsgMatchQueued, gin.H{"status": "ok", "waiting": waiting}); err != nil {
+		return err
+	}
+	matches.run(ctx)
+	return nil
+}
+
+func handleCancelMatch(ctx context.Context, s *Session, msg ws.Message) error {
+	if !matches.remove(s.uuid) {
+		return s.sendError("not_waiting", "not waiting for a match")
+	}
+	return s.send(ws.MsgMatchCancelled, gin.H{"reason": "cancelled"})
+}
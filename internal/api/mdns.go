@@ -0,0 +1,40 @@
+package api
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hoyle1974/seven/internal/mdns"
+)
+
+// With --mdns the server announces itself on the local network as a
+// _seven._tcp service, so clients at a LAN party can find it without being
+// told its address; the Go client's BrowseLAN does the finding. The TXT
+// record says whether it speaks TLS and which protocol versions.
+
+func announceMDNS() (*mdns.Responder, error) {
+	host, port, err := net.SplitHostPort(*addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+	tls := "0"
+	if *tlsCert != "" || *autocertDomain != "" {
+		tls = "1"
+	}
+	r, err := mdns.Local(p, "tls="+tls, "protocol="+strings.ReplaceAll(supportedProtocols(), " ", ""))
+	if err != nil {
+		return nil, err
+	}
+	if *mdnsName != "" {
+		r.Instance = *mdnsName
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		r.IPs = []net.IP{ip}
+	}
+	return mdns.Announce(r)
+}
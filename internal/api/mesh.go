@@ -0,0 +1,45 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/hoyle1974/seven/internal/ws"
+	"github.com/rs/zerolog/log"
+)
+
+// In rooms of up to --mesh-max-peers members the server tells every member
+// who to connect to so a full mesh forms without glare: each peer sends
+// offers to everyone who joined before it and waits for offers from everyone
+// who joined after. Roles only depend on join order, so replanning when the
+// room changes never flips an existing pair.
+
+// meshPlan is the plan for the member at index i of members, which must be in
+// join order.
+func meshPlan(members []string, i int) gin.H {
+	return gin.H{
+		"offer_to":    append([]string{}, members[:i]...),
+		"answer_to":   append([]string{}, members[i+1:]...),
+		"connections": len(members) * (len(members) - 1) / 2,
+	}
+}
+
+// sendMeshPlan sends every member of room its part of the current plan.
+func sendMeshPlan(room string) {
+	if *meshMaxPeers <= 0 {
+		return
+	}
+	members := rooms.MembersByJoin(room)
+	if len(members) < 2 || len(members) > *meshMaxPeers {
+		return
+	}
+	for i, peer := range members {
+		msg, err := ws.NewMessage(ws.MsgMeshPlan, meshPlan(members, i))
+		if err != nil {
+			log.Err(err).Msg("Error encoding mesh plan")
+			return
+		}
+		msg.Room = room
+		if err := connections.Send(peer, msg); err != nil {
+			log.Err(err).Str("room", room).Str("to", peer).Msg("Error sending mesh plan")
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// validateMetadata is the schema check a peer's metadata must pass before it
+// is stored. By default any JSON object is accepted; a deployment that wants
+// particular fields swaps in its own check.
+var validateMetadata = func(md json.RawMessage) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(md, &fields); err != nil {
+		return fmt.Errorf("Metadata must be a JSON object")
+	}
+	return nil
+}
+
+// normalizeMetadata checks md against --max-metadata-size and
+// validateMetadata, returning it compacted for storage.
+func normalizeMetadata(md json.RawMessage) (json.RawMessage, error) {
+	if len(md) == 0 || bytes.Equal(md, []byte("null")) {
+		return nil, nil
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, md); err != nil {
+		return nil, fmt.Errorf("Metadata is not valid JSON")
+	}
+	if compact.Len() > *maxMetadataSize {
+		return nil, fmt.Errorf("Metadata is larger than %d bytes", *maxMetadataSize)
+	}
+	if err := validateMetadata(compact.Bytes()); err != nil {
+		return nil, err
+	}
+	return compact.Bytes(), nil
+}
@@ -0,0 +1,272 @@
+package api
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Rooms come and go by the thousand and tenants may be many, so neither is
+// a label of the metrics above but through metricTenant, which names the
+// first --metrics-max-tenants tenants and counts the rest as "other", and
+// roomCollector, which reports rooms by tenant and only the busiest
+// --metrics-top-rooms by id.
+
+var (
+	metricConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "seven_websocket_connections",
+		Help: "Number of open websocket connections.",
+	})
+	metricSlowClients = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "seven_websocket_slow_clients_total",
+		Help: "Number of websocket clients disconnected for falling behind on their messages.",
+	})
+	metricRegistrations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "seven_registrations_total",
+		Help: "Number of successful registrations.",
+	})
+	metricEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seven_registry_evictions_total",
+		Help: "Number of entries dropped from the registry because of size or ttl.",
+	}, []string{"reason"})
+	metricRelayed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seven_messages_relayed_total",
+		Help: "Number of signaling messages relayed to another peer, by type.",
+	}, []string{"type"})
+	metricGlare = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seven_glare_total",
+		Help: "Number of offers that crossed another between the same peers, by how they were resolved.",
+	}, []string{"resolution"})
+	metricClusterMembers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "seven_cluster_members",
+		Help: "Number of live cluster members, this one included.",
+	})
+	metricRoomOwnership = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seven_room_ownership_changes_total",
+		Help: "Number of rooms that changed instance with --room-store=etcd, by what happened here: taken_over, moved or fenced.",
+	}, []string{"change"})
+	metricNodeForwards = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seven_node_forwards_total",
+		Help: "Number of websockets forwarded to the cluster member their cookie or ?node= names, by result: forwarded or failed.",
+	}, []string{"result"})
+	metricWebhooks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seven_webhooks_total",
+		Help: "Number of webhook deliveries, by result: delivered, retried, failed or dropped when a URL's queue was full.",
+	}, []string{"result"})
+	metricConfigReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seven_config_reloads_total",
+		Help: "Number of config reloads, by result: ok or error.",
+	}, []string{"result"})
+	metricBans = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seven_bans_total",
+		Help: "Number of bans made, by source: admin or auto.",
+	}, []string{"source"})
+	metricBanRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "seven_ban_rejections_total",
+		Help: "Number of requests and registrations refused because of a ban.",
+	})
+	metricLegacyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seven_legacy_requests_total",
+		Help: "Number of requests to the deprecated unversioned client endpoints, by route.",
+	}, []string{"route"})
+	metricCaptcha = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seven_captcha_total",
+		Help: "Number of captcha tokens verified, by result: passed or failed.",
+	}, []string{"result"})
+	metricSDPFiltered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seven_sdp_filtered_total",
+		Help: "Number of signals the SDP policy refused or candidates it dropped, by action.",
+	}, []string{"action"})
+	metricUndelivered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seven_messages_undelivered_total",
+		Help: "Number of queued signaling messages dropped before delivery, by reason.",
+	}, []string{"reason"})
+	metricTenantRegistrations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seven_tenant_registrations_total",
+		Help: "Number of successful registrations, by tenant.",
+	}, []string{"tenant"})
+	metricTenantRelayed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seven_tenant_messages_relayed_total",
+		Help: "Number of signaling messages relayed to another peer, by tenant.",
+	}, []string{"tenant"})
+	metricTenantPeers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "seven_tenant_connected_peers",
+		Help: "Number of uuids connected to this instance, by tenant.",
+	}, []string{"tenant"})
+	metricMessageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "seven_ws_message_duration_seconds",
+		Help:    "Time spent handling a websocket message, by type.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"type"})
+	metricConnectionReports = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seven_connection_reports_total",
+		Help: "Number of peer connection reports, by tenant, region of the reporter, outcome and selected candidate type.",
+	}, []string{"tenant", "region", "outcome", "candidate_type"})
+	metricTimeToConnect = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "seven_time_to_connect_seconds",
+		Help:    "Reported time for peers to connect, by tenant and region of the reporter.",
+		Buckets: []float64{.1, .25, .5, 1, 2, 4, 8, 15, 30},
+	}, []string{"tenant", "region"})
+	metricPeerScores = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "seven_peer_score",
+		Help:    "Score of a peer after each connection report about it.",
+		Buckets: prometheus.LinearBuckets(0.1, 0.1, 9),
+	})
+	metricNATProbes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "seven_nat_probes_total",
+		Help: "Number of NAT probes classified, by mapping behavior.",
+	}, []string{"nat"})
+	metricRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "seven_http_request_duration_seconds",
+		Help:    "Time spent handling an HTTP request.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "path", "status"})
+)
+
+func init() {
+	prometheus.MustRegister(roomCollector{})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "seven_registered_peers",
+		Help: "Number of peers in the registry.",
+	}, func() float64 {
+		if peerRegistry == nil {
+			return 0
+		}
+		n, err := peerRegistry.Len(context.Background())
+		if err != nil {
+			log.Err(err).Msg("Error counting registry")
+		}
+		return float64(n)
+	})
+}
+
+// metricsMiddleware records the latency of every HTTP request by route.
+// Websocket upgrades are left out since they last as long as the connection.
+func metricsMiddleware(ctx *gin.Context) {
+	if ctx.IsWebsocket() {
+		ctx.Next()
+		return
+	}
+	start := time.Now()
+	ctx.Next()
+	path := ctx.FullPath()
+	if path == "" {
+		path = "unmatched"
+	}
+	observe(ctx.Request.Context(),
+		metricRequestDuration.WithLabelValues(ctx.Request.Method, path, strconv.Itoa(ctx.Writer.Status())),
+		time.Since(start).Seconds())
+}
+
+// observe records v with the trace of ctx as exemplar, when it is sampled,
+// so latency outliers lead to their traces.
+func observe(ctx context.Context, h prometheus.Observer, v float64) {
+	sc := trace.SpanContextFromContext(ctx)
+	if e, ok := h.(prometheus.ExemplarObserver); ok && sc.IsSampled() {
+		e.ObserveWithExemplar(v, prometheus.Labels{"trace_id": sc.TraceID().String(), "span_id": sc.SpanID().String()})
+		return
+	}
+	h.Observe(v)
+}
+
+// otherTenants is the label of tenants past --metrics-max-tenants.
+const otherTenants = "other"
+
+var metricTenants = struct {
+	sync.Mutex
+	named map[string]bool
+	peers map[string]int // connected uuids of the tenants counted as other
+}{named: map[string]bool{}, peers: map[string]int{}}
+
+// metricTenant is tenant's label in metrics: its name if it is one of the
+// first --metrics-max-tenants seen, or configured with --tenants.
+func metricTenant(tenant string) string {
+	label := tenantLabel(tenant)
+	metricTenants.Lock()
+	defer metricTenants.Unlock()
+	if metricTenants.named[label] {
+		return label
+	}
+	if allowedTenants[tenant] || len(metricTenants.named) < *metricsMaxTenants {
+		metricTenants.named[label] = true
+		return label
+	}
+	return otherTenants
+}
+
+// setTenantPeers sets the connected uuids of tenant, adding up those of the
+// tenants counted as other.
+func setTenantPeers(tenant string, n int) {
+	label := metricTenant(tenant)
+	if label != otherTenants {
+		metricTenantPeers.WithLabelValues(label).Set(float64(n))
+		return
+	}
+	metricTenants.Lock()
+	defer metricTenants.Unlock()
+	if n == 0 {
+		delete(metricTenants.peers, tenant)
+	} else {
+		metricTenants.peers[tenant] = n
+	}
+	total := 0
+	for _, n := range metricTenants.peers {
+		total += n
+	}
+	metricTenantPeers.WithLabelValues(otherTenants).Set(float64(total))
+}
+
+var (
+	descRooms = prometheus.NewDesc("seven_rooms",
+		"Number of open rooms, by tenant.", []string{"tenant"}, nil)
+	descRoomMembers = prometheus.NewDesc("seven_room_members",
+		"Number of peers in rooms, by tenant.", []string{"tenant"}, nil)
+	descTopRoomMembers = prometheus.NewDesc("seven_top_room_members",
+		"Members of the --metrics-top-rooms rooms with the most.", []string{"room", "tenant"}, nil)
+	descTopRoomRelayed = prometheus.NewDesc("seven_top_room_messages_relayed_total",
+		"Messages relayed in the --metrics-top-rooms rooms that relayed the most.", []string{"room", "tenant"}, nil)
+)
+
+// roomCollector reports the rooms at every scrape.
+type roomCollector struct{}
+
+func (roomCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descRooms
+	ch <- descRoomMembers
+	ch <- descTopRoomMembers
+	ch <- descTopRoomRelayed
+}
+
+func (roomCollector) Collect(ch chan<- prometheus.Metric) {
+	list := rooms.List()
+	count, members := map[string]int{}, map[string]int{}
+	for _, r := range list {
+		tenant := metricTenant(r.Tenant)
+		count[tenant]++
+		members[tenant] += r.Members
+	}
+	for tenant, n := range count {
+		ch <- prometheus.MustNewConstMetric(descRooms, prometheus.GaugeValue, float64(n), tenant)
+		ch <- prometheus.MustNewConstMetric(descRoomMembers, prometheus.GaugeValue, float64(members[tenant]), tenant)
+	}
+	top := min(*metricsTopRooms, len(list))
+	if top <= 0 {
+		return
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Members > list[j].Members })
+	for _, r := range list[:top] {
+		ch <- prometheus.MustNewConstMetric(descTopRoomMembers, prometheus.GaugeValue, float64(r.Members), r.ID, tenantLabel(r.Tenant))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Relayed > list[j].Relayed })
+	for _, r := range list[:top] {
+		ch <- prometheus.MustNewConstMetric(descTopRoomRelayed, prometheus.CounterValue, float64(r.Relayed), r.ID, tenantLabel(r.Tenant))
+	}
+}
@@ -0,0 +1,259 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/hoyle1974/seven/internal/registry"
+	"github.com/hoyle1974/seven/internal/stun"
+	"github.com/hoyle1974/seven/internal/ws"
+	"github.com/rs/zerolog/log"
+)
+
+// With --nat-probe-addr the server answers STUN Binding requests on two UDP
+// ports. A registered client asks for a probe with probe_nat and sends a
+// Binding request from one socket to each port. If its NAT maps both to the
+// same public address the mapping is endpoint independent, and hole
+// punching has a chance; if not it is endpoint dependent ("symmetric"), and
+// two such peers are better off going straight to TURN. The result is kept
+// on the entry and handed out in discovery as nat.
+//
+// Requests name their probe with the token in USERNAME. Browsers cannot set
+// one on their STUN requests, so requests without it count toward the probe
+// last opened from the same public IP.
+
+const (
+	// natProbeWindow is how long a probe takes requests.
+	natProbeWindow = 30 * time.Second
+	// natResultTTL is how long a result is applied to registrations from
+	// the same public IP.
+	natResultTTL = time.Hour
+)
+
+type natProbe struct {
+	token   string
+	uuid    string
+	tenant  string
+	ip      string
+	expires time.Time
+	mapped  [2]map[netip.AddrPort]bool // by listener
+	result  string
+}
+
+// classify returns the mapping behavior the requests so far show, or "" if
+// only one listener has seen any. Any address seen by both means one socket
+// was mapped the same way to both, whatever other sockets did.
+func (p *natProbe) classify() string {
+	if len(p.mapped[0]) == 0 || len(p.mapped[1]) == 0 {
+		return ""
+	}
+	for addr := range p.mapped[0] {
+		if p.mapped[1][addr] {
+			return registry.NATEndpointIndependent
+		}
+	}
+	return registry.NATEndpointDependent
+}
+
+type natProber struct {
+	mu      sync.Mutex
+	conns   []net.PacketConn
+	byToken map[string]*natProbe
+	byIP    map[string]*natProbe
+	results *expirable.LRU[string, string] // by public IP
+
+	// endpoints are where the socket of each uuid's latest probe was
+	// seen, for rendezvous.go.
+	endpoints *expirable.LRU[string, netip.AddrPort]
+}
+
+var natProbes = &natProber{
+	byToken:   map[string]*natProbe{},
+	byIP:      map[string]*natProbe{},
+	results:   expirable.NewLRU[string, string](65536, nil, natResultTTL),
+	endpoints: expirable.NewLRU[string, netip.AddrPort](65536, nil, natResultTTL),
+}
+
+// listen opens the two listeners, on --nat-probe-addr and the next port.
+func (n *natProber) listen(ctx context.Context) error {
+	host, port, err := net.SplitHostPort(*natProbeAddr)
+	if err != nil {
+		return fmt.Errorf("Invalid --nat-probe-addr %q: %w", *natProbeAddr, err)
+	}
+	first, err := strconv.Atoi(port)
+	if err != nil || first <= 0 || first >= 65535 {
+		return fmt.Errorf("Invalid --nat-probe-addr port %q", port)
+	}
+	var lc net.ListenConfig
+	for i := 0; i < 2; i++ {
+		addr := net.JoinHostPort(host, strconv.Itoa(first+i))
+		conn, err := lc.ListenPacket(ctx, "udp", addr)
+		if err != nil {
+			n.close()
+			return fmt.Errorf("Error listening for NAT probes on %s: %w", addr, err)
+		}
+		n.conns = append(n.conns, conn)
+		log.Info().Str("addr", addr).Msg("Answering NAT probes")
+		go n.serve(i, conn)
+	}
+	return nil
+}
+
+func (n *natProber) close() {
+	for _, c := range n.conns {
+		c.Close()
+	}
+}
+
+func (n *natProber) enabled() bool {
+	return len(n.conns) > 0
+}
+
+// ports are the UDP ports probes go to.
+func (n *natProber) ports() []int {
+	ports := make([]int, len(n.conns))
+	for i, c := range n.conns {
+		ports[i] = c.LocalAddr().(*net.UDPAddr).Port
+	}
+	return ports
+}
+
+func (n *natProber) serve(listener int, conn net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		size, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req, err := stun.Decode(buf[:size])
+		if err != nil || req.Type != stun.TypeBindingRequest {
+			continue
+		}
+		src := from.(*net.UDPAddr).AddrPort()
+		src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+		if _, err := conn.WriteTo(stun.Response(req, src).Encode(), from); err != nil {
+			log.Debug().Err(err).Str("addr", src.String()).Msg("Error answering NAT probe")
+		}
+		n.observe(listener, req.Username, src)
+	}
+}
+
+// open starts a probe for the registered session s.
+func (n *natProber) open(s *Session) *natProbe {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.expire(time.Now())
+	p := &natProbe{
+		token:   uuid.NewString(),
+		uuid:    s.uuid,
+		tenant:  s.tenant,
+		ip:      s.observed.IP,
+		expires: time.Now().Add(natProbeWindow),
+		mapped:  [2]map[netip.AddrPort]bool{{}, {}},
+	}
+	n.byToken[p.token] = p
+	n.byIP[p.ip] = p
+	return p
+}
+
+func (n *natProber) expire(now time.Time) {
+	for token, p := range n.byToken {
+		if now.After(p.expires) {
+			delete(n.byToken, token)
+			if n.byIP[p.ip] == p {
+				delete(n.byIP, p.ip)
+			}
+		}
+	}
+}
+
+// observe counts a request from src to a listener toward its probe.
+func (n *natProber) observe(listener int, token string, src netip.AddrPort) {
+	n.mu.Lock()
+	p := n.byToken[token]
+	if token == "" {
+		p = n.byIP[src.Addr().String()]
+	}
+	if p == nil || time.Now().After(p.expires) || len(p.mapped[listener]) >= 16 {
+		n.mu.Unlock()
+		return
+	}
+	p.mapped[listener][src] = true
+	if token != "" {
+		n.endpoints.Add(p.uuid, src)
+	}
+	result := p.classify()
+	changed := result != "" && result != p.result
+	p.result = result
+	n.mu.Unlock()
+
+	if changed {
+		n.results.Add(src.Addr().String(), result)
+		go n.detected(p, result)
+	}
+}
+
+// detected stores a result on the probing peer's entry and tells it.
+func (n *natProber) detected(p *natProbe, result string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	metricNATProbes.WithLabelValues(result).Inc()
+	e, ok, err := peerRegistry.Get(ctx, p.uuid)
+	if err != nil {
+		log.Err(err).Str("uuid", p.uuid).Msg("Error looking up probed peer")
+	} else if ok && e.Tenant == p.tenant {
+		e.NAT = result
+		if err := peerRegistry.Add(ctx, e); err != nil {
+			log.Err(err).Str("uuid", p.uuid).Msg("Error storing NAT behavior")
+		}
+	}
+	msg, err := ws.NewMessage(ws.MsgNATDetected, gin.H{"nat": result})
+	if err != nil {
+		return
+	}
+	if err := connections.Send(p.uuid, msg); err != nil {
+		log.Debug().Err(err).Str("uuid", p.uuid).Msg("Error sending NAT behavior")
+	}
+}
+
+// natBehavior is the NAT behavior of a peer registering as id from ip: that
+// of the last probe from ip, or failing that what its entry already says
+// if it registered from ip before, probed on another instance.
+func natBehavior(ctx context.Context, id string, ip string) string {
+	if !natProbes.enabled() {
+		return ""
+	}
+	if result, ok := natProbes.results.Get(ip); ok {
+		return result
+	}
+	if e, ok, err := peerRegistry.Get(ctx, id); err == nil && ok && e.IP == ip {
+		return e.NAT
+	}
+	return ""
+}
+
+func handleProbeNAT(ctx context.Context, s *Session, msg ws.Message) error {
+	if s.uuid == "" {
+		return s.sendError("not_registered", "not registered")
+	}
+	if !natProbes.enabled() {
+		return s.sendError("nat_probe_disabled", "nat probes are not enabled")
+	}
+	if ok, err := s.requireFeature("nat_probe"); !ok {
+		return err
+	}
+	p := natProbes.open(s)
+	return s.send(ws.MsgNATProbe, gin.H{
+		"token":      p.token,
+		"ports":      natProbes.ports(),
+		"expires_in": int(natProbeWindow.Seconds()),
+	})
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hoyle1974/seven/internal/hub"
+	"github.com/hoyle1974/seven/internal/ws"
+	"github.com/rs/zerolog/log"
+)
+
+// Signals addressed to a uuid that has no live session are held here until
+// that peer registers, so an offer or trickled candidate racing a reconnect
+// isn't lost. Senders get an undelivered notice for anything that overflows
+// the queue or expires in it.
+const maxOfflineTargets = 1024
+
+type offlineMessage struct {
+	msg    ws.Message
+	queued time.Time
+}
+
+var offlineMu sync.Mutex
+var offlineQueues = map[string][]offlineMessage{}
+
+// splitExpired separates the messages still within --offline-queue-ttl from
+// the ones that are not.
+func splitExpired(queue []offlineMessage, now time.Time) ([]offlineMessage, []ws.Message) {
+	live := queue[:0]
+	var expired []ws.Message
+	for _, q := range queue {
+		if now.Sub(q.queued) < *offlineQueueTTL {
+			live = append(live, q)
+		} else {
+			expired = append(expired, q.msg)
+		}
+	}
+	return live, expired
+}
+
+// expireOffline drops expired messages from every queue and returns them.
+// offlineMu must be held.
+func expireOffline(now time.Time) []ws.Message {
+	var expired []ws.Message
+	for uuid, queue := range offlineQueues {
+		live, dead := splitExpired(queue, now)
+		expired = append(expired, dead...)
+		if len(live) == 0 {
+			delete(offlineQueues, uuid)
+		} else {
+			offlineQueues[uuid] = live
+		}
+	}
+	return expired
+}
+
+// queueOffline buffers msg for the uuid in msg.To, returning false if the
+// queue is full.
+func queueOffline(msg ws.Message) bool {
+	to, _ := hub.SplitDevice(msg.To)
+	offlineMu.Lock()
+	now := time.Now()
+	var expired []ws.Message
+	if _, ok := offlineQueues[to]; !ok && len(offlineQueues) >= maxOfflineTargets {
+		expired = expireOffline(now)
+	}
+
+	queue, ok := offlineQueues[to]
+	queue, dead := splitExpired(queue, now)
+	expired = append(expired, dead...)
+	full := len(queue) >= *offlineQueueSize || (!ok && len(offlineQueues) >= maxOfflineTargets)
+	if !full {
+		queue = append(queue, offlineMessage{msg: msg, queued: now})
+	}
+	if len(queue) > 0 {
+		offlineQueues[to] = queue
+	} else {
+		delete(offlineQueues, to)
+	}
+	offlineMu.Unlock()
+
+	notifyUndelivered(expired, "expired")
+	return !full
+}
+
+// takeOffline removes and returns everything still buffered for uuid.
+func takeOffline(uuid string) []ws.Message {
+	offlineMu.Lock()
+	queue := offlineQueues[uuid]
+	delete(offlineQueues, uuid)
+	offlineMu.Unlock()
+
+	live, expired := splitExpired(queue, time.Now())
+	notifyUndelivered(expired, "expired")
+	msgs := []ws.Message{}
+	for _, q := range live {
+		msgs = append(msgs, q.msg)
+	}
+	return msgs
+}
+
+// offlineQueued returns how many messages wait for uuid.
+func offlineQueued(uuid string) int {
+	offlineMu.Lock()
+	defer offlineMu.Unlock()
+	return len(offlineQueues[uuid])
+}
+
+// dropOffline discards everything queued for uuid without notifying anyone.
+func dropOffline(uuid string) {
+	offlineMu.Lock()
+	defer offlineMu.Unlock()
+	delete(offlineQueues, uuid)
+}
+
+// sweepOffline expires queued messages, every second so their senders hear
+// about it even if the target never comes back.
+func sweepOffline() {
+	offlineMu.Lock()
+	expired := expireOffline(time.Now())
+	offlineMu.Unlock()
+	notifyUndelivered(expired, "expired")
+}
+
+// notifyUndelivered tells the senders of msgs that they were dropped.
+func notifyUndelivered(msgs []ws.Message, reason string) {
+	for _, msg := range msgs {
+		if msg.From == "" {
+			continue
+		}
+		notice, err := ws.NewMessage(ws.MsgUndelivered, gin.H{"to": msg.To, "type": msg.Type, "reason": reason})
+		if err != nil {
+			log.Err(err).Msg("Error encoding undelivered notice")
+			continue
+		}
+		notice.Room, notice.ID = msg.Room, msg.ID
+		if err := connections.Send(msg.From, notice); err != nil && err != hub.ErrNotConnected {
+			log.Err(err).Str("to", msg.From).Msg("Error sending undelivered notice")
+		}
+		metricUndelivered.WithLabelValues(reason).Inc()
+	}
+}
@@ -0,0 +1,341 @@
+package api
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hoyle1974/seven/internal/ws"
+)
+
+// The OpenAPI document of the v1 client endpoints is generated from
+// apiOperations and the Go types they take and return, so it follows the
+// code. TestAPIOperations checks apiOperations against the routes. It is served at /api/openapi.json, with a Swagger UI page at
+// /api/docs when --api-docs is set, and `seven openapi` prints it for client
+// generators.
+
+// apiOperation describes one client endpoint.
+type apiOperation struct {
+	method  string
+	path    string // relative to /api/v1, with {param}s
+	summary string
+	query   []apiParam
+	body    any // JSON request body, nil for none
+	status  int
+	reply   any    // JSON reply, nil for none
+	stream  string // content type of a reply that is not JSON
+	errors  []int
+}
+
+type apiParam struct {
+	name        string
+	kind        string
+	description string
+}
+
+// registerReply is the reply of POST /register.
+type registerReply struct {
+	Status    string           `json:"status"`
+	Entries   []EntryForm      `json:"entries"`
+	Observed  ObservedAddress  `json:"observed"`
+	Next      string           `json:"next,omitempty"`
+	Uuid      string           `json:"uuid,omitempty"`       // the assigned uuid, if one was
+	UuidToken string           `json:"uuid_token,omitempty"` // proves the assignment
+	Turn      *TurnCredentials `json:"turn,omitempty"`
+}
+
+// directoryReply is the reply of GET /rooms.
+type directoryReply struct {
+	Status string        `json:"status"`
+	Rooms  []RoomListing `json:"rooms"`
+	Next   string        `json:"next,omitempty"`
+}
+
+// pollReply is the reply of GET /poll/{uuid}. Code and Reason are set when
+// the status is "closed".
+type pollReply struct {
+	Status   string       `json:"status"`
+	Messages []ws.Message `json:"messages"`
+	Code     int          `json:"code,omitempty"`
+	Reason   string       `json:"reason,omitempty"`
+}
+
+// statusReply is every other reply.
+type statusReply struct {
+	Status string `json:"status"`
+}
+
+// errorReply is every error, see errors.go.
+type errorReply struct {
+	Code      string         `json:"code"`
+	Message   string         `json:"message"`
+	Details   map[string]any `json:"details,omitempty"`
+	RequestID string         `json:"request_id"`
+	Status    string         `json:"status"` // the message, for older clients
+}
+
+var uuidTokenParam = apiParam{"uuid_token", "string", "Proves an assigned uuid was assigned to the caller"}
+
+var apiOperations = []apiOperation{
+	{
+		method: http.MethodGet, path: "/ws/register", summary: "Open a signaling websocket",
+		query: []apiParam{
+			{"api_key", "string", "API key, for browsers that cannot set X-API-Key"},
+			{"access_token", "string", "Bearer token, for browsers that cannot set Authorization"},
+			{"protocol", "string", "Protocol versions the client speaks, for browsers that cannot set X-Seven-Protocol"},
+		},
+		status: http.StatusSwitchingProtocols, errors: []int{http.StatusForbidden, http.StatusTooManyRequests},
+	},
+	{
+		method: http.MethodGet, path: "/config", summary: "Get the URLs clients connect to",
+		status: http.StatusOK, reply: SDKConfig{}, errors: []int{http.StatusNotFound},
+	},
+	{
+		method: http.MethodGet, path: "/capabilities", summary: "Get the protocol versions, transports, features and limits of the server",
+		status: http.StatusOK, reply: Capabilities{}, errors: []int{http.StatusNotFound},
+	},
+	{
+		method: http.MethodPost, path: "/register", summary: "Register a peer and discover others",
+		body: EntryForm{}, status: http.StatusOK, reply: registerReply{},
+		errors: []int{http.StatusForbidden, http.StatusNotAcceptable, http.StatusTooManyRequests},
+	},
+	{
+		method: http.MethodDelete, path: "/register/{uuid}", summary: "Deregister a peer and close its sessions",
+		query: []apiParam{uuidTokenParam}, status: http.StatusOK, reply: statusReply{},
+		errors: []int{http.StatusForbidden, http.StatusNotFound},
+	},
+	{
+		method: http.MethodGet, path: "/rooms", summary: "List the room directory",
+		query: []apiParam{
+			{"filter", "string", "Tag filter, such as mode=ranked,region!=eu"},
+			{"name", "string", "Case insensitive substring of the room name"},
+			{"available", "boolean", "Only rooms that can be joined"},
+			{"cursor", "string", "The next of the previous page"},
+			{"count", "integer", "Page size"},
+		},
+		status: http.StatusOK, reply: directoryReply{}, errors: []int{http.StatusBadRequest},
+	},
+	{
+		method: http.MethodGet, path: "/turn-credentials", summary: "Get TURN credentials",
+		query:  []apiParam{{"uuid", "string", "Peer the credentials are for, unless the bearer token names one"}},
+		status: http.StatusOK, reply: TurnCredentials{}, errors: []int{http.StatusNotFound},
+	},
+	{
+		method: http.MethodGet, path: "/sse/{uuid}", summary: "Receive signaling messages as Server-Sent Events",
+		query: []apiParam{uuidTokenParam}, status: http.StatusOK, stream: "text/event-stream",
+		errors: []int{http.StatusForbidden},
+	},
+	{
+		method: http.MethodPost, path: "/sse/{uuid}", summary: "Send a signaling message on an event stream session",
+		query: []apiParam{uuidTokenParam}, body: ws.Message{}, status: http.StatusAccepted, reply: statusReply{},
+		errors: []int{http.StatusForbidden, http.StatusNotFound, http.StatusServiceUnavailable},
+	},
+	{
+		method: http.MethodGet, path: "/poll/{uuid}", summary: "Wait for signaling messages",
+		query:  []apiParam{uuidTokenParam, {"timeout", "string", "How long to wait, such as 25s"}},
+		status: http.StatusOK, reply: pollReply{}, errors: []int{http.StatusBadRequest, http.StatusForbidden},
+	},
+	{
+		method: http.MethodPost, path: "/poll/{uuid}", summary: "Send a signaling message on a long poll session",
+		query: []apiParam{uuidTokenParam}, body: ws.Message{}, status: http.StatusAccepted, reply: statusReply{},
+		errors: []int{http.StatusForbidden, http.StatusServiceUnavailable},
+	},
+	{
+		method: http.MethodPost, path: "/reports", summary: "Report how a connection to a peer went",
+		body: ReportForm{}, status: http.StatusAccepted, reply: statusReply{},
+		errors: []int{http.StatusBadRequest, http.StatusForbidden, http.StatusNotAcceptable, http.StatusTooManyRequests},
+	},
+}
+
+// OpenAPI returns the OpenAPI 3 document of the client endpoints.
+func OpenAPI() []byte {
+	return openAPIJSON()
+}
+
+var openAPIJSON = sync.OnceValue(func() []byte {
+	doc, err := json.MarshalIndent(openAPIDocument(), "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return doc
+})
+
+func openAPIDocument() gin.H {
+	schemas := gin.H{}
+	paths := gin.H{}
+	for _, op := range apiOperations {
+		params := []gin.H{{
+			"name": protocolHeader, "in": "header",
+			"description": "Protocol versions the client speaks, see Versioning in the README",
+			"schema":      gin.H{"type": "string"},
+		}}
+		for _, part := range strings.Split(op.path, "/") {
+			if strings.HasPrefix(part, "{") {
+				name := strings.Trim(part, "{}")
+				params = append(params, gin.H{"name": name, "in": "path", "required": true, "schema": gin.H{"type": "string"}})
+			}
+		}
+		for _, p := range op.query {
+			params = append(params, gin.H{"name": p.name, "in": "query", "description": p.description, "schema": gin.H{"type": p.kind}})
+		}
+
+		ok := gin.H{"description": http.StatusText(op.status)}
+		switch {
+		case op.reply != nil:
+			ok["content"] = gin.H{"application/json": gin.H{"schema": typeSchema(reflect.TypeOf(op.reply), schemas)}}
+		case op.stream != "":
+			ok["content"] = gin.H{op.stream: gin.H{"schema": gin.H{"type": "string"}}}
+		}
+		responses := gin.H{strconv.Itoa(op.status): ok}
+		for _, code := range op.errors {
+			responses[strconv.Itoa(code)] = gin.H{
+				"description": http.StatusText(code),
+				"content":     gin.H{"application/json": gin.H{"schema": typeSchema(reflect.TypeOf(errorReply{}), schemas)}},
+			}
+		}
+
+		operation := gin.H{"summary": op.summary, "parameters": params, "responses": responses}
+		if op.body != nil {
+			operation["requestBody"] = gin.H{
+				"required": true,
+				"content":  gin.H{"application/json": gin.H{"schema": typeSchema(reflect.TypeOf(op.body), schemas)}},
+			}
+		}
+		item, _ := paths[op.path].(gin.H)
+		if item == nil {
+			item = gin.H{}
+			paths[op.path] = item
+		}
+		item[strings.ToLower(op.method)] = operation
+	}
+
+	return gin.H{
+		"openapi": "3.0.3",
+		"info": gin.H{
+			"title":   "Seven signaling API",
+			"version": "1.0.0",
+		},
+		"servers": []gin.H{
+			{"url": "/api/v1"},
+			{"url": "/t/{tenant}/api/v1", "variables": gin.H{"tenant": gin.H{"default": "tenant", "description": "Tenant name"}}},
+		},
+		"paths": paths,
+		"components": gin.H{
+			"schemas": schemas,
+			"securitySchemes": gin.H{
+				"apiKey": gin.H{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"bearer": gin.H{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+		"security": []gin.H{{}, {"apiKey": []string{}}, {"bearer": []string{}}},
+	}
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	rawType  = reflect.TypeOf(json.RawMessage{})
+)
+
+// typeSchema returns the schema of values of t as encoding/json writes
+// them. Named structs are added to schemas and referenced.
+func typeSchema(t reflect.Type, schemas gin.H) gin.H {
+	switch t {
+	case timeType:
+		return gin.H{"type": "string", "format": "date-time"}
+	case rawType:
+		return gin.H{}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem(), schemas)
+	case reflect.Bool:
+		return gin.H{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return gin.H{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return gin.H{"type": "number"}
+	case reflect.String:
+		return gin.H{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return gin.H{"type": "string", "format": "byte"}
+		}
+		return gin.H{"type": "array", "items": typeSchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return gin.H{"type": "object", "additionalProperties": typeSchema(t.Elem(), schemas)}
+	case reflect.Struct:
+	default:
+		return gin.H{}
+	}
+
+	// Unexported reply types are exported in the document.
+	name := t.Name()
+	if name != "" {
+		name = strings.ToUpper(name[:1]) + name[1:]
+		if _, ok := schemas[name]; !ok {
+			schemas[name] = gin.H{} // placeholder for recursive types
+			schemas[name] = structSchema(t, schemas)
+		}
+		return gin.H{"$ref": "#/components/schemas/" + name}
+	}
+	return structSchema(t, schemas)
+}
+
+func structSchema(t reflect.Type, schemas gin.H) gin.H {
+	props := gin.H{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = typeSchema(f.Type, schemas)
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	schema := gin.H{"type": "object", "properties": props}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+func openAPISpec(ctx *gin.Context) {
+	ctx.Data(http.StatusOK, "application/json", OpenAPI())
+}
+
+func apiDocs(ctx *gin.Context) {
+	ctx.Data(http.StatusOK, "text/html; charset=utf-8", swaggerHTML)
+}
+
+// swaggerUIFiles are the Swagger UI page's scripts and styles, served with
+// it rather than from a CDN.
+//
+//go:embed swagger-ui
+var swaggerUIFiles embed.FS
+
+var swaggerUI = func() http.FileSystem {
+	sub, err := fs.Sub(swaggerUIFiles, "swagger-ui")
+	if err != nil {
+		panic(err)
+	}
+	return http.FS(sub)
+}()
+
+func apiDocsFile(ctx *gin.Context) {
+	ctx.FileFromFS(ctx.Param("file"), swaggerUI)
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAPIOperations(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	initConnections()
+	r, err := newRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	param := regexp.MustCompile(`:([a-z_]+)`)
+	var routes []string
+	for _, route := range r.Routes() {
+		if path, ok := strings.CutPrefix(route.Path, "/api/v1"); ok {
+			routes = append(routes, route.Method+" "+param.ReplaceAllString(path, "{$1}"))
+		}
+	}
+	var documented []string
+	for _, op := range apiOperations {
+		documented = append(documented, op.method+" "+op.path)
+	}
+	sort.Strings(routes)
+	sort.Strings(documented)
+	if strings.Join(routes, "\n") != strings.Join(documented, "\n") {
+		t.Errorf("Routes under /api/v1:\n%s\nare not those of apiOperations:\n%s", strings.Join(routes, "\n"), strings.Join(documented, "\n"))
+	}
+}
@@ -0,0 +1,430 @@
+package api
+
+import (
+	"compress/flate"
+	"flag"
+	"time"
+)
+
+// Options are the settings of a Server, one for each flag of the seven
+// binary, which are named after them. NewOptions has their defaults; they
+// can be set as fields, by flag name with Set, or from a command line with
+// RegisterFlags.
+type Options struct {
+	ConfigFile            string
+	Addr                  string
+	GRPCAddr              string
+	LogLevel              string
+	LogFormat             string
+	LogSample             int
+	PingInterval          time.Duration
+	PongWait              time.Duration
+	Registry              string
+	PostgresURL           string
+	SnapshotFile          string
+	BoltPath              string
+	RedisAddr             string
+	Relay                 string
+	RoomStore             string
+	EtcdEndpoints         string
+	EtcdPrefix            string
+	EtcdLeaseTTL          time.Duration
+	NodeName              string
+	AffinityCookie        string
+	ClusterAddr           string
+	ClusterAdvertise      string
+	ClusterJoin           string
+	ClusterSecret         string
+	ResumeGrace           time.Duration
+	OfflineQueueSize      int
+	OfflineQueueTTL       time.Duration
+	WebhookURL            string
+	WebhookSecret         string
+	WebhookEvents         string
+	MatchSkillWindow      int
+	MatchWiden            float64
+	MatchTimeout          time.Duration
+	MeshMaxPeers          int
+	DuplicateUUID         string
+	AssignUUIDs           bool
+	UUIDSecret            string
+	GlareWindow           time.Duration
+	MaxDataSize           int
+	MaxMetadataSize       int
+	AllowPrivate          bool
+	Tenants               string
+	TenantMaxPeers        int
+	SDPPolicy             string
+	TenantSDPPolicies     string
+	TenantLimits          string
+	TenantMaxEntries      int
+	TenantEntryLimits     string
+	RoomMaxPeers          int
+	RoomGrace             time.Duration
+	RoomFull              string
+	SendQueue             int
+	WriteTimeout          time.Duration
+	Compression           bool
+	CompressionLevel      int
+	CompressionThreshold  int
+	DebugAddr             string
+	ShutdownDelay         time.Duration
+	AuditLog              string
+	Demo                  bool
+	APIDocs               bool
+	Authorizer            string
+	DrainTimeout          time.Duration
+	TLSCert               string
+	TLSKey                string
+	AutocertDomain        string
+	AutocertCache         string
+	AutocertHTTPAddr      string
+	H2C                   bool
+	HTTPReadHeaderTimeout time.Duration
+	HTTPReadTimeout       time.Duration
+	HTTPWriteTimeout      time.Duration
+	HTTPIdleTimeout       time.Duration
+	HTTPMaxHeaderBytes    int
+	JWTSecret             string
+	JWTJWKSURL            string
+	AdminToken            string
+	RequireAPIKey         bool
+	TurnSecret            string
+	TurnURLs              string
+	TurnTTL               time.Duration
+	TrustedProxies        string
+	ProxyProtocol         bool
+	RemoteIPHeaders       string
+	IPRate                float64
+	IPBurst               int
+	PeerRate              float64
+	PeerBurst             int
+	BanStrikes            int
+	BanWindow             time.Duration
+	BanDuration           time.Duration
+	CaptchaProvider       string
+	CaptchaSecret         string
+	CaptchaVerifyURL      string
+	AllowedOrigins        string
+	MaxMessageSize        int64
+	MaxMessageRate        float64
+	MaxMessageBurst       int
+	RegistrySize          int
+	MetricsMaxTenants     int
+	MetricsTopRooms       int
+	EntryTTL              time.Duration
+	MaxEntries            int
+	PeerScoreHalfLife     time.Duration
+	ExcludeSameIP         bool
+	RendezvousLead        time.Duration
+	PublicURL             string
+	Features              string
+	TenantFeatures        string
+	StaticDir             string
+	StaticMaxAge          time.Duration
+	MDNS                  bool
+	MDNSName              string
+	NATProbeAddr          string
+	GeoIPDB               string
+
+	flags        *flag.FlagSet
+	explicit     map[string]bool
+	commandLines []*flag.FlagSet
+}
+
+// NewOptions returns the default Options.
+func NewOptions() *Options {
+	o := &Options{flags: flag.NewFlagSet("seven", flag.ContinueOnError), explicit: map[string]bool{}}
+	o.define(o.flags)
+	return o
+}
+
+// define adds a flag for every option to fs.
+func (o *Options) define(fs *flag.FlagSet) {
+	fs.StringVar(&o.ConfigFile, "config", "", "File of flags, one name = value per line, re-read on SIGHUP for those that can change at runtime")
+	fs.StringVar(&o.Addr, "addr", ":8080", "http service address")
+	fs.StringVar(&o.GRPCAddr, "grpc-addr", "", "Address to serve the gRPC signaling API on (disabled when empty)")
+	fs.StringVar(&o.LogLevel, "log-level", "info", "Least severe log level written: trace, debug, info, warn or error")
+	fs.StringVar(&o.LogFormat, "log-format", "console", "Log output: console or json")
+	fs.IntVar(&o.LogSample, "log-sample", 0, "Most relay path log messages written per second (0 writes all)")
+	fs.DurationVar(&o.PingInterval, "ping-interval", 30*time.Second, "How often to ping websocket clients")
+	fs.DurationVar(&o.PongWait, "pong-wait", 60*time.Second, "How long to wait for a pong before dropping a websocket client")
+	fs.StringVar(&o.Registry, "registry", "memory", "Registry backend: memory, redis, bolt, postgres or cluster")
+	fs.StringVar(&o.PostgresURL, "postgres-url", "postgres://localhost/seven", "Connection string for --registry=postgres")
+	fs.StringVar(&o.SnapshotFile, "snapshot", "", "File to restore registry entries and rooms from on startup and save them to on shutdown, gob when it ends in .gob and JSON otherwise (disabled when empty)")
+	fs.StringVar(&o.BoltPath, "bolt-path", "seven.db", "Database file for the bolt registry")
+	fs.StringVar(&o.RedisAddr, "redis-addr", "localhost:6379", "Redis address used by --registry=redis and --relay=redis")
+	fs.StringVar(&o.Relay, "relay", "none", "Cross-instance message relay: none, redis or cluster")
+	fs.StringVar(&o.RoomStore, "room-store", "memory", "Where rooms are kept: memory, or etcd to give each room one owner across instances")
+	fs.StringVar(&o.EtcdEndpoints, "etcd-endpoints", "http://localhost:2379", "Comma separated etcd endpoints used by --room-store=etcd")
+	fs.StringVar(&o.EtcdPrefix, "etcd-prefix", "seven/", "Prefix of the keys kept in etcd")
+	fs.DurationVar(&o.EtcdLeaseTTL, "etcd-lease-ttl", 10*time.Second, "How long an instance out of touch with etcd keeps its rooms before others may take them over")
+	fs.StringVar(&o.NodeName, "node-name", "", "Name of this instance in etcd and the cluster (default the hostname)")
+	fs.StringVar(&o.AffinityCookie, "affinity-cookie", "", "Cookie naming this instance to set on websocket upgrades, for load balancers to stick to (disabled when empty)")
+	fs.StringVar(&o.ClusterAddr, "cluster-addr", "", "Address to gossip with other instances on, such as :7946, for --registry=cluster and --relay=cluster; the next port serves calls between them")
+	fs.StringVar(&o.ClusterAdvertise, "cluster-advertise", "", "Address other instances reach this one's --cluster-addr at (default its IP and port)")
+	fs.StringVar(&o.ClusterJoin, "cluster-join", "", "Comma separated --cluster-addr addresses of instances to join through")
+	fs.StringVar(&o.ClusterSecret, "cluster-secret", "", "Secret every instance of the cluster shares")
+	fs.DurationVar(&o.ResumeGrace, "resume-grace", 30*time.Second, "How long a dropped websocket session can be resumed with its token (0 disables resumption)")
+	fs.IntVar(&o.OfflineQueueSize, "offline-queue-size", 64, "Messages held per uuid while its peer is disconnected")
+	fs.DurationVar(&o.OfflineQueueTTL, "offline-queue-ttl", 30*time.Second, "How long a message waits for a disconnected peer before the sender is told it was undelivered")
+	fs.StringVar(&o.WebhookURL, "webhook-url", "", "Comma separated URLs to POST lifecycle events to")
+	fs.StringVar(&o.WebhookSecret, "webhook-secret", "", "Key used to sign webhook bodies")
+	fs.StringVar(&o.WebhookEvents, "webhook-events", "peer_registered,peer_expired,room_created,room_closed", "Comma separated event types sent to webhooks")
+	fs.IntVar(&o.MatchSkillWindow, "match-skill-window", 100, "Largest skill gap matchmaking accepts straight away")
+	fs.Float64Var(&o.MatchWiden, "match-widen", 10, "How much the accepted skill gap grows per second of waiting")
+	fs.DurationVar(&o.MatchTimeout, "match-timeout", 60*time.Second, "How long a peer waits for a match before giving up (0 waits forever)")
+	fs.IntVar(&o.MeshMaxPeers, "mesh-max-peers", 6, "Largest room the server plans a full mesh for (0 disables planning)")
+	fs.StringVar(&o.DuplicateUUID, "duplicate-uuid", "replace", "What to do when a connected uuid registers again: replace, reject or multi")
+	fs.BoolVar(&o.AssignUUIDs, "assign-uuids", false, "Mint peer uuids on the server instead of trusting the ones clients send")
+	fs.StringVar(&o.UUIDSecret, "uuid-secret", "", "Secret the uuid tokens handed out with --assign-uuids are signed with")
+	fs.DurationVar(&o.GlareWindow, "glare-window", 10*time.Second, "How long an unanswered offer is held against one coming the other way, 0 to not detect glare")
+	fs.IntVar(&o.MaxDataSize, "max-data-size", 4096, "Largest payload of a broadcast or direct message, in bytes")
+	fs.IntVar(&o.MaxMetadataSize, "max-metadata-size", 4096, "Largest metadata document a peer may register, in bytes")
+	fs.BoolVar(&o.AllowPrivate, "allow-private", false, "Accept loopback, multicast, link-local and unlabelled private addresses in registrations")
+	fs.StringVar(&o.Tenants, "tenants", "", "Comma separated tenants reachable under /t/<tenant>/ without an API key naming them")
+	fs.IntVar(&o.TenantMaxPeers, "tenant-max-peers", 0, "Most uuids of one tenant connected to this instance (0 is unlimited)")
+	fs.StringVar(&o.SDPPolicy, "sdp-policy", "", "Rules applied to relayed offers, answers and candidates, e.g. max-size=16384,strip=H264+VP9,bundle,relay-only")
+	fs.StringVar(&o.TenantSDPPolicies, "tenant-sdp-policies", "", "Per tenant overrides of --sdp-policy, as tenant:rule,...;tenant:rule,...")
+	fs.StringVar(&o.TenantLimits, "tenant-limits", "", "Per tenant overrides of --tenant-max-peers, as tenant=max,...")
+	fs.IntVar(&o.TenantMaxEntries, "tenant-max-entries", 0, "Most registry entries one tenant may hold, out of --registry-size (0 is unlimited)")
+	fs.StringVar(&o.TenantEntryLimits, "tenant-entry-limits", "", "Per tenant overrides of --tenant-max-entries, as tenant=max,...")
+	fs.IntVar(&o.RoomMaxPeers, "room-max-peers", 0, "Most members a room can have; create_room may ask for fewer (0 is unlimited)")
+	fs.DurationVar(&o.RoomGrace, "room-grace", 0, "How long a room nobody live is in stays open before it is closed")
+	fs.StringVar(&o.RoomFull, "room-full", "reject", "What happens to joins of a full room: reject or queue")
+	fs.IntVar(&o.SendQueue, "send-queue", 256, "Messages buffered for a websocket client before it is disconnected as too slow")
+	fs.DurationVar(&o.WriteTimeout, "write-timeout", 10*time.Second, "How long a write to a websocket client may take before it is dropped")
+	fs.BoolVar(&o.Compression, "compression", false, "Offer permessage-deflate to websocket clients")
+	fs.IntVar(&o.CompressionLevel, "compression-level", flate.BestSpeed, "Deflate level used with --compression, from -2 (huffman only) to 9")
+	fs.IntVar(&o.CompressionThreshold, "compression-threshold", 512, "Smallest websocket message, in bytes, compressed with --compression")
+	fs.StringVar(&o.DebugAddr, "debug-addr", "", "Internal address to serve pprof and expvar on without authentication (disabled when empty)")
+	fs.DurationVar(&o.ShutdownDelay, "shutdown-delay", 0, "How long to fail /readyz after a shutdown signal before closing connections, so load balancers stop sending clients")
+	fs.StringVar(&o.AuditLog, "audit-log", "", "Where to write the audit log: a file, stdout, stderr or syslog (disabled when empty)")
+	fs.BoolVar(&o.Demo, "demo", false, "Serve the video chat example at /demo/")
+	fs.BoolVar(&o.APIDocs, "api-docs", false, "Serve a Swagger UI page for the client API at /api/docs")
+	fs.StringVar(&o.Authorizer, "authorizer", "allow", "Who may register, join rooms and signal whom: allow, same-room or claims")
+	fs.DurationVar(&o.DrainTimeout, "drain-timeout", 10*time.Second, "How long to wait for websocket clients to disconnect on shutdown")
+	fs.StringVar(&o.TLSCert, "tls-cert", "", "TLS certificate file, enables https/wss together with --tls-key")
+	fs.StringVar(&o.TLSKey, "tls-key", "", "TLS private key file")
+	fs.StringVar(&o.AutocertDomain, "autocert-domain", "", "Comma separated domains to obtain Let's Encrypt certificates for")
+	fs.StringVar(&o.AutocertCache, "autocert-cache", "autocert-cache", "Directory to cache Let's Encrypt certificates in")
+	fs.StringVar(&o.AutocertHTTPAddr, "autocert-http-addr", ":80", "Address to answer ACME http-01 challenges on")
+	fs.BoolVar(&o.H2C, "h2c", false, "Serve HTTP/2 without TLS (prior knowledge or Upgrade: h2c) for internal deployments")
+	fs.DurationVar(&o.HTTPReadHeaderTimeout, "http-read-header-timeout", 10*time.Second, "How long a client may take to send the request headers")
+	fs.DurationVar(&o.HTTPReadTimeout, "http-read-timeout", 30*time.Second, "How long a client may take to send a whole request")
+	fs.DurationVar(&o.HTTPWriteTimeout, "http-write-timeout", 30*time.Second, "How long writing a response may take; event streams and long polls are exempt")
+	fs.DurationVar(&o.HTTPIdleTimeout, "http-idle-timeout", 2*time.Minute, "How long an idle keep-alive connection is kept open")
+	fs.IntVar(&o.HTTPMaxHeaderBytes, "http-max-header-bytes", 64<<10, "Largest request header accepted, in bytes")
+	fs.StringVar(&o.JWTSecret, "jwt-secret", "", "HMAC secret used to verify bearer tokens")
+	fs.StringVar(&o.JWTJWKSURL, "jwt-jwks-url", "", "JWKS URL used to verify bearer tokens")
+	fs.StringVar(&o.AdminToken, "admin-token", "", "Bearer token for the /admin API, which is disabled when empty")
+	fs.BoolVar(&o.RequireAPIKey, "require-api-key", false, "Require an API key on all client endpoints")
+	fs.StringVar(&o.TurnSecret, "turn-secret", "", "Shared secret of the coturn static-auth-secret")
+	fs.StringVar(&o.TurnURLs, "turn-urls", "", "Comma separated TURN/STUN URIs handed out with credentials")
+	fs.DurationVar(&o.TurnTTL, "turn-ttl", 12*time.Hour, "Lifetime of vended TURN credentials")
+	fs.StringVar(&o.TrustedProxies, "trusted-proxies", "", "Comma separated proxy IPs/CIDRs whose forwarding headers are trusted")
+	fs.BoolVar(&o.ProxyProtocol, "proxy-protocol", false, "Read a PROXY protocol v1 or v2 header on connections from --trusted-proxies (every connection when unset)")
+	fs.StringVar(&o.RemoteIPHeaders, "remote-ip-headers", "X-Forwarded-For,X-Real-IP", "Headers holding the client IP when set by a trusted proxy")
+	fs.Float64Var(&o.IPRate, "ip-rate", 10, "Requests per second allowed from one IP on client endpoints (0 disables)")
+	fs.IntVar(&o.IPBurst, "ip-burst", 20, "Burst size for --ip-rate")
+	fs.Float64Var(&o.PeerRate, "peer-rate", 20, "Registrations and relayed messages per second allowed for one uuid (0 disables)")
+	fs.IntVar(&o.PeerBurst, "peer-burst", 40, "Burst size for --peer-rate")
+	fs.IntVar(&o.BanStrikes, "ban-strikes", 20, "Failed authentications and rate limit rejections from one IP within --ban-window that get it banned (0 disables automatic bans)")
+	fs.DurationVar(&o.BanWindow, "ban-window", time.Minute, "Period --ban-strikes are counted over")
+	fs.DurationVar(&o.BanDuration, "ban-duration", 10*time.Minute, "How long an automatic ban lasts")
+	fs.StringVar(&o.CaptchaProvider, "captcha", "", "Captcha anonymous registrations must pass: hcaptcha or turnstile (disabled when empty)")
+	fs.StringVar(&o.CaptchaSecret, "captcha-secret", "", "Secret key of the --captcha site")
+	fs.StringVar(&o.CaptchaVerifyURL, "captcha-verify-url", "", "Verification endpoint to use instead of the --captcha provider's")
+	fs.StringVar(&o.AllowedOrigins, "allowed-origins", "", "Comma separated origins allowed to use the server from a browser, * for any (default same-origin)")
+	fs.Int64Var(&o.MaxMessageSize, "max-message-size", 64*1024, "Largest websocket message accepted, in bytes")
+	fs.Float64Var(&o.MaxMessageRate, "max-message-rate", 50, "Websocket messages per second a connection may send before it is disconnected (0 disables)")
+	fs.IntVar(&o.MaxMessageBurst, "max-message-burst", 100, "Burst size for --max-message-rate")
+	fs.IntVar(&o.RegistrySize, "registry-size", 1024, "Most entries the registry holds before dropping the least recently seen")
+	fs.IntVar(&o.MetricsMaxTenants, "metrics-max-tenants", 100, "Tenants to label metrics with by name; the rest are counted together as other")
+	fs.IntVar(&o.MetricsTopRooms, "metrics-top-rooms", 10, "Busiest rooms to report by id in seven_top_room_* metrics (0 disables)")
+	fs.DurationVar(&o.EntryTTL, "entry-ttl", 10*time.Minute, "How long a registration lives without being refreshed (0 disables expiry)")
+	fs.IntVar(&o.MaxEntries, "max-entries", 100, "Most peer entries returned by one registration")
+	fs.DurationVar(&o.PeerScoreHalfLife, "peer-score-half-life", 24*time.Hour, "How long until a connection report counts half toward the score of the peer it is about (0 picks peers uniformly)")
+	fs.BoolVar(&o.ExcludeSameIP, "exclude-same-ip", false, "Leave peers registered from the requester's IP out of its entries")
+	fs.DurationVar(&o.RendezvousLead, "rendezvous-lead", 500*time.Millisecond, "How far ahead of time rendezvous punches are scheduled, to reach both peers first")
+	fs.StringVar(&o.PublicURL, "public-url", "", "URL clients reach the server at, such as https://signal.example.com (default from each request)")
+	fs.StringVar(&o.Features, "features", "", "Feature flags for every tenant, e.g. matchmaking=off,reports=on")
+	fs.StringVar(&o.TenantFeatures, "tenant-features", "", "Per tenant overrides of --features, as tenant:feature=on,...;tenant:feature=off,...")
+	fs.StringVar(&o.StaticDir, "static-dir", "", "Directory of a web app to serve at /, with index.html for unknown paths")
+	fs.DurationVar(&o.StaticMaxAge, "static-max-age", time.Hour, "How long browsers may cache --static-dir files other than HTML and fingerprinted ones")
+	fs.BoolVar(&o.MDNS, "mdns", false, "Announce the server on the local network over mDNS as _seven._tcp")
+	fs.StringVar(&o.MDNSName, "mdns-name", "", "Instance name to announce over mDNS (default the hostname)")
+	fs.StringVar(&o.NATProbeAddr, "nat-probe-addr", "", "UDP address to answer STUN NAT probes on, with a second listener on the next port (empty disables)")
+	fs.StringVar(&o.GeoIPDB, "geoip-db", "", "MaxMind GeoIP2/GeoLite2 database used to prefer nearby peers")
+}
+
+// Set sets the option of the flag name, as if given on the command line.
+func (o *Options) Set(name string, value string) error {
+	if err := o.flags.Set(name, value); err != nil {
+		return err
+	}
+	o.explicit[name] = true
+	return nil
+}
+
+// RegisterFlags adds a flag for every option to fs, for parsing a command
+// line into o. fs is the caller's; importing the package registers none.
+func (o *Options) RegisterFlags(fs *flag.FlagSet) {
+	values := o.Clone()
+	o.define(fs)
+	values.copyTo(o)
+	o.commandLines = append(o.commandLines, fs)
+}
+
+// Clone returns a copy of o.
+func (o *Options) Clone() *Options {
+	c := NewOptions()
+	o.copyTo(c)
+	return c
+}
+
+// copyTo sets dst to the options of o.
+func (o *Options) copyTo(dst *Options) {
+	o.flags.VisitAll(func(f *flag.Flag) {
+		dst.flags.Set(f.Name, f.Value.String())
+		dst.explicit[f.Name] = o.isExplicit(f.Name)
+	})
+}
+
+// isExplicit reports whether option name was set, by Set, on a command line
+// or as a field, rather than left at its default.
+func (o *Options) isExplicit(name string) bool {
+	f := o.flags.Lookup(name)
+	if o.explicit[name] || f.Value.String() != f.DefValue {
+		return true
+	}
+	for _, fs := range o.commandLines {
+		set := false
+		fs.Visit(func(f *flag.Flag) { set = set || f.Name == name })
+		if set {
+			return true
+		}
+	}
+	return false
+}
+
+// opts are the options of the server. NewServer sets them, and the package
+// reads them through the pointers below, or with setting for those a reload
+// may change.
+var opts = NewOptions()
+
+var configFile = &opts.ConfigFile
+var addr = &opts.Addr
+var grpcAddr = &opts.GRPCAddr
+var logLevel = &opts.LogLevel
+var logFormat = &opts.LogFormat
+var logSample = &opts.LogSample
+var pingInterval = &opts.PingInterval
+var pongWait = &opts.PongWait
+var registryKind = &opts.Registry
+var postgresURL = &opts.PostgresURL
+var snapshotFile = &opts.SnapshotFile
+var boltPath = &opts.BoltPath
+var redisAddr = &opts.RedisAddr
+var relayKind = &opts.Relay
+var roomStoreKind = &opts.RoomStore
+var etcdEndpoints = &opts.EtcdEndpoints
+var etcdPrefix = &opts.EtcdPrefix
+var etcdLeaseTTL = &opts.EtcdLeaseTTL
+var nodeName = &opts.NodeName
+var affinityCookie = &opts.AffinityCookie
+var clusterAddr = &opts.ClusterAddr
+var clusterAdvertise = &opts.ClusterAdvertise
+var clusterJoin = &opts.ClusterJoin
+var clusterSecret = &opts.ClusterSecret
+var resumeGrace = &opts.ResumeGrace
+var offlineQueueSize = &opts.OfflineQueueSize
+var offlineQueueTTL = &opts.OfflineQueueTTL
+var webhookURL = &opts.WebhookURL
+var webhookSecret = &opts.WebhookSecret
+var webhookEvents = &opts.WebhookEvents
+var matchSkillWindow = &opts.MatchSkillWindow
+var matchWiden = &opts.MatchWiden
+var matchTimeout = &opts.MatchTimeout
+var meshMaxPeers = &opts.MeshMaxPeers
+var duplicateUUID = &opts.DuplicateUUID
+var assignUUIDs = &opts.AssignUUIDs
+var uuidSecret = &opts.UUIDSecret
+var glareWindow = &opts.GlareWindow
+var maxDataSize = &opts.MaxDataSize
+var maxMetadataSize = &opts.MaxMetadataSize
+var allowPrivate = &opts.AllowPrivate
+var tenantsFlag = &opts.Tenants
+var tenantMaxPeers = &opts.TenantMaxPeers
+var sdpPolicyFlag = &opts.SDPPolicy
+var tenantSDPPolicies = &opts.TenantSDPPolicies
+var tenantLimits = &opts.TenantLimits
+var tenantMaxEntries = &opts.TenantMaxEntries
+var tenantEntryLimits = &opts.TenantEntryLimits
+var roomMaxPeers = &opts.RoomMaxPeers
+var roomGrace = &opts.RoomGrace
+var roomFull = &opts.RoomFull
+var sendQueue = &opts.SendQueue
+var writeTimeout = &opts.WriteTimeout
+var compression = &opts.Compression
+var compressionLevel = &opts.CompressionLevel
+var compressionThreshold = &opts.CompressionThreshold
+var debugAddr = &opts.DebugAddr
+var shutdownDelay = &opts.ShutdownDelay
+var auditLog = &opts.AuditLog
+var demo = &opts.Demo
+var apiDocsEnabled = &opts.APIDocs
+var authorizerKind = &opts.Authorizer
+var drainTimeout = &opts.DrainTimeout
+var tlsCert = &opts.TLSCert
+var tlsKey = &opts.TLSKey
+var autocertDomain = &opts.AutocertDomain
+var autocertCache = &opts.AutocertCache
+var autocertHTTPAddr = &opts.AutocertHTTPAddr
+var h2cEnabled = &opts.H2C
+var httpReadHeaderTimeout = &opts.HTTPReadHeaderTimeout
+var httpReadTimeout = &opts.HTTPReadTimeout
+var httpWriteTimeout = &opts.HTTPWriteTimeout
+var httpIdleTimeout = &opts.HTTPIdleTimeout
+var httpMaxHeaderBytes = &opts.HTTPMaxHeaderBytes
+var jwtSecret = &opts.JWTSecret
+var jwtJWKSURL = &opts.JWTJWKSURL
+var adminToken = &opts.AdminToken
+var requireAPIKeys = &opts.RequireAPIKey
+var turnSecret = &opts.TurnSecret
+var turnURLs = &opts.TurnURLs
+var turnTTL = &opts.TurnTTL
+var trustedProxies = &opts.TrustedProxies
+var proxyProtocol = &opts.ProxyProtocol
+var remoteIPHeaders = &opts.RemoteIPHeaders
+var ipRate = &opts.IPRate
+var ipBurst = &opts.IPBurst
+var peerRate = &opts.PeerRate
+var peerBurst = &opts.PeerBurst
+var banStrikes = &opts.BanStrikes
+var banWindow = &opts.BanWindow
+var banDuration = &opts.BanDuration
+var captchaProvider = &opts.CaptchaProvider
+var captchaSecret = &opts.CaptchaSecret
+var captchaVerifyURLFlag = &opts.CaptchaVerifyURL
+var allowedOriginsFlag = &opts.AllowedOrigins
+var maxMessageSize = &opts.MaxMessageSize
+var maxMessageRate = &opts.MaxMessageRate
+var maxMessageBurst = &opts.MaxMessageBurst
+var registrySize = &opts.RegistrySize
+var metricsMaxTenants = &opts.MetricsMaxTenants
+var metricsTopRooms = &opts.MetricsTopRooms
+var entryTTL = &opts.EntryTTL
+var maxEntries = &opts.MaxEntries
+var peerScoreHalfLife = &opts.PeerScoreHalfLife
+var excludeSameIP = &opts.ExcludeSameIP
+var rendezvousLead = &opts.RendezvousLead
+var publicURLFlag = &opts.PublicURL
+var featuresFlag = &opts.Features
+var tenantFeaturesFlag = &opts.TenantFeatures
+var staticDir = &opts.StaticDir
+var staticMaxAge = &opts.StaticMaxAge
+var mdnsEnabled = &opts.MDNS
+var mdnsName = &opts.MDNSName
+var natProbeAddr = &opts.NATProbeAddr
+var geoIPDB = &opts.GeoIPDB
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// allowedOrigins holds the --allowed-origins list. Empty means same-origin
+// only, which is also what the upgrader does by default.
+var allowedOrigins = map[string]bool{}
+
+func parseOrigins(list string) map[string]bool {
+	origins := map[string]bool{}
+	for _, o := range strings.Split(list, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			origins[strings.ToLower(strings.TrimSuffix(o, "/"))] = true
+		}
+	}
+	return origins
+}
+
+func originAllowed(r *http.Request, origin string) bool {
+	origins := setting(&allowedOrigins)
+	if len(origins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	return origins["*"] || origins[strings.ToLower(origin)]
+}
+
+// checkOrigin is the websocket upgrader's CheckOrigin. Requests without an
+// Origin header come from non-browser clients and are let through.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || originAllowed(r, origin) {
+		return true
+	}
+	log.Warn().Str("origin", origin).Msg("Rejected websocket origin")
+	return false
+}
+
+// cors adds CORS headers for allowed origins and answers preflight requests.
+func cors(ctx *gin.Context) {
+	origin := ctx.GetHeader("Origin")
+	if origin == "" || len(setting(&allowedOrigins)) == 0 || !originAllowed(ctx.Request, origin) {
+		ctx.Next()
+		return
+	}
+
+	h := ctx.Writer.Header()
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Add("Vary", "Origin")
+	h.Set("Access-Control-Expose-Headers", "X-Request-ID, X-Seven-Protocol, Deprecation, Link")
+	if ctx.Request.Method == http.MethodOptions {
+		h.Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-API-Key, X-Request-ID, X-Seven-Protocol")
+		h.Set("Access-Control-Max-Age", "600")
+		ctx.AbortWithStatus(http.StatusNoContent)
+		return
+	}
+	ctx.Next()
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hoyle1974/seven/internal/ws"
+)
+
+const (
+	defaultPollTimeout = 25 * time.Second
+	maxPollTimeout     = 55 * time.Second
+)
+
+// pollSession returns the long poll session for id, starting one if needed.
+// A session nobody has polled for --pong-wait is closed. Only its owner
+// gets an open session; anyone else is refused with a response.
+func pollSession(ctx *gin.Context, id string) (*httpSession, bool) {
+	if hs, ok := lookupHTTPSession(id); ok && hs.idle != nil && !hs.t.isClosed() {
+		if !ownsHTTPSession(ctx, hs) {
+			respondError(ctx, http.StatusConflict, "session_exists", "another session is open for the uuid", nil)
+			return nil, false
+		}
+		hs.idle.Reset(*pongWait)
+		return hs, true
+	}
+	hs, err := openHTTPSession(ctx, id, *pongWait)
+	if err == errSessionExists {
+		respondError(ctx, http.StatusConflict, "session_exists", "another session is open for the uuid", nil)
+		return nil, false
+	}
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error opening long poll session")
+		respondError(ctx, http.StatusInternalServerError, "internal", "error", nil)
+		return nil, false
+	}
+	return hs, true
+}
+
+// pollWait holds the request until there are messages for the uuid in the
+// path or the timeout (?timeout=, 25s by default) passes.
+func pollWait(ctx *gin.Context) {
+	id := ctx.Param("uuid")
+	if !subjectAllows(ctx.GetString(subjectKey), id) {
+		respondError(ctx, http.StatusForbidden, "subject_mismatch", "uuid does not match token subject", nil)
+		return
+	}
+	if !uuidAllowed(id, ctx.Query("uuid_token")) {
+		respondError(ctx, http.StatusForbidden, "invalid_uuid_token", "missing or invalid uuid_token", nil)
+		return
+	}
+	if !tenantAllows(ctx.Request.Context(), ctx.GetString(tenantKey), id) {
+		respondError(ctx, http.StatusForbidden, "other_tenant", "uuid belongs to another tenant", nil)
+		return
+	}
+	timeout := defaultPollTimeout
+	if v := ctx.Query("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			respondError(ctx, http.StatusBadRequest, "invalid_timeout", "invalid timeout", nil)
+			return
+		}
+		timeout = min(d, maxPollTimeout)
+	}
+
+	extendDeadlines(ctx.Writer, timeout+*httpWriteTimeout)
+	hs, ok := pollSession(ctx, id)
+	if !ok {
+		return
+	}
+	defer hs.idle.Reset(*pongWait)
+	if peer := hs.peer(); peer != "" {
+		touchEntry(ctx.Request.Context(), peer)
+	}
+
+	wait := time.NewTimer(timeout)
+	defer wait.Stop()
+	select {
+	case <-hs.t.notify:
+	case <-wait.C:
+	case <-ctx.Request.Context().Done():
+		return
+	case <-hs.t.closed:
+		ctx.JSON(http.StatusOK, gin.H{"status": "closed", "code": hs.t.code, "reason": hs.t.reason, "messages": hs.t.take()})
+		return
+	}
+	messages := hs.t.take()
+	if messages == nil {
+		messages = []ws.Message{}
+	}
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok", "messages": messages, "session_token": hs.token})
+}
+
+// pollPost handles a client message for the long poll session of the uuid
+// in the path. Replies are returned by the next poll.
+func pollPost(ctx *gin.Context) {
+	id := ctx.Param("uuid")
+	if !subjectAllows(ctx.GetString(subjectKey), id) {
+		respondError(ctx, http.StatusForbidden, "subject_mismatch", "uuid does not match token subject", nil)
+		return
+	}
+	if !uuidAllowed(id, ctx.Query("uuid_token")) {
+		respondError(ctx, http.StatusForbidden, "invalid_uuid_token", "missing or invalid uuid_token", nil)
+		return
+	}
+	if !tenantAllows(ctx.Request.Context(), ctx.GetString(tenantKey), id) {
+		respondError(ctx, http.StatusForbidden, "other_tenant", "uuid belongs to another tenant", nil)
+		return
+	}
+	var msg ws.Message
+	if err := ctx.BindJSON(&msg); err != nil {
+		reqLog(ctx).Err(err).Msg("Error parsing message")
+		respondError(ctx, http.StatusNotAcceptable, "invalid_json", "error parsing json", nil)
+		return
+	}
+
+	hs, ok := pollSession(ctx, id)
+	if !ok {
+		return
+	}
+	if err := hs.dispatch(id, msg); err != nil {
+		reqLog(ctx).Err(err).Str("uuid", id).Msg("Error handling message")
+		respondError(ctx, http.StatusServiceUnavailable, "message_queue_full", "message queue full", nil)
+		return
+	}
+	ctx.JSON(http.StatusAccepted, gin.H{"status": "ok", "session_token": hs.token})
+}
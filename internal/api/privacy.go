@@ -0,0 +1,42 @@
+package api
+
+// Privacy mode keeps peers from learning each other's IP addresses, for
+// applications where that could get someone doxxed. It applies to every
+// peer of a tenant whose SDP policy is relay-only, and to the members of
+// rooms created with relay_only: only TURN relay candidates get through, and
+// entries handed out for them carry no addresses.
+
+// signalPolicy is the SDP policy for signals of tenant's peers within room,
+// that of the tenant, made relay-only if the room is.
+func signalPolicy(tenant string, room string) *sdpPolicy {
+	p := sdpPolicyOf(tenant)
+	if room == "" || (p != nil && p.relayOnly) || !rooms.RelayOnly(room) {
+		return p
+	}
+	relayOnly := sdpPolicy{strip: map[string]bool{}}
+	if p != nil {
+		relayOnly = *p
+	}
+	relayOnly.relayOnly = true
+	return &relayOnly
+}
+
+// addressesHidden reports whether the addresses of peer, of tenant, must
+// not be handed out.
+func addressesHidden(tenant string, peer string) bool {
+	if p := sdpPolicyOf(tenant); p != nil && p.relayOnly {
+		return true
+	}
+	room := rooms.RoomOf(peer)
+	return room != "" && rooms.RelayOnly(room)
+}
+
+// hideAddresses blanks the addresses of the entries of tenant's peers in
+// privacy mode.
+func hideAddresses(tenant string, entries []EntryForm) {
+	for i := range entries {
+		if addressesHidden(tenant, entries[i].Uuid) {
+			entries[i].Address, entries[i].Addrs, entries[i].SameNetwork = "", nil, false
+		}
+	}
+}
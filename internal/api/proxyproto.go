@@ -0,0 +1,245 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// With --proxy-protocol an L4 load balancer passes the client's address in a
+// PROXY protocol (v1 or v2) header in front of each connection, so
+// RemoteAddr, and with it rate limiting, GeoIP and the observed address, is
+// the client's rather than the balancer's. Headers are only expected from
+// --trusted-proxies, when set; other peers connect as they are.
+
+// proxyHeaderTimeout is how long a connection has to send its header.
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyHeader = errors.New("Invalid PROXY protocol header")
+
+// trustedPrefixes are --trusted-proxies, parsed.
+var trustedPrefixes []netip.Prefix
+
+func initTrustedProxies(list string) error {
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			addr, err := netip.ParseAddr(p)
+			if err != nil {
+				return fmt.Errorf("Invalid trusted proxy %q", p)
+			}
+			p = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()).String()
+		}
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return fmt.Errorf("Invalid trusted proxy %q", p)
+		}
+		trustedPrefixes = append(trustedPrefixes, prefix.Masked())
+	}
+	return nil
+}
+
+// trustedProxy reports whether ip is one of --trusted-proxies.
+func trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	for _, p := range trustedPrefixes {
+		if p.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyListener reads the PROXY header of the connections it accepts.
+type proxyListener struct {
+	net.Listener
+}
+
+func listenProxied(lis net.Listener) net.Listener {
+	if !*proxyProtocol {
+		return lis
+	}
+	return proxyListener{lis}
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	if len(trustedPrefixes) > 0 && !trustedProxy(host) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c}, nil
+}
+
+// proxyConn reads the header on first use rather than in Accept, so a slow
+// client holds up only its own connection.
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.r = bufio.NewReader(c.Conn)
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			log.Debug().Err(c.err).Str("addr", c.Conn.RemoteAddr().String()).Msg("Rejected connection")
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init(); c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a v1 or v2 header from r. It returns the client's
+// address, or nil for headers without one: v1 UNKNOWN and v2 LOCAL, which
+// balancers use for their own health checks.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyV1(r)
+	}
+	return nil, errProxyHeader
+}
+
+// readProxyV1 parses "PROXY TCP4 <src> <dst> <sport> <dport>\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errProxyHeader
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readProxyV2 parses the binary header: the signature, version and command,
+// address family, length and the addresses, followed by TLVs it skips.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var head [16]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	switch head[12] & 0x0f {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, errProxyHeader
+	}
+
+	var ip netip.Addr
+	var port []byte
+	switch head[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errProxyHeader
+		}
+		ip, port = netip.AddrFrom4([4]byte(body[:4])), body[8:10]
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errProxyHeader
+		}
+		ip, port = netip.AddrFrom16([16]byte(body[:16])).Unmap(), body[32:34]
+	default:
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(port))), nil
+}
+
+// forwardedIP is gin's ClientIP for gRPC: the client IP in the
+// --remote-ip-headers metadata a trusted proxy at ip set, or ip itself.
+func forwardedIP(ip string, header func(string) string) string {
+	if !trustedProxy(ip) {
+		return ip
+	}
+	for _, name := range strings.Split(*remoteIPHeaders, ",") {
+		// X-Forwarded-For lists every hop; the client is the last one that
+		// is not a trusted proxy.
+		hops := strings.Split(header(strings.ToLower(strings.TrimSpace(name))), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if _, err := netip.ParseAddr(hop); err != nil {
+				break
+			}
+			if i == 0 || !trustedProxy(hop) {
+				return hop
+			}
+		}
+	}
+	return ip
+}
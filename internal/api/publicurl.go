@@ -0,0 +1,126 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Pages and the SDK config need the URL clients reach the server at, which
+// behind a proxy or load balancer is not the one requests arrive on. With
+// --public-url it is fixed. Without it the scheme is wss when the request
+// came over TLS, or a trusted proxy says in X-Forwarded-Proto or Forwarded
+// that it did, and the host is the request's, or the proxy's
+// X-Forwarded-Host.
+
+// publicBase is --public-url as a ws or wss URL without a trailing slash.
+var publicBase string
+
+func initPublicURL() error {
+	if *publicURLFlag == "" {
+		return nil
+	}
+	u, err := url.Parse(*publicURLFlag)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("Invalid --public-url %q", *publicURLFlag)
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return fmt.Errorf("Invalid --public-url scheme %q, want http, https, ws or wss", u.Scheme)
+	}
+	u.RawQuery, u.Fragment = "", ""
+	publicBase = strings.TrimSuffix(u.String(), "/")
+	return nil
+}
+
+// publicURL is the ws or wss base URL clients of ctx's request connect to.
+func publicURL(ctx *gin.Context) string {
+	if publicBase != "" {
+		return publicBase
+	}
+	r := ctx.Request
+	scheme, host := "ws", r.Host
+	if r.TLS != nil {
+		scheme = "wss"
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil && trustedProxy(ip) {
+		proto, fwdHost := forwardedProto(r.Header)
+		switch strings.ToLower(proto) {
+		case "https", "wss":
+			scheme = "wss"
+		case "http", "ws":
+			scheme = "ws"
+		}
+		if fwdHost != "" {
+			host = fwdHost
+		}
+	}
+	return scheme + "://" + host
+}
+
+// forwardedProto is the scheme and host the first proxy saw, from
+// X-Forwarded-Proto and X-Forwarded-Host or else Forwarded (RFC 7239).
+func forwardedProto(h http.Header) (proto string, host string) {
+	first := func(v string) string {
+		v, _, _ = strings.Cut(v, ",")
+		return strings.TrimSpace(v)
+	}
+	proto, host = first(h.Get("X-Forwarded-Proto")), first(h.Get("X-Forwarded-Host"))
+	if proto != "" || host != "" {
+		return proto, host
+	}
+	for _, pair := range strings.Split(first(h.Get("Forwarded")), ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		v = strings.Trim(v, `"`)
+		switch strings.ToLower(k) {
+		case "proto":
+			proto = v
+		case "host":
+			host = v
+		}
+	}
+	return proto, host
+}
+
+// httpURL is the http(s) form of the ws(s) URL u.
+func httpURL(u string) string {
+	return "http" + strings.TrimPrefix(u, "ws")
+}
+
+// SDKConfig tells a client where to connect, for apps that load it rather
+// than build the URLs themselves.
+type SDKConfig struct {
+	URL        string `json:"url"`      // base URL for the SDKs, such as wss://signal.example.com
+	Register   string `json:"register"` // the signaling websocket
+	SDK        string `json:"sdk"`      // the browser SDK script
+	SDKVersion string `json:"sdk_version"`
+	Protocols  []int  `json:"protocols"`
+}
+
+func sdkConfigFor(ctx *gin.Context) SDKConfig {
+	base := publicURL(ctx)
+	root := base
+	if tenant := ctx.Param("tenant"); tenant != "" {
+		base += "/t/" + tenant
+	}
+	return SDKConfig{
+		URL:        base,
+		Register:   base + "/api/v1/ws/register",
+		SDK:        httpURL(root) + "/sdk/" + sdkBuild + "/seven.js",
+		SDKVersion: sdkVersion,
+		Protocols:  protocolVersions,
+	}
+}
+
+func sdkConfig(ctx *gin.Context) {
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.JSON(http.StatusOK, sdkConfigFor(ctx))
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"golang.org/x/time/rate"
+)
+
+// limiterSet hands out a token bucket per key. Buckets live in an LRU so a
+// flood of distinct IPs cannot grow it without bound.
+type limiterSet struct {
+	mu       sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters *lru.Cache[string, *rate.Limiter]
+}
+
+// newLimiterSet makes a set allowing perSecond, or anything if that is not
+// positive.
+func newLimiterSet(perSecond float64, burst int) *limiterSet {
+	limiters, _ := lru.New[string, *rate.Limiter](65536)
+	l := &limiterSet{limiters: limiters}
+	l.configure(perSecond, burst)
+	return l
+}
+
+// configure changes the rate of l, keeping the tokens buckets have left.
+func (l *limiterSet) configure(perSecond float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit, l.burst = rate.Limit(max(perSecond, 0)), burst
+	for _, key := range l.limiters.Keys() {
+		if limiter, ok := l.limiters.Peek(key); ok {
+			limiter.SetLimit(l.limit)
+			limiter.SetBurst(l.burst)
+		}
+	}
+}
+
+// allow takes a token for key. When none is left it returns how long the
+// caller should wait before retrying.
+func (l *limiterSet) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	if l.limit == 0 {
+		l.mu.Unlock()
+		return true, 0
+	}
+	limiter, ok := l.limiters.Get(key)
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters.Add(key, limiter)
+	}
+	l.mu.Unlock()
+
+	now := time.Now()
+	r := limiter.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// messageLimiter is the --max-message-rate bucket of one connection. It
+// follows reloads of the flags, keeping the tokens it has left.
+type messageLimiter struct {
+	limiter *rate.Limiter
+}
+
+// allow takes a token, reporting false once the connection floods.
+func (m *messageLimiter) allow() bool {
+	settingsMu.RLock()
+	perSecond, burst := *maxMessageRate, max(*maxMessageBurst, 1)
+	settingsMu.RUnlock()
+	if perSecond <= 0 {
+		return true
+	}
+	switch {
+	case m.limiter == nil:
+		m.limiter = rate.NewLimiter(rate.Limit(perSecond), burst)
+	case m.limiter.Limit() != rate.Limit(perSecond) || m.limiter.Burst() != burst:
+		m.limiter.SetLimit(rate.Limit(perSecond))
+		m.limiter.SetBurst(burst)
+	}
+	return m.limiter.Allow()
+}
+
+var ipLimits *limiterSet
+var peerLimits *limiterSet
+
+func initRateLimits() {
+	ipLimits = newLimiterSet(*ipRate, *ipBurst)
+	peerLimits = newLimiterSet(*peerRate, *peerBurst)
+}
+
+func retryAfterSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+func abortRateLimited(ctx *gin.Context, retry time.Duration) {
+	ctx.Header("Retry-After", strconv.Itoa(retryAfterSeconds(retry)))
+	abortClient(ctx, http.StatusTooManyRequests, "rate_limited", "rate limited")
+}
+
+// rateLimitIP is middleware limiting requests per client IP.
+func rateLimitIP(ctx *gin.Context) {
+	if ok, retry := ipLimits.allow(ctx.ClientIP()); !ok {
+		reqLog(ctx).Warn().Str("ip", ctx.ClientIP()).Str("path", ctx.Request.URL.Path).Msg("Rate limited")
+		abortRateLimited(ctx, retry)
+		return
+	}
+	ctx.Next()
+}
@@ -0,0 +1,26 @@
+package api
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ObservedAddress is the client's address as seen by the server, which for a
+// peer behind NAT is its public (server reflexive) address.
+type ObservedAddress struct {
+	IP   string `json:"ip"`
+	Port int    `json:"port,omitempty"`
+}
+
+// observedAddress uses gin's trusted proxy handling for the IP. The port is
+// only known when the client connected directly.
+func observedAddress(ctx *gin.Context) ObservedAddress {
+	obs := ObservedAddress{IP: ctx.ClientIP()}
+	host, port, err := net.SplitHostPort(ctx.Request.RemoteAddr)
+	if err == nil && host == obs.IP {
+		obs.Port, _ = strconv.Atoi(port)
+	}
+	return obs
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hoyle1974/seven/internal/registry"
+	"github.com/hoyle1974/seven/internal/ws"
+	"github.com/rs/zerolog/log"
+)
+
+// peerRegistry stores the registered peers of the one Server running.
+var peerRegistry registry.Registry
+
+// closeRegistry releases the connection or file of the registry backend, nil
+// when it has none.
+var closeRegistry func() error
+
+// initRegistry creates the backend named by kind, holding up to size entries
+// and dropping those that have not re-registered within ttl. A ttl of zero
+// disables expiry.
+func initRegistry(kind string, size int, ttl time.Duration) error {
+	closeRegistry = nil
+	if hooks.Registry != nil {
+		peerRegistry = tracedRegistry{hooks.Registry}
+		apiKeys = newMemoryKeyStore()
+		banStore = newMemoryBanStore()
+		return nil
+	}
+	switch kind {
+	case "memory":
+		peerRegistry = tracedRegistry{registry.NewMemory(size, ttl, entriesDropped)}
+		apiKeys = newMemoryKeyStore()
+		banStore = newMemoryBanStore()
+	case "redis":
+		r, err := registry.NewRedis(*redisAddr, size, ttl, entriesDropped)
+		if err != nil {
+			return err
+		}
+		peerRegistry = tracedRegistry{r}
+		closeRegistry = r.Client.Close
+		apiKeys = &redisKeyStore{client: r.Client}
+		banStore = &redisBanStore{client: r.Client}
+	case "bolt":
+		r, err := registry.NewBolt(*boltPath, size, ttl, entriesDropped, boltAPIKeysBucket, boltAPIKeyHashesBucket, boltBansBucket)
+		if err != nil {
+			return err
+		}
+		peerRegistry = tracedRegistry{r}
+		closeRegistry = r.DB.Close
+		apiKeys = &boltKeyStore{db: r.DB}
+		banStore = &boltBanStore{db: r.DB}
+	case "cluster":
+		r, err := newClusterRegistry(size, ttl, entriesDropped)
+		if err != nil {
+			return err
+		}
+		peerRegistry = tracedRegistry{r}
+		apiKeys = newMemoryKeyStore()
+		banStore = newMemoryBanStore()
+	case "postgres":
+		r, err := registry.NewPostgres(*postgresURL, size, ttl, entriesDropped)
+		if err != nil {
+			return err
+		}
+		peerRegistry = tracedRegistry{r}
+		closeRegistry = func() error {
+			r.Pool.Close()
+			return nil
+		}
+		apiKeys = &postgresKeyStore{pool: r.Pool}
+		banStore = &postgresBanStore{pool: r.Pool}
+	default:
+		return fmt.Errorf("Unknown registry %q", kind)
+	}
+	return nil
+}
+
+// entriesDropped accounts for entries a backend dropped by itself, because
+// the registry was full ("size") or they were not refreshed in time ("ttl").
+// Backends may call it while holding locks of their own, so the peers are
+// let go of in the background, unless they registered again in the meantime.
+func entriesDropped(reason string, ids ...string) {
+	metricEvictions.WithLabelValues(reason).Add(float64(len(ids)))
+	for _, id := range ids {
+		log.Info().Str("uuid", id).Str("reason", reason).Msg("Registry entry dropped")
+		events.publish(Event{Type: EventPeerExpired, UUID: id, Reason: reason})
+	}
+	go func() {
+		for _, id := range ids {
+			peerDropped(id, reason)
+		}
+	}()
+}
+
+// peerDropped lets go of a peer whose entry the registry dropped: a client
+// still connected as it is closed with CloseEntryDropped so it registers
+// again, and its room is told it left.
+func peerDropped(id string, reason string) {
+	if _, ok, err := peerRegistry.Get(context.Background(), id); err != nil {
+		log.Err(err).Str("uuid", id).Msg("Error checking dropped registry entry")
+	} else if ok {
+		log.Debug().Str("uuid", id).Msg("Dropped registry entry is back, keeping its peer")
+		return
+	}
+	sessions := connections.Sessions(id)
+	for _, s := range sessions {
+		connections.Remove(s)
+	}
+	resumes.forget(id)
+	matches.remove(id)
+	leaveRoom(id, "dropped")
+	for _, s := range sessions {
+		if err := s.t.CloseWith(ws.CloseEntryDropped, "registration dropped: "+reason); err != nil {
+			log.Err(err).Msg("Error sending close frame")
+		}
+	}
+}
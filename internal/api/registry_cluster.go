@@ -0,0 +1,203 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hoyle1974/seven/internal/cluster"
+	"github.com/hoyle1974/seven/internal/registry"
+	"github.com/rs/zerolog/log"
+)
+
+// --registry=cluster keeps the peers registered with each instance in its
+// own memory registry and gossips a digest of it, a version bumped on every
+// change. Members whose digest changed are asked for their entries, so
+// every instance hands out the peers of all of them.
+
+const registryPath = "/seven/v1/registry"
+
+// clusterEntries is set with --registry=cluster.
+var clusterEntries *clusterRegistry
+
+type clusterRegistry struct {
+	local   *registry.Memory
+	version atomic.Uint64
+
+	mu      sync.RWMutex
+	remote  map[string]map[string]registry.Entry // by member, then uuid
+	pulled  map[string]string                    // digest of what remote has of each member
+	pulling map[string]bool
+}
+
+func newClusterRegistry(size int, ttl time.Duration, dropped registry.DropFunc) (*clusterRegistry, error) {
+	if members == nil {
+		return nil, errClusterOff
+	}
+	r := &clusterRegistry{
+		remote:  make(map[string]map[string]registry.Entry),
+		pulled:  make(map[string]string),
+		pulling: make(map[string]bool),
+	}
+	r.version.Store(uint64(time.Now().UnixNano()))
+	r.local = registry.NewMemory(size, ttl, func(reason string, ids ...string) {
+		r.changed()
+		dropped(reason, ids...)
+	})
+	members.Handle(registryPath, http.HandlerFunc(r.serveEntries))
+	r.changed()
+	clusterEntries = r
+	return r, nil
+}
+
+// changed gossips a new digest.
+func (r *clusterRegistry) changed() {
+	members.SetMeta("registry", strconv.FormatUint(r.version.Add(1), 36))
+}
+
+func (r *clusterRegistry) Add(ctx context.Context, e registry.Entry) error {
+	if err := r.local.Add(ctx, e); err != nil {
+		return err
+	}
+	r.changed()
+	return nil
+}
+
+func (r *clusterRegistry) Get(ctx context.Context, uuid string) (registry.Entry, bool, error) {
+	if e, ok, err := r.local.Get(ctx, uuid); ok || err != nil {
+		return e, ok, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, entries := range r.remote {
+		if e, ok := entries[uuid]; ok {
+			return e, true, nil
+		}
+	}
+	return registry.Entry{}, false, nil
+}
+
+// Remove only removes entries of this instance; the others remove theirs.
+func (r *clusterRegistry) Remove(ctx context.Context, uuid string) (bool, error) {
+	ok, err := r.local.Remove(ctx, uuid)
+	if ok {
+		r.changed()
+	}
+	return ok, err
+}
+
+func (r *clusterRegistry) Values(ctx context.Context) ([]registry.Entry, error) {
+	values, err := r.local.Values(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(values))
+	for _, e := range values {
+		seen[e.UUID.String()] = true
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, entries := range r.remote {
+		for id, e := range entries {
+			if !seen[id] {
+				seen[id] = true
+				values = append(values, e)
+			}
+		}
+	}
+	return values, nil
+}
+
+func (r *clusterRegistry) Len(ctx context.Context) (int, error) {
+	values, err := r.Values(ctx)
+	return len(values), err
+}
+
+func (r *clusterRegistry) Ping(ctx context.Context) error {
+	return members.Ping(ctx)
+}
+
+// membersChanged drops the entries of members that are gone and pulls
+// those of members whose digest changed.
+func (r *clusterRegistry) membersChanged(list []cluster.Member) {
+	live := make(map[string]bool, len(list))
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range list {
+		live[m.Name] = true
+		if m.Name == members.Name() || r.pulling[m.Name] || r.pulled[m.Name] == m.Meta["registry"] {
+			continue
+		}
+		r.pulling[m.Name] = true
+		go r.pull(m.Name)
+	}
+	for name := range r.remote {
+		if !live[name] {
+			delete(r.remote, name)
+			delete(r.pulled, name)
+		}
+	}
+}
+
+// pull fetches the entries of member name until they match its digest.
+func (r *clusterRegistry) pull(name string) {
+	defer func() {
+		r.mu.Lock()
+		delete(r.pulling, name)
+		r.mu.Unlock()
+	}()
+	for {
+		digest, ok := digestOf(name)
+		if !ok {
+			return
+		}
+		r.mu.RLock()
+		current := r.pulled[name] == digest
+		r.mu.RUnlock()
+		if current {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		reply, err := members.Call(ctx, name, registryPath, nil)
+		cancel()
+		var list []registry.Entry
+		if err == nil {
+			err = json.Unmarshal(reply, &list)
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("node", name).Msg("Error pulling registry from cluster member")
+			return
+		}
+		entries := make(map[string]registry.Entry, len(list))
+		for _, e := range list {
+			entries[e.UUID.String()] = e
+		}
+		r.mu.Lock()
+		r.remote[name], r.pulled[name] = entries, digest
+		r.mu.Unlock()
+	}
+}
+
+// digestOf is the registry digest member name gossips, if it is live.
+func digestOf(name string) (string, bool) {
+	for _, m := range members.Members() {
+		if m.Name == name {
+			return m.Meta["registry"], true
+		}
+	}
+	return "", false
+}
+
+func (r *clusterRegistry) serveEntries(w http.ResponseWriter, req *http.Request) {
+	values, err := r.local.Values(req.Context())
+	if err != nil {
+		http.Error(w, "error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(values)
+}
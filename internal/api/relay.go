@@ -0,0 +1,26 @@
+package api
+
+import (
+	"fmt"
+)
+
+func initRelay(kind string) error {
+	switch kind {
+	case "none":
+	case "redis":
+		r, err := newRedisRelay(*redisAddr, connections.DeliverLocal)
+		if err != nil {
+			return err
+		}
+		connections.SetRelay(r)
+	case "cluster":
+		r, err := newClusterRelay(connections.DeliverLocal)
+		if err != nil {
+			return err
+		}
+		connections.SetRelay(r)
+	default:
+		return fmt.Errorf("Unknown relay %q", kind)
+	}
+	return nil
+}
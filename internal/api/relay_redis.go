@@ -0,0 +1,65 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hoyle1974/seven/internal/ws"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+const redisPeerChannelPrefix = "seven:peer:"
+
+// redisRelay routes messages over one pub/sub channel per uuid. Each node
+// subscribes to the channels of the peers connected to it.
+type redisRelay struct {
+	client *redis.Client
+	pubsub *redis.PubSub
+}
+
+func newRedisRelay(addr string, deliver func(uuid string, msg ws.Message)) (*redisRelay, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		return nil, fmt.Errorf("Error connecting to redis at %s: %w", addr, err)
+	}
+
+	r := &redisRelay{client: client, pubsub: client.Subscribe(context.Background())}
+	go func() {
+		for m := range r.pubsub.Channel() {
+			var msg ws.Message
+			if err := json.Unmarshal([]byte(m.Payload), &msg); err != nil {
+				log.Err(err).Str("channel", m.Channel).Msg("Error decoding relayed message")
+				continue
+			}
+			deliver(strings.TrimPrefix(m.Channel, redisPeerChannelPrefix), msg)
+		}
+	}()
+	return r, nil
+}
+
+func (r *redisRelay) Publish(uuid string, msg ws.Message) (bool, error) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return false, err
+	}
+	n, err := r.client.Publish(context.Background(), redisPeerChannelPrefix+uuid, b).Result()
+	return n > 0, err
+}
+
+func (r *redisRelay) Subscribe(uuid string) error {
+	return r.pubsub.Subscribe(context.Background(), redisPeerChannelPrefix+uuid)
+}
+
+func (r *redisRelay) Unsubscribe(uuid string) error {
+	return r.pubsub.Unsubscribe(context.Background(), redisPeerChannelPrefix+uuid)
+}
+
+func (r *redisRelay) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
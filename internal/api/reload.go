@@ -0,0 +1,294 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// --config names a file of flags, one `name = value` per line, read when the
+// server is created. Options given on the command line, or set by a program
+// embedding the server, win over it.
+//
+// SIGHUP and POST /admin/reload read the file again and apply the flags in
+// reloadable without dropping anybody; the ban list is reloaded from its
+// store too. A flag whose line was removed goes back to its default. Other
+// flags that changed are only logged as needing a restart. Flags a reload
+// can change are read with setting, under settingsMu.
+
+var reloadable = map[string]bool{
+	"log-level":         true,
+	"ip-rate":           true,
+	"ip-burst":          true,
+	"peer-rate":         true,
+	"peer-burst":        true,
+	"max-message-rate":  true,
+	"max-message-burst": true,
+	"allowed-origins":   true,
+	"ban-strikes":       true,
+	"ban-window":        true,
+	"ban-duration":      true,
+	"room-max-peers":    true,
+	"tenant-max-peers":  true,
+	"tenant-limits":     true,
+	"features":          true,
+	"tenant-features":   true,
+}
+
+var settingsMu sync.RWMutex
+
+// setting reads a flag a reload may change.
+func setting[T any](p *T) T {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return *p
+}
+
+// explicitFlags were set in the Options the server was created with.
+var explicitFlags = map[string]bool{}
+
+// configuredFlags are the flags the config file set, last it was read.
+var configuredFlags = map[string]bool{}
+
+// reloadMu serializes reloads.
+var reloadMu sync.Mutex
+
+// readConfigFile parses the --config file.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		name, value = strings.TrimLeft(strings.TrimSpace(name), "-"), strings.TrimSpace(value)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: want name = value", path, n)
+		}
+		if opts.flags.Lookup(name) == nil || name == "config" {
+			return nil, fmt.Errorf("%s:%d: unknown flag %q", path, n, name)
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		values[name] = value
+	}
+	return values, scanner.Err()
+}
+
+// loadConfig applies the --config file at startup.
+func loadConfig() error {
+	opts.flags.VisitAll(func(f *flag.Flag) {
+		if opts.isExplicit(f.Name) {
+			explicitFlags[f.Name] = true
+		}
+	})
+	if *configFile == "" {
+		return nil
+	}
+	values, err := readConfigFile(*configFile)
+	if err != nil {
+		return fmt.Errorf("Error reading --config: %w", err)
+	}
+	for name, value := range values {
+		if explicitFlags[name] {
+			continue
+		}
+		if err := opts.flags.Set(name, value); err != nil {
+			return fmt.Errorf("Error setting %s from %s: %w", name, *configFile, err)
+		}
+		configuredFlags[name] = true
+	}
+	return nil
+}
+
+// sameValue reports whether value means what f is set to, so "60s" is the
+// same as a duration of "1m0s".
+func sameValue(f *flag.Flag, value string) bool {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return f.Value.String() == value
+	}
+	switch current := getter.Get().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		return err == nil && d == current
+	case bool:
+		b, err := strconv.ParseBool(value)
+		return err == nil && b == current
+	case int:
+		i, err := strconv.Atoi(value)
+		return err == nil && i == current
+	case int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		return err == nil && i == current
+	case float64:
+		x, err := strconv.ParseFloat(value, 64)
+		return err == nil && x == current
+	}
+	return f.Value.String() == value
+}
+
+// ConfigReload is the reply of POST /admin/reload.
+type ConfigReload struct {
+	Status  string   `json:"status"`
+	Changed []string `json:"changed"`
+	Restart []string `json:"restart"` // changed, but only applied by a restart
+}
+
+// reloadConfig re-reads the --config file and applies it. A file with an
+// invalid value changes nothing.
+func reloadConfig(ctx context.Context) (ConfigReload, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	r := ConfigReload{Status: "ok", Changed: []string{}, Restart: []string{}}
+	values := map[string]string{}
+	if *configFile != "" {
+		var err error
+		if values, err = readConfigFile(*configFile); err != nil {
+			return r, err
+		}
+	}
+	// Flags set by the previous file but no longer in it go back to their
+	// defaults.
+	configured := map[string]bool{}
+	for name := range values {
+		if !explicitFlags[name] {
+			configured[name] = true
+		}
+	}
+	for name := range configuredFlags {
+		if !configured[name] {
+			values[name] = opts.flags.Lookup(name).DefValue
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	settingsMu.Lock()
+	previous := map[string]string{}
+	err := func() error {
+		for _, name := range names {
+			f := opts.flags.Lookup(name)
+			if explicitFlags[name] || sameValue(f, values[name]) {
+				continue
+			}
+			if !reloadable[name] {
+				// Still set until the restart, so reported again until then.
+				configured[name] = true
+				r.Restart = append(r.Restart, name)
+				continue
+			}
+			previous[name] = f.Value.String()
+			if err := opts.flags.Set(name, values[name]); err != nil {
+				return fmt.Errorf("Error setting %s: %w", name, err)
+			}
+			r.Changed = append(r.Changed, name)
+		}
+		_, level := previous["log-level"]
+		return applySettings(level)
+	}()
+	if err != nil {
+		for name, value := range previous {
+			opts.flags.Set(name, value)
+		}
+		_, level := previous["log-level"]
+		applySettings(level)
+		r.Changed = []string{}
+	}
+	settingsMu.Unlock()
+	if err != nil {
+		return r, err
+	}
+	configuredFlags = configured
+
+	if err := loadBans(ctx); err != nil {
+		return r, fmt.Errorf("Error reloading bans: %w", err)
+	}
+	for _, name := range r.Changed {
+		log.Info().Str("flag", name).Str("value", values[name]).Msg("Reloaded setting")
+	}
+	for _, name := range r.Restart {
+		log.Warn().Str("flag", name).Msg("Changed setting needs a restart")
+	}
+	return r, nil
+}
+
+// applySettings rebuilds what the reloadable flags are parsed into, and
+// sets the log level if it changed, which would otherwise undo a change
+// made with PUT /admin/log-level. settingsMu must be held.
+func applySettings(level bool) error {
+	lvl, err := zerolog.ParseLevel(*logLevel)
+	if err != nil || *logLevel == "" {
+		return fmt.Errorf("Unknown log level %q", *logLevel)
+	}
+	limits, err := parseTenantLimits(*tenantLimits)
+	if err != nil {
+		return err
+	}
+	if err := initFeatures(); err != nil {
+		return err
+	}
+	if level {
+		zerolog.SetGlobalLevel(lvl)
+	}
+	tenantMaxPeersOf = limits
+	allowedOrigins = parseOrigins(*allowedOriginsFlag)
+	ipLimits.configure(*ipRate, *ipBurst)
+	peerLimits.configure(*peerRate, *peerBurst)
+	return nil
+}
+
+// reloadOnHangup reloads the config on every SIGHUP until ctx is done.
+func reloadOnHangup(ctx context.Context, hangups <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+		}
+		r, err := reloadConfig(ctx)
+		if err != nil {
+			metricConfigReloads.WithLabelValues("error").Inc()
+			log.Err(err).Msg("Error reloading config")
+			continue
+		}
+		metricConfigReloads.WithLabelValues("ok").Inc()
+		auditEvent("config_reloaded", "sighup", "").Strs("changed", r.Changed).Send()
+	}
+}
+
+func reloadHandler(ctx *gin.Context) {
+	r, err := reloadConfig(ctx.Request.Context())
+	if err != nil {
+		metricConfigReloads.WithLabelValues("error").Inc()
+		reqLog(ctx).Err(err).Msg("Error reloading config")
+		respondError(ctx, http.StatusUnprocessableEntity, "invalid_config", err.Error(), nil)
+		return
+	}
+	metricConfigReloads.WithLabelValues("ok").Inc()
+	auditRequest(ctx, "config_reloaded").Strs("changed", r.Changed).Send()
+	ctx.JSON(http.StatusOK, r)
+}
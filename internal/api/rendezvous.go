@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hoyle1974/seven/internal/hub"
+	"github.com/hoyle1974/seven/internal/ws"
+)
+
+// Peers that talk over their own UDP sockets rather than WebRTC, such as
+// game netcode, can still have Seven open a path through their NATs: a
+// rendezvous message naming a peer makes the server send both a punch
+// message with the other's endpoints and a time, and both start sending to
+// each other at that time, so each NAT sees outgoing packets before the
+// other side's arrive. The endpoints are those the peer's socket was last
+// seen on by the NAT probe listeners, then its registered addresses.
+
+// Punch tells a peer where to send to and when.
+type Punch struct {
+	ID        string   `json:"id"`
+	Peer      string   `json:"peer"`
+	Endpoints []string `json:"endpoints"`
+	At        int64    `json:"at"`    // unix milliseconds, by the server's clock
+	InMs      int64    `json:"in_ms"` // the same, relative to when it was sent
+}
+
+// punchEndpoints are the endpoints to try for id, best first.
+func punchEndpoints(ctx context.Context, id string) ([]string, error) {
+	var endpoints []string
+	seen := map[string]bool{}
+	add := func(addr string) {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			endpoints = append(endpoints, addr)
+		}
+	}
+	if addr, ok := natProbes.endpoints.Get(id); ok {
+		add(addr.String())
+	}
+	e, ok, err := peerRegistry.Get(ctx, id)
+	if err != nil || !ok {
+		return endpoints, err
+	}
+	add(e.Address)
+	for _, a := range e.Addrs {
+		if a.Transport != "tcp" {
+			add(a.Addr)
+		}
+	}
+	return endpoints, nil
+}
+
+func handleRendezvous(ctx context.Context, s *Session, msg ws.Message) error {
+	if s.uuid == "" {
+		return s.sendError("not_registered", "not registered")
+	}
+	if ok, err := s.requireFeature("rendezvous"); !ok {
+		return err
+	}
+	if ok, err := s.allowRelay(); !ok {
+		return err
+	}
+	to, _ := hub.SplitDevice(msg.To)
+	if to == "" {
+		return s.sendError("missing_destination", "missing destination")
+	}
+	if to == s.uuid || !s.mayReach(ctx, to) {
+		return s.sendError("forbidden_destination", "cannot rendezvous with that peer")
+	}
+	if _, ok := connections.Lookup(to); !ok {
+		return s.sendError("peer_not_connected", "peer not connected")
+	}
+
+	mine, err := punchEndpoints(ctx, s.uuid)
+	if err != nil {
+		return err
+	}
+	theirs, err := punchEndpoints(ctx, to)
+	if err != nil {
+		return err
+	}
+	if len(mine) == 0 || len(theirs) == 0 {
+		return s.sendError("no_endpoints", "no endpoints to punch")
+	}
+
+	id := uuid.NewString()
+	lead := *rendezvousLead
+	at := time.Now().Add(lead).UnixMilli()
+	notice, err := ws.NewMessage(ws.MsgPunch, Punch{ID: id, Peer: s.uuid, Endpoints: mine, At: at, InMs: lead.Milliseconds()})
+	if err != nil {
+		return err
+	}
+	notice.Room = rooms.RoomOf(s.uuid)
+	if err := connections.Send(to, notice); err != nil {
+		return s.sendError("delivery_failed", "delivery failed")
+	}
+	metricRelayed.WithLabelValues(string(msg.Type)).Inc()
+	s.log.Debug().Str("uuid", s.uuid).Str("peer", to).Str("rendezvous", id).Strs("endpoints", theirs).Msg("Rendezvous")
+	return s.send(ws.MsgPunch, Punch{ID: id, Peer: to, Endpoints: theirs, At: at, InMs: lead.Milliseconds()})
+}
@@ -0,0 +1,238 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hoyle1974/seven/internal/ws"
+)
+
+// Peers report how each WebRTC connection to a peer Seven handed them went,
+// with POST /reports or a report message, once it connected or gave up.
+// Reports are counted by tenant and the reporter's region (its continent,
+// with --geoip-db) in metrics and in GET /admin/reports, which measures how
+// often the peers handed out can actually be reached.
+
+// maxTimeToConnect bounds reported connection times, so one bogus report
+// does not skew the means.
+const maxTimeToConnect = 10 * time.Minute
+
+// candidateTypes are the ICE candidate types a report may name.
+var candidateTypes = map[string]bool{"host": true, "srflx": true, "prflx": true, "relay": true}
+
+// ReportForm is a report on one connection attempt to peer.
+type ReportForm struct {
+	Uuid            string `json:"uuid,omitempty"` // the reporter; the session's over websockets
+	UuidToken       string `json:"uuid_token,omitempty"`
+	Peer            string `json:"peer,omitempty"`
+	Outcome         string `json:"outcome"`                      // connected or failed
+	TimeToConnectMs int64  `json:"time_to_connect_ms,omitempty"` // from the first offer or answer to connected
+	CandidateType   string `json:"candidate_type,omitempty"`     // host, srflx, prflx or relay, of the selected local candidate
+}
+
+// validate returns the code and message of the error with f, if any.
+func (f ReportForm) validate() (string, string) {
+	switch f.Outcome {
+	case "connected", "failed":
+	case "":
+		return "missing_outcome", "missing outcome"
+	default:
+		return "invalid_outcome", "outcome must be connected or failed"
+	}
+	if f.CandidateType != "" && !candidateTypes[f.CandidateType] {
+		return "invalid_candidate_type", "candidate_type must be host, srflx, prflx or relay"
+	}
+	if f.TimeToConnectMs < 0 || f.TimeToConnectMs > maxTimeToConnect.Milliseconds() {
+		return "invalid_time_to_connect", "invalid time_to_connect_ms"
+	}
+	return "", ""
+}
+
+// ReportStats sums up the reports of a tenant's peers in a region.
+type ReportStats struct {
+	Tenant              string         `json:"tenant"`
+	Region              string         `json:"region"`
+	Connected           int            `json:"connected"`
+	Failed              int            `json:"failed"`
+	SuccessRate         float64        `json:"success_rate"`
+	MeanTimeToConnectMs int64          `json:"mean_time_to_connect_ms,omitempty"`
+	CandidateTypes      map[string]int `json:"candidate_types,omitempty"` // of the connected ones
+	Updated             time.Time      `json:"updated"`
+
+	totalTimeToConnect time.Duration
+	timed              int
+}
+
+type reportKey struct {
+	tenant string
+	region string
+}
+
+// reportAggregate is the per instance sum of the reports received.
+type reportAggregate struct {
+	mu    sync.Mutex
+	stats map[reportKey]*ReportStats
+}
+
+var reports = &reportAggregate{stats: map[reportKey]*ReportStats{}}
+
+func (a *reportAggregate) add(tenant string, region string, f ReportForm) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := reportKey{tenantLabel(tenant), region}
+	st, ok := a.stats[key]
+	if !ok {
+		st = &ReportStats{Tenant: key.tenant, Region: key.region, CandidateTypes: map[string]int{}}
+		a.stats[key] = st
+	}
+	if f.Outcome == "connected" {
+		st.Connected++
+		if f.CandidateType != "" {
+			st.CandidateTypes[f.CandidateType]++
+		}
+		if f.TimeToConnectMs > 0 {
+			st.totalTimeToConnect += time.Duration(f.TimeToConnectMs) * time.Millisecond
+			st.timed++
+			st.MeanTimeToConnectMs = (st.totalTimeToConnect / time.Duration(st.timed)).Milliseconds()
+		}
+	} else {
+		st.Failed++
+	}
+	st.SuccessRate = float64(st.Connected) / float64(st.Connected+st.Failed)
+	st.Updated = time.Now()
+}
+
+// List returns the stats by tenant, then region.
+func (a *reportAggregate) List() []ReportStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := make([]ReportStats, 0, len(a.stats))
+	for _, st := range a.stats {
+		c := *st
+		c.CandidateTypes = make(map[string]int, len(st.CandidateTypes))
+		for k, v := range st.CandidateTypes {
+			c.CandidateTypes[k] = v
+		}
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Tenant != list[j].Tenant {
+			return list[i].Tenant < list[j].Tenant
+		}
+		return list[i].Region < list[j].Region
+	})
+	return list
+}
+
+// reportRegion is the continent of ip, or "unknown", keeping the metric
+// labels few.
+func reportRegion(ip string) string {
+	if loc := lookupLocation(ip); loc != nil && loc.Continent != "" {
+		return loc.Continent
+	}
+	return "unknown"
+}
+
+// recordReport counts a valid report by the peer in tenant at ip.
+func recordReport(ctx context.Context, tenant string, ip string, f ReportForm) {
+	region := reportRegion(ip)
+	reports.add(tenant, region, f)
+	scoreReport(ctx, tenant, f)
+	candidate := f.CandidateType
+	if candidate == "" {
+		candidate = "unknown"
+	}
+	metricConnectionReports.WithLabelValues(metricTenant(tenant), region, f.Outcome, candidate).Inc()
+	if f.Outcome == "connected" && f.TimeToConnectMs > 0 {
+		observe(ctx, metricTimeToConnect.WithLabelValues(metricTenant(tenant), region), float64(f.TimeToConnectMs)/1000)
+	}
+	logFor(ctx).Debug().
+		Str("uuid", f.Uuid).
+		Str("peer", f.Peer).
+		Str("outcome", f.Outcome).
+		Int64("time_to_connect_ms", f.TimeToConnectMs).
+		Str("candidate_type", f.CandidateType).
+		Msg("Connection report")
+}
+
+func postReport(ctx *gin.Context) {
+	var form ReportForm
+	if err := ctx.BindJSON(&form); err != nil {
+		reqLog(ctx).Err(err).Msg("Error parsing report")
+		respondError(ctx, http.StatusNotAcceptable, "invalid_json", "error parsing json", nil)
+		return
+	}
+	if form.Uuid == "" {
+		form.Uuid = ctx.GetString(subjectKey)
+	}
+	if form.Uuid == "" {
+		respondError(ctx, http.StatusBadRequest, "missing_uuid", "missing uuid", nil)
+		return
+	}
+	if !subjectAllows(ctx.GetString(subjectKey), form.Uuid) {
+		respondError(ctx, http.StatusForbidden, "subject_mismatch", "uuid does not match token subject", nil)
+		return
+	}
+	if !uuidAllowed(form.Uuid, form.UuidToken) {
+		respondError(ctx, http.StatusForbidden, "invalid_uuid_token", "missing or invalid uuid_token", nil)
+		return
+	}
+	if !featureEnabled(ctx.GetString(tenantKey), "reports") {
+		abortFeatureDisabled(ctx, "reports")
+		return
+	}
+	if !tenantAllows(ctx.Request.Context(), ctx.GetString(tenantKey), form.Uuid) {
+		respondError(ctx, http.StatusForbidden, "other_tenant", "uuid belongs to another tenant", nil)
+		return
+	}
+	if code, message := form.validate(); code != "" {
+		respondError(ctx, http.StatusBadRequest, code, message, nil)
+		return
+	}
+	if ok, retry := peerLimits.allow(form.Uuid); !ok {
+		abortRateLimited(ctx, retry)
+		return
+	}
+	recordReport(ctx.Request.Context(), ctx.GetString(tenantKey), ctx.ClientIP(), form)
+	ctx.JSON(http.StatusAccepted, gin.H{"status": "ok"})
+}
+
+func handleReport(ctx context.Context, s *Session, msg ws.Message) error {
+	if s.uuid == "" {
+		return s.sendError("not_registered", "not registered")
+	}
+	if ok, err := s.requireFeature("reports"); !ok {
+		return err
+	}
+	var form ReportForm
+	if err := json.Unmarshal(msg.Payload, &form); err != nil {
+		return s.sendError("invalid_payload", "error parsing payload")
+	}
+	form.Uuid = s.uuid
+	if code, message := form.validate(); code != "" {
+		return s.sendError(code, message)
+	}
+	if ok, retry := peerLimits.allow(s.uuid); !ok {
+		return s.sendRateLimited(retry)
+	}
+	recordReport(ctx, s.tenant, s.observed.IP, form)
+	return nil
+}
+
+// listReports returns the connection reports this instance has received,
+// narrowed with ?tenant=.
+func listReports(ctx *gin.Context) {
+	list := []ReportStats{}
+	tenant := ctx.Query("tenant")
+	for _, st := range reports.List() {
+		if tenant == "" || st.Tenant == tenant {
+			list = append(list, st)
+		}
+	}
+	ctx.JSON(http.StatusOK, gin.H{"status": "ok", "reports": list})
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/hoyle1974/seven/internal/hub"
+	"github.com/hoyle1974/seven/internal/ws"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Every request has an id: the X-Request-ID it came with, or a new one
+// (x-request-id metadata over gRPC). It is echoed in the response and tagged
+// on the request's log lines, and the sessions a request opens keep it.
+// Signals relayed between two peers also carry a correlation_id, the same
+// from an offer to the next one, so one negotiation can be followed through
+// the logs of every instance it passed.
+
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDKey    = "request_id"
+	maxRequestID    = 128
+)
+
+// requestID is the id of the request ctx serves.
+func requestID(ctx *gin.Context) string {
+	if id := ctx.GetString(requestIDKey); id != "" {
+		return id
+	}
+	id := ctx.GetHeader(requestIDHeader)
+	if id == "" || len(id) > maxRequestID {
+		id = uuid.NewString()
+	}
+	ctx.Set(requestIDKey, id)
+	return id
+}
+
+// tagRequest is middleware echoing the request id and giving the request a
+// logger that adds it.
+func tagRequest(ctx *gin.Context) {
+	id := requestID(ctx)
+	ctx.Header(requestIDHeader, id)
+	logger := log.With().Str("request_id", id).Logger()
+	ctx.Request = ctx.Request.WithContext(logger.WithContext(ctx.Request.Context()))
+	ctx.Next()
+}
+
+// logFor is the logger of the request ctx belongs to, or the global one.
+func logFor(ctx context.Context) *zerolog.Logger {
+	if l := zerolog.Ctx(ctx); l.GetLevel() != zerolog.Disabled {
+		return l
+	}
+	return &log.Logger
+}
+
+// reqLog is the logger of the request ctx serves.
+func reqLog(ctx *gin.Context) *zerolog.Logger {
+	return logFor(ctx.Request.Context())
+}
+
+// accessLog is middleware logging every request once it is served, at warn
+// for client errors and error for server errors.
+func accessLog(ctx *gin.Context) {
+	start := time.Now()
+	path := ctx.Request.URL.Path
+	if raw := ctx.Request.URL.RawQuery; raw != "" {
+		path += "?" + raw
+	}
+	ctx.Next()
+
+	l := reqLog(ctx)
+	e := l.Info()
+	switch status := ctx.Writer.Status(); {
+	case status >= 500:
+		e = l.Error()
+	case status >= 400:
+		e = l.Warn()
+	}
+	msg := ctx.Errors.String()
+	if msg == "" {
+		msg = "Request"
+	}
+	e.Str("ser_name", "gin").Str("method", ctx.Request.Method).Str("path", path).
+		Dur("resp_time", time.Since(start)).Int("status", ctx.Writer.Status()).
+		Str("client_ip", ctx.ClientIP()).Msg(msg)
+}
+
+// exchanges holds the correlation id of the latest offer between each pair
+// of peers, in an LRU so a flood of pairs cannot grow it without bound.
+var exchanges, _ = lru.New[[2]string, string](65536)
+
+// correlate sets the correlation id of a signal: the one the client sent, a
+// new one for an offer, or that of the latest offer between the two peers.
+func correlate(msg *ws.Message) {
+	from, _ := hub.SplitDevice(msg.From)
+	to, _ := hub.SplitDevice(msg.To)
+	pair := [2]string{from, to}
+	if to < from {
+		pair = [2]string{to, from}
+	}
+	if msg.CorrelationID == "" && msg.Type != ws.MsgOffer {
+		msg.CorrelationID, _ = exchanges.Get(pair)
+	}
+	if len(msg.CorrelationID) > maxRequestID {
+		msg.CorrelationID = ""
+	}
+	if msg.CorrelationID == "" {
+		msg.CorrelationID = uuid.NewString()
+	}
+	exchanges.Add(pair, msg.CorrelationID)
+}
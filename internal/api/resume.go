@@ -0,0 +1,221 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/hoyle1974/seven/internal/hub"
+	"github.com/hoyle1974/seven/internal/ws"
+)
+
+// A websocket or gRPC session that drops without saying bye is parked for
+// --resume-grace. Its uuid stays in its room and messages sent to it are
+// queued, so a client that reconnects with the session's resume token picks
+// up where it left off. Each device of a uuid is parked on its own, even
+// while others are still connected. Parked sessions are local to this
+// instance.
+const maxParkedMessages = 256
+
+type parkedSession struct {
+	uuid    string
+	tenant  string
+	device  string
+	subject string
+	reason  string
+	queue   []ws.Message
+	timer   *time.Timer
+}
+
+type resumeStore struct {
+	mu     sync.Mutex
+	tokens map[string]*parkedSession
+	byUUID map[string]map[string]string // device to token
+}
+
+var resumes = &resumeStore{
+	tokens: make(map[string]*parkedSession),
+	byUUID: make(map[string]map[string]string),
+}
+
+func newResumeToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "rt_" + hex.EncodeToString(b), nil
+}
+
+// issue gives s a fresh resume token, or none when resumption is disabled or
+// the transport cannot reconnect.
+func (r *resumeStore) issue(s *Session) string {
+	s.resumeToken = ""
+	if !s.resumable || *resumeGrace <= 0 {
+		return ""
+	}
+	token, err := newResumeToken()
+	if err != nil {
+		s.log.Err(err).Msg("Error generating resume token")
+		return ""
+	}
+	s.resumeToken = tagResumeToken(token)
+	return s.resumeToken
+}
+
+// park holds s's registration and room for the grace window. When nobody
+// resumes it in time, and no other device of the uuid is left, the peer
+// leaves its room for reason.
+func (r *resumeStore) park(s *Session, reason string) {
+	p := &parkedSession{uuid: s.uuid, tenant: s.tenant, device: s.device, subject: s.subject, reason: reason}
+	token := s.resumeToken
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.byUUID[p.uuid][p.device]; ok {
+		r.drop(old)
+	}
+	r.tokens[token] = p
+	if r.byUUID[p.uuid] == nil {
+		r.byUUID[p.uuid] = map[string]string{}
+	}
+	r.byUUID[p.uuid][p.device] = token
+	p.timer = time.AfterFunc(*resumeGrace, func() {
+		r.mu.Lock()
+		expired := r.tokens[token] == p
+		if expired {
+			r.drop(token)
+		}
+		alone := len(r.byUUID[p.uuid]) == 0
+		r.mu.Unlock()
+		if expired {
+			s.log.Debug().Str("uuid", p.uuid).Str("device", p.device).Msg("Resume grace expired")
+			if alone && len(connections.Sessions(p.uuid)) == 0 {
+				dropOutOfRoom(p.uuid, p.reason)
+			}
+		}
+	})
+	s.log.Debug().Str("uuid", p.uuid).Str("device", p.device).Msg("Parked session for resumption")
+}
+
+// drop forgets a parked session. r.mu must be held.
+func (r *resumeStore) drop(token string) {
+	p, ok := r.tokens[token]
+	if !ok {
+		return
+	}
+	p.timer.Stop()
+	delete(r.tokens, token)
+	if devices := r.byUUID[p.uuid]; devices[p.device] == token {
+		delete(devices, p.device)
+		if len(devices) == 0 {
+			delete(r.byUUID, p.uuid)
+		}
+	}
+}
+
+// parkedFor are the sessions parked for addr: every device of a bare uuid,
+// or the one named by uuid/device. r.mu must be held.
+func (r *resumeStore) parkedFor(addr string) []*parkedSession {
+	uuid, device := hub.SplitDevice(addr)
+	var parked []*parkedSession
+	for d, token := range r.byUUID[uuid] {
+		if device == "" || d == device {
+			parked = append(parked, r.tokens[token])
+		}
+	}
+	return parked
+}
+
+// enqueue holds msg for the sessions parked for addr. It returns false if
+// none is, or their queues are full.
+func (r *resumeStore) enqueue(addr string, msg ws.Message) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	kept := false
+	for _, p := range r.parkedFor(addr) {
+		if len(p.queue) < maxParkedMessages {
+			p.queue = append(p.queue, msg)
+			kept = true
+		}
+	}
+	return kept
+}
+
+// resume claims the session parked under token for a caller in tenant
+// authenticated as subject.
+func (r *resumeStore) resume(token string, tenant string, subject string) (*parkedSession, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.tokens[token]
+	if !ok || p.tenant != tenant || !subjectAllows(subject, p.uuid) {
+		return nil, false
+	}
+	r.drop(token)
+	return p, true
+}
+
+// forget drops the sessions parked for addr, returning one of them if there
+// were any.
+func (r *resumeStore) forget(addr string) *parkedSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var forgotten *parkedSession
+	for _, p := range r.parkedFor(addr) {
+		r.drop(r.byUUID[p.uuid][p.device])
+		forgotten = p
+	}
+	return forgotten
+}
+
+// cancel ends the grace window for uuid/device early because it registered
+// afresh. The uuid leaves its room unless another device is still around.
+func (r *resumeStore) cancel(uuid string, device string) {
+	addr := uuid
+	if device != "" {
+		addr += "/" + device
+	}
+	p := r.forget(addr)
+	if p == nil {
+		return
+	}
+	if _, parked := r.queued(uuid); !parked && len(connections.Sessions(uuid)) == 0 {
+		leaveRoom(uuid, p.reason)
+	}
+}
+
+// queued returns how many messages wait for addr, and whether any of its
+// sessions is parked.
+func (r *resumeStore) queued(addr string) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	parked := r.parkedFor(addr)
+	n := 0
+	for _, p := range parked {
+		n += len(p.queue)
+	}
+	return n, len(parked) > 0
+}
+
+// endSession cleans up after a connection closes, parking it instead when the
+// client may still resume. Each device is parked on its own; the uuid only
+// counts as disconnected once its last device is gone.
+func endSession(s *Session, reason string) {
+	removed, last := connections.RemoveSession(s)
+	if !removed {
+		return
+	}
+	if last {
+		matches.remove(s.uuid)
+		events.publish(Event{Type: EventPeerDisconnected, UUID: s.uuid, Reason: reason})
+	}
+	switch _, parked := resumes.queued(s.uuid); {
+	case s.resumeToken != "" && !s.done:
+		resumes.park(s, reason)
+	case !last || parked:
+	case s.done:
+		leaveRoom(s.uuid, reason)
+	default:
+		dropOutOfRoom(s.uuid, reason)
+	}
+}
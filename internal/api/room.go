@@ -0,0 +1,871 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Room is a set of peers that are allowed to signal each other. Only peers
+// of the room's tenant can join it.
+type Room struct {
+	id       string
+	tenant   string
+	members  map[string]uint64 // peer to the order it joined in
+	maxPeers int               // 0 is unlimited
+	waiting  []string          // peers queued for a place, see --room-full
+	created  time.Time
+	relayed  atomic.Int64
+	empty    time.Time // since when nobody live is in it, see Sweep
+	held     time.Time // until when Sweep leaves it open anyway
+
+	// Set for protected rooms, which only admit joins carrying the password
+	// or the invite token.
+	password []byte // sha256 of it
+	invite   string
+
+	// host may kick and mute members, lock and close the room and hand it
+	// to another member. It passes to the earliest joiner when the host
+	// leaves; rooms made by matchmaking have none.
+	host   string
+	locked bool // refusing new members
+	muted  map[string]bool
+	kicked map[string]bool // refused for as long as the room is open
+
+	// What the directory shows, see Describe.
+	name     string
+	tags     map[string]string
+	metadata json.RawMessage
+	unlisted bool
+
+	relayOnly bool // see privacy.go
+
+	reservation *reservation
+}
+
+// reservation books a room, through the admin API, for peers presenting its
+// token between starts and expires.
+type reservation struct {
+	token        string
+	starts       time.Time
+	expires      time.Time
+	participants map[string]bool // who may use the token; anyone when empty
+}
+
+// errRoomFull is returned by Join when the room has maxPeers members.
+var errRoomFull = errors.New("Room is full")
+
+// Refusals of Join and of the host's powers.
+var (
+	errRoomLocked = errors.New("Room is locked")
+	errNotHost    = errors.New("Only the host may do that")
+	errNotMember  = errors.New("Peer is not in the room")
+	errKicked     = errors.New("Peer was kicked from the room")
+
+	errRoomExists         = errors.New("Room already exists")
+	errRoomNotStarted     = errors.New("Room has not started yet")
+	errReservationRefused = errors.New("Reservation token is wrong or expired")
+)
+
+// RoomStats is a snapshot of a room for the admin API.
+type RoomStats struct {
+	ID        string `json:"id"`
+	Tenant    string `json:"tenant,omitempty"`
+	Members   int    `json:"members"`
+	MaxPeers  int    `json:"max_peers,omitempty"`
+	Queued    int    `json:"queued,omitempty"`
+	Protected bool   `json:"protected,omitempty"`
+	Host      string `json:"host,omitempty"`
+	Locked    bool   `json:"locked,omitempty"`
+	Muted     int    `json:"muted,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Unlisted  bool   `json:"unlisted,omitempty"`
+	RelayOnly bool   `json:"relay_only,omitempty"`
+
+	Reservation *ReservationStats `json:"reservation,omitempty"`
+	Created     time.Time         `json:"created"`
+	Relayed     int64             `json:"relayed"`
+}
+
+type ReservationStats struct {
+	StartsAt     time.Time `json:"starts_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	Participants []string  `json:"participants,omitempty"`
+}
+
+// RoomManager owns every room and which room each peer is currently in. A
+// peer is a member of at most one room at a time.
+type RoomManager struct {
+	mu       sync.RWMutex
+	rooms    map[string]*Room
+	byPeer   map[string]string
+	queued   map[string]string    // peer to the room it waits for
+	departed map[string]departure // peers that dropped out of their room
+	joins    uint64
+}
+
+// departure is the room a peer was in when its session dropped, which its
+// members may still queue messages to it from until it has been gone too
+// long.
+type departure struct {
+	room  string
+	until time.Time
+}
+
+// Rooms are the rooms of an instance and who is in them. They are a
+// RoomManager unless Hooks.Rooms replaces it.
+type Rooms interface {
+	Create(tenant string, host string, maxPeers int) string
+	Reserve(id string, tenant string, host string, maxPeers int, starts time.Time, expires time.Time, participants []string) (string, string, error)
+	JoinReserved(id string, peer string, tenant string, token string) (string, error)
+	StartsAt(id string) time.Time
+	Protect(id string, password string, invite bool) string
+	Admits(id string, peer string, password string, invite string) bool
+	Describe(id string, name string, tags map[string]string, metadata json.RawMessage, unlisted bool)
+	SetRelayOnly(id string)
+	RelayOnly(id string) bool
+	Join(id string, peer string, tenant string) (string, error)
+	Enqueue(id string, peer string, tenant string) (int, error)
+	Admit(id string) (peer string, previous string, ok bool)
+	Leave(peer string) string
+	Drop(peer string, until time.Time) string
+	Departed(peer string, id string) bool
+	Host(id string) string
+	Transfer(id string, by string, peer string) error
+	Lock(id string, by string, locked bool) ([]string, error)
+	Mute(id string, by string, peer string, muted bool) error
+	Muted(id string, peer string) bool
+	Kick(id string, by string, peer string) error
+	Close(id string, by string) (members []string, waiting []string, err error)
+	Evict(id string, reason string) (members []string, waiting []string)
+	Sweep(now time.Time, live func(peer string) bool) map[string][]string
+	RoomOf(peer string) string
+	Members(id string) []string
+	MembersByJoin(id string) []string
+	SameRoom(a, b string) bool
+	CountRelayed(id string)
+	Stats(id string) (RoomStats, bool)
+	List() []RoomStats
+	Directory(tenant string) []RoomListing
+}
+
+// rooms are those of the one Server running, made afresh by NewServer.
+var rooms Rooms = NewRoomManager()
+
+// roomManager is the server's own Rooms, nil when Hooks.Rooms replaced it.
+func roomManager() *RoomManager {
+	m, _ := rooms.(*RoomManager)
+	return m
+}
+
+func NewRoomManager() *RoomManager {
+	return &RoomManager{
+		rooms:    make(map[string]*Room),
+		byPeer:   make(map[string]string),
+		queued:   make(map[string]string),
+		departed: make(map[string]departure),
+	}
+}
+
+// Create opens a room for tenant hosted by host, holding up to maxPeers
+// members, or --room-max-peers when that is lower or maxPeers is 0.
+func (m *RoomManager) Create(tenant string, host string, maxPeers int) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := uuid.New().String()
+	m.rooms[id] = newRoom(id, tenant, host, maxPeers)
+	return id
+}
+
+func newRoom(id string, tenant string, host string, maxPeers int) *Room {
+	if limit := setting(roomMaxPeers); maxPeers <= 0 || (limit > 0 && maxPeers > limit) {
+		maxPeers = limit
+	}
+	return &Room{id: id, tenant: tenant, host: host, members: make(map[string]uint64), muted: make(map[string]bool), kicked: make(map[string]bool), maxPeers: maxPeers, created: time.Now()}
+}
+
+// Reserve books room id, or a new room when id is empty, for tenant. It
+// stays open, unlisted and empty if need be, until expires, and only admits
+// peers presenting the token returned, from starts on. When participants are
+// given only they may use the token.
+func (m *RoomManager) Reserve(id string, tenant string, host string, maxPeers int, starts time.Time, expires time.Time, participants []string) (string, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id == "" {
+		id = uuid.New().String()
+	}
+	if _, ok := m.rooms[id]; ok {
+		return "", "", errRoomExists
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	r := &reservation{token: hex.EncodeToString(b), starts: starts, expires: expires, participants: make(map[string]bool)}
+	for _, peer := range participants {
+		r.participants[peer] = true
+	}
+	room := newRoom(id, tenant, host, maxPeers)
+	room.reservation, room.unlisted = r, true
+	m.rooms[id] = room
+	return id, r.token, nil
+}
+
+// JoinReserved moves peer, of tenant, into the reserved room id if token is
+// its reservation's, regardless of the room being full, locked or protected.
+func (m *RoomManager) JoinReserved(id string, peer string, tenant string, token string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	room, ok := m.rooms[id]
+	if !ok || room.tenant != tenant {
+		return "", fmt.Errorf("Room %s does not exist", id)
+	}
+	r, now := room.reservation, time.Now()
+	if r == nil || subtle.ConstantTimeCompare([]byte(token), []byte(r.token)) != 1 || !now.Before(r.expires) {
+		return "", errReservationRefused
+	}
+	if len(r.participants) > 0 && !r.participants[peer] {
+		return "", errReservationRefused
+	}
+	if now.Before(r.starts) {
+		return "", errRoomNotStarted
+	}
+	if room.kicked[peer] {
+		return "", errKicked
+	}
+	m.unqueue(peer)
+	return m.join(room, peer), nil
+}
+
+// StartsAt returns when the reservation of room id starts, if it has one.
+func (m *RoomManager) StartsAt(id string) time.Time {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if room, ok := m.rooms[id]; ok && room.reservation != nil {
+		return room.reservation.starts
+	}
+	return time.Time{}
+}
+
+// reserved reports whether room is booked at now, which keeps it open.
+func (r *Room) reserved(now time.Time) bool {
+	return r.reservation != nil && now.Before(r.reservation.expires)
+}
+
+// Protect makes room id only admit joins with password, when it is not
+// empty, or with the invite token returned when invite is set.
+func (m *RoomManager) Protect(id string, password string, invite bool) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	room, ok := m.rooms[id]
+	if !ok {
+		return ""
+	}
+	if password != "" {
+		sum := sha256.Sum256([]byte(password))
+		room.password = sum[:]
+	}
+	if invite {
+		b := make([]byte, 16)
+		rand.Read(b)
+		room.invite = hex.EncodeToString(b)
+	}
+	return room.invite
+}
+
+// Admits reports whether peer may join room id with the password or invite
+// token given. Unprotected rooms admit everyone, and members may always join
+// again.
+func (m *RoomManager) Admits(id string, peer string, password string, invite string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	room, ok := m.rooms[id]
+	if !ok || !room.protected() {
+		return true
+	}
+	if _, ok := room.members[peer]; ok {
+		return true
+	}
+	if room.password != nil && password != "" {
+		sum := sha256.Sum256([]byte(password))
+		if subtle.ConstantTimeCompare(sum[:], room.password) == 1 {
+			return true
+		}
+	}
+	return room.invite != "" && subtle.ConstantTimeCompare([]byte(invite), []byte(room.invite)) == 1
+}
+
+// Describe sets what GET /rooms shows of room id, leaving it out of the
+// directory altogether when unlisted is set.
+func (m *RoomManager) Describe(id string, name string, tags map[string]string, metadata json.RawMessage, unlisted bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if room, ok := m.rooms[id]; ok {
+		room.name, room.tags, room.metadata, room.unlisted = name, tags, metadata, unlisted
+	}
+}
+
+// SetRelayOnly puts room id in privacy mode.
+func (m *RoomManager) SetRelayOnly(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if room, ok := m.rooms[id]; ok {
+		room.relayOnly = true
+	}
+}
+
+// RelayOnly reports whether room id is in privacy mode.
+func (m *RoomManager) RelayOnly(id string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	room, ok := m.rooms[id]
+	return ok && room.relayOnly
+}
+
+// protected reports whether joins need a password or token. Reserved rooms
+// only admit their reservation's token.
+func (r *Room) protected() bool {
+	return r.password != nil || r.invite != "" || r.reservation != nil
+}
+
+// Join moves peer, of tenant, into the room id, leaving any room it was
+// already in. The id of the room it left, if any, is returned. Rooms of other
+// tenants do not exist as far as peer is concerned.
+func (m *RoomManager) Join(id string, peer string, tenant string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	room, ok := m.rooms[id]
+	if !ok || room.tenant != tenant {
+		return "", fmt.Errorf("Room %s does not exist", id)
+	}
+	if room.kicked[peer] {
+		return "", errKicked
+	}
+	if _, ok := room.members[peer]; !ok && room.locked {
+		return "", errRoomLocked
+	}
+	if _, ok := room.members[peer]; !ok && room.full() {
+		return "", errRoomFull
+	}
+	m.unqueue(peer)
+	return m.join(room, peer), nil
+}
+
+func (m *RoomManager) join(room *Room, peer string) string {
+	previous := ""
+	if current, ok := m.byPeer[peer]; ok && current != room.id {
+		m.leave(current, peer)
+		previous = current
+	}
+	if _, ok := room.members[peer]; !ok {
+		m.joins++
+		room.members[peer] = m.joins
+	}
+	room.empty = time.Time{}
+	m.byPeer[peer] = room.id
+	delete(m.departed, peer)
+	return previous
+}
+
+func (r *Room) full() bool {
+	return r.maxPeers > 0 && len(r.members) >= r.maxPeers
+}
+
+// Enqueue puts peer in line for a place in the full room id, returning its
+// position, starting at 1. The peer stays in its current room until Admit
+// lets it in.
+func (m *RoomManager) Enqueue(id string, peer string, tenant string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	room, ok := m.rooms[id]
+	if !ok || room.tenant != tenant {
+		return 0, fmt.Errorf("Room %s does not exist", id)
+	}
+	if room.kicked[peer] {
+		return 0, errKicked
+	}
+	if room.locked {
+		return 0, errRoomLocked
+	}
+	if m.queued[peer] != id {
+		m.unqueue(peer)
+		room.waiting = append(room.waiting, peer)
+		m.queued[peer] = id
+	}
+	for i, p := range room.waiting {
+		if p == peer {
+			return i + 1, nil
+		}
+	}
+	return len(room.waiting), nil
+}
+
+// Admit moves the first queued peer into room id if there is space for it,
+// returning the peer and the room it left.
+func (m *RoomManager) Admit(id string) (peer string, previous string, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	room, ok := m.rooms[id]
+	if !ok || len(room.waiting) == 0 || room.full() || room.locked {
+		return "", "", false
+	}
+	peer = room.waiting[0]
+	room.waiting = room.waiting[1:]
+	delete(m.queued, peer)
+	return peer, m.join(room, peer), true
+}
+
+// unqueue takes peer out of the line it is waiting in, if any.
+func (m *RoomManager) unqueue(peer string) {
+	id, ok := m.queued[peer]
+	if !ok {
+		return
+	}
+	delete(m.queued, peer)
+	room, ok := m.rooms[id]
+	if !ok {
+		return
+	}
+	for i, p := range room.waiting {
+		if p == peer {
+			room.waiting = append(room.waiting[:i:i], room.waiting[i+1:]...)
+			break
+		}
+	}
+	m.closeIfEmpty(room)
+}
+
+// Leave removes peer from whatever room it is in, and from any room it is
+// queued for, and returns the id of the room it was in.
+func (m *RoomManager) Leave(peer string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unqueue(peer)
+	delete(m.departed, peer)
+	id, ok := m.byPeer[peer]
+	if !ok {
+		return ""
+	}
+	m.leave(id, peer)
+	return id
+}
+
+// Drop is Leave for a peer whose session dropped, remembering its room until
+// until for Departed.
+func (m *RoomManager) Drop(peer string, until time.Time) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.unqueue(peer)
+	id, ok := m.byPeer[peer]
+	if !ok {
+		return ""
+	}
+	m.leave(id, peer)
+	m.departed[peer] = departure{room: id, until: until}
+	return id
+}
+
+// Departed reports whether peer dropped out of room id recently enough for
+// messages from its members to still be queued for it.
+func (m *RoomManager) Departed(peer string, id string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	d, ok := m.departed[peer]
+	return ok && id != "" && d.room == id && time.Now().Before(d.until)
+}
+
+func (m *RoomManager) leave(id string, peer string) {
+	delete(m.byPeer, peer)
+	room, ok := m.rooms[id]
+	if !ok {
+		return
+	}
+	delete(room.members, peer)
+	delete(room.muted, peer)
+	if peer == room.host {
+		room.host = ""
+		var first uint64
+		for member, order := range room.members {
+			if room.host == "" || order < first {
+				room.host, first = member, order
+			}
+		}
+		if room.host != "" {
+			// In the background, as broadcasting needs m.mu.
+			go announceHost(room.id, room.host)
+		}
+	}
+	m.closeIfEmpty(room)
+}
+
+// hosted returns room id if by is its host.
+func (m *RoomManager) hosted(id string, by string) (*Room, error) {
+	room, ok := m.rooms[id]
+	if !ok {
+		return nil, fmt.Errorf("Room %s does not exist", id)
+	}
+	if room.host == "" || room.host != by {
+		return nil, errNotHost
+	}
+	return room, nil
+}
+
+func (m *RoomManager) Host(id string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if room, ok := m.rooms[id]; ok {
+		return room.host
+	}
+	return ""
+}
+
+// Transfer makes peer the host of room id, if by is its host now.
+func (m *RoomManager) Transfer(id string, by string, peer string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	room, err := m.hosted(id, by)
+	if err != nil {
+		return err
+	}
+	if _, ok := room.members[peer]; !ok {
+		return errNotMember
+	}
+	room.host = peer
+	return nil
+}
+
+// Lock stops room id taking new members, or lets it again, if by is its
+// host. Locking drops the peers queued for a place, which are returned.
+func (m *RoomManager) Lock(id string, by string, locked bool) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	room, err := m.hosted(id, by)
+	if err != nil {
+		return nil, err
+	}
+	room.locked = locked
+	var dropped []string
+	if locked {
+		dropped, room.waiting = room.waiting, nil
+		for _, peer := range dropped {
+			delete(m.queued, peer)
+		}
+	}
+	return dropped, nil
+}
+
+// Mute stops peer signaling the other members of room id, or lets it again,
+// if by is its host.
+func (m *RoomManager) Mute(id string, by string, peer string, muted bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	room, err := m.hosted(id, by)
+	if err != nil {
+		return err
+	}
+	if _, ok := room.members[peer]; !ok {
+		return errNotMember
+	}
+	if muted {
+		room.muted[peer] = true
+	} else {
+		delete(room.muted, peer)
+	}
+	return nil
+}
+
+func (m *RoomManager) Muted(id string, peer string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	room, ok := m.rooms[id]
+	return ok && room.muted[peer]
+}
+
+// Kick removes peer from room id, if by is its host. It may not join the room
+// again.
+func (m *RoomManager) Kick(id string, by string, peer string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	room, err := m.hosted(id, by)
+	if err != nil {
+		return err
+	}
+	if _, ok := room.members[peer]; !ok || peer == by {
+		return errNotMember
+	}
+	m.leave(id, peer)
+	room.kicked[peer] = true
+	return nil
+}
+
+// Close empties and closes room id, if by is its host, returning who was in
+// it and who was waiting for a place.
+func (m *RoomManager) Close(id string, by string) (members []string, waiting []string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	room, err := m.hosted(id, by)
+	if err != nil {
+		return nil, nil, err
+	}
+	members, waiting = m.evict(room, "closed")
+	return members, waiting, nil
+}
+
+// Evict empties and closes room id, whoever hosts it, returning who was in
+// it and who was waiting for a place.
+func (m *RoomManager) Evict(id string, reason string) (members []string, waiting []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	room, ok := m.rooms[id]
+	if !ok {
+		return nil, nil
+	}
+	return m.evict(room, reason)
+}
+
+func (m *RoomManager) evict(room *Room, reason string) (members []string, waiting []string) {
+	for peer := range room.members {
+		members = append(members, peer)
+	}
+	waiting = append(waiting, room.waiting...)
+	m.close(room, reason)
+	return members, waiting
+}
+
+// closeIfEmpty closes room once nobody is in it or waiting for it, or leaves
+// it to Sweep when --room-grace is set.
+func (m *RoomManager) closeIfEmpty(room *Room) {
+	if len(room.members) > 0 || len(room.waiting) > 0 || room.reserved(time.Now()) {
+		return
+	}
+	if *roomGrace > 0 {
+		if room.empty.IsZero() {
+			room.empty = time.Now()
+		}
+		return
+	}
+	m.close(room, "empty")
+}
+
+// close forgets room along with whoever is still in it or waiting for it.
+func (m *RoomManager) close(room *Room, reason string) {
+	for peer := range room.members {
+		if m.byPeer[peer] == room.id {
+			delete(m.byPeer, peer)
+		}
+	}
+	for _, peer := range room.waiting {
+		if m.queued[peer] == room.id {
+			delete(m.queued, peer)
+		}
+	}
+	delete(m.rooms, room.id)
+	events.publish(Event{Type: EventRoomClosed, Room: room.id, Reason: reason})
+}
+
+// Sweep closes the rooms nobody live has been in for --room-grace: empty
+// ones, and ones whose members all went away without leaving, their
+// heartbeats having expired. It returns the members of the latter, by room.
+func (m *RoomManager) Sweep(now time.Time, live func(peer string) bool) map[string][]string {
+	m.mu.RLock()
+	var peers []string
+	for _, room := range m.rooms {
+		for peer := range room.members {
+			peers = append(peers, peer)
+		}
+	}
+	m.mu.RUnlock()
+	dead := make(map[string]bool)
+	for _, peer := range peers {
+		if !live(peer) {
+			dead[peer] = true
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for peer, d := range m.departed {
+		if !now.Before(d.until) {
+			delete(m.departed, peer)
+		}
+	}
+	expired := make(map[string][]string)
+	for _, room := range m.rooms {
+		idle := len(room.waiting) == 0
+		for peer := range room.members {
+			idle = idle && dead[peer]
+		}
+		if !idle || room.reserved(now) || now.Before(room.held) {
+			room.empty = time.Time{}
+			continue
+		}
+		// Wait for the next sweep at least, as someone may be between
+		// sessions, resuming.
+		if room.empty.IsZero() {
+			room.empty = now
+			continue
+		}
+		if now.Sub(room.empty) < *roomGrace {
+			continue
+		}
+		if len(room.members) == 0 {
+			m.close(room, "empty")
+			continue
+		}
+		for peer := range room.members {
+			expired[room.id] = append(expired[room.id], peer)
+		}
+		m.close(room, "expired")
+	}
+	return expired
+}
+
+func (m *RoomManager) RoomOf(peer string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.byPeer[peer]
+}
+
+func (m *RoomManager) Members(id string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	members := []string{}
+	if room, ok := m.rooms[id]; ok {
+		for peer := range room.members {
+			members = append(members, peer)
+		}
+	}
+	return members
+}
+
+// MembersByJoin lists the members of room id, earliest joiner first.
+func (m *RoomManager) MembersByJoin(id string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	members := []string{}
+	room, ok := m.rooms[id]
+	if !ok {
+		return members
+	}
+	for peer := range room.members {
+		members = append(members, peer)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return room.members[members[i]] < room.members[members[j]]
+	})
+	return members
+}
+
+// SameRoom reports whether a and b may signal each other. Peers outside of
+// any room can only reach other peers outside of any room.
+func (m *RoomManager) SameRoom(a, b string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.byPeer[a] == m.byPeer[b]
+}
+
+// CountRelayed records a message relayed within room id.
+func (m *RoomManager) CountRelayed(id string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if room, ok := m.rooms[id]; ok {
+		room.relayed.Add(1)
+	}
+}
+
+func (m *RoomManager) Stats(id string) (RoomStats, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	room, ok := m.rooms[id]
+	if !ok {
+		return RoomStats{}, false
+	}
+	return room.stats(), true
+}
+
+func (m *RoomManager) List() []RoomStats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := make([]RoomStats, 0, len(m.rooms))
+	for _, room := range m.rooms {
+		list = append(list, room.stats())
+	}
+	return list
+}
+
+// RoomListing is a room as the public directory shows it.
+type RoomListing struct {
+	ID        string            `json:"id"`
+	Name      string            `json:"name,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Metadata  json.RawMessage   `json:"metadata,omitempty"`
+	Members   int               `json:"members"`
+	MaxPeers  int               `json:"max_peers,omitempty"`
+	Protected bool              `json:"protected,omitempty"`
+	Locked    bool              `json:"locked,omitempty"`
+	RelayOnly bool              `json:"relay_only,omitempty"`
+	Created   time.Time         `json:"created"`
+}
+
+// Directory lists the rooms of tenant that are not unlisted, in id order.
+func (m *RoomManager) Directory(tenant string) []RoomListing {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := []RoomListing{}
+	for _, r := range m.rooms {
+		if r.tenant != tenant || r.unlisted {
+			continue
+		}
+		list = append(list, RoomListing{
+			ID:        r.id,
+			Name:      r.name,
+			Tags:      r.tags,
+			Metadata:  r.metadata,
+			Members:   len(r.members),
+			MaxPeers:  r.maxPeers,
+			Protected: r.protected(),
+			Locked:    r.locked,
+			RelayOnly: r.relayOnly,
+			Created:   r.created,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (r *Room) stats() RoomStats {
+	var reserved *ReservationStats
+	if r.reservation != nil {
+		reserved = &ReservationStats{StartsAt: r.reservation.starts, ExpiresAt: r.reservation.expires}
+		for peer := range r.reservation.participants {
+			reserved.Participants = append(reserved.Participants, peer)
+		}
+		sort.Strings(reserved.Participants)
+	}
+	return RoomStats{
+		ID:        r.id,
+		Tenant:    r.tenant,
+		Members:   len(r.members),
+		MaxPeers:  r.maxPeers,
+		Queued:    len(r.waiting),
+		Protected: r.protected(),
+		Host:      r.host,
+		Locked:    r.locked,
+		Muted:     len(r.muted),
+		Name:      r.name,
+		Unlisted:  r.unlisted,
+		RelayOnly: r.relayOnly,
+
+		Reservation: reserved,
+		Created:     r.created,
+		Relayed:     r.relayed.Load(),
+	}
+}
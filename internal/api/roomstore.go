@@ -0,0 +1,550 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hoyle1974/seven/internal/etcd"
+	"github.com/rs/zerolog/log"
+)
+
+// With --room-store=etcd every instance writes its rooms to etcd, and a
+// room is served by the one instance that owns its record. Owners hold a
+// node key on a lease they keep alive. Joining a room owned by another live
+// instance is refused with room_elsewhere, naming it, so clients go there
+// instead of splitting the room in two. Once an owner's lease runs out the
+// first instance a member joins through takes the room over, with its
+// members, host, password and the rest, by compare and swap, so only one
+// can. An instance that could not keep its lease alive for a whole lease
+// closes its rooms, as they may have been taken over, and members joining
+// again take them back once it reaches etcd again. Members who were on the
+// old owner have --resume-grace to come back before they are dropped.
+//
+// Records of rooms whose owner went away and that nobody joined since are
+// deleted after --resume-grace and --room-grace have passed.
+
+// roomSyncInterval is how often changed rooms are written to etcd.
+const roomSyncInterval = 500 * time.Millisecond
+
+// roomRecord is a room as etcd holds it.
+type roomRecord struct {
+	Tenant      string             `json:"tenant,omitempty"`
+	Owner       string             `json:"owner"`
+	Host        string             `json:"host,omitempty"`
+	Members     []string           `json:"members"` // earliest joiner first
+	MaxPeers    int                `json:"max_peers,omitempty"`
+	Locked      bool               `json:"locked,omitempty"`
+	Muted       []string           `json:"muted,omitempty"`
+	Kicked      []string           `json:"kicked,omitempty"`
+	Password    []byte             `json:"password,omitempty"`
+	Invite      string             `json:"invite,omitempty"`
+	Name        string             `json:"name,omitempty"`
+	Tags        map[string]string  `json:"tags,omitempty"`
+	Metadata    json.RawMessage    `json:"metadata,omitempty"`
+	Unlisted    bool               `json:"unlisted,omitempty"`
+	RelayOnly   bool               `json:"relay_only,omitempty"`
+	Reservation *reservationRecord `json:"reservation,omitempty"`
+	Created     time.Time          `json:"created"`
+}
+
+type reservationRecord struct {
+	Token        string    `json:"token"`
+	Starts       time.Time `json:"starts"`
+	Expires      time.Time `json:"expires"`
+	Participants []string  `json:"participants,omitempty"`
+}
+
+// nodeRecord is what an instance's node key holds.
+type nodeRecord struct {
+	URL string `json:"url,omitempty"`
+}
+
+// RoomElsewhereError is returned when a room is owned by another instance.
+type RoomElsewhereError struct {
+	Room string
+	Node string
+	URL  string
+}
+
+func (e *RoomElsewhereError) Error() string {
+	return fmt.Sprintf("Room %s is on %s", e.Room, e.Node)
+}
+
+func (e *RoomElsewhereError) details() gin.H {
+	return gin.H{"room": e.Room, "node": e.Node, "url": e.URL}
+}
+
+// etcdRooms keeps the rooms of this instance in etcd.
+type etcdRooms struct {
+	client *etcd.Client
+	prefix string
+	node   string
+	ttl    time.Duration
+	stop   chan struct{}
+	done   sync.WaitGroup
+
+	orphans map[string]time.Time // when sweep found a record's owner gone
+
+	// mu is held while records are written, so a room taken over is not
+	// deleted as closed before it is restored.
+	mu       sync.Mutex
+	lease    int64
+	deadline time.Time         // until when the lease surely holds
+	revs     map[string]int64  // revision of each record written
+	written  map[string][]byte // and what it was
+}
+
+// roomStore is nil unless --room-store=etcd.
+var roomStore *etcdRooms
+
+func initRoomStore(kind string) error {
+	switch kind {
+	case "memory":
+		return nil
+	case "etcd":
+	default:
+		return fmt.Errorf("Unknown room store %q", kind)
+	}
+	if *etcdPrefix == "" {
+		return fmt.Errorf("--etcd-prefix must not be empty")
+	}
+	if *etcdLeaseTTL < 2*time.Second {
+		return fmt.Errorf("--etcd-lease-ttl must be at least 2s, not %s", *etcdLeaseTTL)
+	}
+	node, err := thisNode()
+	if err != nil {
+		return err
+	}
+	e := &etcdRooms{
+		client:  etcd.New(strings.Split(*etcdEndpoints, ",")),
+		prefix:  *etcdPrefix,
+		node:    node,
+		ttl:     *etcdLeaseTTL,
+		stop:    make(chan struct{}),
+		revs:    make(map[string]int64),
+		written: make(map[string][]byte),
+		orphans: make(map[string]time.Time),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.register(ctx); err != nil {
+		return fmt.Errorf("Error registering with etcd at %s: %w", *etcdEndpoints, err)
+	}
+	log.Info().Str("node", node).Str("endpoints", *etcdEndpoints).Msg("Keeping rooms in etcd")
+	e.done.Add(2)
+	go e.keepAlive()
+	go e.sync()
+	roomStore = e
+	return nil
+}
+
+func (e *etcdRooms) roomKey(id string) string {
+	return e.prefix + "rooms/" + id
+}
+
+func (e *etcdRooms) nodeKey(node string) string {
+	return e.prefix + "nodes/" + node
+}
+
+// register takes a new lease and puts the node key on it.
+func (e *etcdRooms) register(ctx context.Context) error {
+	started := time.Now()
+	lease, err := e.client.Grant(ctx, e.ttl)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(nodeRecord{URL: publicBase})
+	if err != nil {
+		return err
+	}
+	if err := e.client.Put(ctx, e.nodeKey(e.node), b, lease); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.lease, e.deadline = lease, started.Add(e.ttl)
+	e.mu.Unlock()
+	return nil
+}
+
+// keepAlive renews the lease three times a lease. When that fails for the
+// whole of it the node key may be gone, and rooms taken over, so they are
+// closed here before it registers again.
+func (e *etcdRooms) keepAlive() {
+	defer e.done.Done()
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+		}
+		e.mu.Lock()
+		lease, deadline := e.lease, e.deadline
+		e.mu.Unlock()
+		sent := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), e.ttl/3)
+		ttl, err := e.client.KeepAlive(ctx, lease)
+		if err == nil {
+			cancel()
+			e.mu.Lock()
+			e.deadline = sent.Add(ttl)
+			e.mu.Unlock()
+			continue
+		}
+		if err != etcd.ErrLeaseExpired && time.Now().Before(deadline) {
+			cancel()
+			log.Warn().Err(err).Msg("Error renewing etcd lease")
+			continue
+		}
+		e.mu.Lock()
+		held := rooms.List()
+		for _, room := range held {
+			e.lost(room.ID, "fenced")
+		}
+		e.mu.Unlock()
+		if len(held) > 0 {
+			log.Warn().Err(err).Str("node", e.node).Int("rooms", len(held)).Msg("Lost etcd lease, closed rooms")
+		}
+		err = e.register(ctx)
+		cancel()
+		if err != nil {
+			log.Err(err).Msg("Error registering with etcd")
+		}
+	}
+}
+
+// sync writes the rooms that changed every roomSyncInterval, and once a
+// lease drops the records of rooms nobody came back for.
+func (e *etcdRooms) sync() {
+	defer e.done.Done()
+	ticker := time.NewTicker(roomSyncInterval)
+	defer ticker.Stop()
+	lastSweep := time.Now()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case <-ticker.C:
+		}
+		e.flush()
+		if time.Since(lastSweep) >= e.ttl {
+			e.sweep()
+			lastSweep = time.Now()
+		}
+	}
+}
+
+// flush writes every room that changed since it was last written and
+// deletes the records of rooms closed since. Rooms whose record changed
+// under it were taken over by another instance, and are closed here.
+func (e *etcdRooms) flush() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), e.ttl/2)
+	defer cancel()
+	records := roomManager().records()
+	for id, rec := range records {
+		rec.Owner = e.node
+		b, err := json.Marshal(rec)
+		if err != nil {
+			log.Err(err).Str("room", id).Msg("Error encoding room")
+			continue
+		}
+		if bytes.Equal(e.written[id], b) {
+			continue
+		}
+		ok, rev, err := e.client.CompareAndSwap(ctx, e.roomKey(id), b, e.revs[id])
+		if err != nil {
+			log.Err(err).Str("room", id).Msg("Error writing room to etcd")
+			continue
+		}
+		if !ok {
+			e.lost(id, "moved")
+			continue
+		}
+		e.revs[id], e.written[id] = rev, b
+	}
+	for id, rev := range e.revs {
+		if _, ok := records[id]; ok {
+			continue
+		}
+		if _, err := e.client.CompareAndDelete(ctx, e.roomKey(id), rev); err != nil {
+			log.Err(err).Str("room", id).Msg("Error deleting room from etcd")
+			continue
+		}
+		delete(e.revs, id)
+		delete(e.written, id)
+	}
+}
+
+// lost closes room id, which another instance has, or may have, now,
+// leaving its record. e.mu must be held.
+func (e *etcdRooms) lost(id string, reason string) {
+	delete(e.revs, id)
+	delete(e.written, id)
+	metricRoomOwnership.WithLabelValues(reason).Inc()
+	members, waiting := rooms.Evict(id, reason)
+	log.Warn().Str("room", id).Str("reason", reason).Int("members", len(members)).Msg("Closed room owned elsewhere")
+	for _, peer := range members {
+		events.publish(Event{Type: EventRoomLeft, UUID: peer, Room: id, Reason: reason})
+		sendRoomLeft(id, peer, reason)
+	}
+	for _, peer := range waiting {
+		sendRoomLeft(id, peer, reason)
+	}
+}
+
+// sweep deletes the records of rooms whose owner has been gone for longer
+// than their members could take to come back.
+func (e *etcdRooms) sweep() {
+	ctx, cancel := context.WithTimeout(context.Background(), e.ttl/2)
+	defer cancel()
+	kvs, err := e.client.List(ctx, e.prefix+"rooms/")
+	if err != nil {
+		log.Err(err).Msg("Error listing rooms in etcd")
+		return
+	}
+	nodes, err := e.client.List(ctx, e.prefix+"nodes/")
+	if err != nil {
+		log.Err(err).Msg("Error listing nodes in etcd")
+		return
+	}
+	alive := map[string]bool{}
+	for _, kv := range nodes {
+		alive[strings.TrimPrefix(string(kv.Key), e.prefix+"nodes/")] = true
+	}
+	idle := *resumeGrace + *roomGrace + e.ttl
+	orphans := make(map[string]time.Time)
+	for _, kv := range kvs {
+		var rec roomRecord
+		if err := json.Unmarshal(kv.Value, &rec); err != nil || alive[rec.Owner] {
+			continue
+		}
+		key := fmt.Sprintf("%s@%d", kv.Key, kv.ModRevision)
+		since, ok := e.orphans[key]
+		if !ok {
+			since = time.Now()
+		}
+		if time.Since(since) < idle {
+			orphans[key] = since
+			continue
+		}
+		if ok, err := e.client.CompareAndDelete(ctx, string(kv.Key), kv.ModRevision); err == nil && ok {
+			log.Debug().Str("key", string(kv.Key)).Str("owner", rec.Owner).Msg("Deleted abandoned room")
+		}
+	}
+	e.orphans = orphans
+}
+
+// claim makes sure room id, of tenant, is here if it is anywhere: it is
+// already, or its owner is gone and it is taken over. A room owned by
+// another live instance is a RoomElsewhereError, and one that does not
+// exist is left for the join to refuse.
+func (e *etcdRooms) claim(ctx context.Context, id string, tenant string) error {
+	if _, ok := rooms.Stats(id); ok {
+		return nil
+	}
+	for attempt := 0; attempt < 3; attempt++ {
+		kv, err := e.client.Get(ctx, e.roomKey(id))
+		if err != nil || kv == nil {
+			return err
+		}
+		var rec roomRecord
+		if err := json.Unmarshal(kv.Value, &rec); err != nil {
+			return fmt.Errorf("Error decoding room %s: %w", id, err)
+		}
+		if rec.Tenant != tenant {
+			return nil
+		}
+		if rec.Owner != e.node {
+			owner, err := e.client.Get(ctx, e.nodeKey(rec.Owner))
+			if err != nil {
+				return err
+			}
+			if owner != nil {
+				var n nodeRecord
+				json.Unmarshal(owner.Value, &n)
+				return &RoomElsewhereError{Room: id, Node: rec.Owner, URL: n.URL}
+			}
+		}
+		if took, err := e.takeOver(ctx, id, rec, kv.ModRevision); took || err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("Room %s keeps changing", id)
+}
+
+// takeOver makes this instance the owner of room id if its record is still
+// at rev, and opens it here.
+func (e *etcdRooms) takeOver(ctx context.Context, id string, rec roomRecord, rev int64) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	previous := rec.Owner
+	rec.Owner = e.node
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return false, err
+	}
+	ok, rev, err := e.client.CompareAndSwap(ctx, e.roomKey(id), b, rev)
+	if err != nil || !ok {
+		return false, err
+	}
+	e.revs[id], e.written[id] = rev, b
+	restored := roomManager().restore(id, rec)
+	metricRoomOwnership.WithLabelValues("taken_over").Inc()
+	log.Info().Str("room", id).Str("from", previous).Int("members", len(restored)).Msg("Took over room")
+	time.AfterFunc(*resumeGrace+e.ttl, func() { dropRestored(id, restored) })
+	return true, nil
+}
+
+// exists reports whether room id is in etcd, for rooms reserved by id.
+func (e *etcdRooms) exists(ctx context.Context, id string) (bool, error) {
+	kv, err := e.client.Get(ctx, e.roomKey(id))
+	return kv != nil, err
+}
+
+func (e *etcdRooms) Ping(ctx context.Context) error {
+	return e.client.Ping(ctx)
+}
+
+// dropRestored takes the members a room was restored with out of it if they
+// did not come back.
+func dropRestored(room string, members []string) {
+	for _, peer := range members {
+		if peerLive(peer) || rooms.RoomOf(peer) != room {
+			continue
+		}
+		rooms.Leave(peer)
+		announceLeft(room, peer, "expired")
+		if !admitWaiting(room) {
+			sendMeshPlan(room)
+		}
+	}
+}
+
+// close writes the rooms one last time and ends the lease, so other
+// instances can take them over at once.
+func (e *etcdRooms) close(ctx context.Context) {
+	close(e.stop)
+	e.done.Wait()
+	e.flush()
+	if err := e.client.Revoke(ctx, e.lease); err != nil {
+		log.Err(err).Msg("Error revoking etcd lease")
+	}
+}
+
+// records are the rooms as etcd holds them, without an owner.
+func (m *RoomManager) records() map[string]roomRecord {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	records := make(map[string]roomRecord, len(m.rooms))
+	for id, r := range m.rooms {
+		rec := roomRecord{
+			Tenant:    r.tenant,
+			Host:      r.host,
+			Members:   make([]string, 0, len(r.members)),
+			MaxPeers:  r.maxPeers,
+			Locked:    r.locked,
+			Password:  r.password,
+			Invite:    r.invite,
+			Name:      r.name,
+			Tags:      r.tags,
+			Metadata:  r.metadata,
+			Unlisted:  r.unlisted,
+			RelayOnly: r.relayOnly,
+			Created:   r.created,
+		}
+		for peer := range r.members {
+			rec.Members = append(rec.Members, peer)
+		}
+		sort.Slice(rec.Members, func(i, j int) bool { return r.members[rec.Members[i]] < r.members[rec.Members[j]] })
+		for peer := range r.muted {
+			rec.Muted = append(rec.Muted, peer)
+		}
+		sort.Strings(rec.Muted)
+		for peer := range r.kicked {
+			rec.Kicked = append(rec.Kicked, peer)
+		}
+		sort.Strings(rec.Kicked)
+		if res := r.reservation; res != nil {
+			rec.Reservation = &reservationRecord{Token: res.token, Starts: res.starts, Expires: res.expires}
+			for peer := range res.participants {
+				rec.Reservation.Participants = append(rec.Reservation.Participants, peer)
+			}
+			sort.Strings(rec.Reservation.Participants)
+		}
+		records[id] = rec
+	}
+	return records
+}
+
+// restore opens room id as rec has it, and returns the members it was
+// opened with. Members already in another room here are left out of it.
+func (m *RoomManager) restore(id string, rec roomRecord) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.rooms[id]; ok {
+		return nil
+	}
+	room := &Room{
+		id:        id,
+		tenant:    rec.Tenant,
+		host:      rec.Host,
+		members:   make(map[string]uint64),
+		muted:     make(map[string]bool),
+		kicked:    make(map[string]bool),
+		maxPeers:  rec.MaxPeers,
+		locked:    rec.Locked,
+		password:  rec.Password,
+		invite:    rec.Invite,
+		name:      rec.Name,
+		tags:      rec.Tags,
+		metadata:  rec.Metadata,
+		unlisted:  rec.Unlisted,
+		relayOnly: rec.RelayOnly,
+		created:   rec.Created,
+	}
+	var restored []string
+	for _, peer := range rec.Members {
+		if _, ok := m.byPeer[peer]; ok {
+			continue
+		}
+		m.joins++
+		room.members[peer] = m.joins
+		m.byPeer[peer] = id
+		restored = append(restored, peer)
+	}
+	for _, peer := range rec.Kicked {
+		room.kicked[peer] = true
+	}
+	for _, peer := range rec.Muted {
+		if _, ok := room.members[peer]; ok {
+			room.muted[peer] = true
+		}
+	}
+	if _, ok := room.members[room.host]; !ok && room.host != "" {
+		room.host = ""
+		if len(restored) > 0 {
+			room.host = restored[0]
+		}
+	}
+	if res := rec.Reservation; res != nil {
+		room.reservation = &reservation{token: res.Token, starts: res.Starts, expires: res.Expires, participants: make(map[string]bool)}
+		for _, peer := range res.Participants {
+			room.reservation.participants[peer] = true
+		}
+	}
+	if len(room.members) == 0 {
+		room.empty = time.Now()
+	}
+	m.rooms[id] = room
+	return restored
+}
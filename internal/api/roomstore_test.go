@@ -0,0 +1,248 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hoyle1974/seven/internal/etcd"
+)
+
+// fakeEtcd is enough of the etcd JSON gateway for etcdRooms: ranges, puts
+// and transactions comparing revisions.
+type fakeEtcd struct {
+	mu   sync.Mutex
+	rev  int64
+	kvs  map[string]etcd.KeyValue
+	txns int
+	// beforeTxn, when set, runs before each transaction, as another
+	// instance writing in between.
+	beforeTxn func(f *fakeEtcd)
+}
+
+func newFakeEtcd(t *testing.T) (*fakeEtcd, *etcd.Client) {
+	f := &fakeEtcd{kvs: map[string]etcd.KeyValue{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, etcd.New([]string{srv.URL})
+}
+
+func (f *fakeEtcd) put(key string, value []byte) int64 {
+	f.rev++
+	kv, ok := f.kvs[key]
+	if !ok {
+		kv = etcd.KeyValue{Key: []byte(key), CreateRevision: f.rev}
+	}
+	kv.Value, kv.ModRevision = value, f.rev
+	f.kvs[key] = kv
+	return f.rev
+}
+
+func (f *fakeEtcd) record(t *testing.T, key string, v any) int64 {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.put(key, b)
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var reply any
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var req struct {
+			Key      []byte `json:"key"`
+			RangeEnd []byte `json:"range_end"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var kvs []etcd.KeyValue
+		for key, kv := range f.kvs {
+			if key == string(req.Key) || (req.RangeEnd != nil && key >= string(req.Key) && key < string(req.RangeEnd)) {
+				kvs = append(kvs, kv)
+			}
+		}
+		reply = map[string]any{"kvs": kvs}
+	case "/v3/kv/txn":
+		if f.beforeTxn != nil {
+			f.beforeTxn(f)
+		}
+		f.txns++
+		var req struct {
+			Compare []struct {
+				Target         string `json:"target"`
+				Key            []byte `json:"key"`
+				CreateRevision int64  `json:"create_revision,string"`
+				ModRevision    int64  `json:"mod_revision,string"`
+			} `json:"compare"`
+			Success []struct {
+				Put *struct {
+					Key   []byte `json:"key"`
+					Value []byte `json:"value"`
+				} `json:"request_put"`
+				Delete *struct {
+					Key []byte `json:"key"`
+				} `json:"request_delete_range"`
+			} `json:"success"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		ok := true
+		for _, c := range req.Compare {
+			kv := f.kvs[string(c.Key)]
+			switch c.Target {
+			case "CREATE":
+				ok = ok && kv.CreateRevision == c.CreateRevision
+			case "MOD":
+				ok = ok && kv.ModRevision == c.ModRevision
+			default:
+				http.Error(w, "unknown target "+c.Target, http.StatusBadRequest)
+				return
+			}
+		}
+		if ok {
+			for _, op := range req.Success {
+				switch {
+				case op.Put != nil:
+					f.put(string(op.Put.Key), op.Put.Value)
+				case op.Delete != nil:
+					f.rev++
+					delete(f.kvs, string(op.Delete.Key))
+				}
+			}
+		}
+		reply = map[string]any{"header": map[string]string{"revision": strconv.FormatInt(f.rev, 10)}, "succeeded": ok}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(reply)
+}
+
+// get returns key and how many transactions there were so far.
+func (f *fakeEtcd) get(key string) (etcd.KeyValue, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.kvs[key], f.txns
+}
+
+func (f *fakeEtcd) owner(t *testing.T, key string) string {
+	t.Helper()
+	kv, _ := f.get(key)
+	var rec roomRecord
+	if err := json.Unmarshal(kv.Value, &rec); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Owner
+}
+
+func newTestEtcdRooms(t *testing.T) (*etcdRooms, *fakeEtcd) {
+	rooms = NewRoomManager()
+	f, client := newFakeEtcd(t)
+	return &etcdRooms{
+		client:  client,
+		prefix:  "seven/",
+		node:    "new",
+		ttl:     2 * time.Second,
+		revs:    make(map[string]int64),
+		written: make(map[string][]byte),
+		orphans: make(map[string]time.Time),
+	}, f
+}
+
+func TestClaimExpiredOwner(t *testing.T) {
+	e, f := newTestEtcdRooms(t)
+	// The old owner's node key went with its lease.
+	f.record(t, "seven/rooms/lobby", roomRecord{Tenant: "acme", Owner: "old", Host: "a", Members: []string{"a", "b"}, Locked: true})
+	if err := e.claim(context.Background(), "lobby", "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if owner := f.owner(t, "seven/rooms/lobby"); owner != "new" {
+		t.Errorf("Record owned by %q, want new", owner)
+	}
+	if kv, _ := f.get("seven/rooms/lobby"); e.revs["lobby"] != kv.ModRevision {
+		t.Errorf("Remembered revision %d, want %d", e.revs["lobby"], kv.ModRevision)
+	}
+	if got := strings.Join(rooms.MembersByJoin("lobby"), ","); got != "a,b" {
+		t.Errorf("Restored members %q, want a,b", got)
+	}
+	if host := rooms.Host("lobby"); host != "a" {
+		t.Errorf("Restored host %q, want a", host)
+	}
+	// Taken over, it is claimed without asking etcd again.
+	_, before := f.get("")
+	err := e.claim(context.Background(), "lobby", "acme")
+	if _, after := f.get(""); err != nil || after != before {
+		t.Errorf("Claiming again = %v after %d more transactions", err, after-before)
+	}
+}
+
+func TestClaimLiveOwner(t *testing.T) {
+	e, f := newTestEtcdRooms(t)
+	f.record(t, "seven/nodes/old", nodeRecord{URL: "https://old.example"})
+	f.record(t, "seven/rooms/lobby", roomRecord{Tenant: "acme", Owner: "old", Members: []string{"a"}})
+	err := e.claim(context.Background(), "lobby", "acme")
+	var elsewhere *RoomElsewhereError
+	if !errors.As(err, &elsewhere) || elsewhere.Node != "old" || elsewhere.URL != "https://old.example" {
+		t.Fatalf("claim = %v, want the room on old", err)
+	}
+	if _, txns := f.get(""); f.owner(t, "seven/rooms/lobby") != "old" || txns != 0 {
+		t.Errorf("Record changed or %d transactions, want old untouched", txns)
+	}
+	if _, ok := rooms.Stats("lobby"); ok {
+		t.Error("Room opened here")
+	}
+}
+
+func TestClaimOtherTenant(t *testing.T) {
+	e, f := newTestEtcdRooms(t)
+	f.record(t, "seven/rooms/lobby", roomRecord{Tenant: "other", Owner: "old"})
+	err := e.claim(context.Background(), "lobby", "acme")
+	if _, txns := f.get(""); err != nil || txns != 0 {
+		t.Errorf("claim = %v after %d transactions, want nothing done", err, txns)
+	}
+}
+
+func TestClaimRace(t *testing.T) {
+	e, f := newTestEtcdRooms(t)
+	f.record(t, "seven/rooms/lobby", roomRecord{Tenant: "acme", Owner: "old", Members: []string{"a"}})
+	// Another instance takes the room over first, and its lease runs out
+	// too before the second attempt.
+	f.beforeTxn = func(f *fakeEtcd) {
+		f.beforeTxn = nil
+		f.put("seven/rooms/lobby", []byte(`{"tenant":"acme","owner":"other","members":["a","b"]}`))
+	}
+	if err := e.claim(context.Background(), "lobby", "acme"); err != nil {
+		t.Fatal(err)
+	}
+	if _, txns := f.get(""); txns != 2 {
+		t.Errorf("Took %d transactions, want 2", txns)
+	}
+	if got := strings.Join(rooms.MembersByJoin("lobby"), ","); got != "a,b" {
+		t.Errorf("Restored members %q, want a,b from the newer record", got)
+	}
+}
+
+func TestClaimKeepsChanging(t *testing.T) {
+	e, f := newTestEtcdRooms(t)
+	f.record(t, "seven/rooms/lobby", roomRecord{Tenant: "acme", Owner: "old"})
+	f.beforeTxn = func(f *fakeEtcd) {
+		f.put("seven/rooms/lobby", f.kvs["seven/rooms/lobby"].Value)
+	}
+	if err := e.claim(context.Background(), "lobby", "acme"); err == nil {
+		t.Fatal("claim of a room that keeps changing succeeded")
+	}
+	if _, ok := rooms.Stats("lobby"); ok {
+		t.Error("Room opened here")
+	}
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/hoyle1974/seven/internal/hub"
+	"github.com/hoyle1974/seven/internal/registry"
+)
+
+// Connection reports also score the peer they are about, and pickSome
+// favors peers with good scores: a peer others keep connecting to is handed
+// out more often than one they keep failing to reach, which is usually
+// stuck behind a NAT or firewall. Connecting only through a TURN relay
+// counts half. Reports fade with --peer-score-half-life, so a peer that
+// moved networks is not held to its old record.
+
+// minScore keeps peers that always fail in the running, so a run of bad
+// reports, or a peer telling lies about another, cannot shut one out.
+const minScore = 0.05
+
+// peerScore is the decayed sum of the reports about one peer.
+type peerScore struct {
+	connected float64
+	relayed   float64 // of connected
+	failed    float64
+	updated   time.Time
+}
+
+func (p *peerScore) decay(now time.Time) {
+	f := math.Exp2(-float64(now.Sub(p.updated)) / float64(*peerScoreHalfLife))
+	p.connected *= f
+	p.relayed *= f
+	p.failed *= f
+	p.updated = now
+}
+
+// value is the chance a connection to the peer succeeds directly, starting
+// from an even chance for peers nobody reported on.
+func (p *peerScore) value() float64 {
+	v := (p.connected - p.relayed/2 + 1) / (p.connected + p.failed + 2)
+	return math.Max(v, minScore)
+}
+
+type scoreBook struct {
+	mu     sync.Mutex
+	scores *lru.Cache[string, *peerScore]
+}
+
+var scores = func() *scoreBook {
+	c, _ := lru.New[string, *peerScore](65536)
+	return &scoreBook{scores: c}
+}()
+
+// enabled reports whether reports score peers.
+func (b *scoreBook) enabled() bool {
+	return *peerScoreHalfLife > 0
+}
+
+func (b *scoreBook) add(id string, f ReportForm) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	p, ok := b.scores.Get(id)
+	if !ok {
+		p = &peerScore{updated: now}
+		b.scores.Add(id, p)
+	}
+	p.decay(now)
+	switch {
+	case f.Outcome == "failed":
+		p.failed++
+	case f.CandidateType == "relay":
+		p.connected++
+		p.relayed++
+	default:
+		p.connected++
+	}
+	metricPeerScores.Observe(p.value())
+}
+
+// Score returns the score of id, and false for peers not reported on.
+func (b *scoreBook) Score(id string) (float64, bool) {
+	if !b.enabled() {
+		return 0, false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	p, ok := b.scores.Peek(id)
+	if !ok {
+		return 0, false
+	}
+	p.decay(time.Now())
+	return p.value(), true
+}
+
+// scoreReport scores the peer a report is about, if it is registered in the
+// reporter's tenant.
+func scoreReport(ctx context.Context, tenant string, f ReportForm) {
+	if !scores.enabled() || f.Peer == "" {
+		return
+	}
+	id, _ := hub.SplitDevice(f.Peer)
+	e, ok, err := peerRegistry.Get(ctx, id)
+	if err != nil {
+		logFor(ctx).Err(err).Msg("Error looking up reported peer")
+		return
+	}
+	if !ok || e.Tenant != tenant || id == f.Uuid {
+		return
+	}
+	scores.add(id, f)
+}
+
+// pickWeighted returns up to amount entries chosen at random, each with a
+// chance in proportion to its score, using Efraimidis and Spirakis' weighted
+// sampling without replacement. Unscored peers weigh as much as one that
+// succeeds half the time.
+func pickWeighted(values []registry.Entry, weights []float64, amount int) []EntryForm {
+	type keyed struct {
+		key float64
+		e   registry.Entry
+	}
+	keys := make([]keyed, len(values))
+	for i, e := range values {
+		keys[i] = keyed{math.Pow(rand.Float64(), 1/weights[i]), e}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].key > keys[j].key })
+	picked := make([]EntryForm, 0, amount)
+	for _, k := range keys[:amount] {
+		picked = append(picked, entryForm(k.e))
+	}
+	return picked
+}
+
+// entryWeights returns the score of each of values, or nil when none has
+// one and picking uniformly is the same.
+func entryWeights(values []registry.Entry) []float64 {
+	if !scores.enabled() {
+		return nil
+	}
+	weights := make([]float64, len(values))
+	scored := false
+	for i, e := range values {
+		v, ok := scores.Score(e.UUID.String())
+		if !ok {
+			v = 0.5
+		}
+		weights[i], scored = v, scored || ok
+	}
+	if !scored {
+		return nil
+	}
+	return weights
+}
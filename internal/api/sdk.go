@@ -0,0 +1,57 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hoyle1974/seven/js"
+)
+
+// The browser SDK in js/ is served as /sdk/<version>/seven.js, the version
+// being the one in js/package.json that is published to npm, and as
+// /sdk/latest/seven.js. Neither is cached for long, as the file can change
+// without the version doing so. /sdk/<version>+<hash>/seven.js, with the
+// hash of the file this binary embeds, never changes and is cached for good;
+// GET /api/v1/config hands that one out.
+
+var sdkVersion = func() string {
+	var pkg struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(js.Package, &pkg); err != nil {
+		panic(err)
+	}
+	return pkg.Version
+}()
+
+var sdkHash = func() string {
+	sum := sha256.Sum256(js.SDK)
+	return hex.EncodeToString(sum[:6])
+}()
+
+// sdkBuild names the SDK this binary serves, for its immutable path.
+var sdkBuild = sdkVersion + "+" + sdkHash
+
+func sdk(ctx *gin.Context) {
+	switch ctx.Param("version") {
+	case sdkBuild:
+		ctx.Header("Cache-Control", "public, max-age=31536000, immutable")
+	case sdkVersion:
+		ctx.Header("Cache-Control", "public, max-age=3600")
+	case "latest":
+		ctx.Header("Cache-Control", "no-cache")
+	default:
+		respondError(ctx, http.StatusNotFound, "unknown_sdk_version", "unknown sdk version", gin.H{"version": sdkVersion, "build": sdkBuild})
+		return
+	}
+	etag := `"` + sdkHash + `"`
+	ctx.Header("ETag", etag)
+	if ctx.GetHeader("If-None-Match") == etag {
+		ctx.Status(http.StatusNotModified)
+		return
+	}
+	ctx.Data(http.StatusOK, "text/javascript; charset=utf-8", js.SDK)
+}
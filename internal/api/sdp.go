@@ -0,0 +1,308 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hoyle1974/seven/internal/ws"
+)
+
+// sdpPolicy is what the server enforces on the SDP of relayed offers and
+// answers, and on trickled candidates. It is written as comma separated
+// rules, e.g. "max-size=16384,strip=H264+VP9,bundle,relay-only".
+type sdpPolicy struct {
+	maxSize   int             // longest SDP accepted, 0 for no limit
+	strip     map[string]bool // codecs, in upper case, taken out of every offer and answer
+	bundle    bool            // refuse SDPs not bundling every m-section
+	relayOnly bool            // drop all candidates but TURN relay ones
+}
+
+// sdpPolicies holds --sdp-policy under "" and the --tenant-sdp-policies
+// overrides of it.
+var sdpPolicies = map[string]*sdpPolicy{}
+
+func initSDPPolicies(def string, tenants string) error {
+	if def != "" {
+		p, err := parseSDPPolicy(def)
+		if err != nil {
+			return err
+		}
+		sdpPolicies[""] = p
+	}
+	for _, pair := range strings.Split(tenants, ";") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		tenant, rules, ok := strings.Cut(pair, ":")
+		if !ok {
+			return fmt.Errorf("Invalid tenant SDP policy %q", pair)
+		}
+		if tenant == "default" {
+			tenant = ""
+		} else if !tenantPattern.MatchString(tenant) {
+			return fmt.Errorf("Invalid tenant name %q", tenant)
+		}
+		p, err := parseSDPPolicy(rules)
+		if err != nil {
+			return err
+		}
+		sdpPolicies[tenant] = p
+	}
+	return nil
+}
+
+func parseSDPPolicy(rules string) (*sdpPolicy, error) {
+	p := &sdpPolicy{strip: map[string]bool{}}
+	for _, rule := range strings.Split(rules, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(rule), "=")
+		switch name {
+		case "":
+		case "max-size":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("Invalid SDP max-size %q", value)
+			}
+			p.maxSize = n
+		case "strip":
+			for _, codec := range strings.Split(value, "+") {
+				if codec != "" {
+					p.strip[strings.ToUpper(codec)] = true
+				}
+			}
+		case "bundle":
+			p.bundle = true
+		case "relay-only":
+			p.relayOnly = true
+		default:
+			return nil, fmt.Errorf("Unknown SDP policy rule %q", rule)
+		}
+	}
+	return p, nil
+}
+
+// sdpPolicyOf returns the policy for peers of tenant, or nil when there is
+// none.
+func sdpPolicyOf(tenant string) *sdpPolicy {
+	if p, ok := sdpPolicies[tenant]; ok {
+		return p
+	}
+	return sdpPolicies[""]
+}
+
+var errCandidateDropped = errors.New("Candidate dropped by SDP policy")
+
+// apply rewrites the payload of an offer, answer or candidate to p. It
+// returns errCandidateDropped for candidates p does not let through, and an
+// error saying why for signals it refuses.
+func (p *sdpPolicy) apply(msg ws.Message) (ws.Message, error) {
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		return msg, errors.New("payload is not a JSON object")
+	}
+	key := "sdp"
+	if msg.Type == ws.MsgCandidate {
+		key = "candidate"
+	}
+	var text string
+	if err := json.Unmarshal(payload[key], &text); err != nil {
+		return msg, fmt.Errorf("payload has no %s", key)
+	}
+
+	var err error
+	if msg.Type == ws.MsgCandidate {
+		// An empty candidate marks the end of candidates.
+		if text == "" || !p.relayOnly {
+			return msg, nil
+		}
+		if candidateType(text) != "relay" {
+			return msg, errCandidateDropped
+		}
+		text = hideRelatedAddress(text)
+	} else if text, err = p.filterSDP(text); err != nil {
+		return msg, err
+	}
+	if payload[key], err = json.Marshal(text); err != nil {
+		return msg, err
+	}
+	if msg.Payload, err = json.Marshal(payload); err != nil {
+		return msg, err
+	}
+	return msg, nil
+}
+
+// filterSDP applies p to a session description.
+func (p *sdpPolicy) filterSDP(sdp string) (string, error) {
+	if p.maxSize > 0 && len(sdp) > p.maxSize {
+		return "", fmt.Errorf("sdp is longer than %d bytes", p.maxSize)
+	}
+	lines := strings.Split(strings.TrimRight(sdp, "\r\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+
+	var err error
+	if len(p.strip) > 0 {
+		if lines, err = stripCodecs(lines, p.strip); err != nil {
+			return "", err
+		}
+	}
+	if p.bundle && !bundled(lines) {
+		return "", errors.New("sdp does not bundle every m-section")
+	}
+	if p.relayOnly {
+		lines = relayCandidates(lines)
+	}
+	return strings.Join(lines, "\r\n") + "\r\n", nil
+}
+
+// stripCodecs takes the payload types of codecs out of every m-section,
+// along with retransmission payload types bound to them.
+func stripCodecs(lines []string, codecs map[string]bool) ([]string, error) {
+	stripped := map[string]bool{}
+	for _, line := range lines {
+		if pt, codec, ok := rtpmap(line); ok && codecs[codec] {
+			stripped[pt] = true
+		}
+	}
+	for _, line := range lines {
+		// a=fmtp:<pt> apt=<pt> binds an rtx payload type to another.
+		if rest, ok := strings.CutPrefix(line, "a=fmtp:"); ok {
+			pt, params, _ := strings.Cut(rest, " ")
+			if apt, ok := strings.CutPrefix(params, "apt="); ok && stripped[apt] {
+				stripped[pt] = true
+			}
+		}
+	}
+	if len(stripped) == 0 {
+		return lines, nil
+	}
+
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			fields := strings.Fields(line)
+			if len(fields) < 4 {
+				kept = append(kept, line)
+				continue
+			}
+			formats := fields[:3]
+			for _, pt := range fields[3:] {
+				if !stripped[pt] {
+					formats = append(formats, pt)
+				}
+			}
+			if len(formats) == 3 {
+				return nil, fmt.Errorf("sdp offers only codecs that are not allowed in %q", fields[0])
+			}
+			kept = append(kept, strings.Join(formats, " "))
+			continue
+		}
+		if pt, ok := attributePayloadType(line); ok && stripped[pt] {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return kept, nil
+}
+
+// rtpmap parses a=rtpmap:<pt> <codec>/<clock rate>.
+func rtpmap(line string) (pt string, codec string, ok bool) {
+	rest, ok := strings.CutPrefix(line, "a=rtpmap:")
+	if !ok {
+		return "", "", false
+	}
+	pt, encoding, ok := strings.Cut(rest, " ")
+	codec, _, _ = strings.Cut(encoding, "/")
+	return pt, strings.ToUpper(codec), ok
+}
+
+// attributePayloadType returns the payload type an rtpmap, fmtp or rtcp-fb
+// attribute is about.
+func attributePayloadType(line string) (string, bool) {
+	for _, prefix := range []string{"a=rtpmap:", "a=fmtp:", "a=rtcp-fb:"} {
+		if rest, ok := strings.CutPrefix(line, prefix); ok {
+			pt, _, _ := strings.Cut(rest, " ")
+			return pt, true
+		}
+	}
+	return "", false
+}
+
+// bundled reports whether an a=group:BUNDLE line names every a=mid.
+func bundled(lines []string) bool {
+	group := map[string]bool{}
+	var mids []string
+	for _, line := range lines {
+		if rest, ok := strings.CutPrefix(line, "a=group:BUNDLE"); ok {
+			for _, mid := range strings.Fields(rest) {
+				group[mid] = true
+			}
+		}
+		if mid, ok := strings.CutPrefix(line, "a=mid:"); ok {
+			mids = append(mids, mid)
+		}
+	}
+	if len(group) == 0 {
+		return false
+	}
+	for _, mid := range mids {
+		if !group[mid] {
+			return false
+		}
+	}
+	return true
+}
+
+// relayCandidates drops every candidate but relay ones and blanks the
+// default connection addresses, which are those of a candidate too.
+func relayCandidates(lines []string) []string {
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "a=candidate:"):
+			if candidateType(line) != "relay" {
+				continue
+			}
+			line = hideRelatedAddress(line)
+		case strings.HasPrefix(line, "c=IN IP4 "):
+			line = "c=IN IP4 0.0.0.0"
+		case strings.HasPrefix(line, "c=IN IP6 "):
+			line = "c=IN IP6 ::"
+		case strings.HasPrefix(line, "a=rtcp:"):
+			port, _, _ := strings.Cut(strings.TrimPrefix(line, "a=rtcp:"), " ")
+			line = "a=rtcp:" + port
+		}
+		kept = append(kept, line)
+	}
+	return kept
+}
+
+// hideRelatedAddress blanks the raddr and rport of a candidate, which for a
+// relay candidate give away the peer's own address.
+func hideRelatedAddress(candidate string) string {
+	fields := strings.Fields(candidate)
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "raddr":
+			fields[i+1] = "0.0.0.0"
+		case "rport":
+			fields[i+1] = "0"
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// candidateType returns the typ of an ICE candidate line: host, srflx,
+// prflx or relay.
+func candidateType(candidate string) string {
+	fields := strings.Fields(candidate)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "typ" {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
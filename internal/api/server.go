@@ -0,0 +1,445 @@
+package api
+
+import (
+	"compress/flate"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hellofresh/health-go/v5"
+	"github.com/hoyle1974/seven/internal/mdns"
+	"github.com/hoyle1974/seven/internal/ws"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"google.golang.org/grpc"
+)
+
+// Server is the signaling server. It is configured by Options and keeps its
+// state in package globals, so a process runs at most one at a time.
+type Server struct {
+	router          *gin.Engine
+	http            *http.Server
+	grpc            *grpc.Server
+	shutdownTracing func(context.Context) error
+	mdns            *mdns.Responder
+
+	stop     chan struct{} // closed by Shutdown to end the sweeps
+	stopOnce sync.Once
+	sweeps   sync.WaitGroup
+}
+
+// created is set from NewServer until Shutdown.
+var created atomic.Bool
+
+// NewServer sets up the registry, relay and everything else o asks for,
+// without listening yet.
+func NewServer(o *Options, h Hooks) (_ *Server, err error) {
+	if created.Swap(true) {
+		return nil, errors.New("A server is already running in this process")
+	}
+	defer func() {
+		if err != nil {
+			created.Store(false)
+		}
+	}()
+	o.copyTo(opts)
+	if err := loadConfig(); err != nil {
+		return nil, err
+	}
+	resetState()
+	hooks = h
+	if hooks.Rooms != nil {
+		if *roomStoreKind != "memory" || *snapshotFile != "" {
+			return nil, errors.New("--room-store and --snapshot need the server's own rooms, not Hooks.Rooms")
+		}
+		rooms = hooks.Rooms
+	}
+	if hooks.Authorizer == nil {
+		a, err := authorizerNamed(*authorizerKind)
+		if err != nil {
+			return nil, err
+		}
+		hooks.Authorizer = a
+	}
+	if err := initLogging(*logLevel, *logFormat, *logSample); err != nil {
+		return nil, fmt.Errorf("Error configuring logging: %w", err)
+	}
+	if zerolog.GlobalLevel() > zerolog.DebugLevel {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	log.Info().Msg("Seven - a WebRTC signaling server")
+
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("Error initializing tracing: %w", err)
+	}
+
+	if *registrySize <= 0 {
+		return nil, fmt.Errorf("--registry-size must be positive, not %d", *registrySize)
+	}
+	if err := initCluster(); err != nil {
+		return nil, fmt.Errorf("Error joining cluster: %w", err)
+	}
+	if err := initRegistry(*registryKind, *registrySize, *entryTTL); err != nil {
+		return nil, fmt.Errorf("Error creating registry: %w", err)
+	}
+	if err := initGeoIP(*geoIPDB); err != nil {
+		return nil, fmt.Errorf("Error opening GeoIP database: %w", err)
+	}
+	switch *duplicateUUID {
+	case "replace", "reject", "multi":
+	default:
+		return nil, fmt.Errorf("Unknown --duplicate-uuid policy %q", *duplicateUUID)
+	}
+	switch *roomFull {
+	case "reject", "queue":
+	default:
+		return nil, fmt.Errorf("Unknown --room-full policy %q", *roomFull)
+	}
+	if err := initAudit(*auditLog); err != nil {
+		return nil, fmt.Errorf("Error opening audit log: %w", err)
+	}
+	if tenantMaxPeersOf, err = parseTenantLimits(*tenantLimits); err != nil {
+		return nil, fmt.Errorf("Error configuring tenant limits: %w", err)
+	}
+	if tenantMaxEntriesOf, err = parseTenantLimits(*tenantEntryLimits); err != nil {
+		return nil, fmt.Errorf("Error configuring tenant entry limits: %w", err)
+	}
+	if err := initFeatures(); err != nil {
+		return nil, fmt.Errorf("Error configuring features: %w", err)
+	}
+	if err := initTenants(*tenantsFlag); err != nil {
+		return nil, fmt.Errorf("Error configuring tenants: %w", err)
+	}
+	if err := initSDPPolicies(*sdpPolicyFlag, *tenantSDPPolicies); err != nil {
+		return nil, fmt.Errorf("Error configuring SDP policies: %w", err)
+	}
+	initConnections()
+	initRateLimits()
+	allowedOrigins = parseOrigins(*allowedOriginsFlag)
+	upgrader.CheckOrigin = checkOrigin
+	if *compressionLevel < flate.HuffmanOnly || *compressionLevel > flate.BestCompression {
+		return nil, fmt.Errorf("Invalid --compression-level %d", *compressionLevel)
+	}
+	upgrader.EnableCompression = *compression
+	if err := initAuth(*jwtSecret, *jwtJWKSURL); err != nil {
+		return nil, fmt.Errorf("Error configuring authentication: %w", err)
+	}
+	if err := initCaptcha(*captchaProvider, *captchaSecret, *captchaVerifyURLFlag); err != nil {
+		return nil, fmt.Errorf("Error configuring captcha: %w", err)
+	}
+	if err := initUUIDSecret(*uuidSecret); err != nil {
+		return nil, fmt.Errorf("Error configuring assigned uuids: %w", err)
+	}
+	if err := initRelay(*relayKind); err != nil {
+		return nil, fmt.Errorf("Error creating relay: %w", err)
+	}
+	if err := initPublicURL(); err != nil {
+		return nil, err
+	}
+	if err := initRoomStore(*roomStoreKind); err != nil {
+		return nil, fmt.Errorf("Error creating room store: %w", err)
+	}
+	if err := initAffinity(); err != nil {
+		return nil, fmt.Errorf("Error configuring session affinity: %w", err)
+	}
+	if err := loadSnapshotFile(context.Background()); err != nil {
+		return nil, err
+	}
+	if err := loadBans(context.Background()); err != nil {
+		return nil, fmt.Errorf("Error loading bans: %w", err)
+	}
+	if err := initWebhooks(*webhookURL, *webhookSecret, *webhookEvents); err != nil {
+		return nil, fmt.Errorf("Error configuring webhooks: %w", err)
+	}
+
+	r, err := newRouter()
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{router: r, shutdownTracing: shutdownTracing, stop: make(chan struct{})}
+	if *grpcAddr != "" {
+		if s.grpc, err = newGRPCServer(); err != nil {
+			return nil, fmt.Errorf("Error creating grpc server: %w", err)
+		}
+	}
+	s.every(time.Second, sweepOffline)
+	s.every(time.Second, sweepMatches)
+	s.every(time.Second, sweepRooms)
+	s.every(banSyncInterval, syncBans)
+	return s, nil
+}
+
+// resetState forgets the peers, rooms and queues of a server shut down
+// earlier in the process.
+func resetState() {
+	draining.Store(false)
+	rooms = NewRoomManager()
+	offlineMu.Lock()
+	offlineQueues = map[string][]offlineMessage{}
+	offlineMu.Unlock()
+	matches = &matchmaker{waiting: make(map[string]*matchTicket)}
+	offers = &offerTracker{pending: make(map[[2]string]time.Time)}
+	resumes = &resumeStore{tokens: make(map[string]*parkedSession), byUUID: make(map[string]map[string]string)}
+	quotas = &keyQuotas{usage: make(map[string]*keyUsage)}
+	httpSessions.mu.Lock()
+	httpSessions.m = make(map[string]*httpSession)
+	httpSessions.mu.Unlock()
+	strikeCounts.Purge()
+	rolling = &rollingStats{started: time.Now()}
+}
+
+// every runs f every interval in the background until Shutdown.
+func (s *Server) every(interval time.Duration, f func()) {
+	s.sweeps.Add(1)
+	go func() {
+		defer s.sweeps.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+			f()
+		}
+	}()
+}
+
+func newRouter() (*gin.Engine, error) {
+	gin.DebugPrintRouteFunc = func(httpMethod, absolutePath, handlerName string, nuHandlers int) {
+		log.Debug().Str("httpMethod", httpMethod).Str("absolutePath", absolutePath).Str("handlerName", handlerName).Int("nuHandlers", nuHandlers)
+	}
+
+	r := gin.New()
+	r.Use(forwardedClient)
+	r.Use(tagRequest)
+	r.Use(accessLog)
+	r.Use(gin.Recovery())
+	r.Use(cors)
+	r.Use(otelgin.Middleware("seven"))
+	// Inside the request's span, for exemplars.
+	r.Use(metricsMiddleware)
+	if err := initTrustedProxies(*trustedProxies); err != nil {
+		return nil, err
+	}
+	if *trustedProxies == "" {
+		r.SetTrustedProxies(nil)
+	} else if err := r.SetTrustedProxies(strings.Split(*trustedProxies, ",")); err != nil {
+		return nil, fmt.Errorf("Error parsing trusted proxies: %w", err)
+	}
+	r.RemoteIPHeaders = strings.Split(*remoteIPHeaders, ",")
+
+	if err := initStatic(); err != nil {
+		return nil, err
+	}
+	if staticFS != nil {
+		r.GET("/", serveStatic)
+		r.HEAD("/", serveStatic)
+		r.NoRoute(serveStatic)
+	} else {
+		r.GET("/", home)
+	}
+	r.GET("/client.js", client)
+	r.GET("/sdk/:version/seven.js", sdk)
+	if *demo {
+		r.GET("/demo/", demoPage)
+	}
+	r.GET("/metrics", gin.WrapH(promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))))
+	r.GET("/api/openapi.json", openAPISpec)
+	r.GET("/api/v1/config", sdkConfig)
+	r.GET("/t/:tenant/api/v1/config", resolveTenant, sdkConfig)
+	r.GET("/api/v1/capabilities", capabilities)
+	r.GET("/t/:tenant/api/v1/capabilities", resolveTenant, capabilities)
+	if *apiDocsEnabled {
+		r.GET("/api/docs", apiDocs)
+		r.GET("/api/docs/:file", apiDocsFile)
+	}
+	signalingRoutes(r.Group("/api/v1", negotiateProtocol))
+	signalingRoutes(r.Group("/t/:tenant/api/v1", negotiateProtocol))
+	signalingRoutes(r.Group("/", legacyAlias, negotiateProtocol))
+	signalingRoutes(r.Group("/t/:tenant", legacyAlias, negotiateProtocol))
+
+	if *adminToken != "" {
+		admin := r.Group("/admin", requireAdmin)
+		admin.GET("/", dashboard)
+		admin.POST("/keys", createAPIKey)
+		admin.GET("/keys", listAPIKeys)
+		admin.DELETE("/keys/:id", revokeAPIKey)
+		admin.GET("/peers", listPeers)
+		admin.GET("/peers/:uuid", getPeer)
+		admin.DELETE("/peers/:uuid", deletePeer)
+		admin.GET("/rooms", listRooms)
+		admin.POST("/rooms", reserveRoom)
+		admin.GET("/rooms/:id", getRoom)
+		admin.GET("/bans", listBans)
+		admin.POST("/bans", createBan)
+		admin.DELETE("/bans/*target", deleteBan)
+		admin.GET("/capacity", getCapacity)
+		admin.GET("/reports", listReports)
+		admin.GET("/log-level", getLogLevel)
+		admin.PUT("/log-level", setLogLevel)
+		admin.POST("/reload", reloadHandler)
+		admin.GET("/features", listFeatures)
+		admin.GET("/cluster", listMembers)
+		admin.GET("/snapshot", exportSnapshot)
+		admin.GET("/stats", getStats)
+		admin.POST("/snapshot", importSnapshot)
+		admin.Any("/debug/*path", gin.WrapH(http.StripPrefix("/admin", debugHandler())))
+		r.GET("/ws/events", requireAdmin, streamEvents)
+	}
+
+	h, _ := health.New(
+		health.WithSystemInfo(),
+		health.WithComponent(health.Component{
+			Name:    "Seven",
+			Version: "v0.1",
+		}))
+	r.GET("/health", func(ctx *gin.Context) {
+		w, r := ctx.Writer, ctx.Request
+		h.HandlerFunc(w, r)
+	})
+	readiness, err := newReadiness()
+	if err != nil {
+		return nil, fmt.Errorf("Error configuring readiness checks: %w", err)
+	}
+	r.GET("/healthz", liveness)
+	r.GET("/readyz", gin.WrapH(readiness.Handler()))
+	return r, nil
+}
+
+// Handler serves every route, for mounting the server in another one instead
+// of calling Start.
+func (s *Server) Handler() http.Handler {
+	return s.router
+}
+
+// Start listens on --addr, and --grpc-addr and --debug-addr when set, and
+// serves in the background.
+func (s *Server) Start(ctx context.Context) error {
+	var lc net.ListenConfig
+	lis, err := lc.Listen(ctx, "tcp", *addr)
+	if err != nil {
+		return fmt.Errorf("Error listening on %s: %w", *addr, err)
+	}
+	lis = listenProxied(lis)
+	s.http = newHTTPServer(s.router)
+	go func() {
+		log.Info().Str("addr", *addr).Msg("Listening")
+		if err := serve(s.http, lis); err != nil && err != http.ErrServerClosed {
+			log.Err(err).Msg("Error serving")
+		}
+	}()
+
+	if *debugAddr != "" {
+		go serveDebug(*debugAddr)
+	}
+
+	if *mdnsEnabled {
+		if s.mdns, err = announceMDNS(); err != nil {
+			return fmt.Errorf("Error announcing over mDNS: %w", err)
+		}
+	}
+
+	if *natProbeAddr != "" {
+		if err := natProbes.listen(ctx); err != nil {
+			return err
+		}
+	}
+
+	if s.grpc != nil {
+		lis, err := lc.Listen(ctx, "tcp", *grpcAddr)
+		if err != nil {
+			return fmt.Errorf("Error listening for grpc on %s: %w", *grpcAddr, err)
+		}
+		lis = listenProxied(lis)
+		go func() {
+			log.Info().Str("addr", *grpcAddr).Msg("Serving gRPC")
+			if err := s.grpc.Serve(lis); err != nil {
+				log.Err(err).Msg("Error serving grpc")
+			}
+		}()
+	}
+	return nil
+}
+
+// Shutdown fails readiness checks for --shutdown-delay, then closes every
+// connection with CloseServerDraining, forcibly once ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	draining.Store(true)
+	if *shutdownDelay > 0 {
+		log.Info().Dur("delay", *shutdownDelay).Msg("Draining, failing readiness checks")
+		select {
+		case <-time.After(*shutdownDelay):
+		case <-ctx.Done():
+		}
+	}
+	log.Info().Msg("Shutting down")
+	if s.mdns != nil {
+		s.mdns.Close()
+	}
+	var err error
+	if s.http != nil {
+		if err = s.http.Shutdown(ctx); err != nil {
+			log.Err(err).Msg("Error shutting down http server")
+		}
+	}
+	// Before draining, while the rooms still have their members.
+	if serr := saveSnapshotFile(ctx); serr != nil {
+		log.Err(serr).Str("file", *snapshotFile).Msg("Error saving snapshot")
+	}
+	connections.Drain(ctx, ws.CloseServerDraining, "server restarting")
+	stopped := false
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		stopped = true
+	})
+	s.sweeps.Wait()
+	events.close()
+	if roomStore != nil {
+		roomStore.close(ctx)
+	}
+	if closeRegistry != nil {
+		if cerr := closeRegistry(); cerr != nil {
+			log.Err(cerr).Msg("Error closing registry")
+		}
+	}
+	if members != nil {
+		if cerr := members.Close(ctx); cerr != nil {
+			log.Err(cerr).Msg("Error leaving cluster")
+		}
+	}
+	natProbes.close()
+	if s.grpc != nil {
+		stopped := make(chan struct{})
+		go func() {
+			s.grpc.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			s.grpc.Stop()
+		}
+	}
+	if terr := s.shutdownTracing(ctx); terr != nil {
+		log.Err(terr).Msg("Error flushing traces")
+	}
+	log.Info().Msg("Shutdown complete")
+	if stopped {
+		created.Store(false)
+	}
+	return err
+}
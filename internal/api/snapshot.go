@@ -0,0 +1,252 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hoyle1974/seven/internal/registry"
+	"github.com/rs/zerolog/log"
+)
+
+// A snapshot is the registry's entries and the rooms, for a new deployment
+// to start with what the old one had. GET /admin/snapshot exports one and
+// POST /admin/snapshot imports it; with --snapshot the file is imported on
+// startup, when it exists, and written on shutdown. Snapshots are JSON, or
+// gob with ?format=gob or a file name ending in .gob, and imports take
+// either.
+//
+// Entries keep when they were last seen, and those past --entry-ttl are
+// left out. Rooms come back with their members, host, password and the
+// rest, and stay open for --resume-grace for their members to register
+// again; those that do not leave with reason expired. Rooms and entries
+// already here are kept as they are.
+
+const snapshotVersion = 1
+
+// maxSnapshotSize bounds POST /admin/snapshot.
+const maxSnapshotSize = 256 << 20
+
+type snapshot struct {
+	Version int                   `json:"version"`
+	Taken   time.Time             `json:"taken"`
+	Entries []registry.Entry      `json:"entries"`
+	Rooms   map[string]roomRecord `json:"rooms"`
+}
+
+// SnapshotImport is the reply of POST /admin/snapshot: what was restored,
+// and what was left out as expired or already here.
+type SnapshotImport struct {
+	Status         string `json:"status"`
+	Entries        int    `json:"entries"`
+	Rooms          int    `json:"rooms"`
+	SkippedEntries int    `json:"skipped_entries"`
+	SkippedRooms   int    `json:"skipped_rooms"`
+}
+
+func takeSnapshot(ctx context.Context) (snapshot, error) {
+	var values []registry.Entry
+	var err error
+	if clusterEntries != nil {
+		// The other members' entries are theirs to snapshot.
+		values, err = clusterEntries.local.Values(ctx)
+	} else {
+		values, err = peerRegistry.Values(ctx)
+	}
+	if err != nil {
+		return snapshot{}, err
+	}
+	snap := snapshot{Version: snapshotVersion, Taken: time.Now().UTC(), Entries: values}
+	if m := roomManager(); m != nil {
+		snap.Rooms = m.records()
+	}
+	return snap, nil
+}
+
+func restoreSnapshot(ctx context.Context, snap snapshot) (SnapshotImport, error) {
+	r := SnapshotImport{Status: "ok"}
+	if snap.Version != snapshotVersion {
+		return r, fmt.Errorf("Unsupported snapshot version %d", snap.Version)
+	}
+	now := time.Now()
+	for _, e := range snap.Entries {
+		if *entryTTL > 0 && now.Sub(e.LastSeen) >= *entryTTL {
+			r.SkippedEntries++
+			continue
+		}
+		if _, ok, err := peerRegistry.Get(ctx, e.UUID.String()); err != nil {
+			return r, err
+		} else if ok {
+			r.SkippedEntries++
+			continue
+		}
+		if string(e.Metadata) == "null" {
+			e.Metadata = nil
+		}
+		if err := peerRegistry.Add(ctx, e); err != nil {
+			return r, err
+		}
+		r.Entries++
+	}
+	m := roomManager()
+	for id, rec := range snap.Rooms {
+		if _, ok := rooms.Stats(id); ok || m == nil {
+			r.SkippedRooms++
+			continue
+		}
+		restored := m.restore(id, rec)
+		m.hold(id, now.Add(*resumeGrace))
+		time.AfterFunc(*resumeGrace, func() { dropRestored(id, restored) })
+		r.Rooms++
+	}
+	return r, nil
+}
+
+// hold keeps room id open until then though nobody live is in it.
+func (m *RoomManager) hold(id string, until time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if room, ok := m.rooms[id]; ok {
+		room.held = until
+	}
+}
+
+func encodeSnapshot(w io.Writer, snap snapshot, asGob bool) error {
+	if asGob {
+		return gob.NewEncoder(w).Encode(snap)
+	}
+	return json.NewEncoder(w).Encode(snap)
+}
+
+// decodeSnapshot reads a JSON or gob snapshot, telling them apart by the
+// first byte.
+func decodeSnapshot(r io.Reader) (snapshot, error) {
+	var snap snapshot
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return snap, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			br.ReadByte()
+			continue
+		case '{':
+			return snap, json.NewDecoder(br).Decode(&snap)
+		}
+		return snap, gob.NewDecoder(br).Decode(&snap)
+	}
+}
+
+// exportSnapshot serves GET /admin/snapshot.
+func exportSnapshot(ctx *gin.Context) {
+	snap, err := takeSnapshot(ctx.Request.Context())
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error taking snapshot")
+		respondError(ctx, http.StatusInternalServerError, "internal", "error", nil)
+		return
+	}
+	asGob := ctx.Query("format") == "gob"
+	name, contentType := "seven-snapshot.json", "application/json"
+	if asGob {
+		name, contentType = "seven-snapshot.gob", "application/x-gob"
+	}
+	ctx.Header("Content-Type", contentType)
+	ctx.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	ctx.Status(http.StatusOK)
+	if err := encodeSnapshot(ctx.Writer, snap, asGob); err != nil {
+		reqLog(ctx).Err(err).Msg("Error writing snapshot")
+		return
+	}
+	auditRequest(ctx, "snapshot_exported").Int("entries", len(snap.Entries)).Int("rooms", len(snap.Rooms)).Send()
+}
+
+// importSnapshot serves POST /admin/snapshot.
+func importSnapshot(ctx *gin.Context) {
+	snap, err := decodeSnapshot(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxSnapshotSize))
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error parsing snapshot")
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respondError(ctx, http.StatusRequestEntityTooLarge, "snapshot_too_large", "snapshot too large", gin.H{"max_bytes": maxSnapshotSize})
+			return
+		}
+		respondError(ctx, http.StatusBadRequest, "invalid_snapshot", "error parsing snapshot", nil)
+		return
+	}
+	r, err := restoreSnapshot(ctx.Request.Context(), snap)
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error restoring snapshot")
+		respondError(ctx, http.StatusUnprocessableEntity, "invalid_snapshot", err.Error(), nil)
+		return
+	}
+	auditRequest(ctx, "snapshot_imported").Int("entries", r.Entries).Int("rooms", r.Rooms).Send()
+	ctx.JSON(http.StatusOK, r)
+}
+
+// loadSnapshotFile imports --snapshot on startup.
+func loadSnapshotFile(ctx context.Context) error {
+	if *snapshotFile == "" {
+		return nil
+	}
+	f, err := os.Open(*snapshotFile)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Info().Str("file", *snapshotFile).Msg("No snapshot to restore")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	snap, err := decodeSnapshot(f)
+	if err != nil {
+		return fmt.Errorf("Error parsing snapshot %s: %w", *snapshotFile, err)
+	}
+	r, err := restoreSnapshot(ctx, snap)
+	if err != nil {
+		return fmt.Errorf("Error restoring snapshot %s: %w", *snapshotFile, err)
+	}
+	log.Info().Str("file", *snapshotFile).Time("taken", snap.Taken).Int("entries", r.Entries).Int("rooms", r.Rooms).
+		Int("skipped_entries", r.SkippedEntries).Int("skipped_rooms", r.SkippedRooms).Msg("Restored snapshot")
+	return nil
+}
+
+// saveSnapshotFile writes --snapshot on shutdown, replacing the file only
+// once the new one is complete.
+func saveSnapshotFile(ctx context.Context) error {
+	if *snapshotFile == "" {
+		return nil
+	}
+	snap, err := takeSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(*snapshotFile), ".seven-snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := encodeSnapshot(f, snap, strings.HasSuffix(*snapshotFile, ".gob")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), *snapshotFile); err != nil {
+		return err
+	}
+	log.Info().Str("file", *snapshotFile).Int("entries", len(snap.Entries)).Int("rooms", len(snap.Rooms)).Msg("Saved snapshot")
+	return nil
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hoyle1974/seven/internal/registry"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	seen := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	snap := snapshot{
+		Version: 1,
+		Taken:   seen.Add(time.Minute),
+		Entries: []registry.Entry{{
+			UUID:     uuid.MustParse("6f1c1b0e-3a0e-4c8e-9a57-2f1d0e4b8c11"),
+			Tenant:   "acme",
+			Address:  "203.0.113.1:4000",
+			Addrs:    []registry.Address{{Addr: "192.168.1.20:7000", Kind: "lan", Priority: 10}},
+			Tags:     map[string]string{"mode": "ranked"},
+			Metadata: json.RawMessage(`{"level":3}`),
+			LastSeen: seen,
+		}},
+		Rooms: map[string]roomRecord{
+			"lobby": {
+				Tenant:   "acme",
+				Host:     "a",
+				Members:  []string{"a", "b"},
+				MaxPeers: 4,
+				Muted:    []string{"b"},
+				Kicked:   []string{"c"},
+				Password: []byte{1, 2, 3},
+				Reservation: &reservationRecord{
+					Token: "t", Starts: seen, Expires: seen.Add(time.Hour), Participants: []string{"a"},
+				},
+				Created: seen,
+			},
+		},
+	}
+	tests := []struct {
+		name   string
+		asGob  bool
+		prefix string
+	}{
+		{"json", false, ""},
+		{"gob", true, ""},
+		{"json after whitespace", false, " \r\n\t"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			buf.WriteString(tt.prefix)
+			if err := encodeSnapshot(&buf, snap, tt.asGob); err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeSnapshot(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, snap) {
+				t.Errorf("Decoded\n%+v\nwant\n%+v", got, snap)
+			}
+		})
+	}
+}
+
+func TestDecodeSnapshotInvalid(t *testing.T) {
+	for _, body := range []string{"", "   ", "{", "not a snapshot"} {
+		if _, err := decodeSnapshot(bytes.NewBufferString(body)); err == nil {
+			t.Errorf("decodeSnapshot(%q) succeeded", body)
+		}
+	}
+}
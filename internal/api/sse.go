@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hoyle1974/seven/internal/ws"
+)
+
+// sseStream sends signaling messages for the uuid in the path as Server-Sent
+// Events, for clients whose proxies do not pass websockets. Each message is
+// a "message" event holding the usual JSON envelope; a final "close" event
+// carries the close code and reason.
+func sseStream(ctx *gin.Context) {
+	id := ctx.Param("uuid")
+	if !subjectAllows(ctx.GetString(subjectKey), id) {
+		respondError(ctx, http.StatusForbidden, "subject_mismatch", "uuid does not match token subject", nil)
+		return
+	}
+	if !uuidAllowed(id, ctx.Query("uuid_token")) {
+		respondError(ctx, http.StatusForbidden, "invalid_uuid_token", "missing or invalid uuid_token", nil)
+		return
+	}
+	if !tenantAllows(ctx.Request.Context(), ctx.GetString(tenantKey), id) {
+		respondError(ctx, http.StatusForbidden, "other_tenant", "uuid belongs to another tenant", nil)
+		return
+	}
+
+	extendDeadlines(ctx.Writer, 0)
+	hs, err := openHTTPSession(ctx, id, 0)
+	if err == errSessionExists {
+		respondError(ctx, http.StatusConflict, "session_exists", "another session is open for the uuid", nil)
+		return
+	}
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error opening event stream")
+		respondError(ctx, http.StatusInternalServerError, "internal", "error", nil)
+		return
+	}
+	reason := "disconnected"
+	defer func() { closeHTTPSession(id, hs, reason) }()
+
+	w := ctx.Writer
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := writeSSE(w, "session", gin.H{"session_token": hs.token}); err != nil {
+		return
+	}
+
+	ping := time.NewTicker(*pingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Request.Context().Done():
+			return
+		case <-hs.t.closed:
+			writeSSE(w, "close", gin.H{"code": hs.t.code, "reason": hs.t.reason})
+			reason = hs.t.reason
+			return
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+			w.Flush()
+			if peer := hs.peer(); peer != "" {
+				touchEntry(context.Background(), peer)
+			}
+		case <-hs.t.notify:
+			for _, msg := range hs.t.take() {
+				if err := writeSSE(w, "message", msg); err != nil {
+					reqLog(ctx).Err(err).Str("uuid", id).Msg("Error writing event")
+					return
+				}
+			}
+		}
+	}
+}
+
+func writeSSE(w gin.ResponseWriter, event string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+// ssePost takes a client message for the event stream of the uuid in the
+// path. Replies arrive on the stream.
+func ssePost(ctx *gin.Context) {
+	id := ctx.Param("uuid")
+	if !subjectAllows(ctx.GetString(subjectKey), id) {
+		respondError(ctx, http.StatusForbidden, "subject_mismatch", "uuid does not match token subject", nil)
+		return
+	}
+	if !uuidAllowed(id, ctx.Query("uuid_token")) {
+		respondError(ctx, http.StatusForbidden, "invalid_uuid_token", "missing or invalid uuid_token", nil)
+		return
+	}
+	if !tenantAllows(ctx.Request.Context(), ctx.GetString(tenantKey), id) {
+		respondError(ctx, http.StatusForbidden, "other_tenant", "uuid belongs to another tenant", nil)
+		return
+	}
+	hs, ok := lookupHTTPSession(id)
+	if !ok {
+		respondError(ctx, http.StatusNotFound, "no_open_stream", "no open stream", nil)
+		return
+	}
+	if !ownsHTTPSession(ctx, hs) {
+		respondError(ctx, http.StatusForbidden, "invalid_session_token", "missing or invalid session_token", nil)
+		return
+	}
+
+	var msg ws.Message
+	if err := ctx.BindJSON(&msg); err != nil {
+		reqLog(ctx).Err(err).Msg("Error parsing message")
+		respondError(ctx, http.StatusNotAcceptable, "invalid_json", "error parsing json", nil)
+		return
+	}
+	if err := hs.dispatch(id, msg); err != nil {
+		reqLog(ctx).Err(err).Str("uuid", id).Msg("Error handling message")
+		respondError(ctx, http.StatusServiceUnavailable, "stream_not_keeping_up", "stream not keeping up", nil)
+		return
+	}
+	ctx.JSON(http.StatusAccepted, gin.H{"status": "ok"})
+}
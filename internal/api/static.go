@@ -0,0 +1,126 @@
+package api
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// With --static-dir the server also serves a web app from a directory, in
+// place of the built-in page at /. Paths that match no route and no file are
+// the app's own client-side routes and get index.html, unless they look like
+// a file (they have an extension) or are under a prefix the server owns.
+//
+// index.html is revalidated on every load so a deploy shows up right away.
+// Files with a content hash in their name, as bundlers write them, never
+// change and are cached for a year; anything else for --static-max-age.
+
+// reservedPrefixes never fall back to index.html, so a mistyped API path
+// still gets a JSON 404.
+var reservedPrefixes = []string{"/api/", "/admin/", "/t/", "/sdk/", "/ws/", "/debug/"}
+
+var staticFS http.FileSystem
+
+func initStatic() error {
+	if *staticDir == "" {
+		return nil
+	}
+	info, err := os.Stat(*staticDir)
+	if err != nil {
+		return fmt.Errorf("Error opening --static-dir: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("--static-dir %q is not a directory", *staticDir)
+	}
+	staticFS = http.Dir(*staticDir)
+	return nil
+}
+
+// staticCacheControl is the Cache-Control header for the file at name.
+func staticCacheControl(name string) string {
+	base := path.Base(name)
+	switch {
+	case strings.HasSuffix(base, ".html"):
+		return "no-cache"
+	case fingerprinted(base):
+		return "public, max-age=31536000, immutable"
+	}
+	return fmt.Sprintf("public, max-age=%d", int(staticMaxAge.Seconds()))
+}
+
+// fingerprinted reports whether base ends, before its extension, in a dot or
+// dash and a hash of at least eight letters and digits, as in
+// app.3f9a2c1e.js or index-BQ2x9f1k.js.
+func fingerprinted(base string) bool {
+	stem := strings.TrimSuffix(base, path.Ext(base))
+	i := strings.LastIndexAny(stem, ".-")
+	hash := stem[i+1:]
+	if i < 0 || len(hash) < 8 || !strings.ContainsAny(hash, "0123456789") {
+		return false
+	}
+	for _, r := range hash {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// openStatic opens the file at name, or the index.html of the directory at
+// name. Dotfiles are never served.
+func openStatic(name string) (http.File, fs.FileInfo, string, bool) {
+	name = path.Clean("/" + name)
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return nil, nil, "", false
+		}
+	}
+	for _, candidate := range []string{name, path.Join(name, "index.html")} {
+		f, err := staticFS.Open(candidate)
+		if err != nil {
+			continue
+		}
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			f.Close()
+			continue
+		}
+		return f, info, candidate, true
+	}
+	return nil, nil, "", false
+}
+
+func serveStatic(ctx *gin.Context) {
+	if ctx.Request.Method != http.MethodGet && ctx.Request.Method != http.MethodHead {
+		respondError(ctx, http.StatusNotFound, "not_found", "not found", nil)
+		return
+	}
+	name := ctx.Request.URL.Path
+	f, info, found, ok := openStatic(name)
+	if !ok && spaRoute(name) {
+		f, info, found, ok = openStatic("/index.html")
+	}
+	if !ok {
+		respondError(ctx, http.StatusNotFound, "not_found", "not found", nil)
+		return
+	}
+	defer f.Close()
+	ctx.Header("Cache-Control", staticCacheControl(found))
+	ctx.Header("ETag", fmt.Sprintf(`W/"%x-%x"`, info.Size(), info.ModTime().UnixNano()))
+	http.ServeContent(ctx.Writer, ctx.Request, found, info.ModTime(), f)
+}
+
+// spaRoute reports whether a path with no file is one of the app's routes.
+func spaRoute(name string) bool {
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	return path.Ext(name) == ""
+}
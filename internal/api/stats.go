@@ -0,0 +1,184 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /admin/stats sums up the last minute, five minutes and hour of this
+// instance as JSON, for dashboards and pollers that do not scrape
+// Prometheus. Activity is counted in statsSlot long slots of an hour long
+// ring; relay latencies go into buckets a quarter of a doubling wide, so
+// the percentiles are within a fifth of the truth.
+
+const (
+	statsSlot      = 5 * time.Second
+	statsSlots     = int(time.Hour / statsSlot)
+	latencyBuckets = 96 // from 1µs to about 16s
+)
+
+var statsWindows = []struct {
+	name string
+	d    time.Duration
+}{{"1m", time.Minute}, {"5m", 5 * time.Minute}, {"1h", time.Hour}}
+
+type slotStats struct {
+	n        int64 // which slot since the epoch this holds
+	opened   int64
+	peak     int64
+	messages int64
+	relayed  int64
+	latency  [latencyBuckets]int64
+}
+
+type rollingStats struct {
+	mu      sync.Mutex
+	started time.Time
+	slots   [statsSlots]slotStats
+}
+
+var rolling = &rollingStats{started: time.Now()}
+
+// slot is the slot of now, emptied if it held an older one. r.mu must be
+// held.
+func (r *rollingStats) slot(now time.Time) *slotStats {
+	n := now.UnixNano() / int64(statsSlot)
+	s := &r.slots[n%int64(statsSlots)]
+	if s.n != n {
+		*s = slotStats{n: n, peak: int64(connections.OpenCount())}
+	}
+	return s
+}
+
+// opened counts a connection of any transport, once it is open.
+func (r *rollingStats) opened() {
+	open := int64(connections.OpenCount())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.slot(time.Now())
+	s.opened++
+	s.peak = max(s.peak, open)
+}
+
+// message counts a message received from a client.
+func (r *rollingStats) message() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.slot(time.Now()).messages++
+}
+
+// relay counts a signal handed on to its peer after d.
+func (r *rollingStats) relay(d time.Duration) {
+	b := latencyBucket(d)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.slot(time.Now())
+	s.relayed++
+	s.latency[b]++
+}
+
+// latencyBucket is the bucket d goes in: the b-th holds latencies from
+// 2^(b/4) to 2^((b+1)/4) µs.
+func latencyBucket(d time.Duration) int {
+	if us := float64(d) / float64(time.Microsecond); us > 1 {
+		return min(int(4*math.Log2(us)), latencyBuckets-1)
+	}
+	return 0
+}
+
+// StatsWindow is what happened within one window.
+type StatsWindow struct {
+	ConnectionsOpened int64   `json:"connections_opened"`
+	ConnectionsPeak   int64   `json:"connections_peak"`
+	Messages          int64   `json:"messages"`
+	MessagesPerSecond float64 `json:"messages_per_second"`
+	Relayed           int64   `json:"relayed"`
+	RelayedPerSecond  float64 `json:"relayed_per_second"`
+	RelayP50Ms        float64 `json:"relay_latency_p50_ms"`
+	RelayP99Ms        float64 `json:"relay_latency_p99_ms"`
+}
+
+// Stats is the reply of GET /admin/stats.
+type Stats struct {
+	Status        string                 `json:"status"`
+	Time          time.Time              `json:"time"`
+	UptimeSeconds float64                `json:"uptime_seconds"`
+	Connections   int64                  `json:"connections"`
+	Peers         int                    `json:"peers"`    // uuids connected here
+	Sessions      int                    `json:"sessions"` // their sessions, one per device
+	Rooms         int                    `json:"rooms"`
+	Windows       map[string]StatsWindow `json:"windows"`
+}
+
+func (r *rollingStats) summary(now time.Time) Stats {
+	open := int64(connections.OpenCount())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current := now.UnixNano() / int64(statsSlot)
+	st := Stats{
+		Status:        "ok",
+		Time:          now.UTC(),
+		UptimeSeconds: now.Sub(r.started).Seconds(),
+		Connections:   open,
+		Windows:       make(map[string]StatsWindow, len(statsWindows)),
+	}
+	for _, win := range statsWindows {
+		slots := int64(win.d / statsSlot)
+		w := StatsWindow{ConnectionsPeak: open}
+		var latency [latencyBuckets]int64
+		for i := range r.slots {
+			s := &r.slots[i]
+			if s.n <= current-slots || s.n > current {
+				continue
+			}
+			w.ConnectionsOpened += s.opened
+			w.ConnectionsPeak = max(w.ConnectionsPeak, s.peak)
+			w.Messages += s.messages
+			w.Relayed += s.relayed
+			for b, n := range s.latency {
+				latency[b] += n
+			}
+		}
+		// The current slot is only partly over.
+		seconds := (time.Duration(slots-1)*statsSlot + time.Duration(now.UnixNano()%int64(statsSlot))).Seconds()
+		seconds = min(seconds, st.UptimeSeconds)
+		if seconds > 0 {
+			w.MessagesPerSecond = float64(w.Messages) / seconds
+			w.RelayedPerSecond = float64(w.Relayed) / seconds
+		}
+		w.RelayP50Ms = percentile(&latency, w.Relayed, 0.5)
+		w.RelayP99Ms = percentile(&latency, w.Relayed, 0.99)
+		st.Windows[win.name] = w
+	}
+	return st
+}
+
+// percentile is the upper bound, in milliseconds, of the bucket the q-th of
+// total latencies falls in.
+func percentile(latency *[latencyBuckets]int64, total int64, q float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(total)))
+	var seen int64
+	for b, n := range latency {
+		if seen += n; seen >= rank {
+			return math.Round(math.Exp2(float64(b+1)/4)) / 1000
+		}
+	}
+	return 0
+}
+
+// getStats serves GET /admin/stats.
+func getStats(ctx *gin.Context) {
+	st := rolling.summary(time.Now())
+	st.Peers = connections.Count()
+	st.Sessions = connections.SessionCount()
+	st.Rooms = len(rooms.List())
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.JSON(http.StatusOK, st)
+}
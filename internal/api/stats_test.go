@@ -0,0 +1,117 @@
+package api
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	tests := []struct {
+		name    string
+		buckets map[int]int64
+		q       float64
+		want    float64 // ms
+	}{
+		{"empty", nil, 0.5, 0},
+		{"single bucket", map[int]int64{40: 3}, 0.5, 1.218},
+		{"first bucket", map[int]int64{0: 1}, 0.99, 0.001},
+		{"p99 in the bulk", map[int]int64{20: 99, 40: 1}, 0.99, 0.038},
+		{"p99 past the bulk", map[int]int64{20: 98, 40: 2}, 0.99, 1.218},
+		{"p50 of two", map[int]int64{20: 1, 40: 1}, 0.5, 0.038},
+		{"last bucket", map[int]int64{latencyBuckets - 1: 1}, 0.5, 16777.216},
+	}
+	for _, tt := range tests {
+		var latency [latencyBuckets]int64
+		var total int64
+		for b, n := range tt.buckets {
+			latency[b] += n
+			total += n
+		}
+		if got := percentile(&latency, total, tt.q); got != tt.want {
+			t.Errorf("%s: percentile = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestLatencyBucket checks that percentiles are within a fifth of the truth,
+// from 10µs on where rounding to whole microseconds does not matter.
+func TestLatencyBucket(t *testing.T) {
+	for d := 10 * time.Microsecond; d < 16*time.Second; d = d * 21 / 20 {
+		var latency [latencyBuckets]int64
+		latency[latencyBucket(d)] = 1
+		got := percentile(&latency, 1, 0.5)
+		want := float64(d) / float64(time.Millisecond)
+		if math.Abs(got-want)/want > 0.2 {
+			t.Errorf("%s is reported as %vms", d, got)
+		}
+	}
+	if b := latencyBucket(time.Hour); b != latencyBuckets-1 {
+		t.Errorf("An hour goes in bucket %d, want the last", b)
+	}
+	if b := latencyBucket(0); b != 0 {
+		t.Errorf("Nothing goes in bucket %d, want the first", b)
+	}
+}
+
+func TestStatsSummary(t *testing.T) {
+	initConnections()
+	// Two seconds into a slot.
+	now := time.Unix(1800000000, 0).Truncate(statsSlot).Add(2 * time.Second)
+	type slot struct {
+		ago      int // slots before now's
+		messages int64
+		peak     int64
+		relayed  int // at 1.218ms
+	}
+	fill := func(r *rollingStats, slots []slot) {
+		for _, s := range slots {
+			st := r.slot(now.Add(-time.Duration(s.ago) * statsSlot))
+			st.messages += s.messages
+			st.peak = max(st.peak, s.peak)
+			st.relayed += int64(s.relayed)
+			st.latency[40] += int64(s.relayed)
+		}
+	}
+	slots := []slot{
+		{ago: 0, messages: 1, relayed: 1},
+		{ago: 11, messages: 10},           // the oldest of the minute
+		{ago: 12, messages: 100, peak: 7}, // the newest before it
+		{ago: 59, messages: 1000},
+		{ago: 60, messages: 10000},
+		{ago: 719, messages: 100000},
+		{ago: 721, messages: 1000000}, // over an hour ago, where ago 1 goes
+	}
+	tests := []struct {
+		name     string
+		uptime   time.Duration
+		window   string
+		messages int64
+		seconds  float64
+		peak     int64
+	}{
+		{"1m", 2 * time.Hour, "1m", 11, 57, 0},
+		{"5m", 2 * time.Hour, "5m", 1111, 297, 7},
+		{"1h", 2 * time.Hour, "1h", 111111, 3597, 7},
+		{"up for less than the window", 30 * time.Second, "1m", 11, 30, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &rollingStats{started: now.Add(-tt.uptime)}
+			fill(r, slots)
+			w := r.summary(now).Windows[tt.window]
+			if w.Messages != tt.messages {
+				t.Errorf("Messages = %d, want %d", w.Messages, tt.messages)
+			}
+			if want := float64(tt.messages) / tt.seconds; math.Abs(w.MessagesPerSecond-want) > 1e-9 {
+				t.Errorf("MessagesPerSecond = %v, want %v", w.MessagesPerSecond, want)
+			}
+			if w.ConnectionsPeak != tt.peak {
+				t.Errorf("ConnectionsPeak = %d, want %d", w.ConnectionsPeak, tt.peak)
+			}
+			if w.Relayed != 1 || w.RelayP50Ms != 1.218 || w.RelayP99Ms != 1.218 {
+				t.Errorf("Relayed %d at p50 %vms and p99 %vms, want 1 at 1.218ms", w.Relayed, w.RelayP50Ms, w.RelayP99Ms)
+			}
+		})
+	}
+}
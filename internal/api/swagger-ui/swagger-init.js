@@ -0,0 +1 @@
+SwaggerUIBundle({url: "/api/openapi.json", dom_id: "#swagger-ui"});
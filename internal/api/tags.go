@@ -0,0 +1,110 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hoyle1974/seven/internal/registry"
+)
+
+const (
+	maxTags           = 16
+	maxTagFieldLength = 64
+)
+
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("At most %d tags are allowed", maxTags)
+	}
+	for k, v := range tags {
+		if k == "" || len(k) > maxTagFieldLength || len(v) > maxTagFieldLength {
+			return fmt.Errorf("Tag %q is empty or longer than %d characters", k, maxTagFieldLength)
+		}
+		if strings.ContainsAny(k, ",=!") {
+			return fmt.Errorf("Tag %q may not contain ',', '=' or '!'", k)
+		}
+	}
+	return nil
+}
+
+type tagOp int
+
+const (
+	tagEquals tagOp = iota
+	tagNotEquals
+	tagExists
+	tagMissing
+)
+
+type tagTerm struct {
+	op    tagOp
+	key   string
+	value string
+}
+
+// TagFilter is a comma separated list of terms that must all match:
+// key=value, key!=value, key (tag present) or !key (tag absent).
+type TagFilter []tagTerm
+
+func parseTagFilter(expr string) (TagFilter, error) {
+	filter := TagFilter{}
+	for _, term := range strings.Split(expr, ",") {
+		term = strings.TrimSpace(term)
+		switch {
+		case term == "":
+			continue
+		case strings.Contains(term, "!="):
+			kv := strings.SplitN(term, "!=", 2)
+			filter = append(filter, tagTerm{op: tagNotEquals, key: kv[0], value: kv[1]})
+		case strings.Contains(term, "="):
+			kv := strings.SplitN(term, "=", 2)
+			filter = append(filter, tagTerm{op: tagEquals, key: kv[0], value: kv[1]})
+		case strings.HasPrefix(term, "!"):
+			filter = append(filter, tagTerm{op: tagMissing, key: term[1:]})
+		default:
+			filter = append(filter, tagTerm{op: tagExists, key: term})
+		}
+		if filter[len(filter)-1].key == "" {
+			return nil, fmt.Errorf("Tag filter term %q has no key", term)
+		}
+	}
+	return filter, nil
+}
+
+func (f TagFilter) Match(tags map[string]string) bool {
+	for _, t := range f {
+		v, ok := tags[t.key]
+		switch t.op {
+		case tagEquals:
+			if !ok || v != t.value {
+				return false
+			}
+		case tagNotEquals:
+			if ok && v == t.value {
+				return false
+			}
+		case tagExists:
+			if !ok {
+				return false
+			}
+		case tagMissing:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func filterEntries(values []registry.Entry, filter TagFilter) []registry.Entry {
+	if len(filter) == 0 {
+		return values
+	}
+	matched := make([]registry.Entry, 0, len(values))
+	for _, e := range values {
+		if filter.Match(e.Tags) {
+			matched = append(matched, e)
+		}
+	}
+	return matched
+}
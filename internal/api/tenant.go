@@ -0,0 +1,203 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/hoyle1974/seven/internal/registry"
+	"github.com/rs/zerolog/log"
+)
+
+// A tenant is an independent application sharing the deployment. Peers only
+// see the entries, rooms and matches of their own tenant, and a uuid belongs
+// to the tenant it registered in. The tenant comes from the caller's API key
+// or a /t/:tenant path prefix (x-seven-tenant metadata over gRPC). Requests
+// with neither are in the default tenant "".
+
+// tenantKey is where resolveTenant stores the request's tenant in the gin
+// context.
+const tenantKey = "tenant"
+
+var tenantPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// allowedTenants are the tenants --tenants opens up to callers without an
+// API key naming one.
+var allowedTenants = map[string]bool{}
+
+// tenantMaxPeersOf holds the --tenant-limits overrides of --tenant-max-peers.
+var tenantMaxPeersOf = map[string]int{}
+
+// tenantMaxEntriesOf holds the --tenant-entry-limits overrides of
+// --tenant-max-entries.
+var tenantMaxEntriesOf = map[string]int{}
+
+var (
+	errTenantMismatch = errors.New("Api key belongs to another tenant")
+	errUnknownTenant  = errors.New("Unknown tenant")
+	errOtherTenant    = errors.New("Uuid belongs to another tenant")
+)
+
+func initTenants(list string) error {
+	for _, t := range strings.Split(list, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		if !tenantPattern.MatchString(t) {
+			return fmt.Errorf("Invalid tenant name %q", t)
+		}
+		allowedTenants[t] = true
+	}
+	return nil
+}
+
+// parseTenantLimits parses --tenant-limits, a list of tenant=max pairs. The
+// default tenant is written as "default".
+func parseTenantLimits(list string) (map[string]int, error) {
+	limits := map[string]int{}
+	for _, pair := range strings.Split(list, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		tenant, value, ok := strings.Cut(pair, "=")
+		max, err := strconv.Atoi(value)
+		if !ok || err != nil || max < 0 {
+			return nil, fmt.Errorf("Invalid tenant limit %q", pair)
+		}
+		if tenant == "default" {
+			tenant = ""
+		} else if !tenantPattern.MatchString(tenant) {
+			return nil, fmt.Errorf("Invalid tenant name %q", tenant)
+		}
+		limits[tenant] = max
+	}
+	return limits, nil
+}
+
+// tenantLimit is the most uuids of tenant that may connect to this instance,
+// 0 being unlimited.
+func tenantLimit(tenant string) int {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	if max, ok := tenantMaxPeersOf[tenant]; ok {
+		return max
+	}
+	return *tenantMaxPeers
+}
+
+// tenantEntryLimit is the most registry entries tenant may hold, 0 being
+// unlimited. Registrations share one --registry-size, so without a limit one
+// busy tenant pushes out the least recently seen entries of all the others.
+func tenantEntryLimit(tenant string) int {
+	if max, ok := tenantMaxEntriesOf[tenant]; ok {
+		return max
+	}
+	return *tenantMaxEntries
+}
+
+// TenantFullError refuses a new registry entry of a tenant holding Max.
+type TenantFullError struct {
+	Tenant string
+	Max    int
+}
+
+func (e *TenantFullError) Error() string {
+	return fmt.Sprintf("Tenant %s holds its %d registry entries", tenantLabel(e.Tenant), e.Max)
+}
+
+// details are the error details clients get for the error.
+func (e *TenantFullError) details() gin.H {
+	return gin.H{"tenant": tenantLabel(e.Tenant), "max_entries": e.Max}
+}
+
+// checkTenantEntries refuses registering self when values, the entries of
+// tenant, are already as many as it may hold. Entries already there can
+// always register again.
+func checkTenantEntries(tenant string, values []registry.Entry, self uuid.UUID) error {
+	max := tenantEntryLimit(tenant)
+	if max == 0 || len(values) < max {
+		return nil
+	}
+	for _, e := range values {
+		if e.UUID == self {
+			return nil
+		}
+	}
+	return &TenantFullError{Tenant: tenant, Max: max}
+}
+
+// pickTenant decides the tenant of a request that asked for requested,
+// authenticated with key if API keys are required.
+func pickTenant(requested string, key *APIKey) (string, error) {
+	if key != nil && requested != "" && requested != key.Tenant {
+		return "", errTenantMismatch
+	}
+	if key != nil {
+		return key.Tenant, nil
+	}
+	if requested != "" && !allowedTenants[requested] {
+		return "", errUnknownTenant
+	}
+	return requested, nil
+}
+
+// resolveTenant records the tenant of a client request for the handlers.
+func resolveTenant(ctx *gin.Context) {
+	var key *APIKey
+	if k, ok := ctx.Get(apiKeyContextKey); ok {
+		k := k.(APIKey)
+		key = &k
+	}
+	tenant, err := pickTenant(ctx.Param("tenant"), key)
+	switch err {
+	case nil:
+	case errTenantMismatch:
+		abortClient(ctx, http.StatusForbidden, "tenant_mismatch", "api key belongs to another tenant")
+		return
+	default:
+		abortClient(ctx, http.StatusNotFound, "unknown_tenant", "unknown tenant")
+		return
+	}
+	ctx.Set(tenantKey, tenant)
+	ctx.Next()
+}
+
+// tenantLabel names tenant in metrics and logs.
+func tenantLabel(tenant string) string {
+	if tenant == "" {
+		return "default"
+	}
+	return tenant
+}
+
+// tenantAllows reports whether a caller in tenant may act as, or signal, the
+// uuid id: nobody in another tenant is connected or registered as it.
+func tenantAllows(ctx context.Context, tenant string, id string) bool {
+	for _, s := range connections.Sessions(id) {
+		if s.tenant != tenant {
+			return false
+		}
+	}
+	e, ok, err := peerRegistry.Get(ctx, id)
+	if err != nil {
+		log.Err(err).Str("uuid", id).Msg("Error looking up tenant of peer")
+		return false
+	}
+	return !ok || e.Tenant == tenant
+}
+
+func tenantEntries(values []registry.Entry, tenant string) []registry.Entry {
+	kept := make([]registry.Entry, 0, len(values))
+	for _, e := range values {
+		if e.Tenant == tenant {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
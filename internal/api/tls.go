@@ -0,0 +1,89 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newHTTPServer is the server for handler on --addr, with the --http-*
+// limits. HTTP/2 is negotiated over TLS; --h2c also serves it in the clear.
+func newHTTPServer(handler http.Handler) *http.Server {
+	h2 := &http2.Server{IdleTimeout: *httpIdleTimeout}
+	if *h2cEnabled {
+		handler = h2c.NewHandler(handler, h2)
+	}
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           handler,
+		ReadHeaderTimeout: *httpReadHeaderTimeout,
+		ReadTimeout:       *httpReadTimeout,
+		WriteTimeout:      *httpWriteTimeout,
+		IdleTimeout:       *httpIdleTimeout,
+		MaxHeaderBytes:    *httpMaxHeaderBytes,
+	}
+	if err := http2.ConfigureServer(srv, h2); err != nil {
+		log.Err(err).Msg("Error configuring HTTP/2")
+	}
+	return srv
+}
+
+// extendDeadlines lifts the read deadline of a long lived response and moves
+// its write deadline to d from now, or lifts it too when d is 0.
+func extendDeadlines(w http.ResponseWriter, d time.Duration) {
+	rc := http.NewResponseController(w)
+	var deadline time.Time
+	if d > 0 {
+		deadline = time.Now().Add(d)
+	}
+	if err := rc.SetReadDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Debug().Err(err).Msg("Error lifting read deadline")
+	}
+	if err := rc.SetWriteDeadline(deadline); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		log.Debug().Err(err).Msg("Error extending write deadline")
+	}
+}
+
+// certManager gets the Let's Encrypt certificates of --autocert-domain, for
+// the http and gRPC listeners alike, answering ACME challenges on
+// --autocert-http-addr.
+var certManager = sync.OnceValue(func() *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(strings.Split(*autocertDomain, ",")...),
+		Cache:      autocert.DirCache(*autocertCache),
+	}
+	go func() {
+		log.Info().Str("addr", *autocertHTTPAddr).Msg("Answering ACME challenges")
+		if err := http.ListenAndServe(*autocertHTTPAddr, m.HTTPHandler(nil)); err != nil {
+			log.Err(err).Msg("Error serving ACME challenges")
+		}
+	}()
+	return m
+})
+
+// serve runs srv on lis in plain http, static TLS or autocert mode depending
+// on the TLS flags.
+func serve(srv *http.Server, lis net.Listener) error {
+	switch {
+	case *autocertDomain != "":
+		srv.TLSConfig = certManager().TLSConfig()
+		return srv.ServeTLS(lis, "", "")
+	case *tlsCert != "" || *tlsKey != "":
+		if *tlsCert == "" || *tlsKey == "" {
+			return fmt.Errorf("Both --tls-cert and --tls-key are required")
+		}
+		return srv.ServeTLS(lis, *tlsCert, *tlsKey)
+	default:
+		return srv.Serve(lis)
+	}
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"os"
+
+	"github.com/hoyle1974/seven/internal/registry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/hoyle1974/seven")
+
+// initTracing exports spans over OTLP/HTTP when an OTLP endpoint is configured
+// through the standard OTEL_EXPORTER_OTLP_* environment variables. Otherwise
+// the global no-op tracer is left in place.
+func initTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "seven")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracedRegistry wraps a Registry with a span per operation.
+type tracedRegistry struct {
+	next registry.Registry
+}
+
+func (r tracedRegistry) Add(ctx context.Context, e registry.Entry) (err error) {
+	ctx, span := tracer.Start(ctx, "registry.Add", trace.WithAttributes(attribute.String("uuid", e.UUID.String())))
+	defer func() { endSpan(span, err) }()
+	return r.next.Add(ctx, e)
+}
+
+func (r tracedRegistry) Get(ctx context.Context, uuid string) (e registry.Entry, ok bool, err error) {
+	ctx, span := tracer.Start(ctx, "registry.Get", trace.WithAttributes(attribute.String("uuid", uuid)))
+	defer func() { endSpan(span, err) }()
+	return r.next.Get(ctx, uuid)
+}
+
+func (r tracedRegistry) Remove(ctx context.Context, uuid string) (ok bool, err error) {
+	ctx, span := tracer.Start(ctx, "registry.Remove", trace.WithAttributes(attribute.String("uuid", uuid)))
+	defer func() { endSpan(span, err) }()
+	return r.next.Remove(ctx, uuid)
+}
+
+func (r tracedRegistry) Values(ctx context.Context) (entries []registry.Entry, err error) {
+	ctx, span := tracer.Start(ctx, "registry.Values")
+	defer func() { endSpan(span, err) }()
+	return r.next.Values(ctx)
+}
+
+func (r tracedRegistry) Len(ctx context.Context) (n int, err error) {
+	ctx, span := tracer.Start(ctx, "registry.Len")
+	defer func() { endSpan(span, err) }()
+	return r.next.Len(ctx)
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/hoyle1974/seven/internal/ws"
+)
+
+const maxQueuedMessages = 256
+
+// queueTransport buffers messages for clients that fetch them over plain
+// HTTP instead of holding a websocket open.
+type queueTransport struct {
+	mu     sync.Mutex
+	queue  []ws.Message
+	notify chan struct{}
+	closed chan struct{}
+	once   sync.Once
+	code   int
+	reason string
+}
+
+func newQueueTransport() *queueTransport {
+	return &queueTransport{notify: make(chan struct{}, 1), closed: make(chan struct{})}
+}
+
+func (t *queueTransport) WriteMessage(msg ws.Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queue) >= maxQueuedMessages {
+		return ws.ErrQueueFull
+	}
+	t.queue = append(t.queue, msg)
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (t *queueTransport) CloseWith(code int, reason string) error {
+	t.once.Do(func() {
+		t.code, t.reason = code, reason
+		close(t.closed)
+	})
+	return nil
+}
+
+func (t *queueTransport) Close() error {
+	return t.CloseWith(websocket.CloseGoingAway, "closed")
+}
+
+func (t *queueTransport) isClosed() bool {
+	select {
+	case <-t.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// take empties the queue.
+func (t *queueTransport) take() []ws.Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	msgs := t.queue
+	t.queue = nil
+	return msgs
+}
+
+// httpSession is a Session driven by HTTP requests: one request holds the
+// downstream open while POSTs carry client messages, one at a time.
+type httpSession struct {
+	*Session
+	t          *queueTransport
+	dispatchMu sync.Mutex
+
+	// token proves later requests come from whoever opened the session.
+	token string
+
+	// idle closes a long poll session that stops polling.
+	idle *time.Timer
+}
+
+// httpSessions holds the SSE and long poll sessions by the uuid in their URL.
+var httpSessions = struct {
+	mu sync.Mutex
+	m  map[string]*httpSession
+}{m: make(map[string]*httpSession)}
+
+var errSessionExists = errors.New("Another session is open for the uuid")
+
+// ownsHTTPSession reports whether the request ctx comes from whoever opened
+// hs. Without JWTs or assigned uuids, which prove the caller owns the uuid
+// before any of this, that takes the session_token hs handed out.
+func ownsHTTPSession(ctx *gin.Context, hs *httpSession) bool {
+	if jwtKeyfunc != nil || assigningUUIDs() {
+		return true
+	}
+	return hmac.Equal([]byte(hs.token), []byte(ctx.Query("session_token")))
+}
+
+// openHTTPSession starts a session for id, opened by the request ctx, closing
+// any previous one. A previous session that is still open is only replaced
+// for its owner; anyone else gets errSessionExists. With an idle timeout the
+// session closes itself unless touched within it; otherwise the caller
+// closes it with closeHTTPSession.
+func openHTTPSession(ctx *gin.Context, id string, idle time.Duration) (*httpSession, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	t := newQueueTransport()
+	s := &Session{t: t, tenant: ctx.GetString(tenantKey), subject: ctx.GetString(subjectKey), claims: tokenClaims(ctx), observed: observedAddress(ctx), claimed: id, captcha: captchaNeeded(ctx)}
+	s.setRequestID(requestID(ctx))
+	hs := &httpSession{Session: s, t: t, token: "st_" + hex.EncodeToString(b)}
+
+	httpSessions.mu.Lock()
+	previous := httpSessions.m[id]
+	if previous != nil && !previous.t.isClosed() && !ownsHTTPSession(ctx, previous) {
+		httpSessions.mu.Unlock()
+		return nil, errSessionExists
+	}
+	httpSessions.m[id] = hs
+	httpSessions.mu.Unlock()
+	if previous != nil {
+		previous.t.CloseWith(ws.CloseDuplicateUUID, "duplicate uuid")
+	}
+	if idle > 0 {
+		hs.idle = time.AfterFunc(idle, func() {
+			t.CloseWith(ws.CloseTimeout, "timeout")
+		})
+		go func() {
+			<-t.closed
+			hs.idle.Stop()
+			closeHTTPSession(id, hs, t.reason)
+		}()
+	}
+	connections.Open(hs.Session)
+	rolling.opened()
+	return hs, nil
+}
+
+func lookupHTTPSession(id string) (*httpSession, bool) {
+	httpSessions.mu.Lock()
+	defer httpSessions.mu.Unlock()
+	hs, ok := httpSessions.m[id]
+	return hs, ok
+}
+
+// closeHTTPSession undoes openHTTPSession once the client is gone.
+func closeHTTPSession(id string, hs *httpSession, reason string) {
+	httpSessions.mu.Lock()
+	if httpSessions.m[id] == hs {
+		delete(httpSessions.m, id)
+	}
+	httpSessions.mu.Unlock()
+
+	hs.dispatchMu.Lock()
+	defer hs.dispatchMu.Unlock()
+	if connections.Remove(hs.Session) {
+		matches.remove(hs.uuid)
+		events.publish(Event{Type: EventPeerDisconnected, UUID: hs.uuid, Reason: reason})
+		if hs.done {
+			leaveRoom(hs.uuid, reason)
+		} else {
+			dropOutOfRoom(hs.uuid, reason)
+		}
+	}
+	connections.Close(hs.Session)
+}
+
+// peer is the uuid the session registered as, if any.
+func (hs *httpSession) peer() string {
+	hs.dispatchMu.Lock()
+	defer hs.dispatchMu.Unlock()
+	return hs.uuid
+}
+
+// dispatch handles one client message, defaulting From to the session's uuid.
+func (hs *httpSession) dispatch(id string, msg ws.Message) error {
+	hs.dispatchMu.Lock()
+	defer hs.dispatchMu.Unlock()
+	if msg.From == "" {
+		msg.From = id
+	}
+	if err := dispatch(hs.Session, msg); err != nil {
+		return err
+	}
+	if hs.done {
+		hs.t.CloseWith(ws.CloseDeregistered, "bye")
+	}
+	return nil
+}
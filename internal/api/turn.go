@@ -0,0 +1,54 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TurnCredentials follow coturn's REST API (use-auth-secret): the username is
+// the expiry timestamp, optionally suffixed with the peer uuid, and the
+// password is the base64 HMAC-SHA1 of the username keyed with the secret.
+type TurnCredentials struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	TTL      int      `json:"ttl"`
+	URIs     []string `json:"uris"`
+}
+
+func turnEnabled() bool {
+	return *turnSecret != "" && *turnURLs != ""
+}
+
+func newTurnCredentials(peer string, now time.Time) TurnCredentials {
+	username := strconv.FormatInt(now.Add(*turnTTL).Unix(), 10)
+	if peer != "" {
+		username += ":" + peer
+	}
+	mac := hmac.New(sha1.New, []byte(*turnSecret))
+	mac.Write([]byte(username))
+	return TurnCredentials{
+		Username: username,
+		Password: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+		TTL:      int(turnTTL.Seconds()),
+		URIs:     strings.Split(*turnURLs, ","),
+	}
+}
+
+func turnCredentials(ctx *gin.Context) {
+	if !turnEnabled() {
+		respondError(ctx, http.StatusNotFound, "turn_not_configured", "turn not configured", nil)
+		return
+	}
+	peer := ctx.GetString(subjectKey)
+	if peer == "" {
+		peer = ctx.Query("uuid")
+	}
+	ctx.JSON(http.StatusOK, newTurnCredentials(peer, time.Now()))
+}
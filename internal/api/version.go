@@ -0,0 +1,88 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hoyle1974/seven/internal/ws"
+)
+
+// The client endpoints are served under /api/v1/ (and /t/:tenant/api/v1/).
+// Within v1 paths, request fields and message types are only ever added, so
+// deployed clients keep working. Changes that would break them, such as a v2
+// message envelope, are negotiated with the X-Seven-Protocol header: the
+// client lists the protocol versions it speaks and the server answers with
+// the one it picked. The unversioned paths of old clients are deprecated
+// aliases of v1.
+
+const (
+	protocolHeader = "X-Seven-Protocol"
+	protocolKey    = "protocol"
+)
+
+// protocolVersions are the protocol versions the server speaks, newest
+// first.
+var protocolVersions = []int{1}
+
+// negotiateProtocol is middleware picking the newest protocol version both
+// sides speak from the X-Seven-Protocol header, or the ?protocol= query
+// parameter browsers' websockets have to use. Clients that send neither
+// speak v1.
+func negotiateProtocol(ctx *gin.Context) {
+	offer := ctx.GetHeader(protocolHeader)
+	if offer == "" {
+		offer = ctx.Query("protocol")
+	}
+	version := 1
+	if offer != "" {
+		if version = pickProtocol(offer); version == 0 {
+			ctx.Header(protocolHeader, supportedProtocols())
+			abortWithClose(ctx, http.StatusNotAcceptable, ws.CloseBadProtocol, "unsupported_protocol", "unsupported protocol")
+			return
+		}
+	}
+	ctx.Set(protocolKey, version)
+	ctx.Header(protocolHeader, strconv.Itoa(version))
+	ctx.Next()
+}
+
+// pickProtocol returns the newest of the comma separated versions in offer
+// the server speaks, or 0 for none.
+func pickProtocol(offer string) int {
+	offered := map[int]bool{}
+	for _, v := range strings.Split(offer, ",") {
+		if n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(v), "v")); err == nil {
+			offered[n] = true
+		}
+	}
+	for _, v := range protocolVersions {
+		if offered[v] {
+			return v
+		}
+	}
+	return 0
+}
+
+func supportedProtocols() string {
+	versions := make([]string, len(protocolVersions))
+	for i, v := range protocolVersions {
+		versions[i] = strconv.Itoa(v)
+	}
+	return strings.Join(versions, ", ")
+}
+
+// legacyAlias is middleware for the unversioned paths, pointing clients at
+// their /api/v1 successor.
+func legacyAlias(ctx *gin.Context) {
+	path := ctx.Request.URL.Path
+	successor := "/api/v1" + path
+	if tenant := ctx.Param("tenant"); tenant != "" {
+		successor = "/t/" + tenant + "/api/v1" + strings.TrimPrefix(path, "/t/"+tenant)
+	}
+	ctx.Header("Deprecation", "true")
+	ctx.Header("Link", "<"+successor+`>; rel="successor-version"`)
+	metricLegacyRequests.WithLabelValues(ctx.FullPath()).Inc()
+	ctx.Next()
+}
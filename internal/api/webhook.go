@@ -0,0 +1,154 @@
+package api
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	webhookAttempts = 3
+	webhookTimeout  = 5 * time.Second
+	webhookQueue    = 1024 // deliveries waiting for one URL
+	webhookWorkers  = 4    // posts in flight to one URL
+)
+
+// webhook POSTs the events it subscribes to to one URL. Each URL gets its own
+// subscription, queue and senders, so a slow receiver only loses its own
+// events. Failed deliveries wait out their backoff off the queue, behind
+// newer events rather than in front of them.
+type webhook struct {
+	url    string
+	secret []byte
+	types  map[string]bool
+	client *http.Client
+	queue  chan delivery
+	done   chan struct{} // closed once the subscription ends, on Shutdown
+}
+
+// delivery is an event on its way to a webhook.
+type delivery struct {
+	event   string
+	body    []byte
+	attempt int
+}
+
+// initWebhooks starts a sender for every comma separated URL in urls.
+func initWebhooks(urls string, secret string, types string) error {
+	if urls == "" {
+		return nil
+	}
+	if secret == "" {
+		return fmt.Errorf("--webhook-secret is required with --webhook-url")
+	}
+	wanted := map[string]bool{}
+	for _, t := range strings.Split(types, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			wanted[t] = true
+		}
+	}
+	for _, u := range strings.Split(urls, ",") {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+		w := &webhook{url: u, secret: []byte(secret), types: wanted, client: &http.Client{Timeout: webhookTimeout}, queue: make(chan delivery, webhookQueue), done: make(chan struct{})}
+		for i := 0; i < webhookWorkers; i++ {
+			go w.send()
+		}
+		go w.run(events.subscribe())
+		log.Info().Str("url", u).Msg("Sending webhooks")
+	}
+	return nil
+}
+
+// run queues the events w subscribes to for its senders.
+func (w *webhook) run(ch chan Event) {
+	defer close(w.done)
+	for e := range ch {
+		if !w.types[e.Type] {
+			continue
+		}
+		body, err := json.Marshal(e)
+		if err != nil {
+			log.Err(err).Msg("Error encoding webhook")
+			continue
+		}
+		w.enqueue(delivery{event: e.Type, body: body, attempt: 1})
+	}
+}
+
+// enqueue hands d to the senders, dropping it when the queue is full.
+func (w *webhook) enqueue(d delivery) {
+	select {
+	case w.queue <- d:
+	default:
+		metricWebhooks.WithLabelValues("dropped").Inc()
+		log.Warn().Str("url", w.url).Str("event", d.event).Msg("Webhook queue full, dropping event")
+	}
+}
+
+// send posts queued deliveries, putting failed ones back on the queue once
+// their backoff of 1s, 2s, ... is over.
+func (w *webhook) send() {
+	for {
+		var d delivery
+		select {
+		case <-w.done:
+			return
+		case d = <-w.queue:
+		}
+		err := w.post(d.event, d.body)
+		switch {
+		case err == nil:
+			metricWebhooks.WithLabelValues("delivered").Inc()
+		case d.attempt == webhookAttempts:
+			metricWebhooks.WithLabelValues("failed").Inc()
+			log.Err(err).Str("url", w.url).Str("event", d.event).Msg("Giving up on webhook")
+		default:
+			metricWebhooks.WithLabelValues("retried").Inc()
+			retry := d
+			retry.attempt++
+			time.AfterFunc(time.Second<<(d.attempt-1), func() { w.enqueue(retry) })
+		}
+	}
+}
+
+// sign is the X-Seven-Signature of body sent at timestamp: an HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with --webhook-secret.
+func (w *webhook) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *webhook) post(event string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Seven-Event", event)
+	req.Header.Set("X-Seven-Timestamp", ts)
+	req.Header.Set("X-Seven-Signature", w.sign(ts, body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook returned %s", resp.Status)
+	}
+	return nil
+}
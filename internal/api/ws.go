@@ -0,0 +1,1192 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/hoyle1974/seven/internal/hub"
+	"github.com/hoyle1974/seven/internal/ws"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// transport carries messages to one client. Session serializes writes, so
+// implementations do not need to be safe for concurrent WriteMessage calls.
+type transport interface {
+	WriteMessage(msg ws.Message) error
+	// CloseWith asks the client to go away with a websocket close code.
+	CloseWith(code int, reason string) error
+	// Close drops the connection without waiting for the client.
+	Close() error
+}
+
+// Session is the server side state of a single client connection.
+type Session struct {
+	t        transport
+	uuid     string
+	tenant   string
+	device   string // only with --duplicate-uuid=multi
+	claimed  string // uuid an HTTP session was opened for
+	subject  string
+	claims   map[string]any // of the bearer token, if any
+	observed ObservedAddress
+	captcha  bool // registering must pass the captcha first, see captcha.go
+	done     bool
+
+	// requestID is of the request that opened the session, and log tags
+	// the session's log lines with it; see requestid.go.
+	requestID string
+	log       zerolog.Logger
+
+	// Set for transports a client can reconnect on; see resume.go.
+	resumable   bool
+	resumeToken string
+
+	// id of the message being dispatched, until it is acked or nacked.
+	replyTo string
+
+	writeMu sync.Mutex
+}
+
+// mayReach reports whether s may signal the uuid to. Rooms never span
+// tenants, so only peers outside of any room need their tenant checked.
+func (s *Session) mayReach(ctx context.Context, to string) bool {
+	return rooms.RoomOf(s.uuid) != "" || tenantAllows(ctx, s.tenant, to)
+}
+
+// maySignal reports whether s may signal to, a uuid: it is in the same room
+// and mayReach it, or it dropped out of s's room so recently that messages
+// are still queued for it. A peer unknown here may be in s's room on another
+// instance, which decides once the relay gets the message there; remote
+// reports that.
+func (s *Session) maySignal(ctx context.Context, to string) (ok bool, remote bool) {
+	room := rooms.RoomOf(s.uuid)
+	switch {
+	case rooms.SameRoom(s.uuid, to):
+		return s.mayReach(ctx, to), false
+	case rooms.Departed(to, room):
+		return true, false
+	case room != "" && rooms.RoomOf(to) == "" && !peerLive(to) && connections.Relay() != nil:
+		return tenantAllows(ctx, s.tenant, to), true
+	}
+	return false, false
+}
+
+// addr is how peers address this session: its uuid, followed by /device for
+// one of several devices sharing the uuid.
+func (s *Session) addr() string {
+	if s.device == "" {
+		return s.uuid
+	}
+	return s.uuid + "/" + s.device
+}
+
+var deviceIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+func newDeviceID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *Session) write(msg ws.Message) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.t.WriteMessage(msg)
+}
+
+// WritePrepared writes p, reusing its encoding on transports that can.
+func (s *Session) WritePrepared(p *ws.Prepared) error {
+	w, ok := s.t.(ws.PreparedWriter)
+	if !ok {
+		return s.write(p.Msg)
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return w.WritePrepared(p)
+}
+
+// setRequestID sets the id of the request that opened s.
+func (s *Session) setRequestID(id string) {
+	s.requestID = id
+	s.log = log.With().Str("request_id", id).Logger()
+}
+
+func (s *Session) UUID() string   { return s.uuid }
+func (s *Session) Tenant() string { return s.tenant }
+func (s *Session) Device() string { return s.device }
+
+func (s *Session) CloseWith(code int, reason string) error {
+	return s.t.CloseWith(code, reason)
+}
+
+func (s *Session) Close() error {
+	return s.t.Close()
+}
+
+func (s *Session) send(t ws.MessageType, payload interface{}) error {
+	msg, err := ws.NewMessage(t, payload)
+	if err != nil {
+		return err
+	}
+	return s.write(msg)
+}
+
+func (s *Session) sendError(code string, message string) error {
+	return s.reject(code, message, nil)
+}
+
+func (s *Session) sendRateLimited(retry time.Duration) error {
+	strike(s.observed.IP, "rate limited")
+	return s.reject("rate_limited", "rate limited", gin.H{"retry_after": retryAfterSeconds(retry)})
+}
+
+// reject answers the message being dispatched with a nack if it carried an
+// id, and with an error otherwise.
+func (s *Session) reject(code string, message string, details gin.H) error {
+	payload := errorBody(code, message, details, s.requestID)
+	if s.replyTo == "" {
+		return s.send(ws.MsgError, payload)
+	}
+	msg, err := ws.NewMessage(ws.MsgNack, payload)
+	if err != nil {
+		return err
+	}
+	msg.ID, s.replyTo = s.replyTo, ""
+	return s.write(msg)
+}
+
+// allowRelay applies the per uuid rate limit to messages relayed to peers.
+func (s *Session) allowRelay() (bool, error) {
+	if ok, retry := peerLimits.allow(s.uuid); !ok {
+		return false, s.sendRateLimited(retry)
+	}
+	return true, nil
+}
+
+type messageHandler func(ctx context.Context, s *Session, msg ws.Message) error
+
+var handlers = map[ws.MessageType]messageHandler{
+	ws.MsgRegister:     handleRegister,
+	ws.MsgResume:       handleResume,
+	ws.MsgOffer:        handleRelay,
+	ws.MsgAnswer:       handleRelay,
+	ws.MsgCandidate:    handleRelay,
+	ws.MsgBroadcast:    handleData,
+	ws.MsgDirect:       handleData,
+	ws.MsgBye:          handleBye,
+	ws.MsgDeregister:   handleDeregister,
+	ws.MsgCreateRoom:   handleCreateRoom,
+	ws.MsgJoinRoom:     handleJoinRoom,
+	ws.MsgLeaveRoom:    handleLeaveRoom,
+	ws.MsgKickPeer:     handleKickPeer,
+	ws.MsgMutePeer:     handleMutePeer,
+	ws.MsgUnmutePeer:   handleMutePeer,
+	ws.MsgTransferHost: handleTransferHost,
+	ws.MsgLockRoom:     handleLockRoom,
+	ws.MsgUnlockRoom:   handleLockRoom,
+	ws.MsgCloseRoom:    handleCloseRoom,
+	ws.MsgDelivered:    handleDelivered,
+	ws.MsgMatch:        handleMatch,
+	ws.MsgCancelMatch:  handleCancelMatch,
+	ws.MsgReport:       handleReport,
+	ws.MsgProbeNAT:     handleProbeNAT,
+	ws.MsgRendezvous:   handleRendezvous,
+}
+
+const maxMessageIDLength = 128
+
+// dispatch runs the handler for msg. Messages with an id are answered with an
+// ack once handled, or a nack in place of the error reply.
+func dispatch(s *Session, msg ws.Message) error {
+	rolling.message()
+	if len(msg.ID) > maxMessageIDLength {
+		return s.sendError("message_id_too_long", "message id too long")
+	}
+	if msg.Type != ws.MsgDelivered {
+		s.replyTo = msg.ID
+	}
+	defer func() { s.replyTo = "" }()
+
+	h, ok := handlers[msg.Type]
+	if !ok {
+		return s.sendError("unknown_type", fmt.Sprintf("unknown message type %q", msg.Type))
+	}
+	room := msg.Room
+	if room == "" && s.uuid != "" {
+		room = rooms.RoomOf(s.uuid)
+	}
+	ctx, span := tracer.Start(s.log.WithContext(context.Background()), "ws."+string(msg.Type), trace.WithAttributes(
+		attribute.String("uuid", s.uuid),
+		attribute.String("to", msg.To),
+		attribute.String("room", room),
+	))
+	start := time.Now()
+	err := h(ctx, s, msg)
+	if err == nil && s.replyTo != "" {
+		err = s.write(ws.Message{Type: ws.MsgAck, ID: s.replyTo})
+	}
+	observe(ctx, metricMessageDuration.WithLabelValues(string(msg.Type)), time.Since(start).Seconds())
+	endSpan(span, err)
+	return err
+}
+
+func handleRegister(ctx context.Context, s *Session, msg ws.Message) error {
+	var form EntryForm
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &form); err != nil {
+			return s.sendError("invalid_payload", "error parsing payload")
+		}
+	}
+	if form.Uuid == "" {
+		form.Uuid = msg.From
+	}
+	var formErr *FormError
+	if err := requireUUID(form); errors.As(err, &formErr) {
+		return s.reject(formErr.Code, formErr.message(), formErr.details())
+	}
+	current := s.uuid
+	if current == "" {
+		current = s.claimed
+	}
+	uuidToken, err := claimUUID(ctx, &form, current)
+	if err == errUUIDNotAssigned {
+		auditEvent("auth_failed", form.Uuid, s.observed.IP).Str("reason", "invalid uuid_token").Send()
+		strike(s.observed.IP, "invalid uuid_token")
+		return s.sendError("invalid_uuid_token", "missing or invalid uuid_token")
+	} else if err != nil {
+		s.log.Err(err).Msg("Error assigning uuid")
+		return s.sendError("internal", "error assigning uuid")
+	}
+	if !subjectAllows(s.subject, form.Uuid) {
+		return s.sendError("subject_mismatch", "uuid does not match token subject")
+	}
+	if ok, retry := peerLimits.allow(form.Uuid); !ok {
+		return s.sendRateLimited(retry)
+	}
+	if s.captcha {
+		if err := checkCaptcha(ctx, form, s.observed.IP); err != nil {
+			_, code, status := captchaRejection(err)
+			return s.sendError(code, status)
+		}
+		s.captcha = false
+	}
+	device := ""
+	if *duplicateUUID == "multi" {
+		device = form.Device
+		if device == "" {
+			device = newDeviceID()
+		} else if !deviceIDPattern.MatchString(device) {
+			return s.sendError("invalid_device", "invalid device")
+		}
+	}
+	if *duplicateUUID == "reject" {
+		for _, o := range connections.Sessions(form.Uuid) {
+			if o != s {
+				return s.sendError("uuid_already_connected", "uuid already connected")
+			}
+		}
+	}
+
+	entries, next, err := registerJSON(ctx, s.tenant, s.claims, form, s.observed)
+	var addrErr *AddressError
+	if errors.As(err, &addrErr) {
+		return s.reject("invalid_address", "invalid address", addrErr.details())
+	}
+	if errors.As(err, &formErr) {
+		return s.reject(formErr.Code, formErr.message(), formErr.details())
+	}
+	var refused *RefusedError
+	if errors.As(err, &refused) {
+		return s.reject("refused", "refused", refused.details())
+	}
+	if err == errOtherTenant {
+		return s.sendError("other_tenant", "uuid belongs to another tenant")
+	}
+	var full *TenantFullError
+	if errors.As(err, &full) {
+		return s.reject("tenant_full", "tenant full", full.details())
+	}
+	if err == errBanned {
+		if err := s.sendError("banned", "banned"); err != nil {
+			return err
+		}
+		return s.CloseWith(ws.CloseBanned, "banned")
+	}
+	if err != nil {
+		s.log.Err(err).Msg("Error registering over websocket")
+		return s.sendError("internal", "error")
+	}
+	if s.uuid != "" && s.uuid != form.Uuid {
+		if connections.Remove(s) {
+			matches.remove(s.uuid)
+			leaveRoom(s.uuid, "left")
+		}
+	} else if s.device != device {
+		connections.Remove(s)
+	}
+	s.uuid, s.device = form.Uuid, device
+	resumes.cancel(s.uuid, s.device)
+	if err := connections.Add(s); err != nil {
+		s.uuid, s.device = "", ""
+		if err == hub.ErrTenantFull {
+			return s.reject("tenant_full", "tenant full", gin.H{"tenant": tenantLabel(s.tenant), "max_peers": tenantLimit(s.tenant)})
+		}
+		return s.sendError("uuid_already_connected", "uuid already connected")
+	}
+
+	resp := gin.H{"status": "ok", "entries": entries, "observed": s.observed}
+	if s.device != "" {
+		resp["device"] = s.device
+	}
+	if uuidToken != "" {
+		resp["uuid"] = s.uuid
+		resp["uuid_token"] = uuidToken
+	}
+	if next != "" {
+		resp["next"] = next
+	}
+	if token := resumes.issue(s); token != "" {
+		resp["resume_token"] = token
+	}
+	if affinityNode != "" {
+		resp["node"] = affinityNode
+	}
+	if turnEnabled() {
+		resp["turn"] = newTurnCredentials(s.uuid, time.Now())
+	}
+	if err := s.send(ws.MsgRegistered, resp); err != nil {
+		return err
+	}
+
+	for _, c := range takeOffline(s.uuid) {
+		if err := s.write(c); err != nil {
+			return err
+		}
+		metricRelayed.WithLabelValues(string(c.Type)).Inc()
+	}
+	return nil
+}
+
+// handleResume reattaches a connection to a session parked after its socket
+// dropped, replaying whatever was queued for it since.
+func handleResume(ctx context.Context, s *Session, msg ws.Message) error {
+	var form struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(msg.Payload, &form); err != nil {
+		return s.sendError("invalid_payload", "error parsing payload")
+	}
+	if s.uuid != "" {
+		return s.sendError("already_registered", "already registered")
+	}
+	p, ok := resumes.resume(form.Token, s.tenant, s.subject)
+	if !ok {
+		if node := tokenNode(form.Token); node != "" && node != affinityNode {
+			if details, live := wrongNode(node); live {
+				return s.reject("wrong_node", "session on another instance", details)
+			}
+		}
+		return s.sendError("invalid_resume_token", "invalid resume token")
+	}
+	s.uuid, s.device = p.uuid, p.device
+	if err := connections.Add(s); err != nil {
+		s.uuid, s.device = "", ""
+		if err == hub.ErrTenantFull {
+			return s.reject("tenant_full", "tenant full", gin.H{"tenant": tenantLabel(s.tenant), "max_peers": tenantLimit(s.tenant)})
+		}
+		return s.sendError("uuid_already_connected", "uuid already connected")
+	}
+	touchEntry(ctx, s.uuid)
+	s.log.Debug().Str("uuid", s.uuid).Int("queued", len(p.queue)).Msg("Session resumed")
+	events.publish(Event{Type: EventPeerResumed, UUID: s.uuid})
+
+	resp := gin.H{"status": "ok", "uuid": s.uuid}
+	if s.device != "" {
+		resp["device"] = s.device
+	}
+	if room := rooms.RoomOf(s.uuid); room != "" {
+		resp["room"] = room
+	}
+	if token := resumes.issue(s); token != "" {
+		resp["resume_token"] = token
+	}
+	if affinityNode != "" {
+		resp["node"] = affinityNode
+	}
+	if err := s.send(ws.MsgResumed, resp); err != nil {
+		return err
+	}
+
+	for _, m := range append(p.queue, takeOffline(s.uuid)...) {
+		if err := s.write(m); err != nil {
+			return err
+		}
+		metricRelayed.WithLabelValues(string(m.Type)).Inc()
+	}
+	return nil
+}
+
+// handleRelay forwards an offer, answer or candidate to the session
+// registered as msg.To, queueing it if that peer is not connected.
+func handleRelay(ctx context.Context, s *Session, msg ws.Message) error {
+	start := time.Now()
+	if s.uuid == "" {
+		return s.sendError("not_registered", "not registered")
+	}
+	if ok, err := s.allowRelay(); !ok {
+		return err
+	}
+	if msg.To == "" {
+		return s.sendError("missing_destination", "missing destination")
+	}
+
+	to, _ := hub.SplitDevice(msg.To)
+	ok, remote := s.maySignal(ctx, to)
+	if !ok {
+		return s.sendError("peer_not_in_room", "peer not in room")
+	}
+
+	msg.From = s.addr()
+	msg.Room = rooms.RoomOf(s.uuid)
+	if msg.Room != "" && rooms.Muted(msg.Room, s.uuid) {
+		return s.reject("muted", "muted", gin.H{"room": msg.Room})
+	}
+	if p := signalPolicy(s.tenant, msg.Room); p != nil {
+		filtered, err := p.apply(msg)
+		if err == errCandidateDropped {
+			metricSDPFiltered.WithLabelValues("candidate_dropped").Inc()
+			return nil
+		}
+		if err != nil {
+			metricSDPFiltered.WithLabelValues("refused").Inc()
+			return s.reject("sdp_refused", "sdp refused", gin.H{"reason": err.Error()})
+		}
+		msg = filtered
+	}
+	var refused *RefusedError
+	if err := relayAllowed(ctx, s, msg); errors.As(err, &refused) {
+		return s.reject("refused", "refused", refused.details())
+	}
+	if *glareWindow > 0 {
+		if lost, err := resolveGlare(s, msg); lost {
+			return err
+		}
+	}
+	correlate(&msg)
+	relayLog.Debug().Str("type", string(msg.Type)).Str("from", msg.From).Str("to", msg.To).
+		Str("correlation_id", msg.CorrelationID).Str("request_id", s.requestID).Msg("Relaying signal")
+	err := connections.Send(msg.To, msg)
+	if err == hub.ErrNotConnected && remote {
+		// Nobody has it, so it was never in the room.
+		return s.sendError("peer_not_in_room", "peer not in room")
+	}
+	if err == hub.ErrNotConnected {
+		if !queueOffline(msg) {
+			notifyUndelivered([]ws.Message{msg}, "queue full")
+			return nil
+		}
+		relayLog.Debug().Str("from", msg.From).Str("to", msg.To).Str("correlation_id", msg.CorrelationID).Msg("Queued signal for offline peer")
+		return nil
+	}
+	if err != nil {
+		relayLog.Err(err).Str("to", msg.To).Str("correlation_id", msg.CorrelationID).Msg("Error relaying signal")
+		return s.sendError("delivery_failed", "delivery failed")
+	}
+	rolling.relay(time.Since(start))
+	metricRelayed.WithLabelValues(string(msg.Type)).Inc()
+	metricTenantRelayed.WithLabelValues(metricTenant(s.tenant)).Inc()
+	rooms.CountRelayed(msg.Room)
+	events.publish(Event{Type: EventMessageRelayed, UUID: msg.From, To: msg.To, Room: msg.Room, Message: msg.Type})
+	return nil
+}
+
+// resolveGlare settles offers crossing between s and msg.To. The polite
+// peer is told to roll its own offer back: in reply, when its offer is the
+// one dropped, or ahead of the impolite peer's offer it is about to get. It
+// reports whether msg lost and must not be relayed.
+func resolveGlare(s *Session, msg ws.Message) (bool, error) {
+	to, _ := hub.SplitDevice(msg.To)
+	switch msg.Type {
+	case ws.MsgAnswer:
+		offers.answered(s.uuid, to)
+		return false, nil
+	case ws.MsgOffer:
+	default:
+		return false, nil
+	}
+	if !offers.offer(s.uuid, to, time.Now()) {
+		return false, nil
+	}
+	if politeTowards(s.uuid, to) {
+		metricGlare.WithLabelValues("dropped").Inc()
+		relayLog.Debug().Str("from", s.uuid).Str("to", to).Msg("Glare, dropping polite offer")
+		return true, s.reject("glare", "glare", gin.H{"peer": to, "action": "rollback"})
+	}
+	metricGlare.WithLabelValues("rollback").Inc()
+	relayLog.Debug().Str("from", s.uuid).Str("to", to).Msg("Glare, telling polite peer to roll back")
+	notice, err := ws.NewMessage(ws.MsgGlare, gin.H{"peer": s.uuid, "action": "rollback"})
+	if err != nil {
+		return false, err
+	}
+	notice.Room = msg.Room
+	if err := connections.Send(msg.To, notice); err != nil && err != hub.ErrNotConnected {
+		relayLog.Err(err).Str("to", msg.To).Msg("Error sending glare notice")
+	}
+	return false, nil
+}
+
+// handleData passes a broadcast to every other member of the sender's room,
+// or a direct message to one of them. They are meant for small things like
+// lobby chat and ready checks before the peers have a data channel.
+func handleData(ctx context.Context, s *Session, msg ws.Message) error {
+	if s.uuid == "" {
+		return s.sendError("not_registered", "not registered")
+	}
+	if ok, err := s.allowRelay(); !ok {
+		return err
+	}
+	room := rooms.RoomOf(s.uuid)
+	if room == "" {
+		return s.sendError("not_in_room", "not in a room")
+	}
+	if len(msg.Payload) > *maxDataSize {
+		return s.reject("payload_too_large", "payload too large", gin.H{"max_data_size": *maxDataSize})
+	}
+	if rooms.Muted(room, s.uuid) {
+		return s.reject("muted", "muted", gin.H{"room": room})
+	}
+	msg.From, msg.Room = s.addr(), room
+	if msg.Type == ws.MsgBroadcast {
+		msg.To = ""
+	} else {
+		if msg.To == "" {
+			return s.sendError("missing_destination", "missing destination")
+		}
+		to, _ := hub.SplitDevice(msg.To)
+		if ok, _ := s.maySignal(ctx, to); !ok {
+			return s.sendError("peer_not_in_room", "peer not in room")
+		}
+	}
+	var refused *RefusedError
+	if err := dataAllowed(ctx, s, msg); errors.As(err, &refused) {
+		return s.reject("refused", "refused", refused.details())
+	}
+	if msg.Type == ws.MsgBroadcast {
+		broadcastRoom(room, s.uuid, msg)
+	} else {
+		if err := connections.Send(msg.To, msg); err != nil {
+			return s.sendError("delivery_failed", "delivery failed")
+		}
+	}
+	metricRelayed.WithLabelValues(string(msg.Type)).Inc()
+	rooms.CountRelayed(room)
+	events.publish(Event{Type: EventMessageRelayed, UUID: msg.From, To: msg.To, Room: room, Message: msg.Type})
+	return nil
+}
+
+// handleDelivered passes a receipt for msg.ID back to the peer that sent it.
+func handleDelivered(ctx context.Context, s *Session, msg ws.Message) error {
+	if s.uuid == "" {
+		return s.sendError("not_registered", "not registered")
+	}
+	if ok, err := s.allowRelay(); !ok {
+		return err
+	}
+	if msg.To == "" || msg.ID == "" {
+		return s.sendError("missing_destination", "missing destination or id")
+	}
+	to, _ := hub.SplitDevice(msg.To)
+	ok, remote := s.maySignal(ctx, to)
+	if !ok {
+		return s.sendError("peer_not_in_room", "peer not in room")
+	}
+
+	msg.From = s.addr()
+	msg.Room = rooms.RoomOf(s.uuid)
+	msg.Payload = nil
+	err := connections.Send(msg.To, msg)
+	if err == hub.ErrNotConnected && (remote || !queueOffline(msg)) {
+		relayLog.Debug().Str("to", msg.To).Msg("Dropping delivery receipt for offline peer")
+	} else if err != nil && err != hub.ErrNotConnected {
+		relayLog.Err(err).Str("to", msg.To).Msg("Error relaying delivery receipt")
+	}
+	return nil
+}
+
+func handleDeregister(ctx context.Context, s *Session, msg ws.Message) error {
+	if s.uuid == "" {
+		return s.sendError("not_registered", "not registered")
+	}
+	id := s.uuid
+	matches.remove(id)
+	leaveRoom(id, "deregistered")
+	connections.Remove(s)
+	s.uuid = ""
+	if _, err := deregisterUUID(ctx, id); err != nil {
+		s.log.Err(err).Msg("Error deregistering over websocket")
+	}
+	events.publish(Event{Type: EventPeerDeregistered, UUID: id})
+	return s.send(ws.MsgDeregistered, gin.H{"status": "ok", "uuid": id})
+}
+
+func handleBye(ctx context.Context, s *Session, msg ws.Message) error {
+	s.done = true
+	return nil
+}
+
+func handleCreateRoom(ctx context.Context, s *Session, msg ws.Message) error {
+	if s.uuid == "" {
+		return s.sendError("not_registered", "not registered")
+	}
+	var form struct {
+		MaxPeers  int               `json:"max_peers"`
+		Password  string            `json:"password"`
+		Invite    bool              `json:"invite"`
+		Name      string            `json:"name"`
+		Tags      map[string]string `json:"tags"`
+		Metadata  json.RawMessage   `json:"metadata"`
+		Unlisted  bool              `json:"unlisted"`
+		RelayOnly bool              `json:"relay_only"`
+	}
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &form); err != nil {
+			return s.sendError("invalid_payload", "error parsing payload")
+		}
+	}
+	if form.RelayOnly {
+		if ok, err := s.requireFeature("privacy_mode"); !ok {
+			return err
+		}
+	}
+	if len(form.Password) > maxRoomPasswordLength {
+		return s.sendError("password_too_long", "password too long")
+	}
+	if len(form.Name) > maxRoomNameLength {
+		return s.sendError("name_too_long", "name too long")
+	}
+	if err := validateTags(form.Tags); err != nil {
+		return s.sendError("invalid_tags", err.Error())
+	}
+	metadata, err := normalizeMetadata(form.Metadata)
+	if err != nil {
+		return s.sendError("invalid_metadata", err.Error())
+	}
+	msg.Room = rooms.Create(s.tenant, s.uuid, form.MaxPeers)
+	rooms.Describe(msg.Room, form.Name, form.Tags, metadata, form.Unlisted)
+	if form.RelayOnly {
+		rooms.SetRelayOnly(msg.Room)
+	}
+	invite := rooms.Protect(msg.Room, form.Password, form.Invite)
+	s.log.Debug().Str("room", msg.Room).Str("uuid", s.uuid).Msg("Room created")
+	events.publish(Event{Type: EventRoomCreated, UUID: s.uuid, Room: msg.Room})
+	return joinRoom(ctx, s, msg, invite)
+}
+
+const (
+	maxRoomPasswordLength = 128
+	maxRoomNameLength     = 64
+)
+
+func handleJoinRoom(ctx context.Context, s *Session, msg ws.Message) error {
+	if s.uuid == "" {
+		return s.sendError("not_registered", "not registered")
+	}
+	if msg.Room == "" {
+		return s.sendError("missing_room", "missing room")
+	}
+	var form struct {
+		Password         string `json:"password"`
+		InviteToken      string `json:"invite_token"`
+		ReservationToken string `json:"reservation_token"`
+	}
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &form); err != nil {
+			return s.sendError("invalid_payload", "error parsing payload")
+		}
+	}
+	var refused *RefusedError
+	if err := authorize(ctx, Action{Kind: ActionJoin, UUID: s.uuid, Tenant: s.tenant, Room: msg.Room, Claims: s.claims}); errors.As(err, &refused) {
+		return s.reject("refused", "refused", refused.details())
+	}
+	if roomStore != nil {
+		var elsewhere *RoomElsewhereError
+		err := roomStore.claim(ctx, msg.Room, s.tenant)
+		if errors.As(err, &elsewhere) {
+			return s.reject("room_elsewhere", "room on another instance", elsewhere.details())
+		}
+		if err != nil {
+			s.log.Err(err).Str("room", msg.Room).Msg("Error claiming room")
+			return s.sendError("internal", "error")
+		}
+	}
+	if form.ReservationToken != "" {
+		return joinReserved(ctx, s, msg.Room, form.ReservationToken)
+	}
+	if !rooms.Admits(msg.Room, s.uuid, form.Password, form.InviteToken) {
+		return s.reject("room_protected", "room protected", gin.H{"room": msg.Room})
+	}
+	return joinRoom(ctx, s, msg, "")
+}
+
+// joinRoom puts s in msg.Room, or in line for it. The invite token of a room
+// s just created goes back to it with the members.
+func joinRoom(ctx context.Context, s *Session, msg ws.Message, invite string) error {
+	previous, err := rooms.Join(msg.Room, s.uuid, s.tenant)
+	if err == errRoomFull {
+		return queueForRoom(s, msg.Room)
+	}
+	if err == errRoomLocked {
+		return s.reject("room_locked", "room locked", gin.H{"room": msg.Room})
+	}
+	if err == errKicked {
+		return s.reject("kicked", "kicked", gin.H{"room": msg.Room})
+	}
+	if err != nil {
+		return s.sendError("room_not_found", "room not found")
+	}
+	return enteredRoom(ctx, s, msg.Room, previous, invite)
+}
+
+// joinReserved puts s in the reserved room, whatever its capacity or lock, if
+// token is the reservation's.
+func joinReserved(ctx context.Context, s *Session, room string, token string) error {
+	previous, err := rooms.JoinReserved(room, s.uuid, s.tenant, token)
+	switch {
+	case err == errRoomNotStarted:
+		return s.reject("room_not_started", "room not started", gin.H{"room": room, "starts_at": rooms.StartsAt(room)})
+	case err == errReservationRefused:
+		return s.reject("reservation_refused", "reservation refused", gin.H{"room": room})
+	case err == errKicked:
+		return s.reject("kicked", "kicked", gin.H{"room": room})
+	case err != nil:
+		return s.sendError("room_not_found", "room not found")
+	}
+	return enteredRoom(ctx, s, room, previous, "")
+}
+
+// enteredRoom tells s, and the others in room, that s joined it, and previous
+// that s left.
+func enteredRoom(ctx context.Context, s *Session, room string, previous string, invite string) error {
+	if previous != "" {
+		announceLeft(previous, s.uuid, "left")
+	}
+	announceJoined(ctx, room, s.uuid)
+
+	joined := gin.H{"members": withRoles(s.uuid, lookupEntries(ctx, rooms.Members(room))), "host": rooms.Host(room)}
+	if invite != "" {
+		joined["invite_token"] = invite
+	}
+	reply, err := ws.NewMessage(ws.MsgRoomJoined, joined)
+	if err != nil {
+		return err
+	}
+	reply.Room = room
+	if err := s.write(reply); err != nil {
+		return err
+	}
+	sendMeshPlan(room)
+	return nil
+}
+
+// queueForRoom handles a join to a full room according to --room-full.
+func queueForRoom(s *Session, room string) error {
+	stats, _ := rooms.Stats(room)
+	if *roomFull != "queue" {
+		return s.reject("room_full", "room full", gin.H{"room": room, "members": stats.Members, "max_peers": stats.MaxPeers})
+	}
+	position, err := rooms.Enqueue(room, s.uuid, s.tenant)
+	if err == errRoomLocked {
+		return s.reject("room_locked", "room locked", gin.H{"room": room})
+	}
+	if err == errKicked {
+		return s.reject("kicked", "kicked", gin.H{"room": room})
+	}
+	if err != nil {
+		return s.sendError("room_not_found", "room not found")
+	}
+	reply, err := ws.NewMessage(ws.MsgRoomQueued, gin.H{"position": position, "max_peers": stats.MaxPeers})
+	if err != nil {
+		return err
+	}
+	reply.Room = room
+	if err := s.write(reply); err != nil {
+		return err
+	}
+	// A place may have opened up since the join was refused.
+	admitWaiting(room)
+	return nil
+}
+
+// admitWaiting lets queued peers into room while it has space, telling each
+// one it joined. It reports whether anyone was let in.
+func admitWaiting(room string) bool {
+	admitted := false
+	for {
+		peer, previous, ok := rooms.Admit(room)
+		if !ok {
+			return admitted
+		}
+		admitted = true
+		if previous != "" {
+			announceLeft(previous, peer, "left")
+		}
+		ctx := context.Background()
+		announceJoined(ctx, room, peer)
+		reply, err := ws.NewMessage(ws.MsgRoomJoined, gin.H{"members": withRoles(peer, lookupEntries(ctx, rooms.Members(room))), "host": rooms.Host(room)})
+		if err != nil {
+			log.Err(err).Msg("Error encoding room_joined")
+			continue
+		}
+		reply.Room = room
+		if err := connections.Send(peer, reply); err != nil {
+			log.Err(err).Str("room", room).Str("to", peer).Msg("Error admitting queued peer")
+		}
+		sendMeshPlan(room)
+	}
+}
+
+func handleLeaveRoom(ctx context.Context, s *Session, msg ws.Message) error {
+	id := leaveRoom(s.uuid, "left")
+	if id == "" {
+		return s.sendError("not_in_room", "not in a room")
+	}
+	return s.write(ws.Message{Type: ws.MsgRoomLeft, Room: id})
+}
+
+// hostedRoom returns the room s is in along with the peer named by the
+// payload, if the message has one, for the host's messages.
+func hostedRoom(s *Session, msg ws.Message) (room string, peer string, err error) {
+	if s.uuid == "" {
+		return "", "", s.sendError("not_registered", "not registered")
+	}
+	room = rooms.RoomOf(s.uuid)
+	if room == "" {
+		return "", "", s.sendError("not_in_room", "not in a room")
+	}
+	var form struct {
+		UUID string `json:"uuid"`
+	}
+	if len(msg.Payload) > 0 {
+		if err := json.Unmarshal(msg.Payload, &form); err != nil {
+			return "", "", s.sendError("invalid_payload", "error parsing payload")
+		}
+	}
+	return room, form.UUID, nil
+}
+
+// refuseHost answers a host's message that the room refused with err.
+func refuseHost(s *Session, room string, err error) error {
+	switch err {
+	case errNotHost:
+		return s.reject("not_host", "not host", gin.H{"room": room, "host": rooms.Host(room)})
+	case errNotMember:
+		return s.sendError("peer_not_in_room", "peer not in room")
+	}
+	return s.sendError("room_not_found", "room not found")
+}
+
+// sendRoomLeft tells peer it is no longer in, or waiting for, room.
+func sendRoomLeft(room string, peer string, reason string) {
+	msg, err := ws.NewMessage(ws.MsgRoomLeft, gin.H{"reason": reason})
+	if err != nil {
+		log.Err(err).Msg("Error encoding room_left")
+		return
+	}
+	msg.Room = room
+	if err := connections.Send(peer, msg); err != nil && err != hub.ErrNotConnected {
+		relayLog.Err(err).Str("room", room).Str("to", peer).Msg("Error sending room_left")
+	}
+}
+
+func handleKickPeer(ctx context.Context, s *Session, msg ws.Message) error {
+	room, peer, err := hostedRoom(s, msg)
+	if room == "" {
+		return err
+	}
+	if err := rooms.Kick(room, s.uuid, peer); err != nil {
+		return refuseHost(s, room, err)
+	}
+	s.log.Debug().Str("room", room).Str("uuid", peer).Str("host", s.uuid).Msg("Peer kicked")
+	events.publish(Event{Type: EventPeerKicked, UUID: peer, Room: room})
+	sendRoomLeft(room, peer, "kicked")
+	announceLeft(room, peer, "kicked")
+	return nil
+}
+
+// handleMutePeer handles mute_peer and unmute_peer. A muted member stays in
+// the room but cannot signal anyone in it.
+func handleMutePeer(ctx context.Context, s *Session, msg ws.Message) error {
+	room, peer, err := hostedRoom(s, msg)
+	if room == "" {
+		return err
+	}
+	muted := msg.Type == ws.MsgMutePeer
+	if err := rooms.Mute(room, s.uuid, peer, muted); err != nil {
+		return refuseHost(s, room, err)
+	}
+	event := EventPeerUnmuted
+	if muted {
+		event = EventPeerMuted
+	}
+	events.publish(Event{Type: event, UUID: peer, Room: room})
+	notice, err := ws.NewMessage(ws.MsgPeerMuted, gin.H{"uuid": peer, "muted": muted})
+	if err != nil {
+		return err
+	}
+	broadcastRoom(room, "", notice)
+	return nil
+}
+
+func handleTransferHost(ctx context.Context, s *Session, msg ws.Message) error {
+	room, peer, err := hostedRoom(s, msg)
+	if room == "" {
+		return err
+	}
+	if err := rooms.Transfer(room, s.uuid, peer); err != nil {
+		return refuseHost(s, room, err)
+	}
+	announceHost(room, peer)
+	return nil
+}
+
+// announceHost tells everyone in room that host hosts it now.
+func announceHost(room string, host string) {
+	events.publish(Event{Type: EventRoomHostChanged, UUID: host, Room: room})
+	notice, err := ws.NewMessage(ws.MsgHostChanged, gin.H{"host": host})
+	if err != nil {
+		log.Err(err).Msg("Error encoding host_changed")
+		return
+	}
+	broadcastRoom(room, "", notice)
+}
+
+// handleLockRoom handles lock_room and unlock_room. Peers queued for a place
+// in the room are turned away when it is locked.
+func handleLockRoom(ctx context.Context, s *Session, msg ws.Message) error {
+	room, _, err := hostedRoom(s, msg)
+	if room == "" {
+		return err
+	}
+	locked := msg.Type == ws.MsgLockRoom
+	dropped, err := rooms.Lock(room, s.uuid, locked)
+	if err != nil {
+		return refuseHost(s, room, err)
+	}
+	for _, peer := range dropped {
+		sendRoomLeft(room, peer, "locked")
+	}
+	event := EventRoomUnlocked
+	if locked {
+		event = EventRoomLocked
+	}
+	events.publish(Event{Type: event, UUID: s.uuid, Room: room})
+	notice, err := ws.NewMessage(ws.MsgRoomLocked, gin.H{"locked": locked})
+	if err != nil {
+		return err
+	}
+	broadcastRoom(room, "", notice)
+	return nil
+}
+
+// handleCloseRoom empties the room, telling everyone in it or queued for it.
+func handleCloseRoom(ctx context.Context, s *Session, msg ws.Message) error {
+	room, _, err := hostedRoom(s, msg)
+	if room == "" {
+		return err
+	}
+	members, waiting, err := rooms.Close(room, s.uuid)
+	if err != nil {
+		return refuseHost(s, room, err)
+	}
+	s.log.Debug().Str("room", room).Str("host", s.uuid).Msg("Room closed by host")
+	for _, peer := range members {
+		events.publish(Event{Type: EventRoomLeft, UUID: peer, Room: room, Reason: "closed"})
+		sendRoomLeft(room, peer, "closed")
+	}
+	for _, peer := range waiting {
+		sendRoomLeft(room, peer, "closed")
+	}
+	return nil
+}
+
+// broadcastRoom sends msg to every connected member of room except one.
+func broadcastRoom(room string, except string, msg ws.Message) {
+	msg.Room = room
+	p := ws.Prepare(msg)
+	for _, peer := range rooms.Members(room) {
+		if peer == except {
+			continue
+		}
+		if err := connections.SendPrepared(peer, p); err != nil {
+			relayLog.Err(err).Str("room", room).Str("to", peer).Msg("Error broadcasting to room")
+		}
+	}
+}
+
+func announceJoined(ctx context.Context, room string, peer string) {
+	events.publish(Event{Type: EventRoomJoined, UUID: peer, Room: room})
+	entries := lookupEntries(ctx, []string{peer})
+	if len(entries) == 0 {
+		entries = append(entries, EntryForm{Uuid: peer})
+	}
+	// Roles depend on who receives it, so there is one copy for the members
+	// the newcomer is polite towards and one for the rest.
+	copies := map[bool]*ws.Prepared{}
+	for _, member := range rooms.Members(room) {
+		if member == peer {
+			continue
+		}
+		polite := politeTowards(member, peer)
+		p, ok := copies[polite]
+		if !ok {
+			msg, err := ws.NewMessage(ws.MsgPeerJoined, withRoles(member, []EntryForm{entries[0]})[0])
+			if err != nil {
+				log.Err(err).Msg("Error encoding peer_joined")
+				return
+			}
+			msg.Room = room
+			p = ws.Prepare(msg)
+			copies[polite] = p
+		}
+		if err := connections.SendPrepared(member, p); err != nil {
+			relayLog.Err(err).Str("room", room).Str("to", member).Msg("Error broadcasting to room")
+		}
+	}
+}
+
+func announceLeft(room string, peer string, reason string) {
+	events.publish(Event{Type: EventRoomLeft, UUID: peer, Room: room, Reason: reason})
+	msg, err := ws.NewMessage(ws.MsgPeerLeft, gin.H{"uuid": peer, "reason": reason, "host": rooms.Host(room)})
+	if err != nil {
+		log.Err(err).Msg("Error encoding peer_left")
+		return
+	}
+	broadcastRoom(room, peer, msg)
+	if !admitWaiting(room) {
+		sendMeshPlan(room)
+	}
+}
+
+// sweepRooms closes rooms left empty, see RoomManager.Sweep.
+func sweepRooms() {
+	for room, members := range rooms.Sweep(time.Now(), peerLive) {
+		for _, peer := range members {
+			events.publish(Event{Type: EventRoomLeft, UUID: peer, Room: room, Reason: "expired"})
+		}
+	}
+}
+
+// peerLive reports whether peer is connected here or may still resume.
+func peerLive(peer string) bool {
+	if _, ok := connections.Lookup(peer); ok {
+		return true
+	}
+	_, parked := resumes.queued(peer)
+	return parked
+}
+
+// leaveRoom takes peer out of its room and tells the remaining members why.
+func leaveRoom(peer string, reason string) string {
+	id := rooms.Leave(peer)
+	if id != "" {
+		announceLeft(id, peer, reason)
+	}
+	return id
+}
+
+// dropOutOfRoom is leaveRoom for a peer whose session dropped. Its room is
+// remembered for --offline-queue-ttl so the members can still queue
+// messages for it in case it comes back.
+func dropOutOfRoom(peer string, reason string) string {
+	id := rooms.Drop(peer, time.Now().Add(*offlineQueueTTL))
+	if id != "" {
+		announceLeft(id, peer, reason)
+	}
+	return id
+}
+
+func registerWS(ctx *gin.Context) {
+	if forwardToNode(ctx) {
+		return
+	}
+	serveWS(ctx)
+}
+
+func serveWS(ctx *gin.Context) {
+	w, r := ctx.Writer, ctx.Request
+	c, err := upgrader.Upgrade(w, r, affinityHeader(r))
+	if err != nil {
+		reqLog(ctx).Err(err).Msg("Error upgrading connection")
+		return
+	}
+	metricConnections.Inc()
+	defer metricConnections.Dec()
+
+	t := newTransport(c)
+	defer t.Close()
+	s := &Session{t: t, tenant: ctx.GetString(tenantKey), subject: ctx.GetString(subjectKey), claims: tokenClaims(ctx), observed: observedAddress(ctx), captcha: captchaNeeded(ctx), resumable: true}
+	s.setRequestID(requestID(ctx))
+	connections.Open(s)
+	rolling.opened()
+	defer connections.Close(s)
+	c.SetReadDeadline(time.Now().Add(*pongWait))
+	c.SetPongHandler(func(string) error {
+		c.SetReadDeadline(time.Now().Add(*pongWait))
+		if s.uuid != "" {
+			touchEntry(context.Background(), s.uuid)
+		}
+		return nil
+	})
+
+	// Oversized frames are answered with CloseMessageTooBig by the websocket
+	// library itself; floods are cut off below with ClosePolicyViolation.
+	c.SetReadLimit(*maxMessageSize)
+	var flood messageLimiter
+
+	reason := "disconnected"
+	defer func() { endSession(s, reason) }()
+	for !s.done {
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				reason = "timeout"
+				t.CloseWith(ws.CloseTimeout, "timeout")
+			}
+			reqLog(ctx).Err(err).Msg("Error reading message")
+			break
+		}
+		if !flood.allow() {
+			reqLog(ctx).Warn().Str("uuid", s.uuid).Str("ip", s.observed.IP).Msg("Disconnecting flooding client")
+			auditEvent("rate_limited", s.uuid, s.observed.IP).Str("reason", "message rate exceeded").Send()
+			strike(s.observed.IP, "message rate exceeded")
+			t.CloseWith(ws.CloseRateLimited, "message rate exceeded")
+			break
+		}
+		msg, err := t.Decode(data)
+		if err != nil {
+			if err := s.sendError("invalid_message", "error parsing message"); err != nil {
+				break
+			}
+			continue
+		}
+		if err := dispatch(s, msg); err != nil {
+			reqLog(ctx).Err(err).Msg("Error writing message")
+			break
+		}
+	}
+	if s.done {
+		t.CloseWith(ws.CloseDeregistered, "bye")
+	}
+}
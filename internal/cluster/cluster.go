@@ -0,0 +1,468 @@
+// Package cluster lets Seven instances find each other without a broker.
+// Membership and failure detection are hashicorp/memberlist's SWIM gossip,
+// encrypted with a keyring made from the shared secret. Keys are assigned to
+// live members by consistent hashing, and members can serve and call
+// handlers of their own over HTTP, on the port after the gossip one.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	stdlog "log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// replicas is how many points each member has on the ring.
+	replicas = 64
+	// rejoinInterval is how often a member alone tries the seeds again.
+	rejoinInterval = 5 * time.Second
+	// leaveTimeout is how long Close waits for the others to hear of it.
+	leaveTimeout = 2 * time.Second
+)
+
+// ErrClosed is returned once the cluster was left.
+var ErrClosed = errors.New("Cluster closed")
+
+// Member is one instance as the cluster knows it.
+type Member struct {
+	Name string            `json:"name"`
+	Addr string            `json:"addr"`
+	Meta map[string]string `json:"meta,omitempty"`
+
+	rpc string
+}
+
+// Config is what New needs.
+type Config struct {
+	Name string
+	// BindAddr is gossiped on, over UDP and TCP, and calls are served on
+	// its next port; AdvertiseAddr, the address other members reach this
+	// one at, defaults to it with this host's IP when it has none.
+	BindAddr      string
+	AdvertiseAddr string
+	// Seeds are members to join through.
+	Seeds []string
+	// Secret, when set, encrypts the gossip and must be presented on calls.
+	Secret string
+	// OnChange is called, from a goroutine of its own, after members
+	// joined, died, left or changed their Meta.
+	OnChange func()
+}
+
+// nodeMeta is what members gossip about themselves.
+type nodeMeta struct {
+	RPC  string            `json:"rpc"`
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// Cluster is this instance's membership.
+type Cluster struct {
+	cfg     Config
+	list    *memberlist.Memberlist
+	http    *http.Client
+	server  *http.Server
+	mux     *http.ServeMux
+	changes chan struct{}
+	stop    chan struct{}
+	done    sync.WaitGroup
+
+	mu      sync.RWMutex
+	self    nodeMeta
+	members map[string]Member
+	ring    []point
+	closed  bool
+}
+
+type point struct {
+	hash uint64
+	name string
+}
+
+// New starts gossiping on cfg.BindAddr and joins through cfg.Seeds.
+func New(cfg Config) (*Cluster, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("Cluster member needs a name")
+	}
+	bindHost, bindPort, err := splitAddr(cfg.BindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cluster address %q: %w", cfg.BindAddr, err)
+	}
+	if bindHost == "" {
+		bindHost = "0.0.0.0"
+	}
+	logger := stdlog.New(logWriter{}, "", 0)
+	transport, err := memberlist.NewNetTransport(&memberlist.NetTransportConfig{BindAddrs: []string{bindHost}, BindPort: bindPort, Logger: logger})
+	if err != nil {
+		return nil, fmt.Errorf("Error listening for cluster on %s: %w", cfg.BindAddr, err)
+	}
+	bindPort = transport.GetAutoBindPort()
+	rpcPort := 0
+	if bindPort != 0 {
+		rpcPort = bindPort + 1
+	}
+	lis, err := net.Listen("tcp", net.JoinHostPort(bindHost, strconv.Itoa(rpcPort)))
+	if err != nil {
+		transport.Shutdown()
+		return nil, fmt.Errorf("Error listening for cluster calls: %w", err)
+	}
+	advertiseHost, advertisePort, err := splitAddr(cfg.AdvertiseAddr)
+	if err != nil {
+		lis.Close()
+		transport.Shutdown()
+		return nil, fmt.Errorf("Invalid cluster advertise address %q: %w", cfg.AdvertiseAddr, err)
+	}
+	if advertiseHost == "" {
+		if advertiseHost, err = advertise(bindHost); err != nil {
+			lis.Close()
+			transport.Shutdown()
+			return nil, err
+		}
+	}
+	if advertisePort == 0 {
+		advertisePort = bindPort
+	}
+
+	c := &Cluster{
+		cfg:     cfg,
+		http:    &http.Client{Timeout: 2 * time.Second},
+		mux:     http.NewServeMux(),
+		changes: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		self:    nodeMeta{RPC: net.JoinHostPort(advertiseHost, strconv.Itoa(lis.Addr().(*net.TCPAddr).Port)), Meta: map[string]string{}},
+		members: make(map[string]Member),
+	}
+	conf := memberlist.DefaultLANConfig()
+	conf.Name = cfg.Name
+	conf.Transport = transport
+	conf.BindAddr = bindHost
+	conf.BindPort = bindPort
+	conf.AdvertiseAddr = advertiseHost
+	conf.AdvertisePort = advertisePort
+	conf.Delegate = delegate{c}
+	conf.Events = events{c}
+	conf.Logger = logger
+	if cfg.Secret != "" {
+		// memberlist takes AES keys; any secret is made into one.
+		key := sha256.Sum256([]byte(cfg.Secret))
+		if conf.Keyring, err = memberlist.NewKeyring(nil, key[:]); err != nil {
+			lis.Close()
+			transport.Shutdown()
+			return nil, err
+		}
+	}
+	c.list, err = memberlist.Create(conf)
+	if err != nil {
+		lis.Close()
+		transport.Shutdown()
+		return nil, fmt.Errorf("Error starting cluster membership: %w", err)
+	}
+	c.server = &http.Server{Handler: c.authorized(c.mux), ReadHeaderTimeout: 5 * time.Second}
+	go c.server.Serve(lis)
+	c.done.Add(2)
+	go c.notify()
+	go c.join()
+	return c, nil
+}
+
+// splitAddr is the host and port of addr, both empty when addr is.
+func splitAddr(addr string) (string, int, error) {
+	if addr == "" {
+		return "", 0, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, p, nil
+}
+
+// advertise is host, or this host's first non loopback IPv4 address when it
+// is unspecified.
+func advertise(host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		return host, nil
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), nil
+		}
+	}
+	return "127.0.0.1", nil
+}
+
+// logWriter passes memberlist's log lines on at their level.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	level, line, _ := strings.Cut(strings.TrimSpace(string(p)), " ")
+	line = strings.TrimPrefix(line, "memberlist: ")
+	switch level {
+	case "[ERR]":
+		log.Error().Str("component", "memberlist").Msg(line)
+	case "[WARN]":
+		log.Warn().Str("component", "memberlist").Msg(line)
+	default:
+		log.Debug().Str("component", "memberlist").Msg(line)
+	}
+	return len(p), nil
+}
+
+// join joins through the seeds, and again while no other member is known.
+func (c *Cluster) join() {
+	defer c.done.Done()
+	if len(c.cfg.Seeds) == 0 {
+		return
+	}
+	ticker := time.NewTicker(rejoinInterval)
+	defer ticker.Stop()
+	for {
+		if c.list.NumMembers() < 2 {
+			if _, err := c.list.Join(c.cfg.Seeds); err != nil {
+				log.Debug().Err(err).Strs("join", c.cfg.Seeds).Msg("Error joining cluster")
+			}
+		}
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// notify calls OnChange after changes, one call for those that come in
+// while it runs.
+func (c *Cluster) notify() {
+	defer c.done.Done()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-c.changes:
+		}
+		if c.cfg.OnChange != nil {
+			c.cfg.OnChange()
+		}
+	}
+}
+
+func (c *Cluster) changed() {
+	select {
+	case c.changes <- struct{}{}:
+	default:
+	}
+}
+
+// Name is this member's name.
+func (c *Cluster) Name() string {
+	return c.cfg.Name
+}
+
+// Handle serves h at path to the other members.
+func (c *Cluster) Handle(path string, h http.Handler) {
+	c.mux.Handle(path, h)
+}
+
+func (c *Cluster) authorized(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.cfg.Secret != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+c.cfg.Secret)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Call posts body to path on member name and returns the reply.
+func (c *Cluster) Call(ctx context.Context, name string, path string, body []byte) ([]byte, error) {
+	c.mu.RLock()
+	m, ok := c.members[name]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("No cluster member %q", name)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+m.rpc+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.cfg.Secret != "" {
+		req.Header.Set("Authorization", "Bearer "+c.cfg.Secret)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Cluster member %s answered %s", name, resp.Status)
+	}
+	return b, nil
+}
+
+// SetMeta sets key of this member's Meta, for the others to see.
+func (c *Cluster) SetMeta(key string, value string) {
+	c.mu.Lock()
+	if c.self.Meta[key] == value {
+		c.mu.Unlock()
+		return
+	}
+	meta := make(map[string]string, len(c.self.Meta)+1)
+	for k, v := range c.self.Meta {
+		meta[k] = v
+	}
+	meta[key] = value
+	c.self.Meta = meta
+	c.mu.Unlock()
+	if err := c.list.UpdateNode(leaveTimeout); err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("Error gossiping cluster meta")
+	}
+}
+
+// Members lists the live members, this one included, by name.
+func (c *Cluster) Members() []Member {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	list := make([]Member, 0, len(c.members))
+	for _, m := range c.members {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Owner is the live member key is assigned to.
+func (c *Cluster) Owner(key string) string {
+	h := hash(key)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.ring) == 0 {
+		return c.cfg.Name
+	}
+	i := sort.Search(len(c.ring), func(i int) bool { return c.ring[i].hash >= h })
+	if i == len(c.ring) {
+		i = 0
+	}
+	return c.ring[i].name
+}
+
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// buildRing places the live members on the ring. c.mu must be held.
+func (c *Cluster) buildRing() {
+	c.ring = c.ring[:0]
+	for name := range c.members {
+		for i := 0; i < replicas; i++ {
+			c.ring = append(c.ring, point{hash(name + "#" + strconv.Itoa(i)), name})
+		}
+	}
+	sort.Slice(c.ring, func(i, j int) bool { return c.ring[i].hash < c.ring[j].hash })
+}
+
+// update records node as alive, or forgets it.
+func (c *Cluster) update(node *memberlist.Node, alive bool) {
+	c.mu.Lock()
+	if alive {
+		var meta nodeMeta
+		if err := json.Unmarshal(node.Meta, &meta); err != nil {
+			log.Warn().Err(err).Str("node", node.Name).Msg("Ignoring cluster member with invalid meta")
+			c.mu.Unlock()
+			return
+		}
+		c.members[node.Name] = Member{Name: node.Name, Addr: node.Address(), Meta: meta.Meta, rpc: meta.RPC}
+	} else {
+		delete(c.members, node.Name)
+	}
+	c.buildRing()
+	c.mu.Unlock()
+	c.changed()
+}
+
+// delegate gossips this member's meta. memberlist calls it with its own
+// locks held, so it only touches c.mu.
+type delegate struct{ c *Cluster }
+
+func (d delegate) NodeMeta(limit int) []byte {
+	d.c.mu.RLock()
+	b, err := json.Marshal(d.c.self)
+	d.c.mu.RUnlock()
+	if err != nil || len(b) > limit {
+		log.Error().Err(err).Int("size", len(b)).Int("limit", limit).Msg("Cluster meta too large to gossip")
+		return nil
+	}
+	return b
+}
+
+func (delegate) NotifyMsg([]byte)                           {}
+func (delegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (delegate) LocalState(join bool) []byte                { return nil }
+func (delegate) MergeRemoteState(buf []byte, join bool)     {}
+
+// events keeps the members and ring up to date.
+type events struct{ c *Cluster }
+
+func (e events) NotifyJoin(n *memberlist.Node)   { e.c.update(n, true) }
+func (e events) NotifyUpdate(n *memberlist.Node) { e.c.update(n, true) }
+func (e events) NotifyLeave(n *memberlist.Node)  { e.c.update(n, false) }
+
+// Ping fails once the cluster was left.
+func (c *Cluster) Ping(ctx context.Context) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Close tells the others this member is leaving and stops serving.
+func (c *Cluster) Close(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+	close(c.stop)
+	c.done.Wait()
+	if err := c.list.Leave(leaveTimeout); err != nil {
+		log.Warn().Err(err).Msg("Error leaving cluster")
+	}
+	if err := c.list.Shutdown(); err != nil {
+		return err
+	}
+	return c.server.Shutdown(ctx)
+}
@@ -0,0 +1,92 @@
+package cluster
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestCluster(t *testing.T, name string, seeds ...string) *Cluster {
+	t.Helper()
+	c, err := New(Config{Name: name, BindAddr: "127.0.0.1:0", Seeds: seeds, Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close(context.Background()) })
+	return c
+}
+
+func eventually(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	a := newTestCluster(t, "a")
+	b := newTestCluster(t, "b", a.Members()[0].Addr)
+	eventually(t, "members to join", func() bool {
+		return len(a.Members()) == 2 && len(b.Members()) == 2
+	})
+
+	b.SetMeta("http", "127.0.0.1:8080")
+	eventually(t, "meta to spread", func() bool {
+		for _, m := range a.Members() {
+			if m.Name == "b" && m.Meta["http"] == "127.0.0.1:8080" {
+				return true
+			}
+		}
+		return false
+	})
+
+	owners := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		if a.Owner(key) != b.Owner(key) {
+			t.Fatalf("Members disagree on the owner of %q", key)
+		}
+		owners[a.Owner(key)]++
+	}
+	if owners["a"] == 0 || owners["b"] == 0 {
+		t.Errorf("Keys are not spread over both members: %v", owners)
+	}
+
+	b.Handle("/test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pong"))
+	}))
+	reply, err := a.Call(context.Background(), "b", "/test", nil)
+	if err != nil || string(reply) != "pong" {
+		t.Fatalf("Call = %q, %v, want pong", reply, err)
+	}
+
+	if err := b.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "b to leave", func() bool { return len(a.Members()) == 1 })
+	if owner := a.Owner("1"); owner != "a" {
+		t.Errorf("Owner after b left = %q, want a", owner)
+	}
+	if _, err := a.Call(context.Background(), "b", "/test", nil); err == nil {
+		t.Error("Call to a member that left succeeded")
+	}
+}
+
+func TestClusterSecret(t *testing.T) {
+	a := newTestCluster(t, "a")
+	b, err := New(Config{Name: "b", BindAddr: "127.0.0.1:0", Seeds: []string{a.Members()[0].Addr}, Secret: "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close(context.Background())
+	time.Sleep(time.Second)
+	if len(a.Members()) != 1 || len(b.Members()) != 1 {
+		t.Errorf("Members with different secrets joined: %v, %v", a.Members(), b.Members())
+	}
+}
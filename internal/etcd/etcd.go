@@ -0,0 +1,267 @@
+// Package etcd is a small client for the etcd v3 API over its JSON gateway,
+// enough to hold keys under a lease and change them with compare and swap.
+// Keys and values are bytes; the gateway wants them base64 encoded, and its
+// 64 bit numbers as strings.
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrLeaseExpired is returned by KeepAlive once the lease is gone.
+var ErrLeaseExpired = errors.New("Lease expired")
+
+// KeyValue is a key as Get and List return it.
+type KeyValue struct {
+	Key            []byte `json:"key"`
+	Value          []byte `json:"value"`
+	CreateRevision int64  `json:"create_revision,string"`
+	ModRevision    int64  `json:"mod_revision,string"`
+	Lease          int64  `json:"lease,string"`
+}
+
+// Client talks to the first of its endpoints that answers.
+type Client struct {
+	endpoints []string
+	http      *http.Client
+
+	mu      sync.Mutex
+	current int
+}
+
+// New returns a client for endpoints such as http://localhost:2379.
+func New(endpoints []string) *Client {
+	for i, e := range endpoints {
+		endpoints[i] = strings.TrimSuffix(e, "/")
+	}
+	return &Client{endpoints: endpoints, http: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// call posts req to the API path and decodes the reply into resp, trying
+// the other endpoints when one cannot be reached.
+func (c *Client) call(ctx context.Context, path string, req any, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	first := c.current
+	c.mu.Unlock()
+	for i := range c.endpoints {
+		n := (first + i) % len(c.endpoints)
+		err = c.post(ctx, c.endpoints[n]+path, body, resp)
+		var status *statusError
+		if err == nil || errors.As(err, &status) || ctx.Err() != nil {
+			if err == nil && n != first {
+				c.mu.Lock()
+				c.current = n
+				c.mu.Unlock()
+			}
+			return err
+		}
+	}
+	return err
+}
+
+// statusError is an error etcd answered with, which another endpoint would
+// answer with too.
+type statusError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("etcd: %s (%d)", e.Message, e.Code)
+}
+
+func (c *Client) post(ctx context.Context, url string, body []byte, resp any) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	res, err := c.http.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(res.Body, 64<<20))
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		e := &statusError{}
+		if json.Unmarshal(b, e) != nil || e.Message == "" {
+			e.Message = res.Status
+		}
+		return e
+	}
+	return json.Unmarshal(b, resp)
+}
+
+// Ping checks the endpoint in use answers.
+func (c *Client) Ping(ctx context.Context) error {
+	var resp struct{}
+	return c.call(ctx, "/v3/maintenance/status", struct{}{}, &resp)
+}
+
+// Grant creates a lease that lasts ttl unless kept alive.
+func (c *Client) Grant(ctx context.Context, ttl time.Duration) (int64, error) {
+	req := struct {
+		TTL int64 `json:"TTL,string"`
+	}{int64(ttl / time.Second)}
+	var resp struct {
+		ID    int64  `json:"ID,string"`
+		Error string `json:"error"`
+	}
+	if err := c.call(ctx, "/v3/lease/grant", req, &resp); err != nil {
+		return 0, err
+	}
+	if resp.Error != "" {
+		return 0, fmt.Errorf("etcd: %s", resp.Error)
+	}
+	return resp.ID, nil
+}
+
+// KeepAlive renews lease, returning how long it now lasts.
+func (c *Client) KeepAlive(ctx context.Context, lease int64) (time.Duration, error) {
+	req := struct {
+		ID int64 `json:"ID,string"`
+	}{lease}
+	var resp struct {
+		Result struct {
+			TTL int64 `json:"TTL,string"`
+		} `json:"result"`
+	}
+	if err := c.call(ctx, "/v3/lease/keepalive", req, &resp); err != nil {
+		return 0, err
+	}
+	if resp.Result.TTL <= 0 {
+		return 0, ErrLeaseExpired
+	}
+	return time.Duration(resp.Result.TTL) * time.Second, nil
+}
+
+// Revoke ends lease, deleting the keys attached to it.
+func (c *Client) Revoke(ctx context.Context, lease int64) error {
+	req := struct {
+		ID int64 `json:"ID,string"`
+	}{lease}
+	var resp struct{}
+	return c.call(ctx, "/v3/lease/revoke", req, &resp)
+}
+
+type rangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+type rangeResponse struct {
+	Kvs []KeyValue `json:"kvs"`
+}
+
+// Get returns key, or nil if there is no such key.
+func (c *Client) Get(ctx context.Context, key string) (*KeyValue, error) {
+	var resp rangeResponse
+	if err := c.call(ctx, "/v3/kv/range", rangeRequest{Key: []byte(key)}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	return &resp.Kvs[0], nil
+}
+
+// List returns the keys starting with prefix.
+func (c *Client) List(ctx context.Context, prefix string) ([]KeyValue, error) {
+	if prefix == "" {
+		return nil, errors.New("etcd: List needs a prefix")
+	}
+	end := []byte(prefix)
+	end[len(end)-1]++
+	var resp rangeResponse
+	if err := c.call(ctx, "/v3/kv/range", rangeRequest{Key: []byte(prefix), RangeEnd: end}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Kvs, nil
+}
+
+type putRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Lease int64  `json:"lease,omitempty,string"`
+}
+
+type deleteRequest struct {
+	Key []byte `json:"key"`
+}
+
+type compare struct {
+	Target         string `json:"target"`
+	Key            []byte `json:"key"`
+	Result         string `json:"result"`
+	CreateRevision *int64 `json:"create_revision,omitempty,string"`
+	ModRevision    *int64 `json:"mod_revision,omitempty,string"`
+}
+
+type op struct {
+	Put    *putRequest    `json:"request_put,omitempty"`
+	Delete *deleteRequest `json:"request_delete_range,omitempty"`
+}
+
+// unchanged compares key to the revision it was last changed at, 0 meaning
+// it does not exist.
+func unchanged(key string, rev int64) compare {
+	if rev == 0 {
+		return compare{Target: "CREATE", Key: []byte(key), Result: "EQUAL", CreateRevision: &rev}
+	}
+	return compare{Target: "MOD", Key: []byte(key), Result: "EQUAL", ModRevision: &rev}
+}
+
+// txn runs then if every compare holds, returning whether it did and the
+// revision it made.
+func (c *Client) txn(ctx context.Context, compares []compare, then []op) (bool, int64, error) {
+	req := struct {
+		Compare []compare `json:"compare"`
+		Success []op      `json:"success"`
+	}{compares, then}
+	var resp struct {
+		Header struct {
+			Revision int64 `json:"revision,string"`
+		} `json:"header"`
+		Succeeded bool `json:"succeeded"`
+	}
+	if err := c.call(ctx, "/v3/kv/txn", req, &resp); err != nil {
+		return false, 0, err
+	}
+	return resp.Succeeded, resp.Header.Revision, nil
+}
+
+// Put sets key to value, attached to lease unless it is 0.
+func (c *Client) Put(ctx context.Context, key string, value []byte, lease int64) error {
+	var resp struct{}
+	return c.call(ctx, "/v3/kv/put", putRequest{Key: []byte(key), Value: value, Lease: lease}, &resp)
+}
+
+// CompareAndSwap sets key to value if it was last changed at rev, or does
+// not exist when rev is 0. It returns whether it did and key's new
+// revision.
+func (c *Client) CompareAndSwap(ctx context.Context, key string, value []byte, rev int64) (bool, int64, error) {
+	return c.txn(ctx, []compare{unchanged(key, rev)}, []op{{Put: &putRequest{Key: []byte(key), Value: value}}})
+}
+
+// CompareAndDelete deletes key if it was last changed at rev, and returns
+// whether it did.
+func (c *Client) CompareAndDelete(ctx context.Context, key string, rev int64) (bool, error) {
+	ok, _, err := c.txn(ctx, []compare{unchanged(key, rev)}, []op{{Delete: &deleteRequest{Key: []byte(key)}}})
+	return ok, err
+}
@@ -0,0 +1,108 @@
+package etcd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// gateway answers every request with reply, keeping the bodies it got by
+// path.
+func gateway(t *testing.T, reply string) (*Client, map[string]string) {
+	t.Helper()
+	got := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got[r.URL.Path] = string(b)
+		io.WriteString(w, reply)
+	}))
+	t.Cleanup(srv.Close)
+	return New([]string{srv.URL + "/"}), got
+}
+
+func TestUnchanged(t *testing.T) {
+	tests := []struct {
+		rev  int64
+		want string
+	}{
+		{0, `{"target":"CREATE","key":"YS9i","result":"EQUAL","create_revision":"0"}`},
+		{42, `{"target":"MOD","key":"YS9i","result":"EQUAL","mod_revision":"42"}`},
+	}
+	for _, tt := range tests {
+		b, err := json.Marshal(unchanged("a/b", tt.rev))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.want {
+			t.Errorf("unchanged(a/b, %d) = %s, want %s", tt.rev, b, tt.want)
+		}
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	c, got := gateway(t, `{"header":{"revision":"9007199254740993"},"succeeded":true}`)
+	ok, rev, err := c.CompareAndSwap(context.Background(), "a/b", []byte("v"), 7)
+	if err != nil || !ok || rev != 9007199254740993 {
+		t.Fatalf("CompareAndSwap = %v, %d, %v", ok, rev, err)
+	}
+	want := `{"compare":[{"target":"MOD","key":"YS9i","result":"EQUAL","mod_revision":"7"}],"success":[{"request_put":{"key":"YS9i","value":"dg=="}}]}`
+	if got["/v3/kv/txn"] != want {
+		t.Errorf("Sent %s, want %s", got["/v3/kv/txn"], want)
+	}
+}
+
+func TestCompareAndDeleteFailed(t *testing.T) {
+	c, got := gateway(t, `{"header":{"revision":"3"}}`)
+	ok, err := c.CompareAndDelete(context.Background(), "a/b", 0)
+	if err != nil || ok {
+		t.Fatalf("CompareAndDelete = %v, %v, want false", ok, err)
+	}
+	want := `{"compare":[{"target":"CREATE","key":"YS9i","result":"EQUAL","create_revision":"0"}],"success":[{"request_delete_range":{"key":"YS9i"}}]}`
+	if got["/v3/kv/txn"] != want {
+		t.Errorf("Sent %s, want %s", got["/v3/kv/txn"], want)
+	}
+}
+
+func TestList(t *testing.T) {
+	c, got := gateway(t, `{"kvs":[{"key":"YS9i","value":"dg==","create_revision":"2","mod_revision":"5","lease":"8"}]}`)
+	kvs, err := c.List(context.Background(), "a/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 1 || string(kvs[0].Key) != "a/b" || string(kvs[0].Value) != "v" || kvs[0].CreateRevision != 2 || kvs[0].ModRevision != 5 || kvs[0].Lease != 8 {
+		t.Errorf("List = %+v", kvs)
+	}
+	// a/ up to a0.
+	if want := `{"key":"YS8=","range_end":"YTA="}`; got["/v3/kv/range"] != want {
+		t.Errorf("Sent %s, want %s", got["/v3/kv/range"], want)
+	}
+	if _, err := c.List(context.Background(), ""); err == nil {
+		t.Error("List of an empty prefix succeeded")
+	}
+}
+
+func TestKeepAliveExpired(t *testing.T) {
+	c, _ := gateway(t, `{"result":{"ID":"8"}}`)
+	if _, err := c.KeepAlive(context.Background(), 8); err != ErrLeaseExpired {
+		t.Errorf("KeepAlive = %v, want ErrLeaseExpired", err)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	up, _ := gateway(t, `{"ID":"5"}`)
+	c := New([]string{down.URL, up.endpoints[0]})
+	for i := 0; i < 2; i++ {
+		if id, err := c.Grant(context.Background(), 10*time.Second); err != nil || id != 5 {
+			t.Fatalf("Grant = %d, %v", id, err)
+		}
+	}
+	if c.current != 1 {
+		t.Errorf("Client went back to the endpoint that is down")
+	}
+}
@@ -0,0 +1,461 @@
+// Package hub routes messages to connected peers, on this instance or, through
+// a Relay, on others.
+package hub
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/hoyle1974/seven/internal/ws"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrNotConnected = ws.ErrNotConnected
+var ErrDuplicateUUID = errors.New("Uuid already connected")
+var ErrTenantFull = errors.New("Tenant has too many peers connected")
+
+// Conn is a client connection as the hub sees it.
+type Conn interface {
+	comparable
+	UUID() string
+	Tenant() string
+	// Device is set when several connections share a uuid.
+	Device() string
+	WritePrepared(p *ws.Prepared) error
+	// CloseWith asks the client to go away with a websocket close code.
+	CloseWith(code int, reason string) error
+	// Close drops the connection without waiting for the client.
+	Close() error
+}
+
+// Relay carries messages to peers connected to other Seven instances.
+type Relay interface {
+	// Publish hands msg to whichever node holds uuid, reporting whether any
+	// node was listening for it.
+	Publish(uuid string, msg ws.Message) (bool, error)
+	Subscribe(uuid string) error
+	Unsubscribe(uuid string) error
+}
+
+// Options tune a Hub. Any of the funcs may be nil.
+type Options struct {
+	// Duplicates is what to do when a connected uuid registers again:
+	// "replace", "reject" or "multi".
+	Duplicates string
+	// TenantLimit is the most uuids of tenant that may connect, 0 for no
+	// limit.
+	TenantLimit func(tenant string) int
+	// Park is offered every message for addr, a uuid or uuid/device, and
+	// reports whether it kept it for a session of addr waiting to resume.
+	Park func(addr string, msg ws.Message) bool
+	// Admit decides whether a message another instance relayed to addr may
+	// be delivered, as the sending instance may not know everything about
+	// the peers here, such as their rooms.
+	Admit func(addr string, msg ws.Message) bool
+	// OnTenantCount is called whenever the uuids connected for tenant change.
+	OnTenantCount func(tenant string, n int)
+	// Log is used on the relay path.
+	Log zerolog.Logger
+}
+
+// Hub tracks the live connection (and therefore websocket) of every
+// registered uuid so messages can be pushed to a specific peer. With a Relay
+// set, peers connected to other instances are reachable too.
+type Hub[C Conn] struct {
+	opts     Options
+	mu       sync.RWMutex
+	sessions map[string][]C
+	tenants  map[string]int // connected uuids per tenant
+	relay    Relay
+
+	// The relay is told about sessions outside mu, as that is network I/O.
+	relayMu    sync.Mutex
+	subscribed map[string]bool
+
+	// Every open session, registered or not, so they can all be drained.
+	open map[C]struct{}
+	wg   sync.WaitGroup
+}
+
+func New[C Conn](opts Options) *Hub[C] {
+	return &Hub[C]{
+		opts:       opts,
+		sessions:   make(map[string][]C),
+		tenants:    make(map[string]int),
+		open:       make(map[C]struct{}),
+		subscribed: make(map[string]bool),
+	}
+}
+
+// Open tracks a newly upgraded connection until Close is called for it.
+func (m *Hub[C]) Open(s C) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.open[s] = struct{}{}
+	m.wg.Add(1)
+}
+
+func (m *Hub[C]) Close(s C) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.open[s]; ok {
+		delete(m.open, s)
+		m.wg.Done()
+	}
+}
+
+// Drain sends a close frame to every open session and waits for their read
+// loops to finish, forcibly closing whatever is left when ctx expires.
+func (m *Hub[C]) Drain(ctx context.Context, code int, reason string) {
+	open := m.OpenSessions()
+	for _, s := range open {
+		if err := s.CloseWith(code, reason); err != nil {
+			log.Err(err).Msg("Error sending close frame")
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn().Int("sessions", len(open)).Msg("Drain timed out, closing remaining connections")
+		for _, s := range open {
+			s.Close()
+		}
+	}
+}
+
+// OpenCount is the number of open sessions, registered or not.
+func (m *Hub[C]) OpenCount() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.open)
+}
+
+// OpenSessions returns every open session, registered or not.
+func (m *Hub[C]) OpenSessions() []C {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	open := make([]C, 0, len(m.open))
+	for s := range m.open {
+		open = append(open, s)
+	}
+	return open
+}
+
+func (m *Hub[C]) SetRelay(r Relay) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.relay = r
+}
+
+func (m *Hub[C]) Relay() Relay {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.relay
+}
+
+// Add registers s for its uuid, applying Options.Duplicates when the uuid is
+// already connected: "replace" closes the older sessions with
+// CloseDuplicateUUID, "reject" refuses s with ErrDuplicateUUID and "multi"
+// keeps every device, replacing only one with the same device id. A uuid new
+// to this instance is refused with ErrTenantFull once its tenant has its
+// TenantLimit connected.
+func (m *Hub[C]) Add(s C) error {
+	m.mu.Lock()
+	current := m.sessions[s.UUID()]
+	if len(current) == 0 {
+		if max := m.tenantLimit(s.Tenant()); max > 0 && m.tenants[s.Tenant()] >= max {
+			m.mu.Unlock()
+			return ErrTenantFull
+		}
+		m.tenants[s.Tenant()]++
+		m.tenantCount(s.Tenant())
+	}
+	kept := []C{}
+	var displaced []C
+	for _, o := range current {
+		switch {
+		case o == s:
+		case m.opts.Duplicates == "reject":
+			m.mu.Unlock()
+			return ErrDuplicateUUID
+		case m.opts.Duplicates == "multi" && o.Device() != s.Device():
+			kept = append(kept, o)
+		default:
+			displaced = append(displaced, o)
+		}
+	}
+	m.sessions[s.UUID()] = append(kept, s)
+	m.mu.Unlock()
+
+	m.syncRelay(s.UUID())
+	if s.Device() != "" {
+		m.syncRelay(addrOf(s))
+	}
+	for _, o := range displaced {
+		if o.Device() != "" && o.Device() != s.Device() {
+			m.syncRelay(addrOf(o))
+		}
+	}
+
+	for _, o := range displaced {
+		log.Info().Str("uuid", s.UUID()).Msg("Closing session replaced by a new registration")
+		if err := o.CloseWith(ws.CloseDuplicateUUID, "duplicate uuid"); err != nil {
+			log.Err(err).Msg("Error sending close frame")
+		}
+	}
+	return nil
+}
+
+func (m *Hub[C]) tenantLimit(tenant string) int {
+	if m.opts.TenantLimit == nil {
+		return 0
+	}
+	return m.opts.TenantLimit(tenant)
+}
+
+func (m *Hub[C]) tenantCount(tenant string) {
+	if m.opts.OnTenantCount != nil {
+		m.opts.OnTenantCount(tenant, m.tenants[tenant])
+	}
+}
+
+// syncRelay subscribes to addr on the relay while sessions for it are
+// registered here, and unsubscribes once they are gone. It reads what
+// should be afresh, so concurrent calls settle on the latest state.
+func (m *Hub[C]) syncRelay(addr string) {
+	m.relayMu.Lock()
+	defer m.relayMu.Unlock()
+	relay := m.Relay()
+	if relay == nil {
+		return
+	}
+	want := len(m.targets(addr)) > 0
+	if want == m.subscribed[addr] {
+		return
+	}
+	if want {
+		if err := relay.Subscribe(addr); err != nil {
+			log.Err(err).Str("uuid", addr).Msg("Error subscribing to relay")
+			return
+		}
+		m.subscribed[addr] = true
+		return
+	}
+	if err := relay.Unsubscribe(addr); err != nil {
+		log.Err(err).Str("uuid", addr).Msg("Error unsubscribing from relay")
+	}
+	delete(m.subscribed, addr)
+}
+
+// Remove drops s if it is still registered for its uuid. It reports whether
+// that was the uuid's last session.
+func (m *Hub[C]) Remove(s C) bool {
+	_, last := m.RemoveSession(s)
+	return last
+}
+
+// RemoveSession drops s if it is still registered for its uuid, reporting
+// whether it was and whether it was the uuid's last session.
+func (m *Hub[C]) RemoveSession(s C) (removed bool, last bool) {
+	m.mu.Lock()
+	current := m.sessions[s.UUID()]
+	kept := make([]C, 0, len(current))
+	for _, o := range current {
+		if o != s {
+			kept = append(kept, o)
+		}
+	}
+	if len(kept) == len(current) {
+		m.mu.Unlock()
+		return false, false
+	}
+	if len(kept) > 0 {
+		m.sessions[s.UUID()] = kept
+	} else {
+		delete(m.sessions, s.UUID())
+		m.tenants[s.Tenant()]--
+		m.tenantCount(s.Tenant())
+	}
+	m.mu.Unlock()
+
+	if s.Device() != "" {
+		m.syncRelay(addrOf(s))
+	}
+	m.syncRelay(s.UUID())
+	return true, len(kept) == 0
+}
+
+// TenantCounts returns how many uuids of each tenant are connected here.
+func (m *Hub[C]) TenantCounts() map[string]int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	counts := make(map[string]int, len(m.tenants))
+	for tenant, n := range m.tenants {
+		if n > 0 {
+			counts[tenant] = n
+		}
+	}
+	return counts
+}
+
+// Owns reports whether s is registered for its uuid.
+func (m *Hub[C]) Owns(s C) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, o := range m.sessions[s.UUID()] {
+		if o == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup returns the session for addr, a uuid or uuid/device. A bare uuid
+// with several devices connected gives the oldest.
+func (m *Hub[C]) Lookup(addr string) (C, bool) {
+	targets := m.targets(addr)
+	if len(targets) == 0 {
+		var none C
+		return none, false
+	}
+	return targets[0], true
+}
+
+// Sessions returns every session registered for uuid.
+func (m *Hub[C]) Sessions(uuid string) []C {
+	return m.targets(uuid)
+}
+
+// targets are the sessions a message to addr goes to: all devices of a bare
+// uuid, or the one named by uuid/device.
+func (m *Hub[C]) targets(addr string) []C {
+	uuid, device := SplitDevice(addr)
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	targets := []C{}
+	for _, s := range m.sessions[uuid] {
+		if device == "" || s.Device() == device {
+			targets = append(targets, s)
+		}
+	}
+	return targets
+}
+
+// Count is the number of uuids registered.
+func (m *Hub[C]) Count() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.sessions)
+}
+
+// SessionCount is the number of registered sessions, counting every device
+// of a uuid.
+func (m *Hub[C]) SessionCount() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n := 0
+	for _, sessions := range m.sessions {
+		n += len(sessions)
+	}
+	return n
+}
+
+// Send writes msg to the sessions registered for addr, going through the relay
+// when none are connected here. Messages for a parked session wait for it to
+// resume. ErrNotConnected means nobody holds addr.
+func (m *Hub[C]) Send(addr string, msg ws.Message) error {
+	return m.SendPrepared(addr, ws.Prepare(msg))
+}
+
+// SendPrepared is Send for a message going to many peers, encoded once for
+// all the websockets it reaches. The devices of a bare uuid that are waiting
+// to resume get it too.
+func (m *Hub[C]) SendPrepared(addr string, p *ws.Prepared) error {
+	msg := p.Msg
+	parked := m.opts.Park != nil && m.opts.Park(addr, msg)
+	if targets := m.targets(addr); len(targets) > 0 {
+		if err := WriteAll(targets, p); err != nil && !parked {
+			return err
+		}
+		return nil
+	}
+	if parked {
+		return nil
+	}
+
+	m.mu.RLock()
+	relay := m.relay
+	m.mu.RUnlock()
+	if relay == nil {
+		return ErrNotConnected
+	}
+	delivered, err := relay.Publish(addr, msg)
+	if err != nil {
+		return err
+	}
+	if !delivered {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+// WriteAll writes p to every session, succeeding if any write did.
+func WriteAll[C Conn](sessions []C, p *ws.Prepared) error {
+	var err error
+	delivered := false
+	for _, s := range sessions {
+		if werr := s.WritePrepared(p); werr != nil {
+			err = werr
+		} else {
+			delivered = true
+		}
+	}
+	if delivered {
+		return nil
+	}
+	return err
+}
+
+// DeliverLocal is called by the relay for messages published to addr.
+func (m *Hub[C]) DeliverLocal(addr string, msg ws.Message) {
+	if m.opts.Admit != nil && !m.opts.Admit(addr, msg) {
+		m.opts.Log.Debug().Str("uuid", addr).Str("from", msg.From).Msg("Refusing relayed message")
+		return
+	}
+	parked := m.opts.Park != nil && m.opts.Park(addr, msg)
+	targets := m.targets(addr)
+	if len(targets) == 0 {
+		if parked {
+			return
+		}
+		m.opts.Log.Debug().Str("uuid", addr).Msg("Dropping relayed message for departed peer")
+		return
+	}
+	if err := WriteAll(targets, ws.Prepare(msg)); err != nil {
+		m.opts.Log.Err(err).Str("uuid", addr).Msg("Error writing relayed message")
+	}
+}
+
+// addrOf is how peers address c: its uuid, followed by /device for one of
+// several devices sharing the uuid.
+func addrOf[C Conn](c C) string {
+	if c.Device() == "" {
+		return c.UUID()
+	}
+	return c.UUID() + "/" + c.Device()
+}
+
+// SplitDevice splits a message destination into a uuid and optional device.
+func SplitDevice(addr string) (string, string) {
+	uuid, device, _ := strings.Cut(addr, "/")
+	return uuid, device
+}
@@ -0,0 +1,205 @@
+package hub
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hoyle1974/seven/internal/ws"
+)
+
+type testConn struct {
+	uuid, tenant, device string
+
+	mu     sync.Mutex
+	closed int // close code, 0 while open
+}
+
+func (c *testConn) UUID() string                       { return c.uuid }
+func (c *testConn) Tenant() string                     { return c.tenant }
+func (c *testConn) Device() string                     { return c.device }
+func (c *testConn) WritePrepared(p *ws.Prepared) error { return nil }
+func (c *testConn) Close() error                       { return nil }
+
+func (c *testConn) CloseWith(code int, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = code
+	return nil
+}
+
+func (c *testConn) closeCode() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// testRelay records the addresses subscribed to.
+type testRelay struct {
+	mu         sync.Mutex
+	subscribed map[string]bool
+}
+
+func (r *testRelay) Publish(uuid string, msg ws.Message) (bool, error) { return false, nil }
+
+func (r *testRelay) Subscribe(addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscribed[addr] = true
+	return nil
+}
+
+func (r *testRelay) Unsubscribe(addr string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.subscribed, addr)
+	return nil
+}
+
+func (r *testRelay) addrs() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var list []string
+	for addr := range r.subscribed {
+		list = append(list, addr)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ",")
+}
+
+func TestSplitDevice(t *testing.T) {
+	tests := []struct {
+		addr, uuid, device string
+	}{
+		{"a", "a", ""},
+		{"a/phone", "a", "phone"},
+		{"a/", "a", ""},
+		{"a/b/c", "a", "b/c"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		uuid, device := SplitDevice(tt.addr)
+		if uuid != tt.uuid || device != tt.device {
+			t.Errorf("SplitDevice(%q) = %q, %q, want %q, %q", tt.addr, uuid, device, tt.uuid, tt.device)
+		}
+	}
+}
+
+func TestHubAdd(t *testing.T) {
+	tests := []struct {
+		name       string
+		duplicates string
+		limit      int
+		conns      []string // uuid or uuid/device, added in order
+		wantErr    error    // of adding the last
+		live       string   // sessions of a, by device, oldest first
+		closed     []int    // indexes of conns closed as duplicates
+		subscribed string
+	}{
+		{"first", "replace", 0, []string{"a"}, nil, "-", nil, "a"},
+		{"replace", "replace", 0, []string{"a", "a"}, nil, "-", []int{0}, "a"},
+		{"reject", "reject", 0, []string{"a", "a"}, ErrDuplicateUUID, "-", nil, "a"},
+		{"multi keeps other devices", "multi", 0, []string{"a/phone", "a/laptop"}, nil, "phone,laptop", nil, "a,a/laptop,a/phone"},
+		{"multi replaces the same device", "multi", 0, []string{"a/phone", "a/laptop", "a/phone"}, nil, "laptop,phone", []int{0}, "a,a/laptop,a/phone"},
+		{"replace drops other devices", "replace", 0, []string{"a/phone", "a/laptop"}, nil, "laptop", []int{0}, "a,a/laptop"},
+		{"tenant full", "replace", 1, []string{"b", "a"}, ErrTenantFull, "", nil, "b"},
+		{"tenant limit counts uuids", "multi", 1, []string{"a/phone", "a/laptop"}, nil, "phone,laptop", nil, "a,a/laptop,a/phone"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			relay := &testRelay{subscribed: map[string]bool{}}
+			m := New[*testConn](Options{Duplicates: tt.duplicates, TenantLimit: func(string) int { return tt.limit }})
+			m.SetRelay(relay)
+			conns := make([]*testConn, len(tt.conns))
+			var err error
+			for i, addr := range tt.conns {
+				uuid, device := SplitDevice(addr)
+				conns[i] = &testConn{uuid: uuid, tenant: "t", device: device}
+				if err = m.Add(conns[i]); err != nil && i < len(conns)-1 {
+					t.Fatalf("Add(%s) = %v", addr, err)
+				}
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Adding the last = %v, want %v", err, tt.wantErr)
+			}
+			var devices []string
+			for _, s := range m.Sessions("a") {
+				device := s.device
+				if device == "" {
+					device = "-"
+				}
+				devices = append(devices, device)
+			}
+			if got := strings.Join(devices, ","); got != tt.live {
+				t.Errorf("Sessions of a = %q, want %q", got, tt.live)
+			}
+			closed := map[int]bool{}
+			for _, i := range tt.closed {
+				closed[i] = true
+			}
+			for i, c := range conns {
+				want := 0
+				if closed[i] {
+					want = ws.CloseDuplicateUUID
+				}
+				if got := c.closeCode(); got != want {
+					t.Errorf("Session %d (%s) closed with %d, want %d", i, tt.conns[i], got, want)
+				}
+			}
+			if got := relay.addrs(); got != tt.subscribed {
+				t.Errorf("Subscribed to %q, want %q", got, tt.subscribed)
+			}
+		})
+	}
+}
+
+func TestHubRemove(t *testing.T) {
+	relay := &testRelay{subscribed: map[string]bool{}}
+	var counts []int
+	m := New[*testConn](Options{Duplicates: "multi", OnTenantCount: func(tenant string, n int) { counts = append(counts, n) }})
+	m.SetRelay(relay)
+	phone := &testConn{uuid: "a", tenant: "t", device: "phone"}
+	laptop := &testConn{uuid: "a", tenant: "t", device: "laptop"}
+	stranger := &testConn{uuid: "a", tenant: "t", device: "phone"}
+	for _, c := range []*testConn{phone, laptop} {
+		if err := m.Add(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps := []struct {
+		name          string
+		conn          *testConn
+		removed, last bool
+		count         int
+		subscribed    string
+	}{
+		{"never added", stranger, false, false, 2, "a,a/laptop,a/phone"},
+		{"one of two", phone, true, false, 1, "a,a/laptop"},
+		{"again", phone, false, false, 1, "a,a/laptop"},
+		{"the last", laptop, true, true, 0, ""},
+	}
+	for _, s := range steps {
+		removed, last := m.RemoveSession(s.conn)
+		if removed != s.removed || last != s.last {
+			t.Errorf("%s: RemoveSession = %v, %v, want %v, %v", s.name, removed, last, s.removed, s.last)
+		}
+		if n := m.SessionCount(); n != s.count {
+			t.Errorf("%s: SessionCount = %d, want %d", s.name, n, s.count)
+		}
+		if got := relay.addrs(); got != s.subscribed {
+			t.Errorf("%s: subscribed to %q, want %q", s.name, got, s.subscribed)
+		}
+	}
+	if len(counts) != 2 || counts[0] != 1 || counts[1] != 0 {
+		t.Errorf("Tenant counts reported %v, want [1 0]", counts)
+	}
+	if c := m.TenantCounts(); len(c) != 0 {
+		t.Errorf("TenantCounts = %v, want none", c)
+	}
+	if _, ok := m.Lookup("a"); ok {
+		t.Error("Lookup found a removed uuid")
+	}
+}
@@ -0,0 +1,272 @@
+// Package mdns announces Seven servers on the local network with multicast
+// DNS service discovery (RFC 6762 and 6763) as _seven._tcp, and finds them.
+// It speaks just enough of the protocol for that: IPv4, PTR, SRV, TXT and A
+// records.
+package mdns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Service is the DNS-SD service type of Seven servers.
+const Service = "_seven._tcp.local."
+
+const (
+	recordTTL = 120
+	// cacheFlush marks records only this host answers for (RFC 6762 10.2);
+	// on questions the same bit asks for a unicast reply.
+	cacheFlush = 1 << 15
+)
+
+var group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// Record is one server.
+type Record struct {
+	Instance string // such as "Ann's laptop"
+	Host     string // such as "ann-laptop.local."
+	Port     int
+	IPs      []net.IP
+	TXT      []string // key=value pairs
+}
+
+// Value returns the TXT value for key.
+func (r Record) Value(key string) string {
+	for _, kv := range r.TXT {
+		if k, v, _ := strings.Cut(kv, "="); k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// instanceName is the DNS name of r. Dots in the instance would split its
+// label, so they become dashes.
+func (r Record) instanceName() string {
+	return strings.ReplaceAll(r.Instance, ".", "-") + "." + Service
+}
+
+// Local is a Record for this host: its short hostname as the instance,
+// hostname.local. as the host, and its IPv4 addresses other than loopback
+// and link-local ones.
+func Local(port int, txt ...string) (Record, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return Record{}, err
+	}
+	hostname, _, _ = strings.Cut(hostname, ".")
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return Record{}, err
+	}
+	r := Record{Instance: hostname, Host: hostname + ".local.", Port: port, TXT: txt}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil && !n.IP.IsLoopback() && !n.IP.IsLinkLocalUnicast() {
+			r.IPs = append(r.IPs, n.IP)
+		}
+	}
+	return r, nil
+}
+
+// Responder answers queries for a Record until closed.
+type Responder struct {
+	conn   *net.UDPConn
+	record Record
+}
+
+// Announce starts answering for r, and announces it twice, a second apart,
+// as RFC 6762 8.3 asks.
+func Announce(r Record) (*Responder, error) {
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return nil, err
+	}
+	s := &Responder{conn: conn, record: r}
+	go s.serve()
+	go func() {
+		for i := 0; i < 2; i++ {
+			if s.send(s.response(0, recordTTL), group) != nil {
+				return
+			}
+			time.Sleep(time.Second)
+		}
+	}()
+	return s, nil
+}
+
+// Close says goodbye, with a TTL of 0, and stops answering.
+func (s *Responder) Close() error {
+	s.send(s.response(0, 0), group)
+	return s.conn.Close()
+}
+
+func (s *Responder) send(msg dnsmessage.Message, to *net.UDPAddr) error {
+	b, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.WriteToUDP(b, to)
+	return err
+}
+
+func (s *Responder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		var msg dnsmessage.Message
+		if msg.Unpack(buf[:n]) != nil || msg.Header.Response {
+			continue
+		}
+		unicast := from.Port != group.Port
+		asked := false
+		for _, q := range msg.Questions {
+			if s.answers(q) {
+				asked = true
+				unicast = unicast || q.Class&cacheFlush != 0
+			}
+		}
+		if !asked {
+			continue
+		}
+		to := group
+		if unicast {
+			to = from
+		}
+		id := uint16(0)
+		if from.Port != group.Port {
+			id = msg.Header.ID // legacy unicast queries want their id back
+		}
+		s.send(s.response(id, recordTTL), to)
+	}
+}
+
+// answers reports whether q asks about s's record.
+func (s *Responder) answers(q dnsmessage.Question) bool {
+	name := strings.ToLower(q.Name.String())
+	switch {
+	case name == Service || name == "_services._dns-sd._udp.local.":
+		return q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL
+	case name == strings.ToLower(s.record.instanceName()):
+		return q.Type == dnsmessage.TypeSRV || q.Type == dnsmessage.TypeTXT || q.Type == dnsmessage.TypeALL
+	case name == strings.ToLower(s.record.Host):
+		return q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeALL
+	}
+	return false
+}
+
+// response has every record of s, whatever was asked: there are few.
+func (s *Responder) response(id uint16, ttl uint32) dnsmessage.Message {
+	r := s.record
+	instance := dnsmessage.MustNewName(r.instanceName())
+	host := dnsmessage.MustNewName(r.Host)
+	header := func(name dnsmessage.Name, typ dnsmessage.Type, class dnsmessage.Class) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: typ, Class: class, TTL: ttl}
+	}
+	unique := dnsmessage.ClassINET | cacheFlush
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, Response: true, Authoritative: true},
+		Answers: []dnsmessage.Resource{
+			{Header: header(dnsmessage.MustNewName(Service), dnsmessage.TypePTR, dnsmessage.ClassINET), Body: &dnsmessage.PTRResource{PTR: instance}},
+			{Header: header(dnsmessage.MustNewName("_services._dns-sd._udp.local."), dnsmessage.TypePTR, dnsmessage.ClassINET), Body: &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(Service)}},
+			{Header: header(instance, dnsmessage.TypeSRV, unique), Body: &dnsmessage.SRVResource{Port: uint16(r.Port), Target: host}},
+			{Header: header(instance, dnsmessage.TypeTXT, unique), Body: &dnsmessage.TXTResource{TXT: r.TXT}},
+		},
+	}
+	for _, ip := range r.IPs {
+		if ip4 := ip.To4(); ip4 != nil {
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: header(host, dnsmessage.TypeA, unique), Body: &dnsmessage.AResource{A: [4]byte(ip4)}})
+		}
+	}
+	if len(r.TXT) == 0 {
+		msg.Answers[3].Body = &dnsmessage.TXTResource{TXT: []string{""}}
+	}
+	return msg
+}
+
+// Browse asks the local network for Seven servers and returns those that
+// answer by the time ctx is done.
+func Browse(ctx context.Context) ([]Record, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	query := dnsmessage.Message{Questions: []dnsmessage.Question{
+		{Name: dnsmessage.MustNewName(Service), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET},
+	}}
+	b, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(b, group); err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Second)
+	}
+	conn.SetReadDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	found := map[string]*Record{}
+	var order []string
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				break
+			}
+			return nil, err
+		}
+		var msg dnsmessage.Message
+		if msg.Unpack(buf[:n]) != nil || !msg.Header.Response {
+			continue
+		}
+		hosts := map[string][]net.IP{}
+		for _, rr := range append(msg.Answers, msg.Additionals...) {
+			if a, ok := rr.Body.(*dnsmessage.AResource); ok {
+				host := strings.ToLower(rr.Header.Name.String())
+				hosts[host] = append(hosts[host], net.IP(a.A[:]))
+			}
+		}
+		for _, rr := range append(msg.Answers, msg.Additionals...) {
+			name := rr.Header.Name.String()
+			if !strings.HasSuffix(strings.ToLower(name), "."+Service) {
+				continue
+			}
+			rec, ok := found[name]
+			if !ok {
+				rec = &Record{Instance: strings.TrimSuffix(name, "."+Service)}
+				found[name] = rec
+				order = append(order, name)
+			}
+			switch body := rr.Body.(type) {
+			case *dnsmessage.SRVResource:
+				rec.Host, rec.Port = body.Target.String(), int(body.Port)
+				rec.IPs = hosts[strings.ToLower(rec.Host)]
+			case *dnsmessage.TXTResource:
+				rec.TXT = body.TXT
+			}
+		}
+	}
+
+	records := []Record{}
+	for _, name := range order {
+		if rec := found[name]; rec.Port != 0 {
+			records = append(records, *rec)
+		}
+	}
+	return records, nil
+}
@@ -0,0 +1,252 @@
+package registry
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltEntriesBucket = []byte("entries")
+	// boltSeenBucket indexes entries by when they were last seen, its keys
+	// being LastSeen in big endian nanoseconds followed by the uuid, so the
+	// least recently seen comes first.
+	boltSeenBucket = []byte("entries_seen")
+	boltMetaBucket = []byte("entries_meta")
+	boltCountKey   = []byte("count")
+)
+
+// Bolt persists registrations in a local bolt database so they survive a
+// restart. Entries past the ttl are dropped on load and whenever the registry
+// is listed.
+type Bolt struct {
+	DB      *bolt.DB
+	size    int
+	ttl     time.Duration
+	dropped DropFunc
+}
+
+// NewBolt opens the database at path, creating buckets along with its own for
+// other stores sharing it.
+func NewBolt(path string, size int, ttl time.Duration, dropped DropFunc, buckets ...[]byte) (*Bolt, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Error opening bolt database %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range append([][]byte{boltEntriesBucket, boltMetaBucket}, buckets...) {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return reindex(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	r := &Bolt{DB: db, size: size, ttl: ttl, dropped: dropped}
+	entries, err := r.Values(context.Background())
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	log.Info().Int("entries", len(entries)).Str("path", path).Msg("Loaded registry")
+	return r, nil
+}
+
+// reindex rebuilds the last seen index and the count of entries, which
+// databases written before they existed lack.
+func reindex(tx *bolt.Tx) error {
+	if tx.Bucket(boltSeenBucket) != nil {
+		if err := tx.DeleteBucket(boltSeenBucket); err != nil {
+			return err
+		}
+	}
+	seen, err := tx.CreateBucket(boltSeenBucket)
+	if err != nil {
+		return err
+	}
+	n := 0
+	err = tx.Bucket(boltEntriesBucket).ForEach(func(k, v []byte) error {
+		n++
+		e, err := decodeEntry(v)
+		if err != nil {
+			return nil
+		}
+		return seen.Put(seenKey(e), nil)
+	})
+	if err != nil {
+		return err
+	}
+	return setCount(tx, n)
+}
+
+func seenKey(e Entry) []byte {
+	key := make([]byte, 8, 8+36)
+	binary.BigEndian.PutUint64(key, uint64(e.LastSeen.UnixNano()))
+	return append(key, e.UUID.String()...)
+}
+
+func count(tx *bolt.Tx) int {
+	b := tx.Bucket(boltMetaBucket).Get(boltCountKey)
+	if len(b) != 8 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint64(b))
+}
+
+func setCount(tx *bolt.Tx, n int) error {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(n))
+	return tx.Bucket(boltMetaBucket).Put(boltCountKey, b)
+}
+
+// remove deletes the entry stored under k, along with its index key.
+func remove(tx *bolt.Tx, k []byte) (bool, error) {
+	entries := tx.Bucket(boltEntriesBucket)
+	v := entries.Get(k)
+	if v == nil {
+		return false, nil
+	}
+	if e, err := decodeEntry(v); err == nil {
+		if err := tx.Bucket(boltSeenBucket).Delete(seenKey(e)); err != nil {
+			return false, err
+		}
+	}
+	if err := entries.Delete(k); err != nil {
+		return false, err
+	}
+	return true, setCount(tx, count(tx)-1)
+}
+
+func (r *Bolt) expired(e Entry, now time.Time) bool {
+	return r.ttl > 0 && now.Sub(e.LastSeen) > r.ttl
+}
+
+func (r *Bolt) Add(ctx context.Context, e Entry) error {
+	b, err := encodeEntry(e)
+	if err != nil {
+		return err
+	}
+	var trimmed []string
+	err = r.DB.Update(func(tx *bolt.Tx) error {
+		key := []byte(e.UUID.String())
+		existed, err := remove(tx, key)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltEntriesBucket).Put(key, b); err != nil {
+			return err
+		}
+		if err := tx.Bucket(boltSeenBucket).Put(seenKey(e), nil); err != nil {
+			return err
+		}
+		n := count(tx) + 1
+		if err := setCount(tx, n); err != nil {
+			return err
+		}
+		if existed {
+			return nil
+		}
+
+		// The least recently seen go first; index keys whose entry is gone
+		// are dropped along the way.
+		seen := tx.Bucket(boltSeenBucket)
+		for n > r.size {
+			k, _ := seen.Cursor().First()
+			if k == nil {
+				return nil
+			}
+			id := string(k[8:])
+			if err := seen.Delete(k); err != nil {
+				return err
+			}
+			removed, err := remove(tx, []byte(id))
+			if err != nil {
+				return err
+			}
+			if removed {
+				trimmed = append(trimmed, id)
+				n--
+			}
+		}
+		return nil
+	})
+	if err == nil && len(trimmed) > 0 {
+		r.dropped("size", trimmed...)
+	}
+	return err
+}
+
+func (r *Bolt) Get(ctx context.Context, id string) (Entry, bool, error) {
+	var e Entry
+	var ok bool
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltEntriesBucket).Get([]byte(id))
+		if b == nil {
+			return nil
+		}
+		var err error
+		e, err = decodeEntry(b)
+		ok = err == nil && !r.expired(e, time.Now())
+		return err
+	})
+	return e, ok, err
+}
+
+func (r *Bolt) Remove(ctx context.Context, id string) (bool, error) {
+	var found bool
+	err := r.DB.Update(func(tx *bolt.Tx) error {
+		var err error
+		found, err = remove(tx, []byte(id))
+		return err
+	})
+	return found, err
+}
+
+func (r *Bolt) Values(ctx context.Context) ([]Entry, error) {
+	entries := []Entry{}
+	now := time.Now()
+	var stale []string
+	err := r.DB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltEntriesBucket)
+		err := bucket.ForEach(func(k, v []byte) error {
+			e, err := decodeEntry(v)
+			if err == nil && !r.expired(e, now) {
+				entries = append(entries, e)
+			} else {
+				stale = append(stale, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Deleting through a cursor while iterating skips keys.
+		for _, k := range stale {
+			if _, err := remove(tx, []byte(k)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		r.dropped("ttl", stale...)
+	}
+	return entries, err
+}
+
+func (r *Bolt) Len(ctx context.Context) (int, error) {
+	var n int
+	err := r.DB.View(func(tx *bolt.Tx) error {
+		n = count(tx)
+		return nil
+	})
+	return n, err
+}
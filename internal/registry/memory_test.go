@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMemoryDrops(t *testing.T) {
+	type step struct {
+		op   string // add, get or remove
+		peer string
+	}
+	tests := []struct {
+		name  string
+		size  int
+		ttl   time.Duration
+		steps []step
+		wait  time.Duration
+		want  []string // reason:peer, in order
+		left  int
+	}{
+		{"full drops least recently added", 2, 0, []step{{"add", "a"}, {"add", "b"}, {"add", "c"}}, 0, []string{"size:a"}, 2},
+		{"get does not refresh", 2, 0, []step{{"add", "a"}, {"add", "b"}, {"get", "a"}, {"add", "c"}}, 0, []string{"size:a"}, 2},
+		{"adding again refreshes", 2, 0, []step{{"add", "a"}, {"add", "b"}, {"add", "a"}, {"add", "c"}}, 0, []string{"size:b"}, 2},
+		{"remove is not a drop", 2, 0, []step{{"add", "a"}, {"remove", "a"}}, 0, nil, 0},
+		{"remove frees a slot", 2, 0, []step{{"add", "a"}, {"add", "b"}, {"remove", "a"}, {"add", "c"}}, 0, nil, 2},
+		{"full with a ttl is still size", 1, time.Hour, []step{{"add", "a"}, {"add", "b"}}, 0, []string{"size:a"}, 1},
+		{"expired", 10, 50 * time.Millisecond, []step{{"add", "a"}}, 300 * time.Millisecond, []string{"ttl:a"}, 0},
+		{"no ttl never expires", 10, 0, []step{{"add", "a"}}, 100 * time.Millisecond, nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids := map[string]uuid.UUID{}
+			names := map[string]string{}
+			idOf := func(peer string) uuid.UUID {
+				if _, ok := ids[peer]; !ok {
+					ids[peer] = uuid.New()
+					names[ids[peer].String()] = peer
+				}
+				return ids[peer]
+			}
+			var mu sync.Mutex
+			var got []string
+			r := NewMemory(tt.size, tt.ttl, func(reason string, drops ...string) {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, id := range drops {
+					got = append(got, reason+":"+names[id])
+				}
+			})
+			ctx := context.Background()
+			for _, s := range tt.steps {
+				id := idOf(s.peer)
+				switch s.op {
+				case "add":
+					r.Add(ctx, Entry{UUID: id, LastSeen: time.Now()})
+				case "get":
+					if _, ok, _ := r.Get(ctx, id.String()); !ok {
+						t.Fatalf("Get(%s) found nothing", s.peer)
+					}
+				case "remove":
+					if ok, _ := r.Remove(ctx, id.String()); !ok {
+						t.Fatalf("Remove(%s) removed nothing", s.peer)
+					}
+				}
+			}
+			time.Sleep(tt.wait)
+			mu.Lock()
+			defer mu.Unlock()
+			if len(got) != len(tt.want) {
+				t.Fatalf("Dropped %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("Dropped %v, want %v", got, tt.want)
+				}
+			}
+			if n, _ := r.Len(ctx); n != tt.left {
+				t.Errorf("Len = %d, want %d", n, tt.left)
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+CREATE TABLE entries (
+	uuid      uuid PRIMARY KEY,
+	addr      text NOT NULL,
+	tags      jsonb NOT NULL DEFAULT '{}',
+	ip        text NOT NULL DEFAULT '',
+	continent text,
+	country   text,
+	last_seen timestamptz NOT NULL
+);
+
+CREATE INDEX entries_last_seen_idx ON entries (last_seen);
+CREATE INDEX entries_tags_idx ON entries USING gin (tags);
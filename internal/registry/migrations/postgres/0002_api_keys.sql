@@ -0,0 +1,8 @@
+CREATE TABLE api_keys (
+	id                  text PRIMARY KEY,
+	name                text NOT NULL,
+	hash                text NOT NULL UNIQUE,
+	requests_per_minute integer NOT NULL DEFAULT 0,
+	max_connections     integer NOT NULL DEFAULT 0,
+	created_at          timestamptz NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE entries ADD COLUMN addrs jsonb NOT NULL DEFAULT '[]';
@@ -0,0 +1,4 @@
+ALTER TABLE entries ADD COLUMN tenant text NOT NULL DEFAULT '';
+ALTER TABLE api_keys ADD COLUMN tenant text NOT NULL DEFAULT '';
+
+CREATE INDEX entries_tenant_idx ON entries (tenant);
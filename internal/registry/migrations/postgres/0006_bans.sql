@@ -0,0 +1,7 @@
+CREATE TABLE bans (
+	target     text PRIMARY KEY,
+	reason     text NOT NULL DEFAULT '',
+	auto       boolean NOT NULL DEFAULT false,
+	created_at timestamptz NOT NULL,
+	expires_at timestamptz
+);
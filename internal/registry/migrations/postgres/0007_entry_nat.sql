@@ -0,0 +1 @@
+ALTER TABLE entries ADD COLUMN nat text NOT NULL DEFAULT '';
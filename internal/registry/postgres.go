@@ -0,0 +1,238 @@
+package registry
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+)
+
+//go:embed migrations/postgres/*.sql
+var postgresMigrations embed.FS
+
+// Postgres keeps peers in an entries table shared by every instance
+// pointed at the same database. Like the other backends it is capped at size
+// rows, trimming the least recently seen.
+type Postgres struct {
+	Pool    *pgxpool.Pool
+	size    int
+	ttl     time.Duration
+	dropped DropFunc
+}
+
+func NewPostgres(url string, size int, ttl time.Duration, dropped DropFunc) (*Postgres, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to postgres: %w", err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("Error connecting to postgres: %w", err)
+	}
+	if err := migratePostgres(ctx, pool); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("Error migrating postgres: %w", err)
+	}
+	return &Postgres{Pool: pool, size: size, ttl: ttl, dropped: dropped}, nil
+}
+
+// migratePostgres applies the embedded migrations in file name order, each
+// in its own transaction. The advisory lock keeps instances starting at the
+// same time from racing each other.
+func migratePostgres(ctx context.Context, pool *pgxpool.Pool) error {
+	_, err := pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    text PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return err
+	}
+
+	files, err := fs.Glob(postgresMigrations, "migrations/postgres/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		sql, err := postgresMigrations.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		err = pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(7777777)`); err != nil {
+				return err
+			}
+			var applied bool
+			err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, file).Scan(&applied)
+			if err != nil || applied {
+				return err
+			}
+			if _, err := tx.Exec(ctx, string(sql)); err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, file)
+			if err == nil {
+				log.Info().Str("migration", file).Msg("Applied migration")
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+func (r *Postgres) Add(ctx context.Context, e Entry) error {
+	var continent, country *string
+	if e.Location != nil {
+		continent, country = &e.Location.Continent, &e.Location.Country
+	}
+	tags := e.Tags
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	addrs := e.Addrs
+	if addrs == nil {
+		addrs = []Address{}
+	}
+	var metadata *string
+	if e.Metadata != nil {
+		s := string(e.Metadata)
+		metadata = &s
+	}
+	_, err := r.Pool.Exec(ctx, `
+		INSERT INTO entries (uuid, tenant, addr, addrs, tags, metadata, ip, continent, country, last_seen, nat)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (uuid) DO UPDATE SET
+			tenant = EXCLUDED.tenant, addr = EXCLUDED.addr, addrs = EXCLUDED.addrs, tags = EXCLUDED.tags, metadata = EXCLUDED.metadata,
+			ip = EXCLUDED.ip, continent = EXCLUDED.continent, country = EXCLUDED.country,
+			last_seen = EXCLUDED.last_seen, nat = EXCLUDED.nat`,
+		e.UUID, e.Tenant, e.Address, addrs, tags, metadata, e.IP, continent, country, e.LastSeen, e.NAT)
+	if err != nil {
+		return err
+	}
+
+	rows, err := r.Pool.Query(ctx, `
+		DELETE FROM entries WHERE uuid IN (
+			SELECT uuid FROM entries ORDER BY last_seen DESC OFFSET $1
+		) RETURNING uuid::text`, r.size)
+	if err != nil {
+		return err
+	}
+	trimmed, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	r.dropped("size", trimmed...)
+	return nil
+}
+
+const postgresEntryColumns = `uuid, tenant, addr, addrs, tags, metadata::text, ip, continent, country, last_seen, nat`
+
+func scanPostgresEntry(row pgx.Row) (Entry, error) {
+	var e Entry
+	var continent, country, metadata *string
+	err := row.Scan(&e.UUID, &e.Tenant, &e.Address, &e.Addrs, &e.Tags, &metadata, &e.IP, &continent, &country, &e.LastSeen, &e.NAT)
+	if err != nil {
+		return Entry{}, err
+	}
+	if metadata != nil {
+		e.Metadata = json.RawMessage(*metadata)
+	}
+	if len(e.Tags) == 0 {
+		e.Tags = nil
+	}
+	if len(e.Addrs) == 0 {
+		e.Addrs = nil
+	}
+	if continent != nil || country != nil {
+		e.Location = &Location{}
+		if continent != nil {
+			e.Location.Continent = *continent
+		}
+		if country != nil {
+			e.Location.Country = *country
+		}
+	}
+	return e, nil
+}
+
+// cutoff is the oldest last_seen still within the ttl.
+func (r *Postgres) cutoff() time.Time {
+	if r.ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(-r.ttl)
+}
+
+func (r *Postgres) Get(ctx context.Context, id string) (Entry, bool, error) {
+	u, err := uuid.Parse(id)
+	if err != nil {
+		return Entry{}, false, nil
+	}
+	row := r.Pool.QueryRow(ctx, `SELECT `+postgresEntryColumns+` FROM entries WHERE uuid = $1 AND last_seen >= $2`, u, r.cutoff())
+	e, err := scanPostgresEntry(row)
+	if err == pgx.ErrNoRows {
+		return Entry{}, false, nil
+	}
+	return e, err == nil, err
+}
+
+func (r *Postgres) Remove(ctx context.Context, id string) (bool, error) {
+	u, err := uuid.Parse(id)
+	if err != nil {
+		return false, nil
+	}
+	tag, err := r.Pool.Exec(ctx, `DELETE FROM entries WHERE uuid = $1`, u)
+	return tag.RowsAffected() > 0, err
+}
+
+func (r *Postgres) Values(ctx context.Context) ([]Entry, error) {
+	if r.ttl > 0 {
+		rows, err := r.Pool.Query(ctx, `DELETE FROM entries WHERE last_seen < $1 RETURNING uuid::text`, r.cutoff())
+		if err != nil {
+			return []Entry{}, err
+		}
+		expired, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return []Entry{}, err
+		}
+		r.dropped("ttl", expired...)
+	}
+
+	rows, err := r.Pool.Query(ctx, `SELECT `+postgresEntryColumns+` FROM entries`)
+	if err != nil {
+		return []Entry{}, err
+	}
+	defer rows.Close()
+	entries := []Entry{}
+	for rows.Next() {
+		e, err := scanPostgresEntry(rows)
+		if err != nil {
+			return []Entry{}, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (r *Postgres) Len(ctx context.Context) (int, error) {
+	var n int
+	err := r.Pool.QueryRow(ctx, `SELECT count(*) FROM entries WHERE last_seen >= $1`, r.cutoff()).Scan(&n)
+	return n, err
+}
+
+func (r *Postgres) Ping(ctx context.Context) error {
+	return r.Pool.Ping(ctx)
+}
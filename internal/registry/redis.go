@@ -0,0 +1,145 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisEntryPrefix = "seven:entry:"
+	redisIndexKey    = "seven:entries"
+)
+
+// Redis shares peer state between Seven instances. Each entry is a
+// key that expires with the registry ttl, and a sorted set ordered by
+// lastSeen caps the registry at size entries the way the LRU does.
+type Redis struct {
+	Client  *redis.Client
+	size    int
+	ttl     time.Duration
+	dropped DropFunc
+}
+
+func NewRedis(addr string, size int, ttl time.Duration, dropped DropFunc) (*Redis, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		return nil, fmt.Errorf("Error connecting to redis at %s: %w", addr, err)
+	}
+	return &Redis{Client: client, size: size, ttl: ttl, dropped: dropped}, nil
+}
+
+func (r *Redis) Add(ctx context.Context, e Entry) error {
+	id := e.UUID.String()
+	b, err := encodeEntry(e)
+	if err != nil {
+		return err
+	}
+
+	pipe := r.Client.TxPipeline()
+	pipe.Set(ctx, redisEntryPrefix+id, b, r.ttl)
+	pipe.ZAdd(ctx, redisIndexKey, redis.Z{Score: float64(e.LastSeen.UnixNano()), Member: id})
+	card := pipe.ZCard(ctx, redisIndexKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	if over := card.Val() - int64(r.size); over > 0 {
+		oldest, err := r.Client.ZPopMin(ctx, redisIndexKey, over).Result()
+		if err != nil {
+			return err
+		}
+		trimmed := make([]string, len(oldest))
+		for i, z := range oldest {
+			trimmed[i] = z.Member.(string)
+			r.Client.Del(ctx, redisEntryPrefix+trimmed[i])
+		}
+		r.dropped("size", trimmed...)
+	}
+	return nil
+}
+
+func (r *Redis) Get(ctx context.Context, id string) (Entry, bool, error) {
+	b, err := r.Client.Get(ctx, redisEntryPrefix+id).Bytes()
+	if err == redis.Nil {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, err
+	}
+	e, err := decodeEntry(b)
+	return e, err == nil, err
+}
+
+func (r *Redis) Remove(ctx context.Context, id string) (bool, error) {
+	pipe := r.Client.TxPipeline()
+	del := pipe.Del(ctx, redisEntryPrefix+id)
+	pipe.ZRem(ctx, redisIndexKey, id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return del.Val() > 0, nil
+}
+
+func (r *Redis) Values(ctx context.Context) ([]Entry, error) {
+	if r.ttl > 0 {
+		cutoff := strconv.FormatInt(time.Now().Add(-r.ttl).UnixNano(), 10)
+		stale, err := r.Client.ZRangeByScore(ctx, redisIndexKey, &redis.ZRangeBy{Min: "-inf", Max: cutoff}).Result()
+		if err == nil && len(stale) > 0 {
+			// Only report the ones this call removed; another instance may
+			// be sweeping too.
+			pipe := r.Client.Pipeline()
+			removed := make([]*redis.IntCmd, len(stale))
+			for i, id := range stale {
+				removed[i] = pipe.ZRem(ctx, redisIndexKey, id)
+			}
+			pipe.Exec(ctx)
+			expired := make([]string, 0, len(stale))
+			for i, id := range stale {
+				if removed[i].Val() > 0 {
+					expired = append(expired, id)
+				}
+			}
+			r.dropped("ttl", expired...)
+		}
+	}
+
+	ids, err := r.Client.ZRange(ctx, redisIndexKey, 0, -1).Result()
+	if err != nil || len(ids) == 0 {
+		return []Entry{}, err
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = redisEntryPrefix + id
+	}
+	values, err := r.Client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return []Entry{}, err
+	}
+
+	entries := make([]Entry, 0, len(values))
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		if e, err := decodeEntry([]byte(s)); err == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (r *Redis) Len(ctx context.Context) (int, error) {
+	n, err := r.Client.ZCard(ctx, redisIndexKey).Result()
+	return int(n), err
+}
+
+func (r *Redis) Ping(ctx context.Context) error {
+	return r.Client.Ping(ctx).Err()
+}
@@ -0,0 +1,162 @@
+// Package registry stores the peers registered with Seven so they can be
+// handed out to each other. Memory keeps them in this process; Redis,
+// Postgres and Bolt share or persist them.
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/golang-lru/v2/expirable"
+	"github.com/rs/zerolog/log"
+)
+
+// Registry stores the registered peers handed out to other clients.
+type Registry interface {
+	Add(ctx context.Context, e Entry) error
+	Get(ctx context.Context, uuid string) (Entry, bool, error)
+	Remove(ctx context.Context, uuid string) (bool, error)
+	Values(ctx context.Context) ([]Entry, error)
+	Len(ctx context.Context) (int, error)
+}
+
+// Entry is a registered peer.
+type Entry struct {
+	UUID     uuid.UUID
+	Tenant   string
+	Address  string
+	Addrs    []Address
+	Tags     map[string]string
+	Metadata json.RawMessage
+	IP       string
+	Location *Location
+	LastSeen time.Time
+	// NAT is how the peer's NAT maps its addresses, if it was probed:
+	// NATEndpointIndependent or NATEndpointDependent.
+	NAT string
+}
+
+// NAT mapping behaviors (RFC 4787). Peers behind endpoint dependent
+// ("symmetric") NATs can rarely connect to each other directly.
+const (
+	NATEndpointIndependent = "endpoint_independent"
+	NATEndpointDependent   = "endpoint_dependent"
+)
+
+// Address is one of several ways to reach a peer, such as its LAN
+// address next to its public one. Clients try them highest priority first.
+type Address struct {
+	Addr      string `json:"addr"`
+	Kind      string `json:"kind,omitempty"`      // lan, wan, ipv6 or relay
+	Transport string `json:"transport,omitempty"` // udp or tcp
+	Priority  int    `json:"priority,omitempty"`
+}
+
+// Location is where a peer's observed IP is according to the GeoIP database.
+type Location struct {
+	Continent string `json:"continent,omitempty"`
+	Country   string `json:"country,omitempty"`
+}
+
+// DropFunc is told about entries a backend dropped by itself, because the
+// registry was full ("size") or they were not refreshed in time ("ttl").
+// Backends may call it while holding locks of their own.
+type DropFunc func(reason string, ids ...string)
+
+// Memory is the default, single instance, registry backed by an LRU.
+type Memory struct {
+	cache *expirable.LRU[string, Entry]
+
+	// The LRU calls back for explicit removals too; removing lets the
+	// callback tell those apart from size and ttl evictions.
+	removeMu sync.Mutex
+	removing atomic.Pointer[string]
+}
+
+// NewMemory holds up to size entries, dropping those not added again within
+// ttl. A ttl of zero disables expiry.
+func NewMemory(size int, ttl time.Duration, dropped DropFunc) *Memory {
+	r := &Memory{}
+	r.cache = expirable.NewLRU[string, Entry](size, func(key string, value Entry) {
+		log.Debug().Str("uuid", key).Time("lastSeen", value.LastSeen).Msg("Registry entry removed")
+		if removing := r.removing.Load(); removing == nil || *removing != key {
+			reason := "size"
+			if ttl > 0 && time.Since(value.LastSeen) >= ttl {
+				reason = "ttl"
+			}
+			dropped(reason, key)
+		}
+	}, ttl)
+	return r
+}
+
+func (r *Memory) Add(ctx context.Context, e Entry) error {
+	r.cache.Add(e.UUID.String(), e)
+	return nil
+}
+
+func (r *Memory) Get(ctx context.Context, uuid string) (Entry, bool, error) {
+	e, ok := r.cache.Peek(uuid)
+	return e, ok, nil
+}
+
+func (r *Memory) Remove(ctx context.Context, uuid string) (bool, error) {
+	r.removeMu.Lock()
+	defer r.removeMu.Unlock()
+	r.removing.Store(&uuid)
+	defer r.removing.Store(nil)
+	return r.cache.Remove(uuid), nil
+}
+
+func (r *Memory) Values(ctx context.Context) ([]Entry, error) {
+	return r.cache.Values(), nil
+}
+
+func (r *Memory) Len(ctx context.Context) (int, error) {
+	return r.cache.Len(), nil
+}
+
+// storedEntry is how the shared and persistent backends serialize an Entry.
+type storedEntry struct {
+	Uuid     string            `json:"uuid"`
+	Tenant   string            `json:"tenant,omitempty"`
+	Address  string            `json:"addr"`
+	Addrs    []Address         `json:"addrs,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Metadata json.RawMessage   `json:"metadata,omitempty"`
+	IP       string            `json:"ip,omitempty"`
+	Location *Location         `json:"location,omitempty"`
+	LastSeen time.Time         `json:"lastSeen"`
+	NAT      string            `json:"nat,omitempty"`
+}
+
+func encodeEntry(e Entry) ([]byte, error) {
+	return json.Marshal(storedEntry{
+		Uuid:     e.UUID.String(),
+		Tenant:   e.Tenant,
+		Address:  e.Address,
+		Addrs:    e.Addrs,
+		Tags:     e.Tags,
+		Metadata: e.Metadata,
+		IP:       e.IP,
+		Location: e.Location,
+		LastSeen: e.LastSeen,
+		NAT:      e.NAT,
+	})
+}
+
+func decodeEntry(b []byte) (Entry, error) {
+	var stored storedEntry
+	if err := json.Unmarshal(b, &stored); err != nil {
+		return Entry{}, err
+	}
+	id, err := uuid.Parse(stored.Uuid)
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{UUID: id, Tenant: stored.Tenant, Address: stored.Address, Addrs: stored.Addrs, Tags: stored.Tags, Metadata: stored.Metadata, IP: stored.IP, Location: stored.Location, LastSeen: stored.LastSeen, NAT: stored.NAT}, nil
+}
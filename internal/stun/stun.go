@@ -0,0 +1,150 @@
+// Package stun encodes and decodes the STUN (RFC 5389) Binding requests and
+// responses of Seven's NAT probes. Other methods and attributes are ignored.
+package stun
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+const (
+	magicCookie = 0x2112A442
+	headerSize  = 20
+
+	TypeBindingRequest  uint16 = 0x0001
+	TypeBindingResponse uint16 = 0x0101
+
+	attrMappedAddress    = 0x0001
+	attrUsername         = 0x0006
+	attrXORMappedAddress = 0x0020
+)
+
+var ErrNotSTUN = errors.New("Not a STUN message")
+
+// Message is a Binding request or response.
+type Message struct {
+	Type        uint16
+	Transaction [12]byte
+	Username    string         // a probe token, on requests
+	Mapped      netip.AddrPort // the client's address as the server saw it, on responses
+}
+
+// NewRequest returns a Binding request with a random transaction id.
+func NewRequest(username string) Message {
+	m := Message{Type: TypeBindingRequest, Username: username}
+	rand.Read(m.Transaction[:])
+	return m
+}
+
+// Response returns the response to req telling the client it came from
+// mapped.
+func Response(req Message, mapped netip.AddrPort) Message {
+	return Message{Type: TypeBindingResponse, Transaction: req.Transaction, Mapped: mapped}
+}
+
+// Encode returns m in wire format.
+func (m Message) Encode() []byte {
+	b := make([]byte, headerSize)
+	binary.BigEndian.PutUint16(b[0:], m.Type)
+	binary.BigEndian.PutUint32(b[4:], magicCookie)
+	copy(b[8:], m.Transaction[:])
+	if m.Username != "" {
+		b = appendAttr(b, attrUsername, []byte(m.Username))
+	}
+	if m.Mapped.IsValid() {
+		b = appendAttr(b, attrXORMappedAddress, m.xorAddress(m.Mapped))
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)-headerSize))
+	return b
+}
+
+func appendAttr(b []byte, typ uint16, value []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// xorAddress returns the XOR-MAPPED-ADDRESS value of addr.
+func (m Message) xorAddress(addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	v := []byte{0, 1, 0, 0}
+	if ip.Is6() {
+		v[1] = 2
+	}
+	binary.BigEndian.PutUint16(v[2:], addr.Port())
+	return m.xorValue(append(v, ip.AsSlice()...))
+}
+
+// Decode parses a Binding message.
+func Decode(b []byte) (Message, error) {
+	var m Message
+	if len(b) < headerSize || b[0]&0xc0 != 0 || binary.BigEndian.Uint32(b[4:]) != magicCookie {
+		return m, ErrNotSTUN
+	}
+	m.Type = binary.BigEndian.Uint16(b[0:])
+	copy(m.Transaction[:], b[8:20])
+	length := int(binary.BigEndian.Uint16(b[2:]))
+	if length%4 != 0 || headerSize+length > len(b) {
+		return m, ErrNotSTUN
+	}
+	attrs := b[headerSize : headerSize+length]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:])
+		n := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+n > len(attrs) {
+			return m, ErrNotSTUN
+		}
+		value := attrs[4 : 4+n]
+		switch typ {
+		case attrUsername:
+			m.Username = string(value)
+		case attrXORMappedAddress:
+			m.Mapped = m.decodeAddress(m.xorValue(value))
+		case attrMappedAddress:
+			if !m.Mapped.IsValid() {
+				m.Mapped = m.decodeAddress(value)
+			}
+		}
+		attrs = attrs[min(len(attrs), 4+(n+3)&^3):]
+	}
+	return m, nil
+}
+
+// xorValue XORs the port and address of a MAPPED-ADDRESS value with the
+// magic cookie and transaction id, which both encodes and decodes an
+// XOR-MAPPED-ADDRESS.
+func (m Message) xorValue(v []byte) []byte {
+	if len(v) < 4 {
+		return nil
+	}
+	out := append([]byte{}, v...)
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint32(key, magicCookie)
+	copy(key[4:], m.Transaction[:])
+	out[2] ^= key[0]
+	out[3] ^= key[1]
+	for i := 4; i < len(out) && i-4 < len(key); i++ {
+		out[i] ^= key[i-4]
+	}
+	return out
+}
+
+func (m Message) decodeAddress(v []byte) netip.AddrPort {
+	if len(v) < 4 {
+		return netip.AddrPort{}
+	}
+	port := binary.BigEndian.Uint16(v[2:])
+	switch {
+	case v[1] == 1 && len(v) >= 8:
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte(v[4:8])), port)
+	case v[1] == 2 && len(v) >= 20:
+		return netip.AddrPortFrom(netip.AddrFrom16([16]byte(v[4:20])), port)
+	}
+	return netip.AddrPort{}
+}
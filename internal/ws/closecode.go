@@ -0,0 +1,23 @@
+package ws
+
+import "github.com/gorilla/websocket"
+
+// Close codes sent in websocket close frames, the SSE close event, the long
+// poll "closed" reply and the seven-close-code gRPC trailer. The standard
+// codes are used where one fits; the 4xxx codes are Seven's own.
+const (
+	CloseDeregistered   = websocket.CloseNormalClosure     // 1000: deregistered or said bye
+	CloseTimeout        = websocket.CloseGoingAway         // 1001: stopped answering pings or polls
+	CloseMessageTooBig  = websocket.CloseMessageTooBig     // 1009: message over --max-message-size
+	CloseServerError    = websocket.CloseInternalServerErr // 1011
+	CloseServerDraining = websocket.CloseServiceRestart    // 1012: shutting down, reconnect elsewhere
+
+	CloseAuthFailed    = 4001 // missing or invalid API key or token; do not retry as is
+	CloseEvicted       = 4003 // removed by an operator
+	CloseBadProtocol   = 4006 // the server speaks none of the offered protocol versions
+	CloseEntryDropped  = 4008 // the registry dropped the entry (size or ttl); register again
+	CloseDuplicateUUID = 4009 // another connection registered the same uuid
+	CloseSlowClient    = 4010 // fell more than --send-queue messages behind; resume
+	CloseBanned        = 4013 // the IP, subnet or uuid is banned; do not reconnect
+	CloseRateLimited   = 4029 // over a rate limit or quota; back off before reconnecting
+)
@@ -0,0 +1,121 @@
+// Package ws holds the signaling protocol: the Message envelope, the close
+// codes and the websocket Transport that carries both.
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/hoyle1974/seven/sevenpb"
+)
+
+// MessageType identifies the kind of signaling message carried by a Message.
+type MessageType string
+
+const (
+	MsgRegister       MessageType = "register"
+	MsgRegistered     MessageType = "registered"
+	MsgResume         MessageType = "resume"
+	MsgResumed        MessageType = "resumed"
+	MsgOffer          MessageType = "offer"
+	MsgAnswer         MessageType = "answer"
+	MsgCandidate      MessageType = "candidate"
+	MsgBye            MessageType = "bye"
+	MsgDeregister     MessageType = "deregister"
+	MsgDeregistered   MessageType = "deregistered"
+	MsgCreateRoom     MessageType = "create_room"
+	MsgJoinRoom       MessageType = "join_room"
+	MsgLeaveRoom      MessageType = "leave_room"
+	MsgRoomJoined     MessageType = "room_joined"
+	MsgRoomLeft       MessageType = "room_left"
+	MsgRoomQueued     MessageType = "room_queued"
+	MsgKickPeer       MessageType = "kick_peer"
+	MsgMutePeer       MessageType = "mute_peer"
+	MsgUnmutePeer     MessageType = "unmute_peer"
+	MsgTransferHost   MessageType = "transfer_host"
+	MsgLockRoom       MessageType = "lock_room"
+	MsgUnlockRoom     MessageType = "unlock_room"
+	MsgCloseRoom      MessageType = "close_room"
+	MsgHostChanged    MessageType = "host_changed"
+	MsgPeerMuted      MessageType = "peer_muted"
+	MsgRoomLocked     MessageType = "room_locked"
+	MsgBroadcast      MessageType = "broadcast"
+	MsgDirect         MessageType = "direct"
+	MsgGlare          MessageType = "glare"
+	MsgPeerJoined     MessageType = "peer_joined"
+	MsgPeerLeft       MessageType = "peer_left"
+	MsgMeshPlan       MessageType = "mesh_plan"
+	MsgMatch          MessageType = "match"
+	MsgCancelMatch    MessageType = "cancel_match"
+	MsgMatchQueued    MessageType = "match_queued"
+	MsgMatched        MessageType = "matched"
+	MsgMatchCancelled MessageType = "match_cancelled"
+	MsgReport         MessageType = "report"
+	MsgProbeNAT       MessageType = "probe_nat"
+	MsgNATProbe       MessageType = "nat_probe"
+	MsgNATDetected    MessageType = "nat_detected"
+	MsgRendezvous     MessageType = "rendezvous"
+	MsgPunch          MessageType = "punch"
+	MsgUndelivered    MessageType = "undelivered"
+	MsgAck            MessageType = "ack"
+	MsgNack           MessageType = "nack"
+	MsgDelivered      MessageType = "delivered"
+	MsgError          MessageType = "error"
+)
+
+// Message is the envelope for everything sent over /ws/register.
+type Message struct {
+	Type    MessageType     `json:"type"`
+	From    string          `json:"from,omitempty"`
+	To      string          `json:"to,omitempty"`
+	Room    string          `json:"room,omitempty"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// CorrelationID ties the signals of one negotiation between two peers
+	// together, for tracing them through the logs.
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+func NewMessage(t MessageType, payload interface{}) (Message, error) {
+	msg := Message{Type: t}
+	if payload == nil {
+		return msg, nil
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return msg, err
+	}
+	msg.Payload = b
+	return msg, nil
+}
+
+var ErrInvalidPayload = errors.New("Payload is not valid JSON")
+
+// ToProto converts msg for the gRPC API and the seven-proto subprotocol. The
+// payload stays JSON.
+func (m Message) ToProto() *sevenpb.Envelope {
+	return &sevenpb.Envelope{
+		Type:    string(m.Type),
+		From:    m.From,
+		To:      m.To,
+		Room:    m.Room,
+		Id:      m.ID,
+		Payload: m.Payload,
+
+		CorrelationId: m.CorrelationID,
+	}
+}
+
+func MessageFromProto(env *sevenpb.Envelope) Message {
+	return Message{
+		Type:    MessageType(env.Type),
+		From:    env.From,
+		To:      env.To,
+		Room:    env.Room,
+		ID:      env.Id,
+		Payload: json.RawMessage(env.Payload),
+
+		CorrelationID: env.CorrelationId,
+	}
+}
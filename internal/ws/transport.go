@@ -0,0 +1,344 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hoyle1974/seven/sevenpb"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/proto"
+)
+
+const closeWait = time.Second
+
+var errWriteTimeout = errors.New("Timed out writing to websocket")
+
+// Websocket subprotocols a client can ask for. Without one, or with
+// seven-json, envelopes are JSON text frames; seven-proto sends them as
+// binary frames holding a sevenpb.Envelope. seven-json-batch is seven-json,
+// except that envelopes queued together reach the client as one text frame
+// holding a JSON array of them.
+const (
+	SubprotocolJSON      = "seven-json"
+	SubprotocolJSONBatch = "seven-json-batch"
+	SubprotocolProto     = "seven-proto"
+)
+
+var ErrNotConnected = errors.New("Peer not connected")
+
+var ErrQueueFull = errors.New("Message queue full")
+
+// Options tune a Transport.
+type Options struct {
+	SendQueue    int // frames that may wait to be written
+	WriteTimeout time.Duration
+	PingInterval time.Duration
+
+	// Compression enables permessage-deflate, if the client negotiated it,
+	// for frames of at least CompressionThreshold bytes.
+	Compression          bool
+	CompressionLevel     int
+	CompressionThreshold int
+
+	// OnSlow is called when a client is disconnected for not keeping up.
+	OnSlow func()
+}
+
+// Transport writes to a websocket from its own write pump goroutine.
+// Writers only queue frames, so a client that reads slowly holds up nobody
+// but itself; once SendQueue frames are waiting for it, it is closed with
+// CloseSlowClient rather than left to stall relays and broadcasts.
+type Transport struct {
+	conn  *websocket.Conn
+	proto bool
+	batch bool
+	opts  Options
+
+	send    chan wsFrame
+	closing chan wsFrame  // the close frame, written after whatever is queued
+	stop    chan struct{} // closed by Close
+	done    chan struct{} // closed when the pump exits
+	closed  atomic.Bool
+	slow    atomic.Bool
+	stopped sync.Once
+	err     error // why the pump exited, set before done is closed
+}
+
+type wsFrame struct {
+	kind     int
+	data     []byte // also what prepared encodes, for batches
+	prepared *websocket.PreparedMessage
+	size     int // of prepared
+}
+
+// PreparedWriter is implemented by transports that can send a Prepared
+// message without encoding it again.
+type PreparedWriter interface {
+	WritePrepared(p *Prepared) error
+}
+
+// Prepared is a message headed for many clients. Each wire format is
+// encoded, and framed, the first time a client using it needs it.
+type Prepared struct {
+	Msg Message
+
+	jsonOnce, protoOnce sync.Once
+	json, proto         *websocket.PreparedMessage
+	jsonData            []byte
+	protoLen            int
+	jsonErr, protoErr   error
+}
+
+func Prepare(msg Message) *Prepared {
+	return &Prepared{Msg: msg}
+}
+
+func (p *Prepared) frame(binary bool) (wsFrame, error) {
+	if !binary {
+		p.jsonOnce.Do(func() {
+			if p.jsonData, p.jsonErr = json.Marshal(p.Msg); p.jsonErr == nil {
+				p.json, p.jsonErr = websocket.NewPreparedMessage(websocket.TextMessage, p.jsonData)
+			}
+		})
+		return wsFrame{kind: websocket.TextMessage, data: p.jsonData, prepared: p.json, size: len(p.jsonData)}, p.jsonErr
+	}
+	p.protoOnce.Do(func() {
+		var b []byte
+		if b, p.protoErr = proto.Marshal(p.Msg.ToProto()); p.protoErr == nil {
+			p.proto, p.protoErr = websocket.NewPreparedMessage(websocket.BinaryMessage, b)
+			p.protoLen = len(b)
+		}
+	})
+	return wsFrame{prepared: p.proto, size: p.protoLen}, p.protoErr
+}
+
+func NewTransport(conn *websocket.Conn, opts Options) *Transport {
+	t := &Transport{
+		conn:    conn,
+		proto:   conn.Subprotocol() == SubprotocolProto,
+		batch:   conn.Subprotocol() == SubprotocolJSONBatch,
+		opts:    opts,
+		send:    make(chan wsFrame, opts.SendQueue),
+		closing: make(chan wsFrame, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if opts.Compression {
+		// Only takes effect if the client negotiated permessage-deflate.
+		conn.SetCompressionLevel(opts.CompressionLevel)
+	}
+	go t.writePump()
+	return t
+}
+
+func (t *Transport) WriteMessage(msg Message) error {
+	if !t.proto {
+		b, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return t.queue(websocket.TextMessage, b)
+	}
+	b, err := proto.Marshal(msg.ToProto())
+	if err != nil {
+		return err
+	}
+	return t.queue(websocket.BinaryMessage, b)
+}
+
+func (t *Transport) WritePrepared(p *Prepared) error {
+	f, err := p.frame(t.proto)
+	if err != nil {
+		return err
+	}
+	return t.queueFrame(f)
+}
+
+// WriteText queues data, already encoded, as a text frame.
+func (t *Transport) WriteText(data []byte) error {
+	return t.queue(websocket.TextMessage, data)
+}
+
+// Proto reports whether the client asked for SubprotocolProto.
+func (t *Transport) Proto() bool {
+	return t.proto
+}
+
+// queue hands a frame to the write pump without waiting for it to be sent.
+func (t *Transport) queue(kind int, data []byte) error {
+	return t.queueFrame(wsFrame{kind: kind, data: data})
+}
+
+func (t *Transport) queueFrame(f wsFrame) error {
+	if t.closed.Load() {
+		return ErrNotConnected
+	}
+	select {
+	case t.send <- f:
+		return nil
+	default:
+	}
+	if !t.slow.Swap(true) {
+		if t.opts.OnSlow != nil {
+			t.opts.OnSlow()
+		}
+		log.Warn().Int("queued", len(t.send)).Msg("Disconnecting slow websocket client")
+		go t.CloseWith(CloseSlowClient, "too slow")
+	}
+	return ErrQueueFull
+}
+
+// writePump writes queued frames and pings the client every PingInterval
+// until the connection is closed or a write fails.
+func (t *Transport) writePump() {
+	defer close(t.done)
+	defer t.closed.Store(true)
+	ping := time.NewTicker(t.opts.PingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case f := <-t.send:
+			// Write out everything that piled up before going back to wait,
+			// so a burst of broadcasts does not wait behind pings.
+			if t.err = t.writeQueued(f); t.err != nil {
+				t.conn.Close()
+				return
+			}
+		case f := <-t.closing:
+			if len(t.send) > 0 {
+				t.err = t.writeQueued(<-t.send)
+			}
+			if t.err == nil {
+				t.err = t.write(f)
+			}
+			return
+		case <-ping.C:
+			if err := t.write(wsFrame{kind: websocket.PingMessage}); err != nil {
+				log.Err(err).Msg("Error sending ping")
+				t.err = err
+				t.conn.Close()
+				return
+			}
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// writeQueued writes first and the frames queued behind it. For batching
+// clients, runs of them go out as one frame.
+func (t *Transport) writeQueued(first wsFrame) error {
+	frames := make([]wsFrame, 1, 1+len(t.send))
+	frames[0] = first
+	for n := len(t.send); n > 0; n-- {
+		frames = append(frames, <-t.send)
+	}
+	if !t.batch {
+		for _, f := range frames {
+			if err := t.write(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for len(frames) > 0 {
+		n := 0
+		for n < len(frames) && frames[n].kind == websocket.TextMessage {
+			n++
+		}
+		var err error
+		if n < 2 {
+			err, n = t.write(frames[0]), 1
+		} else {
+			err = t.writeBatch(frames[:n])
+		}
+		if err != nil {
+			return err
+		}
+		frames = frames[n:]
+	}
+	return nil
+}
+
+// writeBatch writes text frames as one JSON array.
+func (t *Transport) writeBatch(frames []wsFrame) error {
+	size := len(frames) + 1
+	for _, f := range frames {
+		size += len(f.data)
+	}
+	t.conn.SetWriteDeadline(time.Now().Add(t.opts.WriteTimeout))
+	t.conn.EnableWriteCompression(t.opts.Compression && size >= t.opts.CompressionThreshold)
+	w, err := t.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	sep := byte('[')
+	for _, f := range frames {
+		if _, err := w.Write([]byte{sep}); err != nil {
+			return err
+		}
+		if _, err := w.Write(f.data); err != nil {
+			return err
+		}
+		sep = ','
+	}
+	if _, err := w.Write([]byte{']'}); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (t *Transport) write(f wsFrame) error {
+	deadline := time.Now().Add(t.opts.WriteTimeout)
+	if f.kind == websocket.CloseMessage || f.kind == websocket.PingMessage {
+		return t.conn.WriteControl(f.kind, f.data, deadline)
+	}
+	t.conn.SetWriteDeadline(deadline)
+	if f.prepared != nil {
+		t.conn.EnableWriteCompression(t.opts.Compression && f.size >= t.opts.CompressionThreshold)
+		return t.conn.WritePreparedMessage(f.prepared)
+	}
+	t.conn.EnableWriteCompression(t.opts.Compression && len(f.data) >= t.opts.CompressionThreshold)
+	return t.conn.WriteMessage(f.kind, f.data)
+}
+
+func (t *Transport) Decode(data []byte) (Message, error) {
+	var msg Message
+	if !t.proto {
+		err := json.Unmarshal(data, &msg)
+		return msg, err
+	}
+	var env sevenpb.Envelope
+	if err := proto.Unmarshal(data, &env); err != nil {
+		return msg, err
+	}
+	msg = MessageFromProto(&env)
+	if len(msg.Payload) > 0 && !json.Valid(msg.Payload) {
+		return msg, ErrInvalidPayload
+	}
+	return msg, nil
+}
+
+// CloseWith sends the close frame once the frames queued before it are out,
+// and waits up to closeWait for that.
+func (t *Transport) CloseWith(code int, reason string) error {
+	if !t.closed.Swap(true) {
+		t.closing <- wsFrame{kind: websocket.CloseMessage, data: websocket.FormatCloseMessage(code, reason)}
+	}
+	select {
+	case <-t.done:
+		return t.err
+	case <-time.After(closeWait):
+		return errWriteTimeout
+	}
+}
+
+func (t *Transport) Close() error {
+	t.closed.Store(true)
+	t.stopped.Do(func() { close(t.stop) })
+	return t.conn.Close()
+}
@@ -0,0 +1,10 @@
+// Package js embeds the browser SDK so the server can serve it.
+package js
+
+import _ "embed"
+
+//go:embed seven.js
+var SDK []byte
+
+//go:embed package.json
+var Package []byte
@@ -0,0 +1,184 @@
+export const VERSION: string;
+
+export interface Address {
+    addr: string;
+    kind?: "lan" | "wan" | "ipv6" | "relay";
+    transport?: "udp" | "tcp";
+    priority?: number;
+}
+
+export interface Entry {
+    uuid: string;
+    addr: string;
+    addrs?: Address[];
+    tags?: Record<string, string>;
+    metadata?: unknown;
+    polite?: boolean;
+    same_network?: boolean;
+    nat?: NATBehavior;
+}
+
+export interface Registration {
+    uuid?: string;
+    uuid_token?: string;
+    captcha_token?: string;
+    addr?: string;
+    addrs?: Address[];
+    tags?: Record<string, string>;
+    metadata?: unknown;
+    device?: string;
+    filter?: string;
+    count?: number;
+}
+
+export interface Message<P = any> {
+    type: string;
+    from?: string;
+    to?: string;
+    room?: string;
+    id?: string;
+    payload?: P;
+    /** Set by the server on relayed signals, the same for one negotiation. */
+    correlation_id?: string;
+}
+
+export interface TurnCredentials {
+    username: string;
+    password: string;
+    ttl: number;
+    uris: string[];
+}
+
+export interface SevenError extends Error {
+    name: "SevenError";
+    status: string;
+    /** Machine-readable reason such as "room_full"; empty for client side errors. */
+    code: string;
+    requestId: string;
+    payload: Record<string, unknown>;
+}
+
+export interface ClientOptions {
+    /** Base URL such as wss://signal.example.com or wss://signal.example.com/t/chess. */
+    url: string;
+    apiKey?: string;
+    token?: string;
+    registration?: Registration;
+    iceServers?: RTCIceServer[];
+    /** Milliseconds between reconnect attempts, doubling up to maxBackoff. */
+    minBackoff?: number;
+    maxBackoff?: number;
+    requestTimeout?: number;
+    /** Answer offers from unknown peers by creating a Peer. Defaults to true. */
+    autoAnswer?: boolean;
+    /** Have peers report how their connections went to the server. Defaults to true. */
+    reports?: boolean;
+}
+
+export type NATBehavior = "endpoint_independent" | "endpoint_dependent";
+
+export interface Report {
+    peer?: string;
+    outcome: "connected" | "failed";
+    time_to_connect_ms?: number;
+    candidate_type?: "host" | "srflx" | "prflx" | "relay";
+}
+
+export interface Capabilities {
+    protocols: number[];
+    transports: ("ws" | "sse" | "poll" | "grpc")[];
+    /** Such as "rooms", "turn", "resume" or "nat_probe". */
+    features: string[];
+    /** 0 is unlimited. */
+    limits: {
+        max_message_size: number;
+        max_data_size: number;
+        max_metadata_size: number;
+        max_room_size: number;
+        max_entries: number;
+        message_rate: number;
+        message_burst: number;
+        resume_grace_ms: number;
+    };
+}
+
+export interface ClientEvents {
+    open: { resumed: boolean };
+    close: { code: number; reason: string };
+    error: SevenError;
+    peer: Peer;
+    offer: Message<RTCSessionDescriptionInit>;
+    answer: Message<RTCSessionDescriptionInit>;
+    candidate: Message<RTCIceCandidateInit>;
+    bye: Message;
+    peer_joined: Message<Entry>;
+    peer_left: Message<{ uuid: string; reason: string }>;
+    room_joined: Message<{ members: Entry[] }>;
+    room_left: Message;
+    room_queued: Message<{ position: number; max_peers: number }>;
+    mesh_plan: Message<{ offer_to: string[]; answer_to: string[]; connections: number }>;
+    matched: Message<{ mode: string; peers: Entry[] }>;
+    nat_detected: Message<{ nat: NATBehavior }>;
+    undelivered: Message;
+    delivered: Message;
+    broadcast: Message;
+    direct: Message;
+    [type: string]: unknown;
+}
+
+declare class Emitter<E> {
+    on<K extends keyof E & string>(type: K, fn: (ev: E[K]) => void): this;
+    once<K extends keyof E & string>(type: K, fn: (ev: E[K]) => void): this;
+    off<K extends keyof E & string>(type: K, fn: (ev: E[K]) => void): this;
+}
+
+export class Client extends Emitter<ClientEvents> {
+    constructor(options: ClientOptions);
+    readonly uuid: string;
+    readonly room: string;
+    /** The instance the session is on, when the server says. */
+    readonly node: string;
+    readonly entries: Entry[];
+    readonly turn: TurnCredentials | null;
+    readonly peers: Map<string, Peer>;
+    connect(): Promise<Entry[]>;
+    close(): void;
+    discover(filter?: Partial<Registration>): Promise<Entry[]>;
+    signal(to: string, type: string, payload?: unknown): Promise<void>;
+    send(msg: Message): Promise<void>;
+    broadcast(payload: unknown): Promise<void>;
+    direct(to: string, payload: unknown): Promise<void>;
+    createRoom(maxPeers?: number): Promise<string>;
+    joinRoom(room: string): Promise<Entry[]>;
+    leaveRoom(): Promise<void>;
+    report(report: Report): Promise<void>;
+    capabilities(): Promise<Capabilities>;
+    probeNAT(): Promise<NATBehavior | "">;
+    peer(uuid: string, options?: PeerOptions): Peer;
+    iceServers(): RTCIceServer[];
+}
+
+export interface PeerOptions {
+    /** Defaults to whether this client's uuid is the lower one. */
+    polite?: boolean;
+    rtc?: RTCConfiguration;
+}
+
+export interface PeerEvents {
+    track: RTCTrackEvent;
+    datachannel: RTCDataChannel;
+    connectionstatechange: RTCPeerConnectionState;
+    error: Error;
+    close: void;
+}
+
+export class Peer extends Emitter<PeerEvents> {
+    readonly client: Client;
+    readonly uuid: string;
+    readonly polite: boolean;
+    readonly pc: RTCPeerConnection;
+    offer(): Promise<void>;
+    answer(offer: Message<RTCSessionDescriptionInit>): Promise<void>;
+    connected(): Promise<Peer>;
+    close(): void;
+}
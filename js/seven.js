@@ -0,0 +1,641 @@
+// Seven browser SDK. Load it with a script tag from a Seven server
+// (/sdk/<version>/seven.js, which defines window.Seven) or install it from
+// npm and require or import it.
+(function (root, factory) {
+    if (typeof module === "object" && module.exports) {
+        module.exports = factory();
+    } else {
+        root.Seven = factory();
+    }
+}(typeof self !== "undefined" ? self : this, function () {
+    "use strict";
+
+    var VERSION = "1.0.0";
+    var PROTOCOL = "1";
+
+    // Close codes after which reconnecting cannot help: bad credentials,
+    // evicted by an operator, no common protocol version, replaced by another
+    // connection, or banned.
+    var FATAL_CLOSE_CODES = [4001, 4003, 4006, 4009, 4013];
+
+    function SevenError(status, payload) {
+        var e = new Error("seven: " + status);
+        e.name = "SevenError";
+        e.status = status;
+        e.payload = payload || {};
+        e.code = typeof e.payload.code === "string" ? e.payload.code : "";
+        e.requestId = e.payload.request_id || "";
+        return e;
+    }
+
+    // Emitter is the on/off/emit trio shared by Client and Peer.
+    class Emitter {
+        constructor() {
+            this._listeners = {};
+        }
+
+        on(type, fn) {
+            (this._listeners[type] = this._listeners[type] || []).push(fn);
+            return this;
+        }
+
+        once(type, fn) {
+            var self = this;
+            function wrapped(ev) {
+                self.off(type, wrapped);
+                fn(ev);
+            }
+            return this.on(type, wrapped);
+        }
+
+        off(type, fn) {
+            var list = this._listeners[type] || [];
+            var i = list.indexOf(fn);
+            if (i >= 0) {
+                list.splice(i, 1);
+            }
+            return this;
+        }
+
+        emit(type, ev) {
+            (this._listeners[type] || []).slice().forEach(function (fn) {
+                try {
+                    fn(ev);
+                } catch (err) {
+                    setTimeout(function () { throw err; });
+                }
+            });
+        }
+    }
+
+    // Client is a connection to a Seven server. It registers on connect(),
+    // reconnects with backoff when the socket drops, resuming the session when
+    // the server still holds it, and relays offers, answers and candidates to
+    // the Peer objects it creates.
+    //
+    // Events: open ({resumed}), close ({code, reason}), peer (Peer), and one
+    // per server message type, such as offer, peer_joined, mesh_plan or
+    // undelivered, with the message envelope.
+    class Client extends Emitter {
+        constructor(options) {
+            super();
+            this.options = Object.assign({
+                minBackoff: 500,
+                maxBackoff: 30000,
+                requestTimeout: 10000,
+                autoAnswer: true,
+                reports: true,
+            }, options);
+            if (!this.options.url) {
+                throw new Error("seven: missing url");
+            }
+            this.registration = Object.assign({}, this.options.registration);
+            this.uuid = this.registration.uuid || "";
+            this.room = "";
+            this.entries = [];
+            this.turn = null;
+            this.peers = new Map();
+            this._ws = null;
+            this._seq = 0;
+            this._pending = new Map();
+            this._resumeToken = "";
+            // The instance holding the session, and where it is after a
+            // wrong_node refusal.
+            this.node = "";
+            this._nodeURL = "";
+            this._closed = false;
+            this._backoff = this.options.minBackoff;
+        }
+
+        // connect opens the socket and registers, resolving with the entries
+        // the server returned. Later disconnects are retried by themselves.
+        connect() {
+            this._closed = false;
+            return this._open().then(() => this.entries);
+        }
+
+        // close says bye, which deregisters this client, and disconnects for
+        // good.
+        close() {
+            this._closed = true;
+            this.peers.forEach(function (p) { p.close(); });
+            if (this._ws && this._ws.readyState === WebSocket.OPEN) {
+                this._ws.send(JSON.stringify({ type: "bye" }));
+                this._ws.close(1000);
+            }
+        }
+
+        // discover registers again and resolves with the peers handed out.
+        discover(filter) {
+            var reg = Object.assign({}, this.registration, filter);
+            return this._register(reg).then(() => this.entries);
+        }
+
+        // signal relays payload to the peer to as a message of type type,
+        // resolving once the server has passed it on.
+        signal(to, type, payload) {
+            return this.send({ type: type, to: to, payload: payload });
+        }
+
+        // broadcast sends payload to everyone else in the room, and direct to
+        // one member of it, over the signaling channel.
+        broadcast(payload) {
+            return this.send({ type: "broadcast", payload: payload });
+        }
+
+        direct(to, payload) {
+            return this.send({ type: "direct", to: to, payload: payload });
+        }
+
+        // send sends an envelope and resolves when the server acks it.
+        send(msg) {
+            return this._request(msg);
+        }
+
+        // createRoom opens a room of up to maxPeers members, joins it and
+        // resolves with its id.
+        createRoom(maxPeers) {
+            var msg = { type: "create_room" };
+            if (maxPeers) {
+                msg.payload = { max_peers: maxPeers };
+            }
+            return this._request(msg, "room_joined").then(function (reply) { return reply.room; });
+        }
+
+        // joinRoom joins room, waiting in line if it is full and the server
+        // queues joins, and resolves with its members.
+        joinRoom(room) {
+            return this._request({ type: "join_room", room: room }, "room_joined").then(function (reply) {
+                return reply.payload.members;
+            });
+        }
+
+        leaveRoom() {
+            return this._request({ type: "leave_room" }, "room_left").then(() => undefined);
+        }
+
+        // report tells the server how a connection to a peer went, such as
+        // {peer, outcome: "connected", time_to_connect_ms, candidate_type}.
+        // Peers report by themselves unless the client was made with
+        // reports: false.
+        report(report) {
+            return this._request({ type: "report", payload: report }).then(() => undefined);
+        }
+
+        // capabilities fetches the server's protocol versions, transports,
+        // features and limits. It works before connect.
+        capabilities() {
+            var url = this.options.url.replace(/\/$/, "").replace(/^ws/, "http") + "/api/v1/capabilities";
+            return fetch(url).then((resp) => resp.json().then((body) => {
+                if (!resp.ok) {
+                    throw SevenError(body.message || "capabilities: " + resp.status, body);
+                }
+                return body;
+            }));
+        }
+
+        // probeNAT has the server classify this client's NAT, which needs
+        // --nat-probe-addr, by gathering candidates against its two STUN
+        // ports. It resolves with "endpoint_independent" or
+        // "endpoint_dependent", or "" if the ports could not be reached.
+        probeNAT() {
+            return this._request({ type: "probe_nat" }, "nat_probe").then((reply) => {
+                var host = new URL(this.options.url).hostname;
+                var pc = new RTCPeerConnection({
+                    iceServers: reply.payload.ports.map(function (port) { return { urls: "stun:" + host + ":" + port }; }),
+                });
+                return new Promise((resolve) => {
+                    var done = (nat) => {
+                        clearTimeout(timer);
+                        this.off("nat_detected", detected);
+                        pc.close();
+                        resolve(nat);
+                    };
+                    var detected = (msg) => done(msg.payload.nat);
+                    var timer = setTimeout(() => done(""), reply.payload.expires_in * 1000);
+                    this.on("nat_detected", detected);
+                    pc.createDataChannel("probe");
+                    pc.setLocalDescription().catch(() => done(""));
+                });
+            });
+        }
+
+        // peer returns the Peer wrapping the RTCPeerConnection to uuid,
+        // creating it if needed.
+        peer(uuid, options) {
+            var p = this.peers.get(uuid);
+            if (!p) {
+                p = new Peer(this, uuid, options);
+                this.peers.set(uuid, p);
+                this.emit("peer", p);
+            }
+            return p;
+        }
+
+        // iceServers are the options' iceServers plus the TURN server the
+        // server vends, if any.
+        iceServers() {
+            var servers = (this.options.iceServers || []).slice();
+            if (this.turn) {
+                servers.push({ urls: this.turn.uris, username: this.turn.username, credential: this.turn.password });
+            }
+            return servers;
+        }
+
+        _url() {
+            var url = new URL(this.options.url.replace(/\/$/, "") + "/api/v1/ws/register");
+            if (this._nodeURL) {
+                var node = new URL(this._nodeURL);
+                url.protocol = node.protocol;
+                url.host = node.host;
+            }
+            url.searchParams.set("protocol", PROTOCOL);
+            if (this._resumeToken && this.node) {
+                // Clustered instances forward the connection to the one
+                // holding the session.
+                url.searchParams.set("node", this.node);
+            }
+            if (this.options.apiKey) {
+                url.searchParams.set("api_key", this.options.apiKey);
+            }
+            if (this.options.token) {
+                url.searchParams.set("access_token", this.options.token);
+            }
+            return url.toString();
+        }
+
+        _open() {
+            return new Promise((resolve, reject) => {
+                // Envelopes the server queued together come as one array.
+                var ws = new WebSocket(this._url(), ["seven-json-batch"]);
+                var ready = false;
+                var opened = false;
+                ws.onopen = () => {
+                    opened = true;
+                    this._ws = ws;
+                    this._resumeOrRegister().then((resumed) => {
+                        ready = true;
+                        this._backoff = this.options.minBackoff;
+                        this.emit("open", { resumed: resumed });
+                        resolve(resumed);
+                    }, (err) => {
+                        ws.close();
+                        reject(err);
+                    });
+                };
+                ws.onmessage = (ev) => {
+                    var data = JSON.parse(ev.data);
+                    (Array.isArray(data) ? data : [data]).forEach((msg) => this._receive(msg));
+                };
+                ws.onclose = (ev) => {
+                    if (this._ws === ws) {
+                        this._ws = null;
+                    }
+                    this._failPending(SevenError("disconnected"));
+                    if (!ready) {
+                        if (!opened) {
+                            this._nodeURL = "";
+                        }
+                        reject(SevenError("connection failed", { code: ev.code, reason: ev.reason }));
+                        return;
+                    }
+                    this.emit("close", { code: ev.code, reason: ev.reason });
+                    if (!this._closed && FATAL_CLOSE_CODES.indexOf(ev.code) < 0) {
+                        this._reconnect();
+                    }
+                };
+            });
+        }
+
+        _reconnect() {
+            var wait = this._backoff;
+            this._backoff = Math.min(this._backoff * 2, this.options.maxBackoff);
+            setTimeout(() => {
+                if (this._closed) {
+                    return;
+                }
+                this._open().catch((err) => {
+                    if (err.code === "invalid_uuid_token" || FATAL_CLOSE_CODES.indexOf(err.payload.code) >= 0) {
+                        this._closed = true;
+                        this.emit("error", err);
+                        return;
+                    }
+                    if (!this._closed) {
+                        this._reconnect();
+                    }
+                });
+            }, wait);
+        }
+
+        _resumeOrRegister() {
+            if (!this._resumeToken) {
+                return this._register(this.registration).then(() => false);
+            }
+            return this._request({ type: "resume", payload: { token: this._resumeToken } }, "resumed").then((reply) => {
+                this._resumeToken = reply.payload.resume_token || "";
+                this.node = reply.payload.node || "";
+                this.room = reply.payload.room || "";
+                return true;
+            }, (err) => {
+                if (err.status === "disconnected") {
+                    throw err;
+                }
+                if (err.code === "wrong_node" && err.payload.url && err.payload.url !== this._nodeURL) {
+                    // Reconnect there to resume.
+                    this._nodeURL = err.payload.url;
+                    throw err;
+                }
+                this.room = "";
+                return this._register(this.registration).then(() => false);
+            });
+        }
+
+        _register(reg) {
+            return this._request({ type: "register", payload: reg }, "registered").then((reply) => {
+                var r = reply.payload;
+                if (r.uuid) {
+                    this.uuid = this.registration.uuid = r.uuid;
+                    this.registration.uuid_token = r.uuid_token;
+                }
+                if (r.device) {
+                    this.registration.device = r.device;
+                }
+                // Captcha tokens work once; re-registering the same entry
+                // needs none.
+                delete this.registration.captcha_token;
+                this.entries = r.entries || [];
+                this.turn = r.turn || null;
+                this._resumeToken = r.resume_token || "";
+                this.node = r.node || "";
+            });
+        }
+
+        // _request sends msg with a fresh id and resolves with the reply of
+        // type want that precedes the ack, or with the ack itself.
+        _request(msg, want) {
+            if (!this._ws || this._ws.readyState !== WebSocket.OPEN) {
+                return Promise.reject(SevenError(this._closed ? "closed" : "disconnected"));
+            }
+            var id = "c" + (++this._seq);
+            msg = Object.assign({}, msg, { id: id });
+            return new Promise((resolve, reject) => {
+                var call = { seq: this._seq, want: want, reply: null, queued: false, resolve: resolve, reject: reject };
+                call.timer = setTimeout(() => {
+                    if (!call.queued) {
+                        this._settle(id, SevenError("timeout"));
+                    }
+                }, this.options.requestTimeout);
+                this._pending.set(id, call);
+                this._ws.send(JSON.stringify(msg));
+            });
+        }
+
+        _settle(id, err, reply) {
+            var call = this._pending.get(id);
+            if (!call) {
+                return;
+            }
+            this._pending.delete(id);
+            clearTimeout(call.timer);
+            if (err) {
+                call.reject(err);
+            } else {
+                call.resolve(reply);
+            }
+        }
+
+        _failPending(err) {
+            Array.from(this._pending.keys()).forEach((id) => this._settle(id, err));
+        }
+
+        _receive(msg) {
+            if (msg.type === "room_joined") {
+                this.room = msg.room;
+            } else if (msg.type === "room_left") {
+                this.room = "";
+            }
+            if (this._route(msg)) {
+                return;
+            }
+            switch (msg.type) {
+            case "offer":
+            case "answer":
+            case "candidate":
+                var answer = msg.type === "offer" && this.options.autoAnswer && typeof RTCPeerConnection !== "undefined";
+                if (this.peers.has(msg.from) || answer) {
+                    this.peer(msg.from)._signal(msg);
+                }
+                break;
+            case "peer_left":
+                var p = this.peers.get(msg.payload && msg.payload.uuid);
+                if (p) {
+                    p.close();
+                }
+                break;
+            }
+            this.emit(msg.type, msg);
+        }
+
+        // _route settles the request msg answers, as in the Go client:
+        // replies come before their ack, in the order requests were sent.
+        _route(msg) {
+            if (msg.type === "ack" || msg.type === "nack") {
+                var call = this._pending.get(msg.id);
+                if (!call) {
+                    return false;
+                }
+                if (msg.type === "nack") {
+                    var payload = msg.payload || {};
+                    this._settle(msg.id, SevenError(payload.status || "request refused", payload));
+                } else if (call.reply && call.reply.type === "room_queued") {
+                    call.queued = true;
+                    clearTimeout(call.timer);
+                } else {
+                    this._settle(msg.id, null, call.reply || msg);
+                }
+                return true;
+            }
+            var oldest = null;
+            var oldestID = "";
+            this._pending.forEach(function (call, id) {
+                var waiting = !call.reply && (call.want === msg.type || (call.want === "room_joined" && msg.type === "room_queued"));
+                var inLine = call.reply && call.reply.type === "room_queued" && msg.type === "room_joined";
+                if ((waiting || inLine) && (!oldest || call.seq < oldest.seq)) {
+                    oldest = call;
+                    oldestID = id;
+                }
+            });
+            if (!oldest) {
+                return false;
+            }
+            oldest.reply = msg;
+            if (msg.type === "room_queued") {
+                this.emit("room_queued", msg);
+            }
+            if (oldest.queued) {
+                this._settle(oldestID, null, msg);
+            }
+            return true;
+        }
+    }
+
+    // Peer is an RTCPeerConnection to another client, negotiated over Seven
+    // with the perfect negotiation pattern. Add tracks or data channels to
+    // pc, or call offer(), and the offers, answers and candidates are
+    // exchanged for you. The peer with the lower uuid is polite, matching the
+    // roles the server hands out.
+    //
+    // Events: track (RTCTrackEvent), datachannel (RTCDataChannel),
+    // connectionstatechange (state) and close.
+    class Peer extends Emitter {
+        constructor(client, uuid, options) {
+            super();
+            options = options || {};
+            this.client = client;
+            this.uuid = uuid;
+            this.polite = options.polite !== undefined ? options.polite : client.uuid < uuid;
+            this.pc = new RTCPeerConnection(Object.assign({ iceServers: client.iceServers() }, options.rtc));
+            this._makingOffer = false;
+            this._ignoreOffer = false;
+            this._answered = [];
+            this._started = 0;
+            this._reported = false;
+
+            this.pc.onicecandidate = (ev) => {
+                if (ev.candidate) {
+                    this._send("candidate", ev.candidate.toJSON());
+                }
+            };
+            this.pc.onnegotiationneeded = () => this.offer().catch(() => {});
+            this.pc.ontrack = (ev) => this.emit("track", ev);
+            this.pc.ondatachannel = (ev) => this.emit("datachannel", ev.channel);
+            this.pc.onconnectionstatechange = () => {
+                this.emit("connectionstatechange", this.pc.connectionState);
+                if (this.pc.connectionState === "connected" || this.pc.connectionState === "failed") {
+                    this._report(this.pc.connectionState);
+                }
+                if (this.pc.connectionState === "failed") {
+                    this.pc.restartIce();
+                }
+            };
+        }
+
+        // offer sends an offer and resolves once the answer is applied. An
+        // offer the server drops for glare resolves at once: the other
+        // peer's offer, answered as it arrives, takes its place.
+        offer() {
+            this._makingOffer = true;
+            return this.pc.setLocalDescription().then(() => {
+                this._makingOffer = false;
+                var answered = new Promise((resolve) => this._answered.push(resolve));
+                return this._send("offer", this.pc.localDescription.toJSON()).then(() => answered, (err) => {
+                    if (err.status !== "glare") {
+                        throw err;
+                    }
+                });
+            }, (err) => {
+                this._makingOffer = false;
+                throw err;
+            });
+        }
+
+        // answer applies an offer envelope and resolves once the answer is
+        // sent. Offers are answered by themselves unless the client was made
+        // with autoAnswer: false.
+        answer(msg) {
+            return this.pc.setRemoteDescription(msg.payload)
+                .then(() => this.pc.setLocalDescription())
+                .then(() => this._send("answer", this.pc.localDescription.toJSON()));
+        }
+
+        // connected resolves when the connection is up.
+        connected() {
+            if (this.pc.connectionState === "connected") {
+                return Promise.resolve(this);
+            }
+            return new Promise((resolve, reject) => {
+                var check = (state) => {
+                    if (state === "connected") {
+                        this.off("connectionstatechange", check);
+                        resolve(this);
+                    } else if (state === "closed") {
+                        this.off("connectionstatechange", check);
+                        reject(SevenError("peer closed"));
+                    }
+                };
+                this.on("connectionstatechange", check);
+            });
+        }
+
+        close() {
+            if (this.client.peers.get(this.uuid) !== this) {
+                return;
+            }
+            this.client.peers.delete(this.uuid);
+            this.pc.close();
+            this.emit("connectionstatechange", "closed");
+            this.emit("close");
+        }
+
+        _send(type, payload) {
+            if (!this._started && (type === "offer" || type === "answer")) {
+                this._started = Date.now();
+            }
+            var msg = { type: type, to: this.uuid, payload: payload };
+            if (this.client.room) {
+                msg.room = this.client.room;
+            }
+            return this.client.send(msg);
+        }
+
+        // _report reports the first outcome of the connection, with the type
+        // of the local candidate of the pair it went with.
+        _report(outcome) {
+            if (this._reported || !this.client.options.reports) {
+                return;
+            }
+            this._reported = true;
+            var report = { peer: this.uuid, outcome: outcome };
+            if (outcome === "connected" && this._started) {
+                report.time_to_connect_ms = Date.now() - this._started;
+            }
+            this.pc.getStats().then((stats) => {
+                var pair = null;
+                stats.forEach(function (s) {
+                    if (s.type === "transport" && s.selectedCandidatePairId) {
+                        pair = stats.get(s.selectedCandidatePairId);
+                    }
+                });
+                var local = pair && stats.get(pair.localCandidateId);
+                if (local && local.candidateType) {
+                    report.candidate_type = local.candidateType;
+                }
+            }, function () {}).then(() => this.client.report(report)).catch(() => {});
+        }
+
+        _signal(msg) {
+            if (msg.type === "candidate") {
+                this.pc.addIceCandidate(msg.payload).catch((err) => {
+                    if (!this._ignoreOffer) {
+                        this.emit("error", err);
+                    }
+                });
+                return;
+            }
+            var collision = msg.type === "offer" && (this._makingOffer || this.pc.signalingState !== "stable");
+            this._ignoreOffer = !this.polite && collision;
+            if (this._ignoreOffer) {
+                return;
+            }
+            if (msg.type === "offer") {
+                this.answer(msg).catch((err) => this.emit("error", err));
+                return;
+            }
+            this.pc.setRemoteDescription(msg.payload).then(() => {
+                this._answered.splice(0).forEach(function (resolve) { resolve(); });
+            }, (err) => this.emit("error", err));
+        }
+    }
+
+    return { Client: Client, Peer: Peer, VERSION: VERSION };
+}));
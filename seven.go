@@ -0,0 +1,127 @@
+// Package seven runs the Seven signaling server inside another program.
+//
+// The server is configured with Options, one for each flag of the seven
+// binary. None are registered on the program's command line unless it asks
+// with Options.RegisterFlags. A program runs at most one Server at a time.
+package seven
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/hoyle1974/seven/internal/api"
+	"github.com/hoyle1974/seven/internal/registry"
+	"github.com/hoyle1974/seven/internal/ws"
+)
+
+type (
+	// Entry is a registered peer.
+	Entry = registry.Entry
+	// Registry stores the registered peers, see Config.Registry.
+	Registry = registry.Registry
+	// Message is a signaling envelope.
+	Message = ws.Message
+	// Action is something a peer asks to do, see Authorizer.
+	Action = api.Action
+	// Authorizer is asked about every Action. An error refuses it, the
+	// error's message being passed on to the peer.
+	Authorizer = api.Authorizer
+
+	// AllowAll allows every action.
+	AllowAll = api.AllowAll
+	// SameRoom only lets peers signal peers in the same room as them.
+	SameRoom = api.SameRoom
+	// Claims decides by the claims of a peer's bearer token, see the README.
+	Claims = api.Claims
+
+	// Options are the settings of a Server, one for each flag of the seven
+	// binary.
+	Options = api.Options
+)
+
+// NewOptions returns the default Options.
+func NewOptions() *Options {
+	return api.NewOptions()
+}
+
+// Kinds of Action.
+const (
+	ActionRegister  = api.ActionRegister
+	ActionJoin      = api.ActionJoin
+	ActionRelay     = api.ActionRelay
+	ActionDirect    = api.ActionDirect
+	ActionBroadcast = api.ActionBroadcast
+)
+
+// Config sets up a Server: its options, and the hooks and backends a program
+// may replace.
+type Config struct {
+	// Addr is the address to listen on, that of Settings when empty.
+	Addr string
+	// Settings are the server's options, NewOptions when nil.
+	Settings *Options
+	// Options sets options by flag name over Settings, e.g.
+	// {"registry": "redis"}.
+	Options map[string]string
+
+	// OnRegister is called before a peer's entry is stored. An error refuses
+	// the registration.
+	OnRegister func(ctx context.Context, e Entry) error
+	// OnRelay is called before an offer, answer or candidate is passed on.
+	// An error refuses to pass it on.
+	OnRelay func(ctx context.Context, msg Message) error
+	// Authorizer replaces the one --authorizer selects.
+	Authorizer Authorizer
+	// Registry replaces the one --registry selects. It is used by this
+	// Server alone, the only one running until its Shutdown.
+	Registry Registry
+}
+
+// Server is a signaling server made by New.
+type Server struct {
+	s *api.Server
+}
+
+// New sets up a server from cfg, without listening yet.
+func New(cfg Config) (*Server, error) {
+	opts := NewOptions()
+	if cfg.Settings != nil {
+		opts = cfg.Settings.Clone()
+	}
+	if cfg.Addr != "" {
+		opts.Addr = cfg.Addr
+	}
+	for name, value := range cfg.Options {
+		if err := opts.Set(name, value); err != nil {
+			return nil, fmt.Errorf("Error setting %s: %w", name, err)
+		}
+	}
+	s, err := api.NewServer(opts, api.Hooks{
+		OnRegister: cfg.OnRegister,
+		OnRelay:    cfg.OnRelay,
+		Authorizer: cfg.Authorizer,
+		Registry:   cfg.Registry,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Server{s: s}, nil
+}
+
+// Start listens and serves in the background.
+func (s *Server) Start(ctx context.Context) error {
+	return s.s.Start(ctx)
+}
+
+// Shutdown closes every connection, forcibly once ctx is done, and stops the
+// server for good. New may then make another.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.s.Shutdown(ctx)
+}
+
+// Handler serves every route, for mounting the server in the program's own
+// http server instead of calling Start.
+func (s *Server) Handler() http.Handler {
+	return s.s.Handler()
+}
@@ -5,6 +5,6 @@ while [ true ]
 do
 	u=`uuidgen`
 	c=$(( $c + 1 ))
-	curl -X POST localhost:8080/register -H "Content-Type: application/json" -d "{\"uuid\":\"$u\",\"addr\":\"$c\"}"
+	curl -X POST localhost:8080/api/v1/register -H "Content-Type: application/json" -d "{\"uuid\":\"$u\",\"addr\":\"198.51.100.1:$(( 1024 + $c % 60000 ))\"}"
 	echo
 done